@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// WithAdminToken enables the admin endpoints, such as Service.Reload and
+// Service.Explain.  Their requests must carry token as a bearer token.
+func WithAdminToken(token string) Option {
+	return func(s *Service) {
+		s.adminToken = token
+	}
+}
+
+// authorizeAdmin makes sure the request carries the admin token.  If it
+// doesn't, an error response is written and false is returned.
+func (s *Service) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		http.Error(w, "invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
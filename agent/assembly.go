@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// citationInstructions tell the model how to cite sources in the cited
+// assembly mode
+const citationInstructions = `Each source in the context starts with a marker such as [1].  When you use
+information from a source, cite it inline with its marker.
+`
+
+// citationMarker returns the marker of the i-th source in the context
+func citationMarker(i int) string {
+	return fmt.Sprintf("[%d]", i+1)
+}
+
+// citation maps a marker in the context to the file it came from.  Fallback
+// is set if the file is the fallback document rather than a match.
+type citation struct {
+	Marker   string `json:"marker"`
+	Filename string `json:"filename"`
+	Fallback bool   `json:"fallback,omitempty"`
+
+	// Confidence is the rescaled similarity score, see WithScoreScale.  The
+	// fallback document has none.
+	Confidence *float64 `json:"confidence,omitempty"`
+}
+
+// contextSource is a document that was injected as context
+type contextSource struct {
+	embedding.Match
+
+	// Snippet is the text of the document as it was injected
+	Snippet string
+
+	// Truncated is set if the snippet is only part of the document
+	Truncated bool
+}
+
+// citations returns the legend for the markers of sources.  Only the
+// configured number of best scoring sources are cited, in the order of their
+// markers.
+func (s *Service) citations(sources []contextSource) []citation {
+	cited := make([]int, len(sources))
+	for i := range cited {
+		cited[i] = i
+	}
+	if s.maxCitations > 0 && len(cited) > s.maxCitations {
+		sort.SliceStable(cited, func(a, b int) bool {
+			return sources[cited[a]].Score > sources[cited[b]].Score
+		})
+		cited = cited[:s.maxCitations]
+		sort.Ints(cited)
+	}
+
+	legend := make([]citation, len(cited))
+	for i, index := range cited {
+		source := sources[index]
+		legend[i] = citation{
+			Marker:   citationMarker(index),
+			Filename: source.Dataset.Filename,
+			Fallback: s.isFallback(source.Dataset),
+		}
+		if !legend[i].Fallback {
+			legend[i].Confidence = s.confidence(source.Score)
+		}
+	}
+	return legend
+}
+
+// isFallback reports whether dataset stands for the fallback document rather
+// than a match.  Only the fallback has no embedding.
+func (s *Service) isFallback(dataset *embedding.Dataset) bool {
+	return s.fallbackDocument != "" && dataset.Filename == s.fallbackDocument && dataset.Embedding == nil
+}
+
+// warmingUpRetryAfter is how long clients are asked to wait before retrying a
+// request that failed because the datasets aren't ready
+const warmingUpRetryAfter = 5 * time.Second
+
+// contextMessages builds the system messages that carry systemPrompt and the
+// documents most relevant to query, laid out according to the prompt layout,
+// trimming the documents to share what is left of the token budget.  It
+// returns nil if there is no relevant document or no budget left, and
+// otherwise the datasets the context was taken from along with their scores.
+// opts apply to the retrieval of this query only.  Documents found verbatim in
+// history are left out if deduplication is on, see WithContextDeduplication.
+func (s *Service) contextMessages(ctx context.Context, integrationID, apiToken, systemPrompt, query string, history []copilot.ChatMessage, budget *tokenBudget, opts ...embedding.Option) ([]copilot.ChatMessage, []contextSource, error) {
+	// Load most appropriate datasets
+	retrieveCtx, span := s.tracer.Start(ctx, "rag.retrieval")
+	datasets, emb, err := s.retriever.Retrieve(embedding.WithCredentials(retrieveCtx, integrationID, apiToken), query, opts...)
+	span.SetAttributes(Attribute{Key: "rag.datasets", Value: len(datasets)})
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	if err != nil {
+		err = fmt.Errorf("error retrieving datasets for user message: %w", err)
+		if errors.Is(err, embedding.ErrWarmingUp) {
+			return nil, nil, &statusError{status: http.StatusServiceUnavailable, err: err, retryAfter: warmingUpRetryAfter}
+		}
+		return nil, nil, err
+	}
+
+	// The datasets were already chosen, this only recovers their scores
+	ranked, err := embedding.RankDatasets(datasets, emb, s.datasetOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error scoring datasets: %w", err)
+	}
+	scores := map[*embedding.Dataset]float32{}
+	for _, match := range ranked {
+		scores[match.Dataset] = match.Score
+	}
+
+	if len(datasets) == 0 {
+		// The fallback is only for documents the query may see, so that it
+		// doesn't leak out of the scope of an integration
+		if s.fallbackDocument == "" || !embedding.Considered(s.fallbackDocument, opts...) {
+			return nil, nil, nil
+		}
+		fmt.Printf("no relevant dataset, falling back to %s\n", s.fallbackDocument)
+		datasets = []*embedding.Dataset{{Filename: s.fallbackDocument}}
+	}
+
+	assemblyCtx, span := s.tracer.Start(ctx, "rag.assembly")
+	defer span.End()
+
+	preamble, available := s.contextRoom(systemPrompt, budget)
+	score := s.relevanceScorer(embedding.WithCredentials(assemblyCtx, integrationID, apiToken), emb)
+	docs, sources, duplicates, err := s.assembleDocuments(datasets, scores, score, history, available)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(docs) == 0 && duplicates > 0 {
+		// The conversation still needs the system prompt
+		budget.spend(s.countTokens(systemPrompt))
+		return []copilot.ChatMessage{{
+			Role:    "system",
+			Content: systemPrompt,
+		}}, nil, nil
+	}
+	if len(docs) == 0 {
+		return nil, nil, nil
+	}
+
+	content := preamble + strings.Join(docs, "\n\n")
+	budget.spend(s.countTokens(content))
+	span.SetAttributes(
+		Attribute{Key: "rag.sources", Value: len(sources)},
+		Attribute{Key: "rag.context_tokens", Value: s.countTokens(content)},
+	)
+
+	contextMsg := copilot.ChatMessage{
+		Role:    "system",
+		Content: content,
+	}
+	if s.promptLayout == LayoutCombined {
+		return []copilot.ChatMessage{contextMsg}, sources, nil
+	}
+
+	budget.spend(s.countTokens(systemPrompt))
+	personaMsg := copilot.ChatMessage{
+		Role:    "system",
+		Content: systemPrompt,
+	}
+	if s.promptLayout == LayoutContextFirst {
+		return []copilot.ChatMessage{contextMsg, personaMsg}, sources, nil
+	}
+	return []copilot.ChatMessage{personaMsg, contextMsg}, sources, nil
+}
+
+// contextRoom returns the preamble of the document context for systemPrompt,
+// and how many tokens of budget are left for the documents themselves.
+// Unless it is combined with the context, the system prompt goes in a message
+// of its own, which takes up tokens all the same.
+func (s *Service) contextRoom(systemPrompt string, budget *tokenBudget) (string, int) {
+	persona := systemPrompt
+	if s.promptLayout != LayoutCombined {
+		persona = ""
+	}
+	preamble := s.contextPreamble(persona)
+
+	available := budget.remaining() - s.countTokens(preamble)
+	if persona == "" {
+		available -= s.countTokens(systemPrompt)
+	}
+	return preamble, available
+}
+
+// assembleDocuments returns the text of each of datasets as it is injected as
+// context, along with the sources it came from.  The documents share the
+// available tokens equally, and what one of them leaves unused goes to the
+// ones after it.  score ranks the paragraphs of documents that are trimmed.
+// Documents found verbatim in history are left out if deduplication is on, and
+// counted as duplicates.
+func (s *Service) assembleDocuments(datasets []*embedding.Dataset, scores map[*embedding.Dataset]float32, score chunkScorer, history []copilot.ChatMessage, available int) ([]string, []contextSource, int, error) {
+	var docs []string
+	var sources []contextSource
+	var duplicates int
+	for i, dataset := range datasets {
+		fmt.Printf("loading dataset: %s\n", dataset.Filename)
+
+		share := available / (len(datasets) - i)
+		doc, truncated, err := s.injectedDocument(dataset, len(sources), score, share)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if doc == "" {
+			fmt.Printf("no token budget left for context from %s, skipping it\n", dataset.Filename)
+			continue
+		}
+		if s.dedupeContext && injectedBefore(history, strings.TrimPrefix(doc, s.documentLabel(dataset, len(sources)))) {
+			fmt.Printf("context from %s is already in the conversation, skipping it\n", dataset.Filename)
+			duplicates++
+			continue
+		}
+
+		docs = append(docs, doc)
+		available -= s.countTokens(doc)
+		sources = append(sources, contextSource{
+			Match: embedding.Match{
+				Dataset:  dataset,
+				Score:    scores[dataset],
+				Relevant: !s.isFallback(dataset),
+			},
+			Snippet:   doc,
+			Truncated: truncated,
+		})
+	}
+	if s.maxContextBytes > 0 {
+		docs, sources = s.capContextBytes(docs, sources, score)
+	}
+	return docs, sources, duplicates, nil
+}
+
+// capContextBytes cuts docs, the documents of sources as they are injected,
+// down so that joined they take up at most the maximum context bytes.  Past
+// the cap, documents are trimmed according to the trim strategy, and those
+// that don't fit at all are left out.
+func (s *Service) capContextBytes(docs []string, sources []contextSource, score chunkScorer) ([]string, []contextSource) {
+	var used int
+	for i, doc := range docs {
+		if i > 0 {
+			used += len("\n\n")
+		}
+		room := s.maxContextBytes - used
+		if len(doc) <= room {
+			used += len(doc)
+			continue
+		}
+
+		label := s.documentLabel(sources[i].Dataset, i)
+		var trimmed string
+		if room > len(label) {
+			trimmed = s.fitBytes(strings.TrimPrefix(doc, label), score, room-len(label))
+		}
+		if trimmed == "" {
+			fmt.Printf("context reached the cap of %d bytes, leaving out %d documents\n", s.maxContextBytes, len(docs)-i)
+			return docs[:i], sources[:i]
+		}
+
+		fmt.Printf("trimming context from %s to fit the cap of %d bytes\n", sources[i].Dataset.Filename, s.maxContextBytes)
+		docs[i] = label + trimmed
+		sources[i].Snippet = docs[i]
+		sources[i].Truncated = true
+		used += len(docs[i])
+	}
+	return docs, sources
+}
+
+// fitBytes trims text according to the trim strategy to as many tokens as fit
+// in n bytes
+func (s *Service) fitBytes(text string, score chunkScorer, n int) string {
+	var fit string
+	lo, hi := 0, s.countTokens(text)
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		if trimmed := s.trim(text, score, mid); len(trimmed) <= n {
+			fit = trimmed
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return fit
+}
+
+// contextPreamble returns the text that introduces the document context
+func (s *Service) contextPreamble(systemPrompt string) string {
+	switch s.contextAssembly {
+	case AssemblyCited:
+		return systemPrompt + citationInstructions + "Context: "
+	case AssemblyVerbatim:
+		return systemPrompt + verbatimInstructions + "Context: "
+	default:
+		return systemPrompt + "Context: "
+	}
+}
+
+// injectedDocument returns the text of dataset's document as it appears in the
+// context, as the source with the given index, trimmed to available tokens,
+// and whether any of it was cut.  It is empty if there aren't enough tokens
+// available for any of it.
+func (s *Service) injectedDocument(dataset *embedding.Dataset, index int, score chunkScorer, available int) (string, bool, error) {
+	fileContents, _, err := embedding.ReadDocument(s.source, dataset.Filename)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read documents: %w", err)
+	}
+
+	label := s.documentLabel(dataset, index)
+	available -= s.countTokens(label)
+	if available <= 0 {
+		return "", true, nil
+	}
+	docContext := string(fileContents)
+
+	// However relevant, one document may only contribute so many paragraphs
+	if s.maxChunksPerDocument > 0 && strings.Count(docContext, "\n\n") >= s.maxChunksPerDocument {
+		docContext = s.trimTopChunks(docContext, score, available, s.maxChunksPerDocument)
+	}
+
+	if s.countTokens(docContext) > available {
+		fmt.Printf("trimming context from %s to %d tokens to fit the token budget\n", dataset.Filename, available)
+		docContext = s.trim(docContext, score, available)
+	}
+
+	return label + docContext, docContext != string(fileContents), nil
+}
+
+// documentLabel returns the text that introduces dataset's document as the
+// source with the given index.  Only cited context has labels.
+func (s *Service) documentLabel(dataset *embedding.Dataset, index int) string {
+	if s.contextAssembly != AssemblyCited {
+		return ""
+	}
+
+	name := filepath.Base(dataset.Filename)
+	if s.isFallback(dataset) {
+		name += ", general information"
+	}
+	return citationMarker(index) + " (" + name + ")\n"
+}
+
+// injectedBefore reports whether doc appears in any of the messages of
+// history, i.e. was injected earlier in the conversation
+func injectedBefore(history []copilot.ChatMessage, doc string) bool {
+	for _, msg := range history {
+		if strings.Contains(msg.Content, doc) {
+			return true
+		}
+	}
+	return false
+}
+
+// injectedContextMarker starts the system messages added by the service when
+// stale context is stripped, see WithStaleContextStripping.  It is an HTML
+// comment so that it doesn't distract the model.
+const injectedContextMarker = "<!-- rag-context -->\n"
+
+// stripInjectedContext returns history without the system messages that
+// carry injectedContextMarker
+func stripInjectedContext(history []copilot.ChatMessage) []copilot.ChatMessage {
+	stripped := make([]copilot.ChatMessage, 0, len(history))
+	for _, msg := range history {
+		if msg.Role == "system" && strings.HasPrefix(msg.Content, injectedContextMarker) {
+			continue
+		}
+		stripped = append(stripped, msg)
+	}
+	if dropped := len(history) - len(stripped); dropped > 0 {
+		fmt.Printf("dropped %d stale context messages from the conversation\n", dropped)
+	}
+	return stripped
+}
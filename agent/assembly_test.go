@@ -0,0 +1,539 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+func TestMetadataHeaderStaysOutOfContext(t *testing.T) {
+	const doc = "# Batch jobs\n\nThey run nightly, one after the other."
+
+	for _, enabled := range []bool{false, true} {
+		fake := &fakeCopilot{content: []string{"Nightly."}}
+		stubCopilot(t, fake)
+		s := newTestService(t, map[string]string{"batch.md": doc}, []string{"batch"}, WithMetadataHeader(enabled))
+
+		w := doChat(t, s, `{"messages":[{"role":"user","content":"When do batch jobs run?"}],"stream":false}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+
+		system := fake.requests[0].Messages[0].Content
+		if !strings.Contains(system, doc) {
+			t.Errorf("header %v: context is missing the document:\n%s", enabled, system)
+		}
+		if strings.Contains(system, "File: batch.md") {
+			t.Errorf("header %v: the metadata header was injected as context:\n%s", enabled, system)
+		}
+	}
+}
+
+func TestCitedAssembly(t *testing.T) {
+	docs := map[string]string{
+		"billing.md":  "Invoices are sent monthly.",
+		"payments.md": "An invoice can be paid by card.",
+		"deploy.md":   "Deploy from the main branch.",
+	}
+
+	tests := []struct {
+		name    string
+		sources int
+	}{
+		{name: "one source", sources: 1},
+		{name: "two sources", sources: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly [1]."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, docs, []string{"invoice", "deploy"},
+				WithContextAssembly(AssemblyCited), WithMinDistinctSources(tt.sources), WithMinSimilarity(0.5))
+
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"How is an invoice sent and paid?"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var meta completionMetadata
+			events := readEvents(t, w.Body)
+			for _, event := range events {
+				if event.Name == "metadata" {
+					if err := json.Unmarshal(event.Data, &meta); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if len(meta.Citations) != tt.sources {
+				t.Fatalf("legend = %+v, want %d sources", meta.Citations, tt.sources)
+			}
+
+			// Every marker in the context is in the legend, for the same file,
+			// and the other way around
+			system := fake.requests[0].Messages[0].Content
+			_, injected, _ := strings.Cut(system, citationInstructions)
+			markers := citationPattern.FindAllString(injected, -1)
+			if len(markers) != len(meta.Citations) {
+				t.Errorf("context has markers %q, legend %+v", markers, meta.Citations)
+			}
+			for i, c := range meta.Citations {
+				if want := citationMarker(i); c.Marker != want {
+					t.Errorf("citation %d has marker %s, want %s", i, c.Marker, want)
+				}
+				label := c.Marker + " (" + filepath.Base(c.Filename) + ")\n" + docs[filepath.Base(c.Filename)]
+				if !strings.Contains(injected, label) {
+					t.Errorf("context doesn't introduce %s with %s:\n%s", c.Filename, c.Marker, injected)
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackDocument(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"faq.md":     "Ask support about anything else.",
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		fallback     bool
+		scope        []string
+		exclude      []string
+		wantDoc      string
+		wantFallback bool
+	}{
+		{name: "relevant match", query: "When is an invoice sent?", fallback: true, wantDoc: "billing.md"},
+		{name: "no match", query: "What's for lunch?", fallback: true, wantDoc: "faq.md", wantFallback: true},
+		{name: "no match without fallback", query: "What's for lunch?"},
+		// The fallback doesn't get around the isolation of integrations or
+		// the documents the user ruled out
+		{name: "fallback in scope", query: "What's for lunch?", fallback: true, scope: []string{"faq*"}, wantDoc: "faq.md", wantFallback: true},
+		{name: "fallback outside the scope", query: "What's for lunch?", fallback: true, scope: []string{"billing*"}},
+		{name: "fallback excluded", query: "What's for lunch?", fallback: true, exclude: []string{"faq.md"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Ask support."}}
+			stubCopilot(t, fake)
+
+			// The fallback is named as the document source names it
+			dir := t.TempDir()
+			for name, content := range docs {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := []Option{
+				WithDocumentSource(embedding.DirSource(dir)),
+				WithContextAssembly(AssemblyCited),
+				WithMinSimilarity(0.5),
+			}
+			if tt.fallback {
+				opts = append(opts, WithFallbackDocument(filepath.Join(dir, "faq.md")))
+			}
+			if tt.scope != nil {
+				opts = append(opts, WithIntegrationDocuments("integration", tt.scope...))
+			}
+			s := newTestService(t, nil, []string{"invoice", "support"}, opts...)
+
+			body, _ := json.Marshal(map[string]any{
+				"messages":          []map[string]string{{"role": "user", "content": tt.query}},
+				"exclude_documents": tt.exclude,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var prompt strings.Builder
+			for _, msg := range fake.requests[0].Messages {
+				prompt.WriteString(msg.Content)
+			}
+			for name, content := range docs {
+				if injected := strings.Contains(prompt.String(), content); injected != (name == tt.wantDoc) {
+					t.Errorf("%s injected = %v, want %v", name, injected, name == tt.wantDoc)
+				}
+			}
+
+			var meta completionMetadata
+			for _, event := range readEvents(t, w.Body) {
+				if event.Name == "metadata" {
+					if err := json.Unmarshal(event.Data, &meta); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if tt.wantDoc == "" {
+				if len(meta.Citations) != 0 {
+					t.Errorf("citations = %+v, want none", meta.Citations)
+				}
+				return
+			}
+			if len(meta.Citations) != 1 {
+				t.Fatalf("citations = %+v, want one", meta.Citations)
+			}
+			c := meta.Citations[0]
+			if filepath.Base(c.Filename) != tt.wantDoc || c.Fallback != tt.wantFallback {
+				t.Errorf("citation = %+v, want %s with fallback %v", c, tt.wantDoc, tt.wantFallback)
+			}
+			if tt.wantFallback && !strings.Contains(prompt.String(), "faq.md, general information") {
+				t.Errorf("the fallback isn't labelled as such:\n%s", prompt.String())
+			}
+		})
+	}
+}
+
+func TestContextDeduplication(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+
+	tests := []struct {
+		name  string
+		opts  []Option
+		wantN int
+	}{
+		{name: "off", wantN: 2},
+		{name: "on", opts: []Option{WithContextDeduplication()}, wantN: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			opts := append([]Option{WithSystemPrompt("Answer from the context.")}, tt.opts...)
+			s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice"}, opts...)
+
+			turn := func(messages []copilot.ChatMessage) []copilot.ChatMessage {
+				t.Helper()
+				body, _ := json.Marshal(map[string]any{"messages": messages, "stream": false})
+				if w := doChat(t, s, string(body)); w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body)
+				}
+				return fake.requests[len(fake.requests)-1].Messages
+			}
+
+			// The client sends the whole conversation back, context included
+			first := turn([]copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}})
+			history := append(first, copilot.ChatMessage{Role: "assistant", Content: "Monthly."})
+			second := turn(append(history, copilot.ChatMessage{Role: "user", Content: "And how often is an invoice sent?"}))
+
+			var n int
+			for _, msg := range second {
+				n += strings.Count(msg.Content, doc)
+			}
+			if n != tt.wantN {
+				t.Errorf("the document is in the second turn %d times, want %d", n, tt.wantN)
+			}
+
+			// The system prompt is there either way
+			if second[0].Role != "system" || !strings.HasPrefix(second[0].Content, "Answer from the context.") {
+				t.Errorf("first message = %+v, want the system prompt", second[0])
+			}
+		})
+	}
+}
+
+func TestMaxChunksPerDocument(t *testing.T) {
+	paragraphs := []string{
+		"Invoices are sent on the first of every month.",
+		"An invoice lists every seat that was active.",
+		"Invoices can be paid by card or bank transfer.",
+		"Late invoices incur a fee.",
+		"Invoice disputes go to the billing team.",
+	}
+	docs := map[string]string{
+		"billing.md":  strings.Join(paragraphs, "\n\n"),
+		"payments.md": "Pay an invoice from the billing page.",
+	}
+
+	tests := []struct {
+		name string
+		max  int
+		want int
+	}{
+		{name: "unlimited", want: len(paragraphs)},
+		{name: "capped", max: 2, want: 2},
+		{name: "cap above the paragraphs", max: 10, want: len(paragraphs)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, docs, []string{"invoice"},
+				WithMaxChunksPerDocument(tt.max), WithMinDistinctSources(2), WithMinSimilarity(0.5))
+
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var prompt strings.Builder
+			for _, msg := range fake.requests[0].Messages {
+				prompt.WriteString(msg.Content)
+			}
+			var n int
+			for _, p := range paragraphs {
+				if strings.Contains(prompt.String(), p) {
+					n++
+				}
+			}
+			if n != tt.want {
+				t.Errorf("billing.md contributed %d paragraphs, want %d:\n%s", n, tt.want, prompt.String())
+			}
+
+			// The cap leaves the other document its place
+			if !strings.Contains(prompt.String(), docs["payments.md"]) {
+				t.Errorf("payments.md is missing from the context:\n%s", prompt.String())
+			}
+			if tt.want < len(paragraphs) && !strings.Contains(prompt.String(), paragraphs[0]) {
+				t.Errorf("the paragraph closest to the query was dropped:\n%s", prompt.String())
+			}
+		})
+	}
+}
+
+func TestPromptLayout(t *testing.T) {
+	const prompt = "You are a billing assistant."
+	const doc = "Invoices are sent monthly."
+
+	// describe names the system messages: "persona", "context" or both
+	describe := func(content string) string {
+		switch persona, context := strings.Contains(content, prompt), strings.Contains(content, doc); {
+		case persona && context:
+			return "persona+context"
+		case persona:
+			return "persona"
+		case context:
+			return "context"
+		}
+		return content
+	}
+
+	tests := []struct {
+		name   string
+		layout PromptLayout
+		want   []string
+	}{
+		{name: "combined", layout: LayoutCombined, want: []string{"persona+context", "user"}},
+		{name: "persona first", layout: LayoutPersonaFirst, want: []string{"persona", "context", "user"}},
+		{name: "context first", layout: LayoutContextFirst, want: []string{"context", "persona", "user"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice"},
+				WithSystemPrompt(prompt), WithPromptLayout(tt.layout))
+
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var got []string
+			for _, msg := range fake.requests[0].Messages {
+				if msg.Role != "system" {
+					got = append(got, msg.Role)
+					continue
+				}
+				got = append(got, describe(msg.Content))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleContextStripping(t *testing.T) {
+	docs := map[string]string{"billing.md": "Invoices are sent monthly."}
+	const stale = "Deploy from the main branch."
+	conversation := []copilot.ChatMessage{
+		{Role: "system", Content: injectedContextMarker + stale},
+		{Role: "system", Content: "Answer in English."},
+		{Role: "user", Content: "How do I deploy?"},
+		{Role: "assistant", Content: "From the main branch."},
+		{Role: "user", Content: "When is an invoice sent?"},
+	}
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantStale  bool
+		wantMarked int
+	}{
+		{name: "disabled", wantStale: true, wantMarked: 1},
+		{name: "enabled", opts: []Option{WithStaleContextStripping()}, wantMarked: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, docs, []string{"invoice"}, tt.opts...)
+
+			body, _ := json.Marshal(map[string]any{"messages": conversation, "stream": false})
+			if w := doChat(t, s, string(body)); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var hasStale, hasFresh, hasClientSystem bool
+			var marked int
+			for _, msg := range fake.requests[0].Messages {
+				hasStale = hasStale || strings.Contains(msg.Content, stale)
+				hasFresh = hasFresh || strings.Contains(msg.Content, docs["billing.md"])
+				hasClientSystem = hasClientSystem || msg.Content == "Answer in English."
+				if strings.HasPrefix(msg.Content, injectedContextMarker) {
+					marked++
+				}
+			}
+			if hasStale != tt.wantStale {
+				t.Errorf("stale context sent = %v, want %v", hasStale, tt.wantStale)
+			}
+			if !hasFresh {
+				t.Error("fresh context wasn't sent")
+			}
+			// Only what the service added is stripped
+			if !hasClientSystem {
+				t.Error("the client's own system message was dropped")
+			}
+			if marked != tt.wantMarked {
+				t.Errorf("%d marked messages, want %d", marked, tt.wantMarked)
+			}
+		})
+	}
+}
+
+func TestMaxCitations(t *testing.T) {
+	var sources []contextSource
+	for _, m := range []struct {
+		filename string
+		score    float32
+	}{
+		{"a.md", 0.6}, {"b.md", 0.9}, {"c.md", 0.7}, {"d.md", 0.8}, {"e.md", 0.7},
+	} {
+		sources = append(sources, contextSource{Match: embedding.Match{Dataset: &embedding.Dataset{Filename: m.filename}, Score: m.score}})
+	}
+
+	tests := []struct {
+		name string
+		max  int
+		want []string
+	}{
+		{name: "unlimited", want: []string{"a.md", "b.md", "c.md", "d.md", "e.md"}},
+		{name: "above the number of sources", max: 10, want: []string{"a.md", "b.md", "c.md", "d.md", "e.md"}},
+		{name: "best only", max: 1, want: []string{"b.md"}},
+		// Cited in the order of their markers, not of their scores
+		{name: "best two", max: 2, want: []string{"b.md", "d.md"}},
+		// Of equal scores, the earlier source wins
+		{name: "tie", max: 3, want: []string{"b.md", "c.md", "d.md"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{maxCitations: tt.max}
+			legend := s.citations(sources)
+
+			var got []string
+			for _, c := range legend {
+				got = append(got, c.Filename)
+				// Markers still point at the sources in the context
+				i := slices.IndexFunc(sources, func(source contextSource) bool { return source.Dataset.Filename == c.Filename })
+				if want := citationMarker(i); c.Marker != want {
+					t.Errorf("%s has marker %s, want %s", c.Filename, c.Marker, want)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("cited %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxContextBytes(t *testing.T) {
+	texts := []string{
+		"Invoices are sent monthly.",
+		"An invoice can be paid by card or by bank transfer.",
+		"Deploy from the main branch.",
+	}
+	const query = "How is an invoice paid?"
+
+	tests := []struct {
+		name          string
+		opts          []Option
+		max           int
+		wantKept      int
+		wantTruncated []bool
+	}{
+		{name: "within the cap", max: 1000, wantKept: 3, wantTruncated: []bool{false, false, false}},
+		{name: "exactly the cap", max: len(texts[0]) + 2 + len(texts[1]), wantKept: 2, wantTruncated: []bool{false, false}},
+		{name: "trimmed at the end", opts: []Option{WithTrimStrategy(TrimTail)}, max: 50, wantKept: 2, wantTruncated: []bool{false, true}},
+		{name: "trimmed at the beginning", opts: []Option{WithTrimStrategy(TrimHead)}, max: 50, wantKept: 2, wantTruncated: []bool{false, true}},
+		{name: "first document trimmed", opts: []Option{WithTrimStrategy(TrimTail)}, max: 12, wantKept: 1, wantTruncated: []bool{true}},
+		{name: "nothing fits", max: 2},
+		// Labels count towards the cap, and are kept on trimmed documents
+		{name: "cited", opts: []Option{WithContextAssembly(AssemblyCited), WithTrimStrategy(TrimTail)}, max: 80, wantKept: 2, wantTruncated: []bool{false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithMaxContextBytes(tt.max)}, tt.opts...)
+			s := newTestService(t, nil, nil, opts...)
+
+			var docs []string
+			var sources []contextSource
+			for i, text := range texts {
+				dataset := &embedding.Dataset{Filename: filepath.Join("docs", "doc"+strconv.Itoa(i)+".md")}
+				docs = append(docs, s.documentLabel(dataset, i)+text)
+				sources = append(sources, contextSource{Match: embedding.Match{Dataset: dataset}, Snippet: docs[i]})
+			}
+			original := slices.Clone(docs)
+
+			docs, sources = s.capContextBytes(docs, sources, queryScorer(t, s, query))
+			if len(docs) != tt.wantKept || len(sources) != tt.wantKept {
+				t.Fatalf("kept %d documents and %d sources, want %d: %q", len(docs), len(sources), tt.wantKept, docs)
+			}
+			if joined := strings.Join(docs, "\n\n"); len(joined) > tt.max {
+				t.Errorf("context is %d bytes, over the cap of %d: %q", len(joined), tt.max, joined)
+			}
+
+			var truncated []bool
+			for i, doc := range docs {
+				truncated = append(truncated, sources[i].Truncated)
+				if sources[i].Snippet != doc {
+					t.Errorf("snippet %q doesn't match document %q", sources[i].Snippet, doc)
+				}
+				label := s.documentLabel(sources[i].Dataset, i)
+				if !strings.HasPrefix(doc, label) {
+					t.Errorf("document %q lost its label %q", doc, label)
+				}
+				if !sources[i].Truncated {
+					if doc != original[i] {
+						t.Errorf("untruncated document %q changed from %q", doc, original[i])
+					}
+					continue
+				}
+				body := strings.TrimSpace(strings.TrimPrefix(doc, label))
+				if body == "" || !strings.Contains(original[i], body) {
+					t.Errorf("trimmed document %q isn't part of %q", doc, original[i])
+				}
+			}
+			if !slices.Equal(truncated, tt.wantTruncated) {
+				t.Errorf("truncated = %v, want %v", truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// AuditRecord is what the audit log keeps about a single completion: the
+// prompt exactly as it was sent to the model and the model's response.
+// Credentials are never part of it.
+type AuditRecord struct {
+	Time          time.Time             `json:"time"`
+	IntegrationID string                `json:"integration_id,omitempty"`
+	Model         copilot.Model         `json:"model"`
+	Messages      []copilot.ChatMessage `json:"messages"`
+	Response      string                `json:"response"`
+}
+
+// AuditSink stores audit records, e.g. in a file or an external audit system
+type AuditSink func(record *AuditRecord) error
+
+// Redactor removes sensitive information, such as PII, from text before it is
+// audited
+type Redactor func(text string) string
+
+// AuditWriter returns an AuditSink that writes each record to w as a line of
+// JSON
+func AuditWriter(w io.Writer) AuditSink {
+	var mu sync.Mutex
+	return func(record *AuditRecord) error {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit record: %w", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return fmt.Errorf("failed to write audit record: %w", err)
+		}
+		return nil
+	}
+}
+
+// WithAuditLog records every prompt sent to the model, along with the
+// response, in sink.  Every message and response passes through redact first,
+// if it is set.  Auditing is disabled by default.
+func WithAuditLog(sink AuditSink, redact Redactor) Option {
+	return func(s *Service) {
+		s.audit = &auditLog{sink: sink, redact: redact}
+	}
+}
+
+type auditLog struct {
+	sink   AuditSink
+	redact Redactor
+}
+
+// record audits a completion of req.  raw is the upstream response, which is a
+// stream of server-sent events if streaming is set.  Failing to audit doesn't
+// fail the request, which has been answered by now.
+func (a *auditLog) record(integrationID string, req *copilot.ChatCompletionsRequest, raw []byte, streaming bool) {
+	response, err := completionContent(raw, streaming)
+	if err != nil {
+		fmt.Printf("failed to read completion for audit: %v\n", err)
+	}
+
+	record := &AuditRecord{
+		Time:          time.Now().UTC(),
+		IntegrationID: integrationID,
+		Model:         req.Model,
+		Messages:      make([]copilot.ChatMessage, len(req.Messages)),
+		Response:      a.apply(response),
+	}
+	for i, msg := range req.Messages {
+		record.Messages[i] = copilot.ChatMessage{
+			Role:    msg.Role,
+			Content: a.apply(msg.Content),
+		}
+	}
+
+	if err := a.sink(record); err != nil {
+		fmt.Printf("failed to audit completion: %v\n", err)
+	}
+}
+
+func (a *auditLog) apply(text string) string {
+	if a.redact == nil {
+		return text
+	}
+	return a.redact(text)
+}
+
+// completionContent returns the text of a raw upstream completion
+func completionContent(raw []byte, streaming bool) (string, error) {
+	if !streaming {
+		var resp copilot.ChatCompletionsResponse
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return "", fmt.Errorf("failed to decode completion: %w", err)
+		}
+		return resp.Content(), nil
+	}
+
+	var content strings.Builder
+	events := copilot.NewEventReader(bytes.NewReader(raw))
+	for {
+		event, err := events.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return content.String(), fmt.Errorf("failed to read stream: %w", err)
+		}
+		if event.Name != "" || event.IsDone() {
+			continue
+		}
+
+		chunk, err := event.Chunk()
+		if err != nil {
+			continue
+		}
+		content.WriteString(chunk.Content())
+	}
+
+	return content.String(), nil
+}
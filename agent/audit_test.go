@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	email := regexp.MustCompile(`\w[\w.]*@\w+(\.\w+)+`)
+	redact := func(text string) string {
+		return email.ReplaceAllString(text, "[email]")
+	}
+	const message = "Send the invoice to jane.doe@example.com"
+
+	tests := []struct {
+		name      string
+		stream    bool
+		redact    Redactor
+		wantEmail bool
+	}{
+		{name: "redacted", redact: redact},
+		{name: "redacted stream", stream: true, redact: redact},
+		{name: "not redacted", wantEmail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCopilot(t, &fakeCopilot{content: []string{"Sent to ", "jane.doe@example.com."}})
+
+			var records []*AuditRecord
+			var raw []string
+			sink := func(record *AuditRecord) error {
+				b, _ := json.Marshal(record)
+				raw = append(raw, string(b))
+				records = append(records, record)
+				return nil
+			}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"},
+				WithAuditLog(sink, tt.redact))
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []map[string]string{{"role": "user", "content": message}},
+				"stream":   tt.stream,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			// Only the audit record is redacted, not the answer
+			if !strings.Contains(w.Body.String(), "jane.doe@example.com") {
+				t.Errorf("the response was redacted: %s", w.Body)
+			}
+
+			if len(records) != 1 {
+				t.Fatalf("got %d audit records, want 1", len(records))
+			}
+			record := records[0]
+			if hasEmail := strings.Contains(raw[0], "@example.com"); hasEmail != tt.wantEmail {
+				t.Errorf("email in the audit record = %v, want %v: %s", hasEmail, tt.wantEmail, raw[0])
+			}
+			if strings.Contains(raw[0], "token") {
+				t.Errorf("the audit record contains the token: %s", raw[0])
+			}
+			if record.IntegrationID != "integration" || record.Model == "" {
+				t.Errorf("record = %+v", record)
+			}
+			if want := "Sent to " + redactedEmail(tt.wantEmail) + "."; record.Response != want {
+				t.Errorf("response = %q, want %q", record.Response, want)
+			}
+		})
+	}
+}
+
+func redactedEmail(keep bool) string {
+	if keep {
+		return "jane.doe@example.com"
+	}
+	return "[email]"
+}
+
+func TestAuditWriter(t *testing.T) {
+	var buf bytes.Buffer
+	sink := AuditWriter(&buf)
+	for _, response := range []string{"one", "two"} {
+		if err := sink(&AuditRecord{Model: "gpt-4o", Response: response}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %d lines, want one per record: %q", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Errorf("line is not a record: %v", err)
+		}
+	}
+}
+
+func TestAuditDisabledByDefault(t *testing.T) {
+	s := newTestService(t, nil, nil)
+	if s.audit != nil {
+		t.Error("auditing is enabled by default")
+	}
+}
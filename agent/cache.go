@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// responseCache holds the raw upstream responses to deterministic completion
+// requests for a short time so that identical requests can be served without
+// calling the model again.
+type responseCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		entries: map[string]cachedResponse{},
+	}
+}
+
+// key returns the cache key for req, or an empty string if the response to req
+// can't be cached.  Only requests with a temperature of 0 are deterministic
+// enough to be cached.
+func (c *responseCache) key(req *copilot.ChatCompletionsRequest) string {
+	if c == nil || req.Temperature == nil || *req.Temperature != 0 {
+		return ""
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *responseCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return entry.body, true
+}
+
+func (c *responseCache) put(key string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cachedResponse{
+		body:    body,
+		expires: now.Add(c.ttl),
+	}
+}
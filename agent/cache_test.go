@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	docs := map[string]string{"billing.md": "# Billing\n\nInvoices are sent on the first of every month."}
+	words := []string{"invoice"}
+	const streamed = `{"messages":[{"role":"user","content":"When is an invoice sent?"}]}`
+	const unstreamed = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+
+	tests := []struct {
+		name      string
+		opts      []Option
+		body      string
+		wantCalls int
+	}{
+		{name: "stream served from the cache", opts: []Option{WithResponseCache(time.Minute), WithTemperature(0)}, body: streamed, wantCalls: 1},
+		{name: "response served from the cache", opts: []Option{WithResponseCache(time.Minute), WithTemperature(0)}, body: unstreamed, wantCalls: 1},
+		{name: "non-deterministic requests bypass the cache", opts: []Option{WithResponseCache(time.Minute), WithTemperature(0.7)}, body: streamed, wantCalls: 2},
+		{name: "default temperature bypasses the cache", opts: []Option{WithResponseCache(time.Minute)}, body: streamed, wantCalls: 2},
+		{name: "no cache", opts: []Option{WithTemperature(0)}, body: streamed, wantCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"On the first ", "of every month."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, docs, words, tt.opts...)
+
+			first := doChat(t, s, tt.body)
+			second := doChat(t, s, tt.body)
+			for _, w := range []*httptest.ResponseRecorder{first, second} {
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body)
+				}
+			}
+
+			if n := fake.calls(); n != tt.wantCalls {
+				t.Errorf("the model was called %d times, want %d", n, tt.wantCalls)
+			}
+			if first.Header().Get("Content-Type") != second.Header().Get("Content-Type") {
+				t.Errorf("content types %q and %q differ", first.Header().Get("Content-Type"), second.Header().Get("Content-Type"))
+			}
+			if first.Body.String() != second.Body.String() {
+				t.Errorf("second response differs from the first:\n%s\n%s", first.Body, second.Body)
+			}
+			if !strings.Contains(first.Body.String(), "every month.") {
+				t.Errorf("response is missing the completion: %s", first.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+// WithInlineCitations streams a "citation" event as soon as the model cites a
+// source with its marker, interleaved with the content, so that clients can
+// show sources while the answer is still coming in.  The trailing metadata
+// event still lists every source.  It only applies to cited context assembly
+// and streamed completions.
+func WithInlineCitations() Option {
+	return func(s *Service) {
+		s.inlineCitations = true
+	}
+}
+
+// citationPattern matches the markers of sources in the answer
+var citationPattern = regexp.MustCompile(`\[\d+\]`)
+
+// maxPendingMarker is the longest text kept back in case it is the start of a
+// marker that continues in the next chunk
+const maxPendingMarker = 8
+
+// inlineCitations finds the markers the model cites as the answer streams in
+type inlineCitations struct {
+	legend map[string]citation
+	seen   map[string]bool
+
+	// pending is the end of the content so far, if it might be the start of a
+	// marker
+	pending string
+}
+
+func newInlineCitations(citations []citation) *inlineCitations {
+	legend := make(map[string]citation, len(citations))
+	for _, c := range citations {
+		legend[c.Marker] = c
+	}
+	return &inlineCitations{legend: legend, seen: map[string]bool{}}
+}
+
+// cited returns the citations first cited in content, the next chunk of the
+// answer, in the order they are cited
+func (c *inlineCitations) cited(content string) []citation {
+	text := c.pending + content
+
+	var cited []citation
+	for _, marker := range citationPattern.FindAllString(text, -1) {
+		citation, ok := c.legend[marker]
+		if !ok || c.seen[marker] {
+			continue
+		}
+		c.seen[marker] = true
+		cited = append(cited, citation)
+	}
+
+	c.pending = ""
+	if i := strings.LastIndexByte(text, '['); i >= 0 && !strings.Contains(text[i:], "]") && len(text)-i < maxPendingMarker {
+		c.pending = text[i:]
+	}
+	return cited
+}
+
+// writeInlineCitations writes a "citation" event for each source first cited
+// in content
+func (s *Service) writeInlineCitations(w io.Writer, meta *completionMetadata, content string) error {
+	if meta == nil || meta.inline == nil || content == "" {
+		return nil
+	}
+
+	for _, c := range meta.inline.cited(content) {
+		if err := s.writeEvent(w, "citation", c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
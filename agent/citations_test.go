@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestInlineCitationMarkers(t *testing.T) {
+	legend := []citation{
+		{Marker: "[1]", Filename: "billing.md"},
+		{Marker: "[2]", Filename: "deploy.md"},
+	}
+
+	tests := []struct {
+		name   string
+		chunks []string
+		want   [][]string
+	}{
+		{name: "whole marker", chunks: []string{"Monthly [1]."}, want: [][]string{{"[1]"}}},
+		{name: "split marker", chunks: []string{"Monthly [", "1]."}, want: [][]string{nil, {"[1]"}}},
+		{name: "split after the number", chunks: []string{"Monthly [1", "]."}, want: [][]string{nil, {"[1]"}}},
+		{name: "split three ways", chunks: []string{"Monthly [", "1", "]."}, want: [][]string{nil, nil, {"[1]"}}},
+		{name: "cited again", chunks: []string{"[1] and [1]", ", see [1]."}, want: [][]string{{"[1]"}, nil}},
+		{name: "in the order cited", chunks: []string{"[2] before [1]"}, want: [][]string{{"[2]", "[1]"}}},
+		{name: "unknown marker", chunks: []string{"See [3]."}, want: [][]string{nil}},
+		{name: "not a marker", chunks: []string{"An [", "x] [1]"}, want: [][]string{nil, {"[1]"}}},
+		{name: "bracket too long ago", chunks: []string{"A [long aside", "1]"}, want: [][]string{nil, nil}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inline := newInlineCitations(legend)
+			for i, chunk := range tt.chunks {
+				var got []string
+				for _, c := range inline.cited(chunk) {
+					got = append(got, c.Marker)
+				}
+				if !slices.Equal(got, tt.want[i]) {
+					t.Errorf("chunk %d %q cited %q, want %q", i, chunk, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInlineCitations(t *testing.T) {
+	docs := map[string]string{
+		"billing.md":  "Invoices are sent monthly.",
+		"payments.md": "An invoice can be paid by card.",
+		"deploy.md":   "Deploy from the main branch.",
+	}
+	chunks := []string{"Invoices are sent monthly [", "1]", ", and paid by card [2].", " See [1]."}
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		wantNames   []string
+		wantMarkers []string
+	}{
+		{
+			name:      "disabled",
+			wantNames: []string{"data", "data", "data", "data", "metadata", "done"},
+		},
+		{
+			// Each citation follows the content that completes its marker
+			name:        "enabled",
+			opts:        []Option{WithInlineCitations()},
+			wantNames:   []string{"data", "data", "citation", "data", "citation", "data", "metadata", "done"},
+			wantMarkers: []string{"[1]", "[2]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: chunks}
+			stubCopilot(t, fake)
+			opts := append([]Option{WithContextAssembly(AssemblyCited), WithMinDistinctSources(2), WithMinSimilarity(0.5)}, tt.opts...)
+			s := newTestService(t, docs, []string{"invoice", "deploy"}, opts...)
+
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"How is an invoice sent and paid?"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			events := readEvents(t, w.Body)
+			if names := eventNames(events); !slices.Equal(names, tt.wantNames) {
+				t.Fatalf("events = %q, want %q", names, tt.wantNames)
+			}
+
+			var meta completionMetadata
+			var inline []citation
+			for _, event := range events {
+				switch event.Name {
+				case "metadata":
+					if err := json.Unmarshal(event.Data, &meta); err != nil {
+						t.Fatal(err)
+					}
+				case "citation":
+					var c citation
+					if err := json.Unmarshal(event.Data, &c); err != nil {
+						t.Fatal(err)
+					}
+					inline = append(inline, c)
+				}
+			}
+
+			var markers []string
+			for _, c := range inline {
+				markers = append(markers, c.Marker)
+				// Inline citations agree with the trailing legend
+				i := slices.IndexFunc(meta.Citations, func(legend citation) bool { return legend.Marker == c.Marker })
+				if i < 0 || meta.Citations[i].Filename != c.Filename {
+					t.Errorf("citation %+v isn't in the legend %+v", c, meta.Citations)
+				}
+				if !strings.HasSuffix(c.Filename, ".md") {
+					t.Errorf("citation %+v has no filename", c)
+				}
+			}
+			if !slices.Equal(markers, tt.wantMarkers) {
+				t.Errorf("inline citations = %q, want %q", markers, tt.wantMarkers)
+			}
+			if len(meta.Citations) != 2 {
+				t.Errorf("legend = %+v, want both sources", meta.Citations)
+			}
+		})
+	}
+}
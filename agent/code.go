@@ -0,0 +1,83 @@
+package agent
+
+import "strings"
+
+// CodeBlock is a fenced code block in an answer
+type CodeBlock struct {
+	// Language is the info string of the fence, e.g. "xpp", which is empty
+	// if the fence has none
+	Language string `json:"language,omitempty"`
+	Code     string `json:"code"`
+}
+
+// WithCodeExtraction adds the fenced code blocks of non-streamed answers to the
+// response as a code_blocks field alongside the choices, so that clients
+// don't have to parse them out of the prose.  Only blocks in one of languages
+// are extracted, ignoring case, or every block if there are none.
+func WithCodeExtraction(languages ...string) Option {
+	return func(s *Service) {
+		s.codeExtraction = &codeExtraction{languages: languages}
+	}
+}
+
+type codeExtraction struct {
+	languages []string
+}
+
+func (c *codeExtraction) wants(language string) bool {
+	if len(c.languages) == 0 {
+		return true
+	}
+	for _, l := range c.languages {
+		if strings.EqualFold(l, language) {
+			return true
+		}
+	}
+	return false
+}
+
+// codeBlocks returns the fenced code blocks of answer that are in one of the
+// wanted languages.  A block that is never closed runs to the end of answer.
+func (c *codeExtraction) codeBlocks(answer string) []CodeBlock {
+	var blocks []CodeBlock
+	var fence, language string
+	var code []string
+	for _, line := range strings.Split(answer, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence == "" {
+			for _, f := range []string{"```", "~~~"} {
+				if strings.HasPrefix(trimmed, f) {
+					fence = f
+					language = strings.TrimSpace(strings.TrimLeft(trimmed, f[:1]))
+					code = nil
+					break
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			if c.wants(language) {
+				blocks = append(blocks, CodeBlock{Language: language, Code: strings.Join(code, "\n")})
+			}
+			fence = ""
+			continue
+		}
+		code = append(code, line)
+	}
+	if fence != "" && c.wants(language) {
+		blocks = append(blocks, CodeBlock{Language: language, Code: strings.Join(code, "\n")})
+	}
+
+	return blocks
+}
+
+// addCodeBlocks adds the code blocks of answer to the raw completion b, leaving
+// every other field intact
+func (c *codeExtraction) addCodeBlocks(b []byte, answer string) ([]byte, error) {
+	blocks := c.codeBlocks(answer)
+	if blocks == nil {
+		blocks = []CodeBlock{}
+	}
+	return addField(b, "code_blocks", blocks)
+}
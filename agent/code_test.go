@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const codeAnswer = "Use a select statement:\n\n" +
+	"```xpp\nCustTable cust;\nselect firstonly cust;\n```\n\n" +
+	"Then print it:\n\n" +
+	"~~~X++\ninfo(cust.AccountNum);\n~~~\n\n" +
+	"Or from the shell:\n\n" +
+	"```\nAxUpdate --all\n```\n"
+
+func TestCodeBlocks(t *testing.T) {
+	xpp := CodeBlock{Language: "xpp", Code: "CustTable cust;\nselect firstonly cust;"}
+	xppPlus := CodeBlock{Language: "X++", Code: "info(cust.AccountNum);"}
+	plain := CodeBlock{Code: "AxUpdate --all"}
+
+	tests := []struct {
+		name      string
+		languages []string
+		answer    string
+		want      []CodeBlock
+	}{
+		{name: "every language", answer: codeAnswer, want: []CodeBlock{xpp, xppPlus, plain}},
+		{name: "language filter", languages: []string{"x++", "XPP"}, answer: codeAnswer, want: []CodeBlock{xpp, xppPlus}},
+		{name: "no blocks", answer: "Use a select statement."},
+		{name: "unclosed block", answer: "Like so:\n```xpp\nselect cust;", want: []CodeBlock{{Language: "xpp", Code: "select cust;"}}},
+		{name: "longer closing fence", answer: "```\ncode\n`````\nprose", want: []CodeBlock{{Code: "code"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &codeExtraction{languages: tt.languages}
+			if got := c.codeBlocks(tt.answer); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("code blocks = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeExtraction(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		stream     bool
+		wantBlocks int
+	}{
+		{name: "off", wantBlocks: -1},
+		{name: "on", opts: []Option{WithCodeExtraction()}, wantBlocks: 3},
+		{name: "filtered", opts: []Option{WithCodeExtraction("xpp")}, wantBlocks: 1},
+		{name: "streamed", opts: []Option{WithCodeExtraction()}, stream: true, wantBlocks: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCopilot(t, &fakeCopilot{content: []string{codeAnswer}})
+			s := newTestService(t, map[string]string{"select.md": "Select statements read records."}, []string{"select"}, tt.opts...)
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []map[string]string{{"role": "user", "content": "How do I select a customer?"}},
+				"stream":   tt.stream,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if tt.stream {
+				for _, event := range readEvents(t, w.Body) {
+					var chunk map[string]json.RawMessage
+					if json.Unmarshal(event.Data, &chunk) == nil && chunk["code_blocks"] != nil {
+						t.Errorf("streamed event has code blocks: %s", event.Data)
+					}
+				}
+				return
+			}
+
+			var resp struct {
+				Choices    []json.RawMessage `json:"choices"`
+				CodeBlocks []CodeBlock       `json:"code_blocks"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			// The prose is left as it is
+			if len(resp.Choices) != 1 {
+				t.Errorf("choices = %s", resp.Choices)
+			}
+			if tt.wantBlocks < 0 {
+				if resp.CodeBlocks != nil {
+					t.Errorf("code blocks = %+v, want none", resp.CodeBlocks)
+				}
+				return
+			}
+			if len(resp.CodeBlocks) != tt.wantBlocks {
+				t.Errorf("got %d code blocks, want %d: %+v", len(resp.CodeBlocks), tt.wantBlocks, resp.CodeBlocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// WithDebug enables features meant for evaluating the agent rather than for
+// production use, such as comparing models with ChatRequest.CompareModels and
+// explaining retrieval with ChatRequest.Explain.
+func WithDebug(enabled bool) Option {
+	return func(s *Service) {
+		s.debug = enabled
+	}
+}
+
+// comparisonEvent is a "comparison" event, carrying a single chunk of the
+// stream of one of the models being compared.  Done is set once the stream of
+// the model has ended, and Error if it failed.
+type comparisonEvent struct {
+	Model copilot.Model   `json:"model"`
+	Chunk json.RawMessage `json:"chunk,omitempty"`
+	Done  bool            `json:"done,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// compareModels streams completions of the same request from every one of
+// models, multiplexed into a single stream of "comparison" events tagged with
+// the model they come from.  The stream terminates once every model is done.
+func (s *Service) compareModels(ctx context.Context, apiToken string, chatReq *copilot.ChatCompletionsRequest, models []copilot.Model, w http.ResponseWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan *comparisonEvent)
+	var wg sync.WaitGroup
+	for _, model := range models {
+		modelReq := *chatReq
+		modelReq.Model = model
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			streamModel(ctx, apiToken, &modelReq, events)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	for event := range events {
+		if err := s.writeEvent(w, "comparison", event); err != nil {
+			return err
+		}
+		s.flush(w)
+	}
+
+	if err := s.emit(w, &copilot.Event{Data: []byte("[DONE]")}); err != nil {
+		return err
+	}
+	s.flush(w)
+
+	return nil
+}
+
+// streamModel sends the chunks of the completion stream for req to events,
+// followed by an event saying the stream is done or failed
+func streamModel(ctx context.Context, apiToken string, req *copilot.ChatCompletionsRequest, events chan<- *comparisonEvent) {
+	send := func(event *comparisonEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	fail := func(err error) {
+		fmt.Printf("failed to stream %s for comparison: %v\n", req.Model, err)
+		send(&comparisonEvent{Model: req.Model, Done: true, Error: err.Error()})
+	}
+
+	stream, err := copilot.ChatCompletions(ctx, "copilot-chat", apiToken, req)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer stream.Close()
+
+	reader := copilot.NewEventReader(stream)
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		if event.IsDone() {
+			break
+		}
+		if event.Name != "" {
+			continue
+		}
+
+		if !send(&comparisonEvent{Model: req.Model, Chunk: event.Data}) {
+			return
+		}
+	}
+
+	send(&comparisonEvent{Model: req.Model, Done: true})
+}
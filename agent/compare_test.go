@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+func TestCompareModels(t *testing.T) {
+	tests := []struct {
+		name       string
+		debug      bool
+		stream     bool
+		wantStatus int
+	}{
+		{name: "debug", debug: true, stream: true, wantStatus: http.StatusOK},
+		{name: "not in debug mode", stream: true, wantStatus: http.StatusBadRequest},
+		{name: "not streaming", debug: true, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{
+				respond: func(req *copilot.ChatCompletionsRequest) *http.Response {
+					switch req.Model {
+					case "model-a":
+						return fakeResponse(http.StatusOK, "text/event-stream", eventStream("Hello", " from a"))
+					case "model-b":
+						return fakeResponse(http.StatusOK, "text/event-stream", eventStream("Hi", " from", " b"))
+					default:
+						return fakeResponse(http.StatusBadRequest, "application/json", `{"error":"unknown model"}`)
+					}
+				},
+			}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"}, WithDebug(tt.debug))
+
+			body, _ := json.Marshal(map[string]any{
+				"messages":       []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}},
+				"stream":         tt.stream,
+				"compare_models": []string{"model-a", "model-b", "model-c"},
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if fake.calls() != 0 {
+					t.Errorf("made %d completion requests for a rejected request", fake.calls())
+				}
+				return
+			}
+
+			// Every model gets the same prompt
+			if fake.calls() != 3 {
+				t.Fatalf("made %d completion requests, want 3", fake.calls())
+			}
+			for _, req := range fake.requests[1:] {
+				if !slices.EqualFunc(req.Messages, fake.requests[0].Messages, func(a, b copilot.ChatMessage) bool {
+					return a.Role == b.Role && a.Content == b.Content
+				}) {
+					t.Errorf("%s got a different prompt than %s", req.Model, fake.requests[0].Model)
+				}
+			}
+
+			// The streams are interleaved in any order, but each is in order
+			content := map[copilot.Model]string{}
+			done := map[copilot.Model]string{}
+			events := readEvents(t, w.Body)
+			for _, event := range events[:len(events)-1] {
+				if event.Name != "comparison" {
+					t.Fatalf("event %q, want only comparison events before the end", event.Name)
+				}
+				var ce comparisonEvent
+				if err := json.Unmarshal(event.Data, &ce); err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := done[ce.Model]; ok {
+					t.Errorf("%s streamed after it was done", ce.Model)
+				}
+				if ce.Done {
+					done[ce.Model] = ce.Error
+					continue
+				}
+				var chunk copilot.ChatCompletionsResponse
+				if err := json.Unmarshal(ce.Chunk, &chunk); err != nil {
+					t.Fatal(err)
+				}
+				content[ce.Model] += chunk.Choices[0].Delta.Content
+			}
+			if !events[len(events)-1].IsDone() {
+				t.Errorf("stream ends with %+v, want [DONE]", events[len(events)-1])
+			}
+
+			want := map[copilot.Model]string{"model-a": "Hello from a", "model-b": "Hi from b"}
+			for model, text := range want {
+				if content[model] != text {
+					t.Errorf("%s streamed %q, want %q", model, content[model], text)
+				}
+				if err, ok := done[model]; !ok || err != "" {
+					t.Errorf("%s done = %v, error %q", model, ok, err)
+				}
+			}
+			if err := done["model-c"]; !strings.Contains(err, "400") {
+				t.Errorf("model-c error = %q, want the failed request", err)
+			}
+		})
+	}
+}
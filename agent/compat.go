@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// DefaultFieldAliases maps the alternate names that some integration versions
+// use for request fields to the names ChatRequest expects
+var DefaultFieldAliases = map[string]string{
+	"message": "messages",
+}
+
+// WithFieldAliases adds to the alternate names accepted for request fields,
+// mapping each alternate name to the name ChatRequest expects, so that
+// requests of other integration versions work without client changes.
+// DefaultFieldAliases are always accepted.
+func WithFieldAliases(aliases map[string]string) Option {
+	return func(s *Service) {
+		for alias, field := range aliases {
+			s.fieldAliases[alias] = field
+		}
+	}
+}
+
+// decodeRequest decodes a chat request, accepting the configured alternate
+// field names and a single message in place of a list of them.  Requests
+// without any messages are rejected.
+func (s *Service) decodeRequest(body []byte) (*copilot.ChatRequest, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("request must be a JSON object")
+	}
+
+	for alias, field := range s.fieldAliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		if _, ok := fields[field]; ok {
+			return nil, fmt.Errorf("request has both %q and its alternate name %q", field, alias)
+		}
+		fields[field] = value
+		delete(fields, alias)
+	}
+
+	messages, ok := fields["messages"]
+	if !ok {
+		return nil, fmt.Errorf("request has no messages")
+	}
+	if messages = bytes.TrimSpace(messages); len(messages) > 0 && messages[0] == '{' {
+		fields["messages"] = append(append([]byte{'['}, messages...), ']')
+	}
+
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize request: %w", err)
+	}
+
+	var req copilot.ChatRequest
+	if err := json.Unmarshal(normalized, &req); err != nil {
+		return nil, fmt.Errorf("failed to decode request: %w", err)
+	}
+	return &req, nil
+}
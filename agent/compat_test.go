@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	const question = `{"role":"user","content":"When is an invoice sent?"}`
+	const answer = `{"role":"assistant","content":"Monthly."}`
+
+	tests := []struct {
+		name         string
+		aliases      map[string]string
+		body         string
+		wantContents []string
+		wantStream   *bool
+		wantErr      bool
+	}{
+		{name: "messages", body: `{"messages":[` + question + `,` + answer + `]}`, wantContents: []string{"When is an invoice sent?", "Monthly."}},
+		{name: "message", body: `{"message":[` + question + `,` + answer + `]}`, wantContents: []string{"When is an invoice sent?", "Monthly."}},
+		{name: "single message", body: `{"messages":` + question + `}`, wantContents: []string{"When is an invoice sent?"}},
+		{name: "single message under its alternate name", body: `{"message":` + question + `}`, wantContents: []string{"When is an invoice sent?"}},
+		{name: "configured alias", aliases: map[string]string{"chat": "messages"}, body: `{"chat":[` + question + `]}`, wantContents: []string{"When is an invoice sent?"}},
+		{name: "configured alias of another field", aliases: map[string]string{"streaming": "stream"}, body: `{"messages":[` + question + `],"streaming":false}`, wantContents: []string{"When is an invoice sent?"}, wantStream: new(bool)},
+		{name: "default aliases kept", aliases: map[string]string{"chat": "messages"}, body: `{"message":[` + question + `]}`, wantContents: []string{"When is an invoice sent?"}},
+		{name: "both names", body: `{"messages":[` + question + `],"message":[` + answer + `]}`, wantErr: true},
+		{name: "no messages", body: `{"stream":false}`, wantErr: true},
+		{name: "unknown name", body: `{"msgs":[` + question + `]}`, wantErr: true},
+		{name: "messages of the wrong type", body: `{"messages":"When is an invoice sent?"}`, wantErr: true},
+		{name: "array", body: `[` + question + `]`, wantErr: true},
+		{name: "null", body: `null`, wantErr: true},
+		{name: "not JSON", body: `messages`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, nil, nil, WithFieldAliases(tt.aliases))
+
+			req, err := s.decodeRequest([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var contents []string
+			for _, msg := range req.Messages {
+				contents = append(contents, msg.Content)
+			}
+			if !slices.Equal(contents, tt.wantContents) {
+				t.Errorf("messages = %q, want %q", contents, tt.wantContents)
+			}
+			if (req.Stream == nil) != (tt.wantStream == nil) || req.Stream != nil && *req.Stream != *tt.wantStream {
+				t.Errorf("stream = %v, want %v", req.Stream, tt.wantStream)
+			}
+		})
+	}
+}
+
+func TestAlternateFieldNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       map[string]any
+		wantStatus int
+	}{
+		{name: "messages", body: map[string]any{"messages": []map[string]string{{"role": "user", "content": "When is an invoice sent?"}}, "stream": false}, wantStatus: http.StatusOK},
+		{name: "message", body: map[string]any{"message": map[string]string{"role": "user", "content": "When is an invoice sent?"}, "stream": false}, wantStatus: http.StatusOK},
+		{name: "no messages", body: map[string]any{"stream": false}, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"})
+
+			body, _ := json.Marshal(tt.body)
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				if w.Body.Len() == 0 {
+					t.Error("rejected request without a reason")
+				}
+				return
+			}
+
+			if got := fake.requests[0].Messages; got[len(got)-1].Content != "When is an invoice sent?" {
+				t.Errorf("messages sent to the model = %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package agent
+
+// ScoreScale maps a raw similarity score to the confidence figure, from 0 to
+// 100, reported to users.  Ranking always uses the raw scores.
+type ScoreScale func(score float32) float64
+
+// LinearScoreScale maps scores from low to high linearly onto 0 to 100,
+// clamping scores outside the range.  Useful scores of most embedding models
+// cover only part of [0, 1], e.g. LinearScoreScale(0.5, 0.9).
+func LinearScoreScale(low, high float32) ScoreScale {
+	return func(score float32) float64 {
+		if high <= low {
+			if score >= high {
+				return 100
+			}
+			return 0
+		}
+
+		confidence := 100 * float64(score-low) / float64(high-low)
+		return min(max(confidence, 0), 100)
+	}
+}
+
+// WithScoreScale reports a confidence figure computed by scale alongside the
+// sources of an answer and the matches shown by Explain.  No confidence is
+// reported by default.
+func WithScoreScale(scale ScoreScale) Option {
+	return func(s *Service) {
+		s.scoreScale = scale
+	}
+}
+
+// confidence returns the confidence figure for score, or nil if no scale is
+// configured
+func (s *Service) confidence(score float32) *float64 {
+	if s.scoreScale == nil {
+		return nil
+	}
+	confidence := s.scoreScale(score)
+	return &confidence
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"math"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+func TestLinearScoreScale(t *testing.T) {
+	tests := []struct {
+		name      string
+		low, high float32
+		score     float32
+		want      float64
+	}{
+		{name: "low end", low: 0.5, high: 0.9, score: 0.5, want: 0},
+		{name: "high end", low: 0.5, high: 0.9, score: 0.9, want: 100},
+		{name: "midway", low: 0.5, high: 0.9, score: 0.7, want: 50},
+		{name: "below the range", low: 0.5, high: 0.9, score: 0.2, want: 0},
+		{name: "above the range", low: 0.5, high: 0.9, score: 0.95, want: 100},
+		{name: "raw cosine", low: 0, high: 1, score: 0.82, want: 82},
+		{name: "empty range, below", low: 0.8, high: 0.8, score: 0.7, want: 0},
+		{name: "empty range, at", low: 0.8, high: 0.8, score: 0.8, want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LinearScoreScale(tt.low, tt.high)(tt.score)
+			if math.Abs(got-tt.want) > 1e-4 {
+				t.Errorf("confidence = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCitationConfidence(t *testing.T) {
+	fallback := &embedding.Dataset{Filename: "faq.md"}
+	sources := []contextSource{
+		{Match: embedding.Match{Dataset: &embedding.Dataset{Filename: "billing.md", Embedding: []float32{1}}, Score: 0.9}},
+		{Match: embedding.Match{Dataset: &embedding.Dataset{Filename: "deploy.md", Embedding: []float32{1}}, Score: 0.6}},
+		{Match: embedding.Match{Dataset: fallback}},
+	}
+
+	tests := []struct {
+		name  string
+		scale ScoreScale
+		want  []float64
+	}{
+		{name: "no scale"},
+		{name: "linear", scale: LinearScoreScale(0.5, 0.9), want: []float64{100, 25}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{scoreScale: tt.scale, fallbackDocument: "faq.md"}
+			legend := s.citations(sources)
+
+			var got []float64
+			for _, c := range legend {
+				if c.Confidence != nil {
+					got = append(got, *c.Confidence)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("confidences = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 1e-4 {
+					t.Errorf("confidence %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+
+			// The fallback isn't a match, so it has no confidence
+			if last := legend[len(legend)-1]; !last.Fallback || last.Confidence != nil {
+				t.Errorf("fallback citation = %+v", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// maxEmbedInputs is the number of texts a single request to Embed may embed
+const maxEmbedInputs = 16
+
+type embedRequest struct {
+	Input []string `json:"input"`
+}
+
+type embedData struct {
+	Index     int       `json:"index"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// Embed lets other services embed text the same way the documents and queries
+// are embedded, so that they don't need an embedding integration of their
+// own.  Requests are signed like chat requests and embed up to 16 inputs with
+// the caller's X-GitHub-Token.  Each input is limited to the maximum message
+// length.
+func (s *Service) Embed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Leave room for the JSON around the inputs
+	if s.maxMessageLength > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(2*maxEmbedInputs*s.maxMessageLength))
+	}
+	body, ok := s.readVerifiedBody(w, r)
+	if !ok {
+		return
+	}
+
+	apiToken := r.Header.Get("X-GitHub-Token")
+	if apiToken == "" {
+		http.Error(w, "missing X-GitHub-Token header", http.StatusUnauthorized)
+		return
+	}
+	integrationID := s.integrationID(r)
+
+	var req embedRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.validateEmbedRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := embedding.WithCredentials(s.apiContext(r.Context()), integrationID, apiToken)
+	embeddings, err := s.retriever.Embed(ctx, req.Input)
+	if err != nil {
+		fmt.Printf("failed to embed input: %v\n", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	data := make([]embedData, len(embeddings))
+	for i, emb := range embeddings {
+		data[i] = embedData{Index: i, Embedding: emb}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Model string      `json:"model,omitempty"`
+		Data  []embedData `json:"data"`
+	}{
+		Model: s.retriever.EmbeddingModel(),
+		Data:  data,
+	}); err != nil {
+		fmt.Printf("failed to write embeddings: %v\n", err)
+	}
+}
+
+func (s *Service) validateEmbedRequest(req *embedRequest) error {
+	if len(req.Input) == 0 {
+		return fmt.Errorf("input is required")
+	}
+	if len(req.Input) > maxEmbedInputs {
+		return fmt.Errorf("at most %d inputs are allowed, got %d", maxEmbedInputs, len(req.Input))
+	}
+
+	for i, input := range req.Input {
+		if input == "" {
+			return fmt.Errorf("input %d is empty", i)
+		}
+		if s.maxMessageLength > 0 && len(input) > s.maxMessageLength {
+			return fmt.Errorf("input %d is %d bytes, exceeding the maximum of %d", i, len(input), s.maxMessageLength)
+		}
+	}
+
+	return nil
+}
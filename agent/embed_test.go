@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEmbed(t *testing.T) {
+	words := wordEmbedder{"invoice", "deploy"}
+	down := &outageEmbedder{wordEmbedder: words}
+	down.down.Store(true)
+
+	var tooMany embedRequest
+	for i := 0; i <= maxEmbedInputs; i++ {
+		tooMany.Input = append(tooMany.Input, "invoice")
+	}
+	tooManyBody, _ := json.Marshal(tooMany)
+
+	tests := []struct {
+		name       string
+		body       string
+		opts       []Option
+		edit       func(t *testing.T, r *http.Request)
+		wantStatus int
+		wantInputs []string
+	}{
+		{name: "inputs", body: `{"input":["An invoice","Deploy twice: deploy"]}`, wantStatus: http.StatusOK, wantInputs: []string{"An invoice", "Deploy twice: deploy"}},
+		{name: "no input", body: `{"input":[]}`, wantStatus: http.StatusBadRequest},
+		{name: "empty input", body: `{"input":["invoice",""]}`, wantStatus: http.StatusBadRequest},
+		{name: "too many inputs", body: string(tooManyBody), wantStatus: http.StatusBadRequest},
+		{name: "input too long", body: `{"input":["` + strings.Repeat("invoice ", 10) + `"]}`, opts: []Option{WithMaxMessageLength(20)}, wantStatus: http.StatusBadRequest},
+		{name: "body too large", body: `{"input":["` + strings.Repeat("invoice ", 200) + `"]}`, opts: []Option{WithMaxMessageLength(20)}, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "not JSON", body: `input`, wantStatus: http.StatusBadRequest},
+		{
+			name: "bad signature",
+			body: `{"input":["invoice"]}`,
+			edit: func(t *testing.T, r *http.Request) {
+				other := signedRequest(t, "/embed", `{"input":["deploy"]}`)
+				r.Header.Set("X-Github-Public-Key-Signature", other.Header.Get("X-Github-Public-Key-Signature"))
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing token",
+			body:       `{"input":["invoice"]}`,
+			edit:       func(t *testing.T, r *http.Request) { r.Header.Del("X-GitHub-Token") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "embedder down",
+			body:       `{"input":["invoice"]}`,
+			opts:       []Option{WithEmbedder(down)},
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, nil, words, tt.opts...)
+
+			r := signedRequest(t, "/embed", tt.body)
+			if tt.edit != nil {
+				tt.edit(t, r)
+			}
+			w := httptest.NewRecorder()
+			s.Embed(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Model string      `json:"model"`
+				Data  []embedData `json:"data"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Data) != len(tt.wantInputs) {
+				t.Fatalf("got %d embeddings, want %d", len(resp.Data), len(tt.wantInputs))
+			}
+			want, _ := words.Embed(r.Context(), tt.wantInputs)
+			for i, data := range resp.Data {
+				if data.Index != i || !slices.Equal(data.Embedding, want[i]) {
+					t.Errorf("embedding %d = %+v, want %v", i, data, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEmbedMethod(t *testing.T) {
+	s := newTestService(t, nil, nil)
+	w := httptest.NewRecorder()
+	s.Embed(w, httptest.NewRequest(http.MethodGet, "/embed", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("status = %d, Allow = %q", w.Code, w.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// statusError is an error caused by the request itself.  It is reported to the
+// client with the given HTTP status rather than as an internal server error.
+type statusError struct {
+	status int
+	err    error
+
+	// retryAfter is sent in a Retry-After header, if set
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// Error codes sent in the "error" event that terminates a stream when a
+// request fails after streaming has started.  Clients can rely on them not to
+// change.
+const (
+	// ErrorCodeNoContext means the document context couldn't be retrieved,
+	// because the datasets aren't ready or the query couldn't be embedded
+	ErrorCodeNoContext = "NO_CONTEXT"
+
+	// ErrorCodeRateLimited means the Copilot API rate limited the request
+	ErrorCodeRateLimited = "RATE_LIMITED"
+
+	// ErrorCodeUpstream means the Copilot API failed the request
+	ErrorCodeUpstream = "UPSTREAM_ERROR"
+
+	// ErrorCodeTimeout means the request ran out of time
+	ErrorCodeTimeout = "TIMEOUT"
+
+	// ErrorCodeInternal covers every other error
+	ErrorCodeInternal = "INTERNAL"
+)
+
+// errorCode maps an error to the code clients see for it.  Retrieval failures
+// come first, since they wrap upstream errors of the embeddings API.
+func errorCode(err error) string {
+	var apiErr *copilot.APIError
+	switch {
+	case errors.Is(err, embedding.ErrWarmingUp), errors.Is(err, embedding.ErrQueryEmbedding):
+		return ErrorCodeNoContext
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errFirstTokenTimeout):
+		return ErrorCodeTimeout
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests:
+		return ErrorCodeRateLimited
+	case errors.As(err, &apiErr):
+		return ErrorCodeUpstream
+	default:
+		return ErrorCodeInternal
+	}
+}
+
+// writeErrorEvent terminates a stream with an "error" event for err.  Only
+// client errors come with their message; the details of other errors stay in
+// the logs.
+func (s *Service) writeErrorEvent(w io.Writer, err error) error {
+	message := "internal error"
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.status < http.StatusInternalServerError {
+		message = statusErr.Error()
+	}
+
+	if err := s.writeEvent(w, "error", struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{
+		Code:    errorCode(err),
+		Message: message,
+	}); err != nil {
+		return err
+	}
+	s.flush(w)
+	return nil
+}
+
+// responseTracker records whether anything has been written to the response,
+// after which its status can no longer be changed
+type responseTracker struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (t *responseTracker) WriteHeader(status int) {
+	t.started = true
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *responseTracker) Write(b []byte) (int, error) {
+	t.started = true
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *responseTracker) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
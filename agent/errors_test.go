@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+func TestErrorCode(t *testing.T) {
+	rateLimited := &copilot.APIError{StatusCode: http.StatusTooManyRequests}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "warming up", err: fmt.Errorf("retrieving: %w", embedding.ErrWarmingUp), want: ErrorCodeNoContext},
+		{name: "query embedding", err: fmt.Errorf("%w: %w", embedding.ErrQueryEmbedding, &copilot.APIError{StatusCode: http.StatusBadGateway}), want: ErrorCodeNoContext},
+		{name: "rate limited query embedding", err: fmt.Errorf("%w: %w", embedding.ErrQueryEmbedding, rateLimited), want: ErrorCodeNoContext},
+		{name: "deadline", err: fmt.Errorf("completion: %w", context.DeadlineExceeded), want: ErrorCodeTimeout},
+		{name: "first token", err: fmt.Errorf("completion: %w", errFirstTokenTimeout), want: ErrorCodeTimeout},
+		{name: "timeout status", err: &statusError{status: http.StatusGatewayTimeout, err: context.DeadlineExceeded}, want: ErrorCodeTimeout},
+		{name: "rate limited", err: fmt.Errorf("completion: %w", rateLimited), want: ErrorCodeRateLimited},
+		{name: "upstream", err: &statusError{status: http.StatusInternalServerError, err: &copilot.APIError{StatusCode: http.StatusInternalServerError}}, want: ErrorCodeUpstream},
+		{name: "client error from upstream", err: &copilot.APIError{StatusCode: http.StatusBadRequest}, want: ErrorCodeUpstream},
+		{name: "anything else", err: errors.New("broken"), want: ErrorCodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Errorf("errorCode(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteErrorEvent(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      OutputFormat
+		err         error
+		wantCode    string
+		wantMessage string
+	}{
+		{
+			name:        "client error",
+			err:         &statusError{status: http.StatusRequestEntityTooLarge, err: errors.New("too many tokens")},
+			wantCode:    ErrorCodeInternal,
+			wantMessage: "too many tokens",
+		},
+		{
+			name:        "internal details stay in the logs",
+			err:         errors.New("secret details"),
+			wantCode:    ErrorCodeInternal,
+			wantMessage: "internal error",
+		},
+		{
+			name:        "upstream details stay in the logs",
+			err:         &statusError{status: http.StatusBadGateway, err: &copilot.APIError{StatusCode: http.StatusBadGateway, Body: "secret details"}},
+			wantCode:    ErrorCodeUpstream,
+			wantMessage: "internal error",
+		},
+		{
+			name:   "no events in the text format",
+			format: OutputText,
+			err:    errors.New("broken"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{outputFormat: tt.format}
+			w := httptest.NewRecorder()
+			if err := s.writeErrorEvent(w, tt.err); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantCode == "" {
+				if w.Body.Len() > 0 {
+					t.Errorf("wrote %q", w.Body)
+				}
+				return
+			}
+
+			data, ok := strings.CutPrefix(w.Body.String(), "event: error\ndata: ")
+			if !ok {
+				t.Fatalf("not an error event: %q", w.Body)
+			}
+			var event struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Code != tt.wantCode || event.Message != tt.wantMessage {
+				t.Errorf("event = %+v, want code %s and message %q", event, tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+}
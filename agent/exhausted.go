@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// ExhaustedBehavior decides how a request is answered when the Copilot API
+// keeps failing until the retries are exhausted
+type ExhaustedBehavior int
+
+const (
+	// ExhaustedError relays the failure as an error, the way other errors
+	// are reported.  This is the default.
+	ExhaustedError ExhaustedBehavior = iota
+
+	// ExhaustedUnavailable answers 503 Service Unavailable with a Retry-After
+	// header
+	ExhaustedUnavailable
+
+	// ExhaustedCannedMessage answers with UnavailableMessage as if the model
+	// had said it, in the shape of a completion the client asked for
+	ExhaustedCannedMessage
+
+	// ExhaustedDegraded answers without document context if retrieval failed,
+	// and tries the completion once more without document context if the
+	// completion failed.  If that fails too, the failure is relayed as an
+	// error.
+	ExhaustedDegraded
+)
+
+// UnavailableMessage is the answer given by ExhaustedCannedMessage
+const UnavailableMessage = "The service is temporarily unavailable. Please try again in a little while."
+
+// exhaustedRetryAfter is how long clients are asked to wait before retrying a
+// request that failed because the Copilot API kept failing
+const exhaustedRetryAfter = 30 * time.Second
+
+// WithExhaustedBehavior sets how requests are answered when calls to the
+// Copilot API keep failing with transient errors until the retry budget is
+// spent, see WithRetryBudget.
+func WithExhaustedBehavior(b ExhaustedBehavior) Option {
+	return func(s *Service) {
+		s.exhaustedBehavior = b
+	}
+}
+
+// writeExhausted answers a request that failed with err according to the
+// exhausted behavior, if err is a transient failure of the Copilot API that it
+// applies to.  It reports whether it answered the request.  Nothing may have
+// been written to w yet.
+func (s *Service) writeExhausted(w http.ResponseWriter, req *copilot.ChatRequest, err error) bool {
+	if !copilot.Transient(err) {
+		return false
+	}
+
+	switch s.exhaustedBehavior {
+	case ExhaustedUnavailable:
+		w.Header().Set("Retry-After", strconv.Itoa(int(exhaustedRetryAfter.Seconds())))
+		http.Error(w, "service temporarily unavailable", http.StatusServiceUnavailable)
+		return true
+	case ExhaustedCannedMessage:
+		streaming := req.Stream == nil || *req.Stream
+		body, err := cannedCompletion(UnavailableMessage, streaming)
+		if err == nil {
+			err = s.relayCompletion(bytes.NewReader(body), streaming, w, nil)
+		}
+		if err != nil {
+			fmt.Printf("failed to write canned completion: %v\n", err)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// cannedCompletion returns a completion of message in the shape the Copilot
+// API would, as a stream or as a single response
+func cannedCompletion(message string, streaming bool) ([]byte, error) {
+	choice := copilot.ChatCompletionsChoice{FinishReason: "stop"}
+	payload := &copilot.ChatMessage{Role: "assistant", Content: message}
+	if streaming {
+		choice.Delta = payload
+	} else {
+		choice.Message = payload
+	}
+
+	b, err := json.Marshal(copilot.ChatCompletionsResponse{
+		ID:      "canned",
+		Choices: []copilot.ChatCompletionsChoice{choice},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode canned completion: %w", err)
+	}
+	if !streaming {
+		return b, nil
+	}
+	return []byte("data: " + string(b) + "\n\ndata: [DONE]\n\n"), nil
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// overloadedEmbedder embeds like a wordEmbedder, but fails to embed queries
+// the way an overloaded embeddings API does
+type overloadedEmbedder struct {
+	wordEmbedder
+}
+
+func (e overloadedEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	if strings.Contains(inputs[0], "?") {
+		return nil, &copilot.APIError{StatusCode: http.StatusServiceUnavailable, Body: "overloaded"}
+	}
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func TestExhaustedBehavior(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+	failing := func(status int) func(*copilot.ChatCompletionsRequest) *http.Response {
+		return func(*copilot.ChatCompletionsRequest) *http.Response {
+			return fakeResponse(status, "text/plain", "upstream failure")
+		}
+	}
+	// failingWithContext fails only while the request carries document context
+	failingWithContext := func(req *copilot.ChatCompletionsRequest) *http.Response {
+		for _, msg := range req.Messages {
+			if strings.Contains(msg.Content, doc) {
+				return fakeResponse(http.StatusServiceUnavailable, "text/plain", "upstream failure")
+			}
+		}
+		return fakeResponse(http.StatusOK, "text/event-stream", eventStream("Monthly."))
+	}
+
+	tests := []struct {
+		name           string
+		behavior       ExhaustedBehavior
+		respond        func(*copilot.ChatCompletionsRequest) *http.Response
+		embedder       Option
+		stream         bool
+		wantStatus     int
+		wantRetryAfter string
+		wantAnswer     string
+		wantCalls      int
+	}{
+		{name: "error", respond: failing(http.StatusServiceUnavailable), stream: true, wantStatus: http.StatusServiceUnavailable, wantCalls: 1},
+		{name: "unavailable", behavior: ExhaustedUnavailable, respond: failing(http.StatusServiceUnavailable), stream: true, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "30", wantCalls: 1},
+		{name: "canned message, streamed", behavior: ExhaustedCannedMessage, respond: failing(http.StatusServiceUnavailable), stream: true, wantStatus: http.StatusOK, wantAnswer: UnavailableMessage, wantCalls: 1},
+		{name: "canned message, single response", behavior: ExhaustedCannedMessage, respond: failing(http.StatusServiceUnavailable), wantStatus: http.StatusOK, wantAnswer: UnavailableMessage, wantCalls: 1},
+		{name: "degraded completion", behavior: ExhaustedDegraded, respond: failingWithContext, stream: true, wantStatus: http.StatusOK, wantAnswer: "Monthly.", wantCalls: 2},
+		{name: "degraded completion failing too", behavior: ExhaustedDegraded, respond: failing(http.StatusServiceUnavailable), stream: true, wantStatus: http.StatusServiceUnavailable, wantCalls: 2},
+		{name: "degraded retrieval", behavior: ExhaustedDegraded, embedder: WithEmbedder(overloadedEmbedder{wordEmbedder{"invoice"}}), stream: true, wantStatus: http.StatusOK, wantAnswer: "Monthly.", wantCalls: 1},
+		// Failures that retrying wouldn't fix are reported as they are
+		{name: "not transient", behavior: ExhaustedUnavailable, respond: failing(http.StatusBadRequest), stream: true, wantStatus: http.StatusBadRequest, wantCalls: 1},
+		{name: "not transient, canned message", behavior: ExhaustedCannedMessage, respond: failing(http.StatusBadRequest), stream: true, wantStatus: http.StatusBadRequest, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}, respond: tt.respond}
+			stubCopilot(t, fake)
+			opts := []Option{WithExhaustedBehavior(tt.behavior)}
+			if tt.embedder != nil {
+				opts = append(opts, tt.embedder)
+			}
+			s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice"}, opts...)
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}},
+				"stream":   tt.stream,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if fake.calls() != tt.wantCalls {
+				t.Errorf("%d completion requests, want %d", fake.calls(), tt.wantCalls)
+			}
+			if tt.wantAnswer == "" {
+				return
+			}
+
+			// The answer comes in the shape the client asked for
+			var answer string
+			if tt.stream {
+				for _, event := range readEvents(t, w.Body) {
+					if event.Name != "" || event.IsDone() {
+						continue
+					}
+					chunk, err := event.Chunk()
+					if err != nil {
+						t.Fatal(err)
+					}
+					answer += chunk.Content()
+				}
+			} else {
+				var resp copilot.ChatCompletionsResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("response isn't a completion: %v: %s", err, w.Body)
+				}
+				answer = resp.Content()
+			}
+			if answer != tt.wantAnswer {
+				t.Errorf("answer = %q, want %q", answer, tt.wantAnswer)
+			}
+
+			// Degraded answers go without document context
+			if tt.behavior == ExhaustedDegraded {
+				last := fake.requests[len(fake.requests)-1]
+				for _, msg := range last.Messages {
+					if strings.Contains(msg.Content, doc) {
+						t.Errorf("degraded request has document context: %+v", last.Messages)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// defaultExplainLimit is the number of matches Explain returns unless asked
+// for more or fewer
+const defaultExplainLimit = 5
+
+type explainRequest struct {
+	Query         string   `json:"query"`
+	Limit         int      `json:"limit,omitempty"`
+	MinSimilarity *float32 `json:"min_similarity,omitempty"`
+}
+
+type explainMatch struct {
+	Filename string  `json:"filename"`
+	Score    float32 `json:"score"`
+	Relevant bool    `json:"relevant"`
+
+	// Confidence is the rescaled score, see WithScoreScale
+	Confidence *float64 `json:"confidence,omitempty"`
+
+	// Snippet is the document text that would be injected as context if the
+	// document were chosen for the query
+	Snippet string `json:"snippet"`
+}
+
+// retrievalExplanation tells why each source of a completion was chosen.  It
+// is sent in the metadata event of requests that ask for it in debug mode.
+type retrievalExplanation struct {
+	Query string `json:"query"`
+
+	// Turns are the user messages that were embedded and weighted in place of
+	// the query, if there are several
+	Turns []string `json:"turns,omitempty"`
+
+	MinSimilarity float32           `json:"min_similarity"`
+	Sources       []explainedSource `json:"sources"`
+}
+
+type explainedSource struct {
+	// Rank is the position of the source among the documents retrieved, best
+	// match first
+	Rank     int     `json:"rank"`
+	Filename string  `json:"filename"`
+	Score    float32 `json:"score"`
+	Relevant bool    `json:"relevant"`
+	Fallback bool    `json:"fallback,omitempty"`
+
+	// Confidence is the rescaled score, see WithScoreScale
+	Confidence *float64 `json:"confidence,omitempty"`
+
+	// Truncated is set if only part of the document fit in the context, and
+	// Tokens is how many tokens of it did
+	Truncated bool `json:"truncated"`
+	Tokens    int  `json:"tokens"`
+}
+
+// explainRetrieval explains how sources were retrieved for query, or turns if
+// they were weighted in its place
+func (s *Service) explainRetrieval(query string, turns []string, minSimilarity float32, sources []contextSource) *retrievalExplanation {
+	explained := make([]explainedSource, len(sources))
+	for i, source := range sources {
+		explained[i] = explainedSource{
+			Rank:      i + 1,
+			Filename:  source.Dataset.Filename,
+			Score:     source.Score,
+			Relevant:  source.Relevant,
+			Fallback:  s.isFallback(source.Dataset),
+			Truncated: source.Truncated,
+			Tokens:    s.countTokens(source.Snippet),
+		}
+		if !explained[i].Fallback {
+			explained[i].Confidence = s.confidence(source.Score)
+		}
+	}
+
+	return &retrievalExplanation{
+		Query:         query,
+		Turns:         turns,
+		MinSimilarity: minSimilarity,
+		Sources:       explained,
+	}
+}
+
+// writeRetrieval answers a retrieve_only request with the documents chosen as
+// context for query, instead of a completion
+func (s *Service) writeRetrieval(query string, sources []contextSource, w http.ResponseWriter) error {
+	matches := make([]explainMatch, len(sources))
+	for i, source := range sources {
+		matches[i] = explainMatch{
+			Filename: source.Dataset.Filename,
+			Score:    source.Score,
+			Relevant: source.Relevant,
+			Snippet:  source.Snippet,
+		}
+		if !s.isFallback(source.Dataset) {
+			matches[i].Confidence = s.confidence(source.Score)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Query   string         `json:"query"`
+		Matches []explainMatch `json:"matches"`
+	}{
+		Query:   query,
+		Matches: matches,
+	}); err != nil {
+		return fmt.Errorf("failed to write retrieval: %w", err)
+	}
+	return nil
+}
+
+// Explain shows content authors how a query is matched against the documents.
+// It responds with the best matches for the query, their scores, whether they
+// reach the minimum similarity and the text that would be injected for them.
+// It is one of the admin endpoints, see WithAdminToken, and embeds the query
+// with the caller's X-GitHub-Token.
+func (s *Service) Explain(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	apiToken := r.Header.Get("X-GitHub-Token")
+	if apiToken == "" {
+		http.Error(w, "missing X-GitHub-Token header", http.StatusUnauthorized)
+		return
+	}
+	integrationID := s.integrationID(r)
+
+	var req explainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultExplainLimit
+	}
+
+	settings := s.currentSettings()
+	minSimilarity := settings.MinSimilarity
+	if req.MinSimilarity != nil {
+		if !validSimilarity(*req.MinSimilarity) {
+			http.Error(w, fmt.Sprintf("min_similarity %v is out of range [0, 1]", *req.MinSimilarity), http.StatusBadRequest)
+			return
+		}
+		minSimilarity = *req.MinSimilarity
+	}
+
+	// Match the query the way a chat request consisting of it would be
+	query := req.Query
+	if s.queryPreprocessor != nil {
+		var err error
+		query, err = s.queryPreprocessor(query)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error preprocessing query: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := embedding.WithCredentials(s.apiContext(r.Context()), integrationID, apiToken)
+	ranked, err := s.retriever.Rank(ctx, query, embedding.WithMinSimilarity(minSimilarity), embedding.WithDocumentScope(s.integrationDocuments[integrationID]))
+	if err != nil {
+		fmt.Printf("failed to rank datasets: %v\n", err)
+		if errors.Is(err, embedding.ErrWarmingUp) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(warmingUpRetryAfter.Seconds())))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	budget := &tokenBudget{limit: s.maxTokensPerRequest}
+	budget.spend(s.countTokens(query))
+	budget.spend(s.countTokens(req.Query))
+	budget.spend(s.maxCompletionTokens)
+
+	// Rank just embedded the query, so this reuses its embedding
+	emb, err := s.retriever.EmbedQuery(ctx, query)
+	if err != nil {
+		fmt.Printf("failed to embed query: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	score := s.relevanceScorer(ctx, emb)
+
+	_, available := s.contextRoom(settings.SystemPrompt, budget)
+	matches := make([]explainMatch, 0, min(req.Limit, len(ranked)))
+	for _, match := range ranked[:cap(matches)] {
+		// Each snippet is assembled like the context of a chat request
+		// consisting of the query, as if its document were the only one chosen
+		_, sources, _, err := s.assembleDocuments([]*embedding.Dataset{match.Dataset}, nil, score, nil, available)
+		if err != nil {
+			fmt.Printf("failed to build snippet: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var snippet string
+		if len(sources) > 0 {
+			snippet = sources[0].Snippet
+		}
+
+		matches = append(matches, explainMatch{
+			Filename:   match.Dataset.Filename,
+			Score:      match.Score,
+			Relevant:   match.Relevant,
+			Confidence: s.confidence(match.Score),
+			Snippet:    snippet,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Query   string         `json:"query"`
+		Matches []explainMatch `json:"matches"`
+	}{
+		Query:   query,
+		Matches: matches,
+	}); err != nil {
+		fmt.Printf("failed to write explanation: %v\n", err)
+	}
+}
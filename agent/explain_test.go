@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// doExplain asks s to explain query with the admin token "admin"
+func doExplain(s *Service, query string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(explainRequest{Query: query})
+	r := httptest.NewRequest(http.MethodPost, "/admin/explain", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin")
+	r.Header.Set("X-GitHub-Token", "token")
+	w := httptest.NewRecorder()
+	s.Explain(w, r)
+	return w
+}
+
+func TestExplainSnippetsMatchGeneration(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "# Billing\n\nInvoices are sent on the first of every month.\n\nAn invoice can be paid by card or by bank transfer.\n\nLate invoices incur a fee.",
+		"deploy.md":  "# Deploying\n\nRun the deploy pipeline from the main branch.",
+	}
+	words := []string{"invoice", "deploy"}
+	const query = "When is an invoice sent?"
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		maxSize int
+		trimmed bool
+	}{
+		{name: "whole document"},
+		{name: "byte cap", opts: []Option{WithMaxContextBytes(80)}, maxSize: 80, trimmed: true},
+		{name: "paragraph cap", opts: []Option{WithMaxChunksPerDocument(2)}, trimmed: true},
+		{name: "token budget", opts: []Option{WithSystemPrompt("Answer from the context."), WithMaxTokensPerRequest(60), WithMaxCompletionTokens(10)}, trimmed: true},
+		{name: "cited", opts: []Option{WithContextAssembly(AssemblyCited), WithMaxContextBytes(100)}, maxSize: 100, trimmed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithAdminToken("admin")}, tt.opts...)
+			s := newTestService(t, docs, words, opts...)
+
+			w := doExplain(s, query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var resp struct {
+				Matches []explainMatch `json:"matches"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Matches) == 0 || !strings.HasSuffix(resp.Matches[0].Filename, "billing.md") {
+				t.Fatalf("matches = %+v, want billing.md first", resp.Matches)
+			}
+			snippet := resp.Matches[0].Snippet
+
+			// Generation for a chat request consisting of the query
+			budget := &tokenBudget{limit: s.maxTokensPerRequest}
+			budget.spend(s.countTokens(query))
+			budget.spend(s.countTokens(query))
+			budget.spend(s.maxCompletionTokens)
+			history := []copilot.ChatMessage{{Role: "user", Content: query}}
+			_, sources, err := s.contextMessages(context.Background(), "", "token", s.currentSettings().SystemPrompt, query, history, budget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sources) != 1 {
+				t.Fatalf("generation injected %d sources, want 1", len(sources))
+			}
+
+			if snippet == "" || snippet != sources[0].Snippet {
+				t.Errorf("snippet = %q, generation injects %q", snippet, sources[0].Snippet)
+			}
+			if trimmed := len(snippet) < len(docs["billing.md"]); trimmed != tt.trimmed {
+				t.Errorf("trimmed = %v, want %v: %q", trimmed, tt.trimmed, snippet)
+			}
+			if tt.maxSize > 0 && len(snippet) > tt.maxSize {
+				t.Errorf("snippet is %d bytes, over the cap of %d", len(snippet), tt.maxSize)
+			}
+		})
+	}
+}
+
+func TestExplainRequiresAdminToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		header     string
+		want       int
+	}{
+		{name: "disabled", want: http.StatusNotFound},
+		{name: "missing token", adminToken: "admin", want: http.StatusUnauthorized},
+		{name: "wrong token", adminToken: "admin", header: "Bearer other", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{adminToken: tt.adminToken, retriever: embedding.NewRetriever(nil)}
+
+			r := httptest.NewRequest(http.MethodPost, "/admin/explain", strings.NewReader(`{"query":"invoice"}`))
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			s.Explain(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveOnly(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		stream bool
+		want   []string
+	}{
+		{name: "match", query: "When is an invoice sent?", want: []string{"billing.md"}},
+		{name: "match, stream requested", query: "How do I deploy?", stream: true, want: []string{"deploy.md"}},
+		{name: "nothing relevant", query: "What's for lunch?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, docs, []string{"invoice", "deploy"}, WithMinSimilarity(0.5))
+
+			body, _ := json.Marshal(map[string]any{
+				"messages":      []copilot.ChatMessage{{Role: "user", Content: tt.query}},
+				"stream":        tt.stream,
+				"retrieve_only": true,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if n := fake.calls(); n != 0 {
+				t.Errorf("the model was called %d times", n)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+
+			var resp struct {
+				Query   string         `json:"query"`
+				Matches []explainMatch `json:"matches"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Query != tt.query {
+				t.Errorf("query = %q, want %q", resp.Query, tt.query)
+			}
+			var got []string
+			for _, match := range resp.Matches {
+				name := filepath.Base(match.Filename)
+				got = append(got, name)
+				if match.Snippet != docs[name] {
+					t.Errorf("%s: snippet = %q, want %q", name, match.Snippet, docs[name])
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("matches = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrievalExplanation(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "# Billing\n\nInvoices are sent on the first of every month.\n\nLate invoices incur a fee.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+	const question = "When is an invoice sent?"
+
+	tests := []struct {
+		name          string
+		opts          []Option
+		messages      []copilot.ChatMessage
+		stream        bool
+		wantStatus    int
+		wantTruncated bool
+		wantTurns     []string
+	}{
+		{
+			name:       "not in debug mode",
+			messages:   []copilot.ChatMessage{{Role: "user", Content: question}},
+			stream:     true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not streamed",
+			opts:       []Option{WithDebug(true)},
+			messages:   []copilot.ChatMessage{{Role: "user", Content: question}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "whole document",
+			opts:       []Option{WithDebug(true)},
+			messages:   []copilot.ChatMessage{{Role: "user", Content: question}},
+			stream:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "truncated document",
+			opts:          []Option{WithDebug(true), WithMaxContextBytes(40)},
+			messages:      []copilot.ChatMessage{{Role: "user", Content: question}},
+			stream:        true,
+			wantStatus:    http.StatusOK,
+			wantTruncated: true,
+		},
+		{
+			name: "weighted turns",
+			opts: []Option{WithDebug(true), WithQueryHistory(2)},
+			messages: []copilot.ChatMessage{
+				{Role: "user", Content: "How do I deploy?"},
+				{Role: "assistant", Content: "From the main branch."},
+				{Role: "user", Content: question},
+			},
+			stream:     true,
+			wantStatus: http.StatusOK,
+			wantTurns:  []string{"How do I deploy?", question},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			opts := append([]Option{WithMinSimilarity(0.5)}, tt.opts...)
+			s := newTestService(t, docs, []string{"invoice", "deploy"}, opts...)
+
+			body, _ := json.Marshal(map[string]any{"messages": tt.messages, "stream": tt.stream, "explain": true})
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var meta completionMetadata
+			for _, event := range readEvents(t, w.Body) {
+				if event.Name == "metadata" {
+					if err := json.Unmarshal(event.Data, &meta); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			explanation := meta.Retrieval
+			if explanation == nil {
+				t.Fatal("metadata has no retrieval explanation")
+			}
+
+			if !strings.Contains(explanation.Query, question) {
+				t.Errorf("query = %q, want it to contain %q", explanation.Query, question)
+			}
+			if !slices.Equal(explanation.Turns, tt.wantTurns) {
+				t.Errorf("turns = %q, want %q", explanation.Turns, tt.wantTurns)
+			}
+			if explanation.MinSimilarity != 0.5 {
+				t.Errorf("min similarity = %v, want 0.5", explanation.MinSimilarity)
+			}
+			if len(explanation.Sources) != 1 {
+				t.Fatalf("sources = %+v, want billing.md", explanation.Sources)
+			}
+			source := explanation.Sources[0]
+			if source.Rank != 1 || filepath.Base(source.Filename) != "billing.md" || !source.Relevant || source.Fallback {
+				t.Errorf("source = %+v, want billing.md ranked first and relevant", source)
+			}
+			if source.Score < 0.5 || source.Score > 1 {
+				t.Errorf("score = %v, want it between the minimum similarity and 1", source.Score)
+			}
+			if source.Tokens <= 0 {
+				t.Errorf("tokens = %d, want some", source.Tokens)
+			}
+			if source.Truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v, want %v", source.Truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// maxWatchedLineSize bounds the part of an event line kept while looking for
+// the first token.  Longer lines aren't looked at.
+const maxWatchedLineSize = 1024 * 1024
+
+// errFirstTokenTimeout is the cause of a completion being cancelled because the
+// model didn't start answering in time
+var errFirstTokenTimeout = errors.New("no response from the model within the first token timeout")
+
+// WithFirstTokenTimeout bounds how long a streamed completion may take to
+// start, separately from the completion timeout, which bounds the whole of it.
+// A model that hasn't sent any content after d is given up on with 504
+// Gateway Timeout.  There is no such bound by default.
+func WithFirstTokenTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		s.firstTokenTimeout = d
+	}
+}
+
+// firstTokenTimer cancels a completion unless its first token arrives in time
+type firstTokenTimer struct {
+	timer *time.Timer
+	once  sync.Once
+}
+
+// startFirstTokenTimer returns a context that is cancelled with
+// errFirstTokenTimeout after d, unless the timer is stopped first
+func startFirstTokenTimer(ctx context.Context, d time.Duration) (context.Context, *firstTokenTimer, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	t := &firstTokenTimer{
+		timer: time.AfterFunc(d, func() { cancel(errFirstTokenTimeout) }),
+	}
+	return ctx, t, func() { cancel(context.Canceled) }
+}
+
+// stop stops the timer, once the completion has started
+func (t *firstTokenTimer) stop() {
+	t.once.Do(func() { t.timer.Stop() })
+}
+
+// reader returns a reader of the event stream body that stops the timer once
+// an event with content has been read from it.  Comments, keep-alives and
+// chunks without content, such as the one announcing the role, don't count.
+func (t *firstTokenTimer) reader(body io.Reader) io.Reader {
+	return &firstTokenReader{Reader: body, onToken: t.stop}
+}
+
+type firstTokenReader struct {
+	io.Reader
+	onToken func()
+
+	// line is the part of the current line read so far
+	line    []byte
+	started bool
+}
+
+func (r *firstTokenReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if !r.started {
+		r.scan(p[:n])
+	}
+	return n, err
+}
+
+// scan looks for the first token in the lines of b
+func (r *firstTokenReader) scan(b []byte) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			if len(r.line)+len(b) <= maxWatchedLineSize {
+				r.line = append(r.line, b...)
+			}
+			return
+		}
+
+		line := append(r.line, b[:i]...)
+		b = b[i+1:]
+		r.line = r.line[:0]
+		if hasToken(line) {
+			r.started = true
+			r.line = nil
+			r.onToken()
+			return
+		}
+	}
+}
+
+// hasToken reports whether line is the data of a completion chunk with any
+// content or tool calls in it
+func hasToken(line []byte) bool {
+	data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("data:"))
+	if !ok {
+		return false
+	}
+
+	var chunk copilot.ChatCompletionsResponse
+	if err := json.Unmarshal(bytes.TrimSpace(data), &chunk); err != nil {
+		return false
+	}
+	for _, choice := range chunk.Choices {
+		if msg := choice.Payload(); msg != nil && (msg.Content != "" || len(msg.ToolCalls) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstTokenError reports err as a timeout if ctx was cancelled because the
+// model didn't start answering in time
+func firstTokenError(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(context.Cause(ctx), errFirstTokenTimeout) {
+		return err
+	}
+	return &statusError{status: http.StatusGatewayTimeout, err: fmt.Errorf("%w: %w", errFirstTokenTimeout, err)}
+}
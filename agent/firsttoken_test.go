@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// delayedWrite is written to a stream after waiting for delay
+type delayedWrite struct {
+	delay time.Duration
+	data  string
+}
+
+func TestFirstTokenTimer(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	const contentChunk = `data: {"choices":[{"index":0,"delta":{"content":"Hello"}}]}` + "\n\n"
+
+	tests := []struct {
+		name        string
+		writes      []delayedWrite
+		wantTimeout bool
+	}{
+		{
+			name:   "first token in time",
+			writes: []delayedWrite{{delay: 10 * time.Millisecond, data: contentChunk}},
+		},
+		{
+			name:        "first token too late",
+			writes:      []delayedWrite{{delay: 2 * timeout, data: contentChunk}},
+			wantTimeout: true,
+		},
+		{
+			name: "keep-alives before a late token",
+			writes: []delayedWrite{
+				{data: ": keep-alive\n\n"},
+				{delay: timeout / 2, data: "data:\n\n"},
+				{delay: timeout, data: contentChunk},
+			},
+			wantTimeout: true,
+		},
+		{
+			name: "role chunk before a late token",
+			writes: []delayedWrite{
+				{data: `data: {"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}` + "\n\n"},
+				{delay: 2 * timeout, data: contentChunk},
+			},
+			wantTimeout: true,
+		},
+		{
+			name: "token split across reads",
+			writes: []delayedWrite{
+				{data: contentChunk[:20]},
+				{delay: 10 * time.Millisecond, data: contentChunk[20:]},
+				{delay: 2 * timeout, data: "data: [DONE]\n\n"},
+			},
+		},
+		{
+			name: "tool call in time",
+			writes: []delayedWrite{
+				{data: `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"name":"search"}}]}}]}` + "\n\n"},
+				{delay: 2 * timeout, data: "data: [DONE]\n\n"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, timer, cancel := startFirstTokenTimer(context.Background(), timeout)
+			defer cancel()
+			defer timer.stop()
+
+			pr, pw := io.Pipe()
+			writes := tt.writes
+			go func() {
+				for _, write := range writes {
+					time.Sleep(write.delay)
+					if _, err := pw.Write([]byte(write.data)); err != nil {
+						return
+					}
+				}
+				pw.Close()
+			}()
+			// The upstream stream is abandoned once the context is cancelled
+			go func() {
+				<-ctx.Done()
+				pw.CloseWithError(ctx.Err())
+			}()
+
+			_, err := io.ReadAll(timer.reader(pr))
+			timedOut := errors.Is(context.Cause(ctx), errFirstTokenTimeout)
+			if timedOut != tt.wantTimeout {
+				t.Errorf("timed out = %v, want %v", timedOut, tt.wantTimeout)
+			}
+			if !tt.wantTimeout && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantTimeout && err == nil {
+				t.Error("the stream was not abandoned")
+			}
+		})
+	}
+}
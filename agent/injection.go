@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// DefaultInjectionPatterns match common attempts at overriding the system
+// prompt from a user message
+var DefaultInjectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget)\b.{0,20}\b(all\s+)?(previous|prior|above|earlier)\b.{0,20}\b(instructions|prompts?|rules|context)\b`),
+	regexp.MustCompile(`(?i)\byou\s+are\s+no\s+longer\b`),
+	regexp.MustCompile(`(?i)\b(reveal|print|show|repeat)\b.{0,20}\b(system|hidden|initial)\s+(prompt|instructions)\b`),
+	regexp.MustCompile(`(?i)\bnew\s+instructions\s*:`),
+	regexp.MustCompile(`(?i)^\s*(system|assistant)\s*:`),
+}
+
+// InjectionAction decides what happens to a user message that looks like a
+// prompt injection
+type InjectionAction int
+
+const (
+	// InjectionBlock rejects the request with 400 Bad Request
+	InjectionBlock InjectionAction = iota
+
+	// InjectionNeutralize removes the matching text from the message before
+	// it reaches the model
+	InjectionNeutralize
+)
+
+// injectionReplacement stands in for neutralized text
+const injectionReplacement = "[removed]"
+
+// WithInjectionFilter scans the latest user message for text matching any of
+// patterns, DefaultInjectionPatterns if none are given, and handles matches
+// according to action.  No filtering is done by default.
+func WithInjectionFilter(action InjectionAction, patterns ...*regexp.Regexp) Option {
+	return func(s *Service) {
+		if len(patterns) == 0 {
+			patterns = DefaultInjectionPatterns
+		}
+		s.injectionFilter = &injectionFilter{action: action, patterns: patterns}
+	}
+}
+
+type injectionFilter struct {
+	action   InjectionAction
+	patterns []*regexp.Regexp
+}
+
+// apply filters the latest user message of req, returning an error if the
+// request is to be blocked.  A nil filter does nothing.
+func (f *injectionFilter) apply(req *copilot.ChatRequest) error {
+	if f == nil {
+		return nil
+	}
+
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		msg := &req.Messages[i]
+		if msg.Role != "user" {
+			continue
+		}
+
+		for _, pattern := range f.patterns {
+			if !pattern.MatchString(msg.Content) {
+				continue
+			}
+
+			// The message itself may be sensitive, so only the pattern is logged
+			fmt.Printf("user message matches prompt injection pattern %q\n", pattern)
+			if f.action == InjectionBlock {
+				return fmt.Errorf("the message looks like a prompt injection")
+			}
+			msg.MapText(func(text string) string {
+				return pattern.ReplaceAllString(text, injectionReplacement)
+			})
+		}
+		return nil
+	}
+
+	return nil
+}
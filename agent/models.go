@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// modelsCacheTTL is how long the models available to a token are cached
+const modelsCacheTTL = 5 * time.Minute
+
+// Models responds with the models that the caller's token can use, so that
+// clients can offer a valid choice of model.
+func (s *Service) Models(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.readVerifiedBody(w, r); !ok {
+		return
+	}
+
+	apiToken := r.Header.Get("X-GitHub-Token")
+	if apiToken == "" {
+		http.Error(w, "missing X-GitHub-Token header", http.StatusUnauthorized)
+		return
+	}
+
+	models, err := s.models.list(s.apiContext(r.Context()), apiToken)
+	if err != nil {
+		fmt.Printf("failed to list models: %v\n", err)
+
+		var apiErr *copilot.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode >= http.StatusBadRequest {
+			w.WriteHeader(apiErr.StatusCode)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Models []copilot.Model `json:"models"`
+	}{
+		Models: models,
+	}); err != nil {
+		fmt.Printf("failed to write models: %v\n", err)
+	}
+}
+
+// modelsCache briefly holds the models available to each token.  Entries are
+// keyed by a hash of the token so that tokens aren't kept in memory.
+type modelsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedModels
+}
+
+type cachedModels struct {
+	models  []copilot.Model
+	expires time.Time
+}
+
+func newModelsCache(ttl time.Duration) *modelsCache {
+	return &modelsCache{
+		ttl:     ttl,
+		entries: map[[sha256.Size]byte]cachedModels{},
+	}
+}
+
+func (c *modelsCache) list(ctx context.Context, apiToken string) ([]copilot.Model, error) {
+	key := sha256.Sum256([]byte(apiToken))
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.models, nil
+	}
+
+	models, err := copilot.ListModels(ctx, apiToken)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedModels{
+		models:  models,
+		expires: now.Add(c.ttl),
+	}
+
+	return models, nil
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// modelsTransport answers requests for the models with status and body, and
+// counts them
+type modelsTransport struct {
+	status int
+	body   string
+	calls  atomic.Int32
+}
+
+func (m *modelsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.calls.Add(1)
+	return fakeResponse(m.status, "application/json", m.body), nil
+}
+
+func TestModels(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus int
+		want       []copilot.Model
+		wantCalls  int32
+	}{
+		{
+			name:       "models",
+			status:     http.StatusOK,
+			body:       `{"data":[{"id":"gpt-4o"},{"id":"gpt-4"}]}`,
+			wantStatus: http.StatusOK,
+			want:       []copilot.Model{copilot.ModelGPT4o, copilot.ModelGPT4},
+			wantCalls:  1,
+		},
+		{
+			name:       "upstream status relayed",
+			status:     http.StatusForbidden,
+			body:       `{"error":"forbidden"}`,
+			wantStatus: http.StatusForbidden,
+			wantCalls:  2,
+		},
+		{
+			name:       "malformed response",
+			status:     http.StatusOK,
+			body:       `not json`,
+			wantStatus: http.StatusInternalServerError,
+			wantCalls:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &modelsTransport{status: tt.status, body: tt.body}
+			prev := http.DefaultTransport
+			http.DefaultTransport = upstream
+			t.Cleanup(func() { http.DefaultTransport = prev })
+			s := newTestService(t, nil, nil)
+
+			// Only successful lists are cached
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				s.Models(w, signedRequest(t, "/models", ""))
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+				}
+				if tt.want == nil {
+					continue
+				}
+
+				var resp struct {
+					Models []copilot.Model `json:"models"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(resp.Models, tt.want) {
+					t.Errorf("models = %v, want %v", resp.Models, tt.want)
+				}
+			}
+
+			if n := upstream.calls.Load(); n != tt.wantCalls {
+				t.Errorf("listed the models %d times, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,696 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"net/http"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// Option configures optional behavior of the Service
+type Option func(*Service)
+
+// WithDocumentSource sets where the documents of the knowledge base are read
+// from.  By default they are the files in the local "data" directory.
+func WithDocumentSource(source embedding.DocumentSource) Option {
+	return func(s *Service) {
+		s.source = source
+	}
+}
+
+// WithFallbackDocument sets a document, such as an FAQ, that is used as
+// context when no document is relevant to the query.  It is named as the
+// document source names it, e.g. "data/faq.md", and is marked as a fallback in
+// citations.
+func WithFallbackDocument(filename string) Option {
+	return func(s *Service) {
+		s.fallbackDocument = filename
+	}
+}
+
+// WithDocumentPreprocessor sets a hook that is applied to every document
+// before it is embedded.
+func WithDocumentPreprocessor(p embedding.DocumentPreprocessor) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithDocumentPreprocessor(p))
+	}
+}
+
+// QueryPreprocessor transforms the user message used as the retrieval query
+// before it is embedded, e.g. to expand acronyms or strip PII.  The original
+// message is still sent to the model unchanged.
+type QueryPreprocessor func(query string) (string, error)
+
+// WithQueryPreprocessor sets a hook that is applied to the user message before
+// it is embedded for retrieval.
+func WithQueryPreprocessor(p QueryPreprocessor) Option {
+	return func(s *Service) {
+		s.queryPreprocessor = p
+	}
+}
+
+// WithQueryHistory sets how many of the latest user messages make up the query
+// used for retrieval, so that follow-up questions like "and for batch jobs?"
+// keep the context of the conversation.  By default only the latest message
+// is used.  The messages are weighted by recency, see WithTurnDecay.
+func WithQueryHistory(turns int) Option {
+	return func(s *Service) {
+		s.queryHistory = turns
+	}
+}
+
+// WithTurnDecay sets how much less each user message in the query history
+// weighs in retrieval than the one after it.  Each message is embedded on its
+// own and the embeddings are combined, the latest weighing 1, the one before
+// decay, then decay squared and so on.  It defaults to 0.5.  With a decay of
+// zero the messages are joined and embedded as a single query instead.
+func WithTurnDecay(decay float32) Option {
+	return func(s *Service) {
+		s.turnDecay = decay
+	}
+}
+
+// WithSystemPrompt replaces the default system prompt that precedes the
+// document context sent to the model.
+func WithSystemPrompt(prompt string) Option {
+	return func(s *Service) {
+		s.settings.SystemPrompt = prompt
+	}
+}
+
+// WithMaxSystemPromptLength sets the maximum size, in bytes, of the system
+// prompt.  NewService fails if the configured prompt is larger.
+func WithMaxSystemPromptLength(n int) Option {
+	return func(s *Service) {
+		s.maxSystemPromptLength = n
+	}
+}
+
+// WithStreamFlushing sets whether the response is flushed after every streamed
+// event.  Flushing is enabled by default so that clients see tokens as soon as
+// they arrive.
+func WithStreamFlushing(enabled bool) Option {
+	return func(s *Service) {
+		s.flushStream = enabled
+	}
+}
+
+// WithMaxCompletionTokens caps the number of tokens the model may generate for
+// a single completion.  By default the model's own limit applies.
+func WithMaxCompletionTokens(n int) Option {
+	return func(s *Service) {
+		s.maxCompletionTokens = n
+	}
+}
+
+// WithContextWindow sets the size, in tokens, of the context window of model.
+// Requests that can't fit in it even without document context are rejected
+// with 422 Unprocessable Entity rather than sent to the model.  The windows of
+// the models in the copilot package are known already.
+func WithContextWindow(model copilot.Model, tokens int) Option {
+	return func(s *Service) {
+		s.contextWindows[model] = tokens
+	}
+}
+
+// WithDataDirs sets the directories the documents are read from, "data" by
+// default.  Several directories are merged, with files in later directories
+// overriding files of the same name in earlier ones, see
+// embedding.MergedDirSource.
+func WithDataDirs(dirs ...string) Option {
+	return func(s *Service) {
+		if len(dirs) == 1 {
+			s.source = embedding.DirSource(dirs[0])
+			return
+		}
+		s.source = embedding.MergedDirSource(dirs)
+	}
+}
+
+// WithFailOnEmptyDataDir makes NewService and Validate fail if none of the
+// documents has any content, for deployments where an empty knowledge base is
+// a mistake.  By default the service starts anyway and answers without
+// context.
+func WithFailOnEmptyDataDir() Option {
+	return func(s *Service) {
+		s.failOnEmptyDataDir = true
+	}
+}
+
+// ContentFilterMode decides how a completion stopped by the content filter is
+// reported to the client
+type ContentFilterMode int
+
+const (
+	// ContentFilterSignal flags filtered completions: streams end with a
+	// "content_filtered" event and JSON responses get a content_filtered
+	// field, even if there is no content at all.  This is the default.
+	ContentFilterSignal ContentFilterMode = iota
+
+	// ContentFilterPassThrough relays filtered completions like any other,
+	// leaving clients to look at the finish reason
+	ContentFilterPassThrough
+)
+
+// WithContentFilterMode sets how completions stopped by the content filter are
+// reported
+func WithContentFilterMode(mode ContentFilterMode) Option {
+	return func(s *Service) {
+		s.contentFilterMode = mode
+	}
+}
+
+// WithPublicKey adds a key that VerifySignature can verify signatures with,
+// selected by keyID, such as the key_identifier GitHub publishes its keys
+// under.  Requests are still verified with the key the Service was created
+// with.
+func WithPublicKey(keyID string, key *ecdsa.PublicKey) Option {
+	return func(s *Service) {
+		s.publicKeys[keyID] = key
+	}
+}
+
+// WithDefaultIntegrationID sets the integration id that requests without a
+// Copilot-Integration-Id header are treated as coming from, for the selection
+// of models and documents as well as for calls to the Copilot API.
+func WithDefaultIntegrationID(integrationID string) Option {
+	return func(s *Service) {
+		s.defaultIntegrationID = integrationID
+	}
+}
+
+// WithIntegrationModel sets the model that answers requests from the
+// integration with the given Copilot-Integration-Id, instead of the model in
+// the settings.  Reloading the settings doesn't change it.
+func WithIntegrationModel(integrationID string, model copilot.Model) Option {
+	return func(s *Service) {
+		s.integrationModels[integrationID] = model
+	}
+}
+
+// WithIntegrationDocuments restricts the documents retrieved for requests from
+// the integration with the given Copilot-Integration-Id to those whose
+// filenames match one of patterns, isolating its datasets from those of other
+// integrations.  Patterns use the syntax of filepath.Match.  Prompts and
+// models are unaffected, see WithIntegrationModel to vary those.
+func WithIntegrationDocuments(integrationID string, patterns ...string) Option {
+	return func(s *Service) {
+		s.integrationDocuments[integrationID] = patterns
+	}
+}
+
+// WithMaxTokensPerRequest sets a ceiling on the tokens a single request may
+// spend across the retrieval query, the prompt, the injected document context
+// and the completion.  Document context is trimmed to fit and requests that
+// can't fit even without it are rejected.  A completion cap must also be
+// configured with WithMaxCompletionTokens.
+func WithMaxTokensPerRequest(n int) Option {
+	return func(s *Service) {
+		s.maxTokensPerRequest = n
+	}
+}
+
+// WithExtraHeaders attaches headers to every request sent to the Copilot API,
+// e.g. for gateways that require additional headers.  Header values may be
+// sensitive and are never logged.
+func WithExtraHeaders(headers http.Header) Option {
+	return func(s *Service) {
+		s.extraHeaders = headers.Clone()
+	}
+}
+
+// WithTemperature sets the sampling temperature used for completions.  By
+// default the model's own default applies.
+func WithTemperature(t float64) Option {
+	return func(s *Service) {
+		s.settings.Temperature = &t
+	}
+}
+
+// WithMinSimilarity sets the similarity, between 0 and 1, a document must
+// reach to be used as context.  Clients can override it per request.
+func WithMinSimilarity(min float32) Option {
+	return func(s *Service) {
+		s.settings.MinSimilarity = min
+	}
+}
+
+// WithResponseFormat asks the model for output of the given type.  With
+// copilot.ResponseFormatJSONObject, non-streamed completions that don't parse
+// as JSON are rejected rather than returned to the client.
+func WithResponseFormat(t copilot.ResponseFormatType) Option {
+	return func(s *Service) {
+		s.responseFormat = t
+	}
+}
+
+// WithRetryBudget retries calls to the Copilot API that fail with a transient
+// error, such as 503 Service Unavailable.  The time lost to failures is
+// bounded by d for each request, no matter which of its calls fail.  By
+// default calls are not retried.
+func WithRetryBudget(d time.Duration) Option {
+	return func(s *Service) {
+		s.retryBudget = d
+	}
+}
+
+// WithResponseCache enables caching of completions for ttl.  Only requests
+// with a temperature of 0 are cached, since only those are deterministic.
+func WithResponseCache(ttl time.Duration) Option {
+	return func(s *Service) {
+		s.responseCache = newResponseCache(ttl)
+	}
+}
+
+// WithMaxMessageLength sets the maximum size, in bytes, of the content of any
+// single message in a request.  Requests with larger messages are rejected
+// before any embedding work is done.  Zero disables the check.
+func WithMaxMessageLength(n int) Option {
+	return func(s *Service) {
+		s.maxMessageLength = n
+	}
+}
+
+// WithWarmupTimeout bounds how long a request waits for the datasets to be
+// generated while they are cold.  Requests that time out are answered with 503
+// Service Unavailable.  By default requests wait for as long as it takes.
+func WithWarmupTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithWarmupTimeout(d))
+	}
+}
+
+// WithMetadataHeader sets whether each document is embedded with a header
+// naming its file and title.  The header is not part of the context sent to
+// the model.
+func WithMetadataHeader(enabled bool) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithMetadataHeader(enabled))
+	}
+}
+
+// ToolEventPolicy decides what happens to the tool-call deltas in a completion
+// stream, which end users usually shouldn't see raw
+type ToolEventPolicy int
+
+const (
+	// ToolEventsStrip removes tool-call deltas so only user-visible content is
+	// forwarded.  This is the default.
+	ToolEventsStrip ToolEventPolicy = iota
+
+	// ToolEventsForward forwards tool-call deltas unchanged
+	ToolEventsForward
+
+	// ToolEventsSummarize removes tool-call deltas like ToolEventsStrip, but
+	// emits a "tool_call" event naming each function the model calls
+	ToolEventsSummarize
+)
+
+// WithToolEventPolicy sets how tool-call deltas in the completion stream are
+// handled.
+func WithToolEventPolicy(p ToolEventPolicy) Option {
+	return func(s *Service) {
+		s.toolEventPolicy = p
+	}
+}
+
+// WithTieBreak sets how the best dataset is chosen among those whose scores
+// are within epsilon of the best score.
+func WithTieBreak(policy embedding.TieBreak, epsilon float32) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithTieBreak(policy, epsilon))
+	}
+}
+
+// OutputFormat is the format in which completions are streamed to clients
+type OutputFormat int
+
+const (
+	// OutputSSE passes the server-sent events of the completion stream through
+	// to the client.  This is the default.
+	OutputSSE OutputFormat = iota
+
+	// OutputText streams only the text of the completion, for clients that
+	// can't parse server-sent events
+	OutputText
+)
+
+// WithOutputFormat sets the format in which completions are streamed.
+func WithOutputFormat(f OutputFormat) Option {
+	return func(s *Service) {
+		s.outputFormat = f
+	}
+}
+
+// WithTextDelimiter sets what follows the text of every chunk streamed in the
+// OutputText format, e.g. "\n" for clients that read newline delimited
+// chunks.  By default the text of the chunks is written back to back.
+func WithTextDelimiter(delim string) Option {
+	return func(s *Service) {
+		s.textDelimiter = delim
+	}
+}
+
+// EventTransform reshapes a server-sent event before it is written to the
+// client, e.g. to wrap its data in the envelope a frontend expects.  Returning
+// nil drops the event.  The event that terminates the stream can be told apart
+// with IsDone.
+type EventTransform func(event *copilot.Event) (*copilot.Event, error)
+
+// WithEventTransform applies t to every event streamed to the client in the
+// SSE output format.  By default events are passed through as they are.
+func WithEventTransform(t EventTransform) Option {
+	return func(s *Service) {
+		s.eventTransform = t
+	}
+}
+
+// WithQuoteValidation checks the quotes in answers given in the
+// AssemblyVerbatim mode against the context.  Streams report them in the
+// trailing "metadata" event, and other responses in the
+// X-RAG-Unverified-Quotes header, which counts the quotes not found in the
+// context.
+func WithQuoteValidation(enabled bool) Option {
+	return func(s *Service) {
+		s.validateQuotes = enabled
+	}
+}
+
+// TrimStrategy decides which part of a document is kept when it doesn't fit in
+// the token budget
+type TrimStrategy int
+
+const (
+	// TrimTopChunks keeps the paragraphs most similar to the query, scored
+	// with the embeddings and metric used for retrieval.  This is the
+	// default.
+	TrimTopChunks TrimStrategy = iota
+
+	// TrimTail cuts the end of the document
+	TrimTail
+
+	// TrimHead cuts the beginning of the document
+	TrimHead
+
+	// TrimMiddle cuts the middle of the document, keeping its beginning and
+	// end
+	TrimMiddle
+)
+
+// WithTrimStrategy sets how documents are trimmed to fit the token budget.
+func WithTrimStrategy(t TrimStrategy) Option {
+	return func(s *Service) {
+		s.trimStrategy = t
+	}
+}
+
+// ContextAssembly decides how retrieved documents are laid out in the context
+// given to the model
+type ContextAssembly int
+
+const (
+	// AssemblyPlain injects documents as they are.  This is the default.
+	AssemblyPlain ContextAssembly = iota
+
+	// AssemblyCited starts each document with a marker such as [1] and asks
+	// the model to cite its sources by marker.  The legend mapping markers to
+	// filenames is sent to the client in a trailing "metadata" event.
+	AssemblyCited
+
+	// AssemblyVerbatim asks the model to answer only with quotes from the
+	// documents, for answers that must not paraphrase them.  See also
+	// WithQuoteValidation.
+	AssemblyVerbatim
+)
+
+// WithContextAssembly sets how retrieved documents are laid out in the context.
+func WithContextAssembly(a ContextAssembly) Option {
+	return func(s *Service) {
+		s.contextAssembly = a
+	}
+}
+
+// PromptLayout decides how the system prompt and the document context are
+// split into messages
+type PromptLayout int
+
+const (
+	// LayoutCombined sends the system prompt followed by the context in one
+	// system message.  This is the default.
+	LayoutCombined PromptLayout = iota
+
+	// LayoutPersonaFirst sends the system prompt and the context as separate
+	// system messages, the system prompt first
+	LayoutPersonaFirst
+
+	// LayoutContextFirst sends the system prompt and the context as separate
+	// system messages, the context first
+	LayoutContextFirst
+)
+
+// WithPromptLayout sets how the system prompt and the document context are
+// split into messages.  Some models follow the system prompt better when it
+// comes after the context.
+func WithPromptLayout(layout PromptLayout) Option {
+	return func(s *Service) {
+		s.promptLayout = layout
+	}
+}
+
+// WithRelaxedSimilarity retries retrieval that finds no relevant document
+// with the minimum similarity lowered by step at a time, down to floor, before
+// answering without context.  The embedding of the query is reused.
+func WithRelaxedSimilarity(step, floor float32) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithRelaxedSimilarity(step, floor))
+	}
+}
+
+// WithEmbedder sets the embedding provider used for documents and queries, in
+// place of the Copilot embeddings API.
+func WithEmbedder(e embedding.Embedder) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithEmbedder(e))
+	}
+}
+
+// WithEmbeddingTimeout bounds how long embedding a single query or document
+// may take.  It defaults to 30 seconds.
+func WithEmbeddingTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithEmbeddingTimeout(d))
+	}
+}
+
+// WithFieldEmbedding embeds the given fields of JSON documents separately and
+// combines their embeddings by weight, for more precise retrieval from
+// structured documents.  Other documents are embedded whole.
+func WithFieldEmbedding(weights map[string]float32) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithFieldEmbedding(weights))
+	}
+}
+
+// WithEmbeddingTruncation cuts documents and queries that are longer than
+// maxTokens down before they are embedded, keeping their beginning or end, so
+// that they don't fail retrieval.  A maxTokens of zero uses the limit of the
+// Copilot embedding models.  Inputs are embedded as they are by default.
+func WithEmbeddingTruncation(t embedding.Truncation, maxTokens int) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithInputTruncation(t, maxTokens))
+	}
+}
+
+// WithCompletionTimeout bounds how long a completion may take, from the call
+// to the model until the end of the stream.  It defaults to 2 minutes, and
+// zero removes the bound.
+func WithCompletionTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		s.completionTimeout = d
+	}
+}
+
+// WithRetrievalTimeout bounds how long embedding the query and choosing the
+// documents may take.  Past it, the model answers without document context
+// and a warning is logged.  It is separate from the completion timeout, and
+// there is no bound by default.
+func WithRetrievalTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		s.retrievalTimeout = d
+	}
+}
+
+// WithReadConcurrency sets how many documents are read and preprocessed at a
+// time when the datasets are generated.
+func WithReadConcurrency(n int) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithReadConcurrency(n))
+	}
+}
+
+// WithMinDistinctSources sets the number of distinct files the context is
+// taken from, as long as that many are relevant to the query.  They share the
+// token budget.  By default the context comes from the best match only.
+func WithMinDistinctSources(n int) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithMinDistinctSources(n))
+	}
+}
+
+// WithEmbeddingModel sets the model used by the Copilot embeddings API.
+// Changing it invalidates every cached embedding.
+func WithEmbeddingModel(model copilot.Model) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithEmbeddingModel(model))
+	}
+}
+
+// WithQueryCacheSize sets how many query embeddings are kept so that a
+// repeated user message reuses its embedding instead of being embedded again.
+// Zero disables the cache.
+func WithQueryCacheSize(n int) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithQueryCacheSize(n))
+	}
+}
+
+// WithRetrievalObserver sets a function that is called with the full ranking
+// of the documents behind every retrieval, not just the ones chosen, e.g. to
+// build dashboards.  It runs in the background and doesn't delay answers.
+func WithRetrievalObserver(observer func(embedding.RetrievalDecision)) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithRetrievalObserver(observer))
+	}
+}
+
+// WithEmbeddingCache sets a read-through cache for query and document
+// embeddings, e.g. one backed by Redis so that replicas share embeddings.  It
+// takes the place of the in-memory query cache.  When the cache fails,
+// embeddings are generated directly.
+func WithEmbeddingCache(c embedding.EmbeddingCache) Option {
+	return func(s *Service) {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithEmbeddingCache(c))
+	}
+}
+
+// WithBackgroundWarmup generates the datasets in the background as soon as the
+// service starts, after a random delay of up to jitter.  Since there is no
+// request to take credentials from, integrationID and apiToken are used to
+// call the embeddings API.  mode decides what happens to requests that arrive
+// before the datasets are ready.
+func WithBackgroundWarmup(integrationID, apiToken string, jitter time.Duration, mode WarmupMode) Option {
+	return func(s *Service) {
+		s.warmup = &backgroundWarmup{
+			integrationID: integrationID,
+			apiToken:      apiToken,
+			jitter:        jitter,
+		}
+		if mode == WarmupReject {
+			s.datasetOpts = append(s.datasetOpts, embedding.WithWarmupTimeout(-1))
+		}
+	}
+}
+
+// WithPeriodicRefresh refreshes the datasets every interval in the background,
+// like RefreshDatasets, using integrationID and apiToken to call the
+// embeddings API.  Refreshing stops when the service is closed.
+func WithPeriodicRefresh(integrationID, apiToken string, interval time.Duration) Option {
+	return func(s *Service) {
+		s.refresher = &periodicRefresh{
+			integrationID: integrationID,
+			apiToken:      apiToken,
+			interval:      interval,
+			stop:          make(chan struct{}),
+			done:          make(chan struct{}),
+		}
+	}
+}
+
+// RetrievalFailureMode decides what happens to a request when its query can't
+// be embedded, e.g. because the embeddings API is down
+type RetrievalFailureMode int
+
+const (
+	// RetrievalStrict fails the request.  This is the default.
+	RetrievalStrict RetrievalFailureMode = iota
+
+	// RetrievalDegraded answers the request without document context, as if
+	// retrieval had been turned off for it
+	RetrievalDegraded
+)
+
+// WithRetrievalFailureMode sets what happens to a request when its query can't
+// be embedded.  Failing to generate the datasets always fails the request.
+func WithRetrievalFailureMode(mode RetrievalFailureMode) Option {
+	return func(s *Service) {
+		s.retrievalFailureMode = mode
+	}
+}
+
+// WithMaxChunksPerDocument limits the context taken from a single document to
+// its n paragraphs most relevant to the query, scored like they are for
+// TrimTopChunks, leaving the tokens it doesn't use to the other documents.
+// Zero, the default, means no limit.
+func WithMaxChunksPerDocument(n int) Option {
+	return func(s *Service) {
+		s.maxChunksPerDocument = n
+	}
+}
+
+// WithMaxCitations caps the citations reported alongside an answer at n,
+// keeping the sources with the best scores.  Every source is still part of the
+// context.  Zero, the default, reports all of them.
+func WithMaxCitations(n int) Option {
+	return func(s *Service) {
+		s.maxCitations = n
+	}
+}
+
+// WithRecencyBias favors the later paragraphs of a document when they are
+// ranked against each other, for living documents such as changelogs whose
+// latest additions matter most.  The last paragraph gets a boost of bias, the
+// first none, and those in between in proportion to their position.  The
+// boost adds to the similarity of the paragraph to the query, so with cosine
+// similarity a bias of a few hundredths only tips the balance between
+// paragraphs that are about equally relevant.  There is no bias by default.
+//
+// Paragraphs are only ranked when a document is trimmed with
+// TrimTopChunks to fit the token budget, or cut down to the paragraphs
+// allowed by WithMaxChunksPerDocument.  The bias doesn't affect documents that
+// fit, the other trim strategies, or retrieval, which ranks whole documents.
+func WithRecencyBias(bias float64) Option {
+	return func(s *Service) {
+		s.recencyBias = bias
+	}
+}
+
+// WithMaxContextBytes caps the documents injected as context at n bytes in
+// total, on top of any token budget.  Documents past the cap are trimmed
+// according to the trim strategy or left out.  There is no cap by default.
+func WithMaxContextBytes(n int) Option {
+	return func(s *Service) {
+		s.maxContextBytes = n
+	}
+}
+
+// WithContextDeduplication leaves documents out of the context if they are
+// already found verbatim in an earlier message of the conversation, e.g. in
+// context that the client sent back as part of the history.  This saves tokens
+// on long conversations about the same documents.
+func WithContextDeduplication() Option {
+	return func(s *Service) {
+		s.dedupeContext = true
+	}
+}
+
+// WithStaleContextStripping marks the system messages the service adds to a
+// conversation, and drops marked messages from the history of later requests,
+// for clients that send them back.  Every request gets freshly retrieved
+// context anyway, so the old context would only take up tokens.
+func WithStaleContextStripping() Option {
+	return func(s *Service) {
+		s.stripStaleContext = true
+	}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"math"
+	"sync"
+	"time"
+)
+
+// WithRateLimit limits every client to rate requests per second, with bursts
+// of up to burst requests.  Clients are told apart by their X-GitHub-Token.
+// Requests over the limit are answered with 429 Too Many Requests.  By default
+// there is no limit.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(s *Service) {
+		if rate > 0 && burst > 0 {
+			s.rateLimiter = newRateLimiter(rate, burst)
+		}
+	}
+}
+
+// rateLimiterSweepSize is how many clients the rate limiter tracks before it
+// forgets the ones that are idle
+const rateLimiterSweepSize = 1024
+
+// rateLimiter is a token bucket per client.  Clients are keyed by a hash of
+// their token so that tokens aren't kept in memory.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[[sha256.Size]byte]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[[sha256.Size]byte]*bucket{},
+	}
+}
+
+// allow takes a token from the bucket of client.  If there is none, it returns
+// false and how long until there is.  A nil rateLimiter allows everything.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) >= rateLimiterSweepSize {
+		l.sweep(now)
+	}
+
+	key := sha256.Sum256([]byte(client))
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+
+	return true, 0
+}
+
+func (l *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// sweep forgets the clients whose buckets are full again, which are no
+// different from clients that were never seen
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
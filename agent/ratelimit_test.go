@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+
+	tests := []struct {
+		name           string
+		opts           []Option
+		tokens         []string
+		want           []int
+		wantRetryAfter string
+	}{
+		{
+			name:   "unlimited by default",
+			tokens: []string{"a", "a", "a", "a"},
+			want:   []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:   "zero rate is unlimited",
+			opts:   []Option{WithRateLimit(0, 2)},
+			tokens: []string{"a", "a", "a", "a"},
+			want:   []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:           "burst exceeded",
+			opts:           []Option{WithRateLimit(0.5, 2)},
+			tokens:         []string{"a", "a", "a"},
+			want:           []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+			wantRetryAfter: "2",
+		},
+		{
+			name:   "clients are limited separately",
+			opts:   []Option{WithRateLimit(0.5, 2)},
+			tokens: []string{"a", "a", "b", "b"},
+			want:   []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCopilot(t, &fakeCopilot{content: []string{"Monthly."}})
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"}, tt.opts...)
+
+			var got []int
+			var retryAfter string
+			for _, token := range tt.tokens {
+				r := signedRequest(t, "/agent", body)
+				r.Header.Set("X-GitHub-Token", token)
+				w := httptest.NewRecorder()
+				s.ChatCompletion(w, r)
+				got = append(got, w.Code)
+				if w.Code == http.StatusTooManyRequests {
+					retryAfter = w.Header().Get("Retry-After")
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("statuses = %v, want %v", got, tt.want)
+			}
+			if retryAfter != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", retryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(2, 1)
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatal("first request was limited")
+	}
+	if ok, wait := l.allow("a"); ok || wait <= 0 || wait > 500*time.Millisecond {
+		t.Fatalf("second request allowed = %v, wait %s", ok, wait)
+	}
+
+	// Half a second later, at two requests per second, the bucket has refilled
+	key := sha256.Sum256([]byte("a"))
+	l.buckets[key].last = l.buckets[key].last.Add(-500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("request limited after the bucket refilled")
+	}
+
+	// Full buckets are forgotten once there are enough clients to sweep
+	l.buckets[key].last = l.buckets[key].last.Add(-time.Second)
+	for i := 0; i < rateLimiterSweepSize; i++ {
+		l.allow("client" + strconv.Itoa(i))
+	}
+	if _, ok := l.buckets[key]; ok {
+		t.Error("idle client was not forgotten")
+	}
+
+	var unlimited *rateLimiter
+	if ok, _ := unlimited.allow("a"); !ok {
+		t.Error("nil rate limiter limited a request")
+	}
+}
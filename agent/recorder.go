@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// ErrRecordNotFound is returned by a RecordStore that has no record with the
+// requested ID
+var ErrRecordNotFound = errors.New("record not found")
+
+// DebugRecord is everything needed to diagnose and replay a single request:
+// the request as it was served, the prompt that was assembled for it and
+// the model's response.  Credentials are never part of it.
+type DebugRecord struct {
+	ID            string                `json:"id"`
+	Time          time.Time             `json:"time"`
+	IntegrationID string                `json:"integration_id,omitempty"`
+	Request       *copilot.ChatRequest  `json:"request"`
+	Prompt        []copilot.ChatMessage `json:"prompt"`
+	Response      string                `json:"response"`
+}
+
+// RecordStore keeps debug records so that they can be looked up by ID
+type RecordStore interface {
+	Save(record *DebugRecord) error
+	Load(id string) (*DebugRecord, error)
+}
+
+// MemoryRecordStore is a RecordStore that keeps the most recent records in
+// memory
+type MemoryRecordStore struct {
+	size int
+
+	mu      sync.Mutex
+	records map[string]*DebugRecord
+	order   []string
+}
+
+// NewMemoryRecordStore returns a MemoryRecordStore that keeps at most size
+// records, evicting the oldest first
+func NewMemoryRecordStore(size int) *MemoryRecordStore {
+	return &MemoryRecordStore{
+		size:    size,
+		records: map[string]*DebugRecord{},
+	}
+}
+
+func (m *MemoryRecordStore) Save(record *DebugRecord) error {
+	if m.size <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.order) >= m.size {
+		delete(m.records, m.order[0])
+		m.order = m.order[1:]
+	}
+	m.records[record.ID] = record
+	m.order = append(m.order, record.ID)
+	return nil
+}
+
+func (m *MemoryRecordStore) Load(id string) (*DebugRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.records[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRecordNotFound, id)
+	}
+	return record, nil
+}
+
+// WithRecorder saves a debug record of every completion in store.  The ID of
+// the record is sent to the client in the X-RAG-Record-Id header, and the
+// request can be run again with Replay.  Recording is off by default.
+func WithRecorder(store RecordStore) Option {
+	return func(s *Service) {
+		s.recorder = store
+	}
+}
+
+// newRecordID returns a random ID for a debug record
+func newRecordID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate record ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// saveRecord records a completion of req, which was answered with the raw
+// upstream response.  req must be a copy of the request as it was received,
+// see cloneRequest.  Like auditing, failing to record doesn't fail the
+// request.
+func (s *Service) saveRecord(id, integrationID string, req *copilot.ChatRequest, chatReq *copilot.ChatCompletionsRequest, raw []byte, streaming bool) {
+	response, err := completionContent(raw, streaming)
+	if err != nil {
+		fmt.Printf("failed to read completion for record: %v\n", err)
+	}
+
+	if err := s.recorder.Save(&DebugRecord{
+		ID:            id,
+		Time:          time.Now().UTC(),
+		IntegrationID: integrationID,
+		Request:       req,
+		Prompt:        chatReq.Messages,
+		Response:      response,
+	}); err != nil {
+		fmt.Printf("failed to save record %s: %v\n", id, err)
+	}
+}
+
+// Replay runs a recorded request through retrieval and generation again,
+// writing the response to w as if the client had sent it once more.  The
+// Copilot API is called with apiToken, since records don't keep credentials.
+func (s *Service) Replay(ctx context.Context, recordID, apiToken string, w http.ResponseWriter) error {
+	if s.recorder == nil {
+		return fmt.Errorf("recording is not enabled")
+	}
+
+	record, err := s.recorder.Load(recordID)
+	if err != nil {
+		return fmt.Errorf("failed to load record: %w", err)
+	}
+
+	// Serving the request mustn't change the record
+	req, err := cloneRequest(record.Request)
+	if err != nil {
+		return err
+	}
+
+	return s.generateCompletion(ctx, record.IntegrationID, apiToken, req, w)
+}
+
+// cloneRequest returns a deep copy of req
+func cloneRequest(req *copilot.ChatRequest) (*copilot.ChatRequest, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var clone *copilot.ChatRequest
+	if err := json.Unmarshal(b, &clone); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+	return clone, nil
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+func TestMemoryRecordStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		saves []string
+		want  []string
+	}{
+		{name: "disabled", saves: []string{"a"}},
+		{name: "within size", size: 2, saves: []string{"a", "b"}, want: []string{"a", "b"}},
+		{name: "oldest evicted", size: 2, saves: []string{"a", "b", "c"}, want: []string{"b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemoryRecordStore(tt.size)
+			for _, id := range tt.saves {
+				if err := m.Save(&DebugRecord{ID: id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var kept []string
+			for _, id := range []string{"a", "b", "c"} {
+				record, err := m.Load(id)
+				switch {
+				case err == nil:
+					kept = append(kept, record.ID)
+				case !errors.Is(err, ErrRecordNotFound):
+					t.Errorf("load %s: %v", id, err)
+				}
+			}
+			if !slices.Equal(kept, tt.want) {
+				t.Errorf("kept %q, want %q", kept, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+	question := []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}}
+	// The context injected into an earlier turn, which the client sent back
+	withStale := []copilot.ChatMessage{
+		{Role: "system", Content: injectedContextMarker + "Deploy from the main branch."},
+		{Role: "user", Content: "How do I deploy?"},
+		{Role: "assistant", Content: "From the main branch."},
+		{Role: "user", Content: "When is an invoice sent?"},
+	}
+
+	tests := []struct {
+		name     string
+		stream   bool
+		messages []copilot.ChatMessage
+		opts     []Option
+	}{
+		{name: "stream", stream: true, messages: question},
+		{name: "no stream", messages: question},
+		// The record has the request as it was sent, not as it was served
+		{name: "stale context stripped", messages: withStale, opts: []Option{WithStaleContextStripping()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Month", "ly."}}
+			stubCopilot(t, fake)
+			store := NewMemoryRecordStore(10)
+			s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice"}, append([]Option{WithRecorder(store)}, tt.opts...)...)
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": tt.messages,
+				"stream":   tt.stream,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			id := w.Header().Get("X-RAG-Record-Id")
+			record, err := store.Load(id)
+			if err != nil {
+				t.Fatalf("record %q: %v", id, err)
+			}
+			if record.IntegrationID != "integration" || record.Response != "Monthly." {
+				t.Errorf("record = %+v", record)
+			}
+			if msgs := record.Request.Messages; !reflect.DeepEqual(msgs, tt.messages) {
+				t.Errorf("recorded request messages = %+v, want %+v", msgs, tt.messages)
+			}
+			if !reflect.DeepEqual(record.Prompt, fake.requests[0].Messages) {
+				t.Errorf("recorded prompt = %+v, want %+v", record.Prompt, fake.requests[0].Messages)
+			}
+			if b, _ := json.Marshal(record); strings.Contains(string(b), `"token"`) {
+				t.Errorf("the record contains the token: %s", b)
+			}
+
+			// Replaying sends the same prompt, and leaves the record as it was
+			before, _ := json.Marshal(record)
+			rw := httptest.NewRecorder()
+			if err := s.Replay(context.Background(), id, "other-token", rw); err != nil {
+				t.Fatal(err)
+			}
+			if n := fake.calls(); n != 2 {
+				t.Fatalf("the model was called %d times, want twice", n)
+			}
+			if !reflect.DeepEqual(fake.requests[1].Messages, fake.requests[0].Messages) {
+				t.Errorf("replayed prompt = %+v, want %+v", fake.requests[1].Messages, fake.requests[0].Messages)
+			}
+			if !strings.Contains(rw.Body.String(), "ly.") {
+				t.Errorf("replay response = %s", rw.Body)
+			}
+			if after, _ := json.Marshal(record); string(after) != string(before) {
+				t.Errorf("the record changed on replay:\n%s\n%s", before, after)
+			}
+		})
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	ctx := context.Background()
+
+	s := newTestService(t, nil, nil)
+	if err := s.Replay(ctx, "id", "token", httptest.NewRecorder()); err == nil {
+		t.Error("replayed without a recorder")
+	}
+
+	s = newTestService(t, nil, nil, WithRecorder(NewMemoryRecordStore(1)))
+	if err := s.Replay(ctx, "missing", "token", httptest.NewRecorder()); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("err = %v, want ErrRecordNotFound", err)
+	}
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// RefreshDatasets regenerates the datasets after the documents have changed.
+// Only the documents that changed are embedded again, and requests are served
+// from the previous datasets in the meantime.  Calls to the Copilot API use
+// the credentials attached to ctx with embedding.WithCredentials.
+func (s *Service) RefreshDatasets(ctx context.Context) error {
+	return s.retriever.Refresh(s.apiContext(ctx))
+}
+
+// ExportDatasetsMetadata describes the datasets that are currently loaded,
+// without their embeddings, e.g. for monitoring or migrating them.  It is
+// empty until the datasets have been generated.
+func (s *Service) ExportDatasetsMetadata() []embedding.DatasetInfo {
+	return s.retriever.Metadata()
+}
+
+// periodicRefresh holds the settings for refreshing the datasets on a
+// schedule, and what it takes to stop doing so
+type periodicRefresh struct {
+	integrationID string
+	apiToken      string
+	interval      time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// refreshPeriodically refreshes the datasets every interval until the service
+// is closed.  A refresh that is due while another one, e.g. one requested with
+// RefreshDatasets, is still running is skipped.
+func (s *Service) refreshPeriodically() {
+	p := s.refresher
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(embedding.WithCredentials(s.apiContext(context.Background()), p.integrationID, p.apiToken))
+	defer cancel()
+	go func() {
+		// Abandon a refresh in progress on shutdown
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		err := s.retriever.TryRefresh(ctx)
+		switch {
+		case errors.Is(err, embedding.ErrRefreshInProgress):
+			fmt.Println("skipping periodic refresh, datasets are already being refreshed")
+		case err != nil:
+			fmt.Printf("periodic refresh failed: %v\n", err)
+		default:
+			fmt.Printf("datasets refreshed in %v\n", time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
+
+// Close stops the background work of the service, waiting for it to finish.
+// The service can still serve requests afterwards.
+func (s *Service) Close() error {
+	if s.refresher != nil {
+		s.closeOnce.Do(func() {
+			close(s.refresher.stop)
+			<-s.refresher.done
+		})
+	}
+	return nil
+}
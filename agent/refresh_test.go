@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+func TestPeriodicRefresh(t *testing.T) {
+	dir := t.TempDir()
+	billing := filepath.Join(dir, "billing.md")
+	if err := os.WriteFile(billing, []byte("Invoices are sent monthly."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+	s := newTestService(t, nil, nil,
+		WithDocumentSource(embedding.DirSource(dir)),
+		WithEmbedder(embedder),
+		WithPeriodicRefresh("integration", "token", 10*time.Millisecond))
+
+	// The first refresh generates the datasets
+	hash := func() string {
+		for _, info := range s.ExportDatasetsMetadata() {
+			return info.Hash
+		}
+		return ""
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("the datasets", func() bool { return hash() != "" })
+	before := hash()
+
+	if err := os.WriteFile(billing, []byte("Invoices are sent weekly."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("a refresh picking up the change", func() bool { return hash() != before })
+
+	// Nothing is refreshed once the service is closed
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't stop the refresher")
+	}
+	if err := os.WriteFile(billing, []byte("Invoices are sent daily."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n := len(embedder.embedded())
+	time.Sleep(50 * time.Millisecond)
+	if got := len(embedder.embedded()); got != n {
+		t.Errorf("embedded %d more documents after Close", got-n)
+	}
+
+	// Closing twice is harmless
+	s.Close()
+}
+
+func TestPeriodicRefreshNeedsInterval(t *testing.T) {
+	if _, err := NewService(&testKey.PublicKey, WithPeriodicRefresh("integration", "token", 0)); err == nil {
+		t.Error("a refresh interval of zero was accepted")
+	}
+}
+
+func TestRequestsDuringRefresh(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+
+	tests := []struct {
+		name  string
+		warm  bool
+		added string
+		// wantStatus is the status of a request while the refresh embeds the
+		// gated document
+		wantStatus int
+	}{
+		{name: "rebuild", wantStatus: http.StatusServiceUnavailable},
+		{name: "refresh of loaded datasets", warm: true, added: "Salaries are paid weekly.", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "billing.md"), []byte("Invoices are sent monthly."), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			gate := "monthly"
+			if tt.warm {
+				gate = "weekly"
+			}
+			embedder := &gatedEmbedder{wordEmbedder: wordEmbedder{"invoice"}, gate: gate, release: make(chan struct{})}
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, nil, nil, WithDocumentSource(embedding.DirSource(dir)), WithEmbedder(embedder))
+			ctx := embedding.WithCredentials(context.Background(), "integration", "token")
+
+			if tt.warm {
+				if err := s.WarmDatasets(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "payroll.md"), []byte(tt.added), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			refreshed := make(chan error, 1)
+			go func() { refreshed <- s.RefreshDatasets(ctx) }()
+			for embedder.gated.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			// The request doesn't wait for the refresh
+			w := doChat(t, s, body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status during the refresh = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code == http.StatusServiceUnavailable {
+				if got := w.Header().Get("Retry-After"); got != "5" {
+					t.Errorf("Retry-After = %q, want 5", got)
+				}
+			} else if system := fake.requests[0].Messages[0].Content; !strings.Contains(system, "Invoices are sent monthly.") {
+				t.Errorf("the old datasets weren't used during the refresh:\n%s", system)
+			}
+
+			close(embedder.release)
+			if err := <-refreshed; err != nil {
+				t.Fatal(err)
+			}
+			if w := doChat(t, s, body); w.Code != http.StatusOK {
+				t.Errorf("status after the refresh = %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
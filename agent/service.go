@@ -1,22 +1,24 @@
 package agent
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"encoding/asn1"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
+	"maps"
+	"math"
 	"math/big"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/copilot-extensions/rag-extension/copilot"
 	"github.com/copilot-extensions/rag-extension/embedding"
@@ -24,202 +26,879 @@ import (
 
 // Service provides and endpoint for this agent to perform chat completions
 type Service struct {
-	pubKey *ecdsa.PublicKey
+	pubKey     *ecdsa.PublicKey
+	publicKeys map[string]*ecdsa.PublicKey
 
-	// Singleton
-	datasets     []*embedding.Dataset
-	datasetsInit *sync.Once
+	source           embedding.DocumentSource
+	fallbackDocument string
+	retriever        *embedding.Retriever
+	datasetOpts      []embedding.Option
+
+	queryPreprocessor QueryPreprocessor
+	queryHistory      int
+	turnDecay         float32
+
+	retrievalFailureMode RetrievalFailureMode
+
+	maxSystemPromptLength int
+
+	// settings can be replaced while requests are being served, so they are
+	// only read through currentSettings
+	settingsMu     sync.RWMutex
+	settings       Settings
+	baseSettings   Settings
+	settingsLoader SettingsLoader
+	adminToken     string
+
+	flushStream     bool
+	toolEventPolicy ToolEventPolicy
+	outputFormat    OutputFormat
+	textDelimiter   string
+	eventTransform  EventTransform
+	contextAssembly ContextAssembly
+	trimStrategy    TrimStrategy
+	validateQuotes  bool
+
+	maxCompletionTokens int
+	maxTokensPerRequest int
+	contextWindows      map[copilot.Model]int
+
+	responseFormat copilot.ResponseFormatType
+	retryBudget    time.Duration
+
+	extraHeaders      http.Header
+	completionTimeout time.Duration
+	retrievalTimeout  time.Duration
+	responseCache     *responseCache
+
+	maxMessageLength int
+
+	debug bool
+
+	rateLimiter     *rateLimiter
+	injectionFilter *injectionFilter
+
+	scoreScale      ScoreScale
+	maxCitations    int
+	inlineCitations bool
+
+	dedupeContext     bool
+	stripStaleContext bool
+
+	defaultIntegrationID string
+	integrationModels    map[string]copilot.Model
+	integrationDocuments map[string][]string
+
+	fieldAliases map[string]string
+
+	maxChunksPerDocument int
+	maxContextBytes      int
+	recencyBias          float64
+
+	codeExtraction *codeExtraction
+
+	promptLayout PromptLayout
+
+	firstTokenTimeout time.Duration
+
+	tokenizer Tokenizer
+
+	failOnEmptyDataDir bool
+
+	contentFilterMode ContentFilterMode
+
+	models *modelsCache
+	warmup *backgroundWarmup
+
+	refresher *periodicRefresh
+	closeOnce sync.Once
+
+	audit    *auditLog
+	recorder RecordStore
+	tracer   Tracer
+
+	exhaustedBehavior ExhaustedBehavior
 }
 
-func NewService(pubKey *ecdsa.PublicKey) *Service {
-	return &Service{
-		pubKey:       pubKey,
-		datasetsInit: &sync.Once{},
+// defaultTurnDecay is how much less each user message weighs in retrieval than
+// the one after it, unless configured otherwise
+const defaultTurnDecay = 0.5
+
+// errRetrievalTimeout is the cause of retrieval being cancelled because it
+// took longer than the retrieval timeout
+var errRetrievalTimeout = errors.New("retrieval took too long")
+
+// defaultCompletionTimeout bounds every completion unless configured
+// otherwise
+const defaultCompletionTimeout = 2 * time.Minute
+
+func NewService(pubKey *ecdsa.PublicKey, opts ...Option) (*Service, error) {
+	s := &Service{
+		pubKey: pubKey,
+		source: embedding.DirSource("data"),
+		settings: Settings{
+			SystemPrompt: defaultSystemPrompt,
+			Model:        copilot.ModelGPT4o,
+		},
+		maxSystemPromptLength: defaultMaxSystemPromptLength,
+		flushStream:           true,
+		maxMessageLength:      defaultMaxMessageLength,
+		models:                newModelsCache(modelsCacheTTL),
+		contextWindows:        maps.Clone(defaultContextWindows),
+		integrationModels:     map[string]copilot.Model{},
+		fieldAliases:          maps.Clone(DefaultFieldAliases),
+		integrationDocuments:  map[string][]string{},
+		publicKeys:            map[string]*ecdsa.PublicKey{},
+		completionTimeout:     defaultCompletionTimeout,
+		tokenizer:             ApproximateTokenizer{},
+		turnDecay:             defaultTurnDecay,
+		tracer:                noopTracer{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.validateSettings(&s.settings); err != nil {
+		return nil, err
+	}
+	for integrationID, model := range s.integrationModels {
+		if model == "" {
+			return nil, fmt.Errorf("a model is required for integration %q", integrationID)
+		}
 	}
+	for integrationID, patterns := range s.integrationDocuments {
+		if len(patterns) == 0 {
+			return nil, fmt.Errorf("document patterns are required for integration %q", integrationID)
+		}
+		for _, pattern := range patterns {
+			if err := embedding.ValidatePattern(pattern); err != nil {
+				return nil, fmt.Errorf("invalid documents for integration %q: %w", integrationID, err)
+			}
+		}
+	}
+	s.baseSettings = s.settings
+
+	// Without a completion cap the completion could spend any number of tokens
+	if s.maxTokensPerRequest > 0 && s.maxCompletionTokens <= 0 {
+		return nil, fmt.Errorf("a maximum number of completion tokens is required when limiting tokens per request")
+	}
+
+	switch s.responseFormat {
+	case "", copilot.ResponseFormatText, copilot.ResponseFormatJSONObject:
+	default:
+		return nil, fmt.Errorf("unsupported response format %q", s.responseFormat)
+	}
+
+	if s.refresher != nil && s.refresher.interval <= 0 {
+		return nil, fmt.Errorf("the refresh interval must be positive")
+	}
+
+	if s.fallbackDocument != "" {
+		doc, err := s.source.Open(s.fallbackDocument)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open fallback document: %w", err)
+		}
+		doc.Close()
+	}
+
+	if len(s.extraHeaders) > 0 {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithEmbedderWrapper(func(e embedding.Embedder) embedding.Embedder {
+			return headerEmbedder{embedder: e, headers: s.extraHeaders}
+		}))
+	}
+	if _, ok := s.tracer.(noopTracer); !ok {
+		s.datasetOpts = append(s.datasetOpts, embedding.WithEmbedderWrapper(func(e embedding.Embedder) embedding.Embedder {
+			return tracedEmbedder{embedder: e, tracer: s.tracer}
+		}))
+	}
+	s.retriever = embedding.NewRetriever(s.source, s.datasetOpts...)
+	if s.failOnEmptyDataDir {
+		if err := s.retriever.CheckDocuments(); err != nil {
+			return nil, fmt.Errorf("failed to check documents: %w", err)
+		}
+	}
+	if s.warmup != nil {
+		go s.warmInBackground()
+	}
+	if s.refresher != nil {
+		go s.refreshPeriodically()
+	}
+
+	return s, nil
 }
 
 func (s *Service) ChatCompletion(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readVerifiedBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Without a token every call to the Copilot API would fail, so there is
+	// no point in doing any work
+	apiToken := r.Header.Get("X-GitHub-Token")
+	if apiToken == "" {
+		http.Error(w, "missing X-GitHub-Token header", http.StatusUnauthorized)
+		return
+	}
+	integrationID := s.integrationID(r)
+
+	if ok, wait := s.rateLimiter.allow(apiToken); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	req, err := s.decodeRequest(body)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.validateRequest(req); err != nil {
+		fmt.Printf("invalid request: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.injectionFilter.apply(req); err != nil {
+		fmt.Printf("rejected request: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tracker := &responseTracker{ResponseWriter: w}
+	if err := s.generateCompletion(r.Context(), integrationID, apiToken, req, tracker); err != nil {
+		fmt.Printf("failed to execute agent: %v\n", err)
+
+		// The status has been sent already, so all that's left is to tell the
+		// client in the stream
+		if tracker.started {
+			streaming := req.Stream == nil || *req.Stream
+			if streaming {
+				if err := s.writeErrorEvent(w, err); err != nil {
+					fmt.Printf("failed to write error event: %v\n", err)
+				}
+			}
+			return
+		}
+
+		if s.writeExhausted(w, req, err) {
+			return
+		}
+
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			if statusErr.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(statusErr.retryAfter.Seconds()))))
+			}
+			http.Error(w, statusErr.Error(), statusErr.status)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// integrationID returns the Copilot-Integration-Id of r, or the default
+// integration id if it has none
+func (s *Service) integrationID(r *http.Request) string {
+	integrationID := r.Header.Get("Copilot-Integration-Id")
+	if integrationID == "" && s.defaultIntegrationID != "" {
+		fmt.Printf("request has no Copilot-Integration-Id, using the default %q\n", s.defaultIntegrationID)
+		return s.defaultIntegrationID
+	}
+	return integrationID
+}
+
+// readVerifiedBody reads the request body and makes sure it matches the
+// signature.  In this way, you can be sure that an incoming request comes from
+// github.  If it doesn't, an error response is written and false is returned.
+//
+// The signature covers the body exactly as GitHub sent it, including any
+// trailing whitespace, so the body must reach this point unmodified: nothing
+// may decode, trim or reformat it first, and the bytes returned are the bytes
+// that were verified.
+func (s *Service) readVerifiedBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
 	sig := r.Header.Get("X-Github-Public-Key-Signature")
 
 	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
 	if err != nil {
 		fmt.Println(fmt.Errorf("failed to read request body: %w", err))
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, false
+	}
+
+	// A body of a different length than was sent has been tampered with, e.g.
+	// by middleware, and would fail verification for no apparent reason
+	if r.ContentLength >= 0 && int64(len(body)) != r.ContentLength {
+		fmt.Printf("request body is %d bytes but Content-Length is %d, it was modified before verification\n", len(body), r.ContentLength)
+		http.Error(w, "request body does not match Content-Length", http.StatusBadRequest)
+		return nil, false
 	}
 
-	// Make sure the payload matches the signature. In this way, you can be sure
-	// that an incoming request comes from github
 	isValid, err := validPayload(body, sig, s.pubKey)
 	if err != nil {
 		fmt.Printf("failed to validate payload signature: %v\n", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 	if !isValid {
 		http.Error(w, "invalid payload signature", http.StatusUnauthorized)
-		return
+		return nil, false
 	}
 
-	apiToken := r.Header.Get("X-GitHub-Token")
-	integrationID := r.Header.Get("Copilot-Integration-Id")
+	return body, true
+}
 
-	var req *copilot.ChatRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		fmt.Printf("failed to unmarshal request: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if err := s.generateCompletion(r.Context(), integrationID, apiToken, req, w); err != nil {
-		fmt.Printf("failed to execute agent: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+func (s *Service) generateCompletion(ctx context.Context, integrationID, apiToken string, req *copilot.ChatRequest, w http.ResponseWriter) (err error) {
+	ctx = s.apiContext(ctx)
+
+	// Use the same settings throughout, even if they are reloaded meanwhile
+	settings := s.currentSettings()
+	if model, ok := s.integrationModels[integrationID]; ok {
+		settings.Model = model
 	}
-}
 
-func (s *Service) generateCompletion(ctx context.Context, integrationID, apiToken string, req *copilot.ChatRequest, w io.Writer) error {
-	// Initialize the datasets.  In a real application, these would be generated
-	// ahead of time and stored in a database
-	var err error
-	s.datasetsInit.Do(func() {
-		var files []fs.DirEntry
-		files, err = os.ReadDir("data")
+	ctx, span := s.tracer.Start(ctx, "rag.generate_completion")
+	defer func() {
 		if err != nil {
-			err = fmt.Errorf("error reading files from \"data\" directory: %w", err)
-			return
+			span.RecordError(err)
 		}
-
-		filenames := make([]string, len(files))
-		for i, file := range files {
-			filenames[i] = filepath.Join("data", file.Name())
+		span.End()
+	}()
+	span.SetAttributes(
+		Attribute{Key: "rag.integration_id", Value: integrationID},
+		Attribute{Key: "rag.model", Value: settings.Model},
+	)
+
+	// Records keep the request exactly as the client sent it, so replaying one
+	// goes through everything below again
+	var received *copilot.ChatRequest
+	if s.recorder != nil {
+		var err error
+		if received, err = cloneRequest(req); err != nil {
+			fmt.Printf("failed to keep request for record: %v\n", err)
 		}
+	}
+
+	// Context the client sent back is stale, fresh context is retrieved below
+	if s.stripStaleContext {
+		req.Messages = stripInjectedContext(req.Messages)
+	}
 
-		s.datasets, err = embedding.GenerateDatasets(integrationID, apiToken, filenames)
+	// Embedding and completion calls share one budget for retries
+	if s.retryBudget > 0 {
+		ctx = copilot.WithRetryBudget(ctx, copilot.NewRetryBudget(s.retryBudget))
+	}
+
+	// Clients can opt out of retrieval for general questions, in which case
+	// only the base system prompt is sent along with their messages
+	useRAG := req.RAG == nil || *req.RAG
+
+	var query string
+	if useRAG {
+		var err error
+		query, err = s.retrievalQuery(req)
 		if err != nil {
-			err = fmt.Errorf("error generating datasets: %w", err)
-			return
+			return err
 		}
-	})
-	if err != nil {
-		return err
 	}
 
-	var messages []copilot.ChatMessage
+	// Everything but the document context has to fit in the token budget,
+	// otherwise there is no point in retrieving anything
+	budget := &tokenBudget{limit: s.maxTokensPerRequest}
+	budget.spend(s.countTokens(query))
+	for _, msg := range req.Messages {
+		budget.spend(s.countTokens(msg.Content))
+	}
+	if !useRAG {
+		budget.spend(s.countTokens(settings.SystemPrompt))
+	}
+	budget.spend(s.maxCompletionTokens)
+	if budget.exceeded() {
+		return &statusError{
+			status: http.StatusRequestEntityTooLarge,
+			err:    fmt.Errorf("request needs at least %d tokens, exceeding the limit of %d tokens per request", budget.used, budget.limit),
+		}
+	}
 
-	// Create embeddings from user messages
-	for i := len(req.Messages) - 1; i >= 0; i-- {
-		msg := req.Messages[i]
-		if msg.Role != "user" {
-			continue
+	// Without room for the system prompt, the messages and the completion
+	// the model is bound to fail, whatever the context
+	if window, ok := s.contextWindows[settings.Model]; ok {
+		needed := s.countTokens(settings.SystemPrompt) + s.maxCompletionTokens
+		for _, msg := range req.Messages {
+			needed += s.countTokens(msg.Content)
+		}
+		if needed > window {
+			return &statusError{
+				status: http.StatusUnprocessableEntity,
+				err:    fmt.Errorf("the prompt needs at least %d tokens, exceeding the %d token context window of %s", needed, window, settings.Model),
+			}
 		}
+	}
 
-		// Filter empty messages
-		if msg.Content == "" {
-			continue
+	streaming := req.Stream == nil || *req.Stream
+	progress := streaming && req.Progress && !req.RetrieveOnly
+
+	var messages []copilot.ChatMessage
+	var sources []contextSource
+	var injected string
+	var explanation *retrievalExplanation
+	switch {
+	case !useRAG:
+		messages = append(messages, copilot.ChatMessage{
+			Role:    "system",
+			Content: settings.SystemPrompt,
+		})
+	case query != "":
+		if progress {
+			if err := s.writeEvent(w, "retrieval_started", struct{}{}); err != nil {
+				return err
+			}
+			s.flush(w)
 		}
 
-		emb, err := embedding.Create(ctx, integrationID, apiToken, msg.Content)
-		if err != nil {
-			return fmt.Errorf("error creating embedding for user message: %w", err)
+		minSimilarity := settings.MinSimilarity
+		if req.MinSimilarity != nil {
+			minSimilarity = *req.MinSimilarity
 		}
 
-		// Load most appropriate dataset
-		dataset, err := embedding.FindBestDataset(s.datasets, emb)
+		turns, err := s.queryTurns(req)
 		if err != nil {
-			return fmt.Errorf("error computing best dataset")
+			return err
 		}
 
-		if dataset == nil {
-			break
+		// Retrieval has a deadline of its own, past which the model answers
+		// without context rather than keep the user waiting
+		retrievalCtx := ctx
+		if s.retrievalTimeout > 0 {
+			var cancel context.CancelFunc
+			retrievalCtx, cancel = context.WithTimeoutCause(ctx, s.retrievalTimeout, errRetrievalTimeout)
+			defer cancel()
 		}
 
-		fmt.Printf("loading dataset: %s\n", dataset.Filename)
+		var usage embedding.Usage
+		var contextMsgs []copilot.ChatMessage
+		contextMsgs, sources, err = s.contextMessages(embedding.WithUsage(retrievalCtx, &usage), integrationID, apiToken, settings.SystemPrompt, query, req.Messages[:len(req.Messages)-1], budget,
+			embedding.WithMinSimilarity(minSimilarity),
+			embedding.WithDocumentFilter(req.IncludeDocuments, req.ExcludeDocuments),
+			embedding.WithTurnWeighting(turns, s.turnDecay),
+			embedding.WithDocumentScope(s.integrationDocuments[integrationID]))
+		switch {
+		case err != nil && (s.retrievalFailureMode == RetrievalDegraded || s.exhaustedBehavior == ExhaustedDegraded && copilot.Transient(err)) && errors.Is(err, embedding.ErrQueryEmbedding):
+			// The model can still give a general answer
+			fmt.Printf("warning: answering without document context: %v\n", err)
+			budget.spend(s.countTokens(settings.SystemPrompt))
+			messages = append(messages, copilot.ChatMessage{
+				Role:    "system",
+				Content: settings.SystemPrompt,
+			})
+		case err != nil && ctx.Err() == nil && errors.Is(context.Cause(retrievalCtx), errRetrievalTimeout):
+			fmt.Printf("warning: retrieval took longer than %s, answering without document context\n", s.retrievalTimeout)
+			sources = nil
+			budget.spend(s.countTokens(settings.SystemPrompt))
+			messages = append(messages, copilot.ChatMessage{
+				Role:    "system",
+				Content: settings.SystemPrompt,
+			})
+		case err != nil:
+			return err
+		case contextMsgs != nil:
+			messages = append(messages, contextMsgs...)
+			for _, msg := range contextMsgs {
+				injected += msg.Content
+			}
+		}
 
-		file, err := os.Open(dataset.Filename)
-		if err != nil {
-			return fmt.Errorf("failed to open documents: %w", err)
+		if req.Explain {
+			explanation = s.explainRetrieval(query, turns, minSimilarity, sources)
 		}
 
-		fileContents, err := io.ReadAll(file)
-		if err != nil {
-			return fmt.Errorf("failed to read documents: %w", err)
-		}
-
-		// Declare the text to be used as context for the chat completion
-		var lPrePrompt = `You are a senior Dynamics 365 Finance and Operations (D365 F&O) X++ developer assistant.
-		Your role is to assist developers with:
-		Writing, reviewing, and debugging X++ code.
-		Designing and implementing Data Entities, Classes, Forms, Extensions, Reports, and Workflows.
-		Helping with event handlers, Chain of Command (CoC), batch jobs, SysOperations framework, and custom services.
-		Offering best practices on performance optimization, security development (like XDS policies), unit testing, and development patterns.
-		Assisting with deployment, builds, and package management using LCS and Azure DevOps pipelines.
-
-		You must:
-		Write code that is clean, modular, and well-documented.
-		Explain solutions step-by-step where necessary, assuming the user has an beginner to intermediate understanding of D365 F&O.
-		Follow D365 F&O Microsoft official guidelines for extensions (never overlayer unless explicitly asked).
-		When possible, recommend event handlers and extensions over customization.
-		Help troubleshoot common errors in the build process and runtime, and suggest troubleshooting steps or possible causes.
-		Suggest example X++ code snippets, SQL queries, or API call patterns related to D365 F&O when needed.
-		Assume the environment is D365 F&O latest version (OneVersion) and uses Visual Studio 2022 as the development environment.
-
-		Never guess. If unsure, suggest a next action or direct the user to proper Microsoft Docs references.
-		Respond in a detailed, structured format, using headings, bullet points, and code blocks where applicable. 
-		
-		Use the following context when responding to a message.\n`
+		promptTokens, totalTokens := usage.Tokens()
+		fmt.Printf("embedding usage: %d prompt tokens, %d total tokens\n", promptTokens, totalTokens)
+		span.SetAttributes(
+			Attribute{Key: "rag.sources", Value: len(sources)},
+			Attribute{Key: "rag.embedding.prompt_tokens", Value: promptTokens},
+			Attribute{Key: "rag.embedding.total_tokens", Value: totalTokens},
+		)
+
+		if progress {
+			if err := s.writeEvent(w, "retrieval_completed", struct {
+				Sources         int `json:"sources"`
+				EmbeddingTokens int `json:"embedding_tokens"`
+			}{
+				Sources:         len(sources),
+				EmbeddingTokens: totalTokens,
+			}); err != nil {
+				return err
+			}
+			s.flush(w)
+		}
+	}
 
-		messages = append(messages, copilot.ChatMessage{
-			Role: "system",
-			Content: lPrePrompt +
-				"Context: " + string(fileContents),
-		})
+	// Summarize the context for clients that don't parse the body.  Progress
+	// events have sent the headers already, so they go without.
+	var contextBytes int
+	if len(sources) > 0 {
+		contextBytes = len(injected)
+	}
+	w.Header().Set("X-RAG-Context-Bytes", strconv.Itoa(contextBytes))
+	w.Header().Set("X-RAG-Sources-Count", strconv.Itoa(len(sources)))
 
-		break
+	if req.RetrieveOnly {
+		return s.writeRetrieval(query, sources, w)
 	}
 
+	// Mark what the service added, so that it can be told apart if the
+	// client sends it back
+	if s.stripStaleContext {
+		for i := range messages {
+			messages[i].Content = injectedContextMarker + messages[i].Content
+		}
+	}
 	messages = append(messages, req.Messages...)
 
+	var meta *completionMetadata
+	switch {
+	case s.contextAssembly == AssemblyCited && len(sources) > 0:
+		meta = &completionMetadata{Citations: s.citations(sources)}
+		if s.inlineCitations && streaming {
+			meta.inline = newInlineCitations(meta.Citations)
+		}
+	case s.contextAssembly == AssemblyVerbatim && s.validateQuotes && injected != "":
+		meta = &completionMetadata{quoteSource: injected}
+	}
+	if explanation != nil {
+		if meta == nil {
+			meta = &completionMetadata{}
+		}
+		meta.Retrieval = explanation
+	}
+
 	chatReq := &copilot.ChatCompletionsRequest{
-		Model:    copilot.ModelGPT4o,
-		Messages: messages,
-		Stream:   true,
+		Model:       settings.Model,
+		Messages:    messages,
+		Stream:      streaming,
+		MaxTokens:   s.maxCompletionTokens,
+		Stop:        req.Stop,
+		Temperature: settings.Temperature,
+	}
+	if s.responseFormat != "" {
+		chatReq.ResponseFormat = &copilot.ResponseFormat{Type: s.responseFormat}
+	}
+
+	// Everything from here on is part of the completion
+	ctx, completionSpan := s.tracer.Start(ctx, "rag.completion")
+	defer completionSpan.End()
+	completionSpan.SetAttributes(
+		Attribute{Key: "rag.model", Value: settings.Model},
+		Attribute{Key: "rag.streaming", Value: streaming},
+		Attribute{Key: "rag.messages", Value: len(messages)},
+		Attribute{Key: "rag.max_tokens", Value: s.maxCompletionTokens},
+	)
+	if s.completionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.completionTimeout)
+		defer cancel()
+	}
+
+	if len(req.CompareModels) > 0 {
+		return s.compareModels(ctx, apiToken, chatReq, req.CompareModels, w)
+	}
+
+	cacheKey := s.responseCache.key(chatReq)
+	if cacheKey != "" {
+		if cached, ok := s.responseCache.get(cacheKey); ok {
+			fmt.Println("serving completion from cache")
+			return s.relayCompletion(bytes.NewReader(cached), streaming, w, meta)
+		}
+	}
+
+	// Only a stream can start before the model has finished answering
+	var firstToken *firstTokenTimer
+	if streaming && s.firstTokenTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, firstToken, cancel = startFirstTokenTimer(ctx, s.firstTokenTimeout)
+		defer cancel()
+		defer firstToken.stop()
 	}
 
 	stream, err := copilot.ChatCompletions(ctx, "copilot-chat", apiToken, chatReq)
+	if err != nil && s.exhaustedBehavior == ExhaustedDegraded && copilot.Transient(err) && len(sources) > 0 {
+		// The model may yet manage without the document context
+		fmt.Printf("warning: completion failed, trying again without document context: %v\n", err)
+		chatReq.Messages = append([]copilot.ChatMessage{{
+			Role:    "system",
+			Content: settings.SystemPrompt,
+		}}, req.Messages...)
+		meta = nil
+		cacheKey = ""
+		stream, err = copilot.ChatCompletions(ctx, "copilot-chat", apiToken, chatReq)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get chat completions stream: %w", err)
+		err = firstTokenError(ctx, fmt.Errorf("failed to get chat completions stream: %w", err))
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &statusError{status: http.StatusGatewayTimeout, err: err}
+		}
+
+		// Relay upstream failures rather than reporting them as our own
+		var apiErr *copilot.APIError
+		if errors.As(err, &apiErr) {
+			status := apiErr.StatusCode
+			if status < http.StatusBadRequest {
+				status = http.StatusBadGateway
+			}
+			return &statusError{status: status, err: err}
+		}
+		return err
 	}
 	defer stream.Close()
 
-	reader := bufio.NewScanner(stream)
-	for reader.Scan() {
-		buf := reader.Bytes()
-		_, err := w.Write(buf)
-		if err != nil {
-			return fmt.Errorf("failed to write to stream: %w", err)
+	var body io.Reader = stream
+	if firstToken != nil {
+		body = firstToken.reader(body)
+	}
+
+	var recordID string
+	if s.recorder != nil {
+		if recordID, err = newRecordID(); err != nil {
+			return err
 		}
+		w.Header().Set("X-RAG-Record-Id", recordID)
+	}
 
-		if _, err := w.Write([]byte("\n")); err != nil {
-			return fmt.Errorf("failed to write delimiter to stream: %w", err)
+	if cacheKey == "" && s.audit == nil && s.recorder == nil {
+		return firstTokenError(ctx, s.relayCompletion(body, streaming, w, meta))
+	}
+
+	// Record the upstream response as it is relayed so it can be replayed,
+	// audited or debugged
+	var recorded bytes.Buffer
+	if err := s.relayCompletion(io.TeeReader(body, &recorded), streaming, w, meta); err != nil {
+		return firstTokenError(ctx, err)
+	}
+	if cacheKey != "" {
+		s.responseCache.put(cacheKey, recorded.Bytes())
+	}
+	if s.audit != nil {
+		s.audit.record(integrationID, chatReq, recorded.Bytes(), streaming)
+	}
+	if s.recorder != nil && received != nil {
+		s.saveRecord(recordID, integrationID, received, chatReq, recorded.Bytes(), streaming)
+	}
+
+	return nil
+}
+
+// relayCompletion writes the upstream completion in body to w, either as a
+// stream of server-sent events or as a single JSON response.  Streams end with
+// meta, if there is any.
+func (s *Service) relayCompletion(body io.Reader, streaming bool, w http.ResponseWriter, meta *completionMetadata) error {
+	if !streaming {
+		return s.writeCompletion(body, w, meta)
+	}
+
+	if s.outputFormat == OutputText {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	return s.forwardStream(body, w, meta)
+}
+
+// defaultMaxMessageLength is the maximum size, in bytes, of the content of a
+// single message unless configured otherwise
+const defaultMaxMessageLength = 256 * 1024
+
+// maxStopSequences is the most stop sequences the Copilot API accepts
+const maxStopSequences = 4
+
+// validateRequest checks the request before any embedding or completion work
+// is done for it
+func (s *Service) validateRequest(req *copilot.ChatRequest) error {
+	for i, msg := range req.Messages {
+		if s.maxMessageLength > 0 && len(msg.Content) > s.maxMessageLength {
+			return fmt.Errorf("message %d is %d bytes, exceeding the maximum of %d", i, len(msg.Content), s.maxMessageLength)
 		}
 	}
 
-	if err := reader.Err(); err != nil {
-		if errors.Is(err, io.EOF) {
-			return nil
+	if req.MinSimilarity != nil && !validSimilarity(*req.MinSimilarity) {
+		return fmt.Errorf("min_similarity %v is out of range [0, 1]", *req.MinSimilarity)
+	}
+
+	for _, patterns := range [][]string{req.IncludeDocuments, req.ExcludeDocuments} {
+		for _, pattern := range patterns {
+			if err := embedding.ValidatePattern(pattern); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(req.CompareModels) > 0 {
+		if !s.debug {
+			return fmt.Errorf("compare_models is only available in debug mode")
+		}
+		if req.Stream != nil && !*req.Stream || s.outputFormat != OutputSSE {
+			return fmt.Errorf("compare_models requires a stream of server-sent events")
+		}
+	}
+
+	if req.Explain {
+		if !s.debug {
+			return fmt.Errorf("explain is only available in debug mode")
 		}
+		if req.Stream != nil && !*req.Stream || s.outputFormat != OutputSSE {
+			return fmt.Errorf("explain requires a stream of server-sent events")
+		}
+	}
+
+	if req.RetrieveOnly && req.RAG != nil && !*req.RAG {
+		return fmt.Errorf("retrieve_only requires retrieval")
+	}
 
-		return fmt.Errorf("failed to read from stream: %w", err)
+	if len(req.Stop) > maxStopSequences {
+		return fmt.Errorf("at most %d stop sequences are allowed, got %d", maxStopSequences, len(req.Stop))
+	}
+	for _, seq := range req.Stop {
+		if seq == "" {
+			return fmt.Errorf("stop sequences must not be empty")
+		}
 	}
 
 	return nil
 }
 
+// retrievalQuery returns the text used to retrieve document context for the
+// request: the latest non-empty user message, preceded by as many earlier ones
+// as the query history allows.  An empty query means there is nothing to
+// retrieve.
+func (s *Service) retrievalQuery(req *copilot.ChatRequest) (string, error) {
+	messages := s.queryMessages(req)
+	if len(messages) == 0 {
+		return "", nil
+	}
+	return s.preprocessQuery(strings.Join(messages, "\n"))
+}
+
+// queryTurns returns the user messages that make up the retrieval query, oldest
+// first and each preprocessed on its own, if they are to be embedded and
+// weighted separately.  It returns nil otherwise.
+func (s *Service) queryTurns(req *copilot.ChatRequest) ([]string, error) {
+	if s.turnDecay <= 0 {
+		return nil, nil
+	}
+
+	messages := s.queryMessages(req)
+	if len(messages) < 2 {
+		return nil, nil
+	}
+
+	for i, msg := range messages {
+		var err error
+		if messages[i], err = s.preprocessQuery(msg); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// queryMessages returns the latest non-empty user messages, as many as the
+// query history allows, oldest first so the conversation reads in order
+func (s *Service) queryMessages(req *copilot.ChatRequest) []string {
+	turns := max(s.queryHistory, 1)
+
+	var messages []string
+	for i := len(req.Messages) - 1; i >= 0 && len(messages) < turns; i-- {
+		msg := req.Messages[i]
+		if msg.Role != "user" {
+			continue
+		}
+
+		// Filter empty messages
+		if msg.Content == "" {
+			continue
+		}
+
+		messages = append(messages, msg.Content)
+	}
+
+	slices.Reverse(messages)
+	return messages
+}
+
+func (s *Service) preprocessQuery(query string) (string, error) {
+	if s.queryPreprocessor == nil {
+		return query, nil
+	}
+
+	query, err := s.queryPreprocessor(query)
+	if err != nil {
+		return "", fmt.Errorf("error preprocessing user message: %w", err)
+	}
+	return query, nil
+}
+
+// apiContext returns a copy of ctx under which calls to the Copilot API carry
+// the extra headers, if any
+func (s *Service) apiContext(ctx context.Context) context.Context {
+	if len(s.extraHeaders) == 0 {
+		return ctx
+	}
+	return copilot.WithHeaders(ctx, s.extraHeaders)
+}
+
+// headerEmbedder attaches the extra headers to the calls of an Embedder, since
+// some are made outside of any request, such as when datasets are generated
+type headerEmbedder struct {
+	embedder embedding.Embedder
+	headers  http.Header
+}
+
+func (e headerEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	return e.embedder.Embed(copilot.WithHeaders(ctx, e.headers), inputs)
+}
+
+func (e headerEmbedder) EmbeddingModel() string {
+	if m, ok := e.embedder.(embedding.ModelEmbedder); ok {
+		return m.EmbeddingModel()
+	}
+	return ""
+}
+
 // asn1Signature is a struct for ASN.1 serializing/parsing signatures.
 type asn1Signature struct {
 	R *big.Int
 	S *big.Int
 }
 
+// ErrUnknownKey is returned by VerifySignature for a key identifier it has no
+// key for
+var ErrUnknownKey = errors.New("unknown public key identifier")
+
+// VerifySignature reports whether sig is GitHub's signature of body, the way
+// requests are verified, but without HTTP, e.g. for tests and signing tools.
+// keyID selects a key added with WithPublicKey, and the key the Service was
+// created with if it is empty.
+func (s *Service) VerifySignature(body []byte, sig string, keyID string) (bool, error) {
+	key := s.pubKey
+	if keyID != "" {
+		var ok bool
+		if key, ok = s.publicKeys[keyID]; !ok {
+			return false, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+		}
+	}
+	if key == nil {
+		return false, fmt.Errorf("no public key to verify with")
+	}
+
+	return validPayload(body, sig, key)
+}
+
+// validPayload reports whether sig is GitHub's signature of data.  data must be
+// the raw request body, byte for byte.
 func validPayload(data []byte, sig string, publicKey *ecdsa.PublicKey) (bool, error) {
 	asnSig, err := base64.StdEncoding.DecodeString(sig)
 	parsedSig := asn1Signature{}
@@ -0,0 +1,1470 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// testKey signs the requests sent to services made with newTestService
+var testKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+// wordEmbedder embeds text as the number of times each of its words occurs
+// in it, plus a constant so that no embedding is a zero vector
+type wordEmbedder []string
+
+func (e wordEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		emb := make([]float32, len(e)+1)
+		for j, word := range e {
+			emb[j] = float32(strings.Count(strings.ToLower(input), word))
+		}
+		emb[len(e)] = 0.1
+		embeddings[i] = emb
+	}
+	return embeddings, nil
+}
+
+// recordingEmbedder embeds like a wordEmbedder and records the inputs
+type recordingEmbedder struct {
+	wordEmbedder
+
+	mu     sync.Mutex
+	inputs []string
+}
+
+func (e *recordingEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	e.mu.Lock()
+	e.inputs = append(e.inputs, inputs...)
+	e.mu.Unlock()
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func (e *recordingEmbedder) embedded() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.inputs...)
+}
+
+// newTestService creates a Service over docs, by filename, that embeds with a
+// wordEmbedder of words
+func newTestService(t *testing.T, docs map[string]string, words []string, opts ...Option) *Service {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range docs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts = append([]Option{
+		WithDocumentSource(embedding.DirSource(dir)),
+		WithEmbedder(wordEmbedder(words)),
+	}, opts...)
+	s, err := NewService(&testKey.PublicKey, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// signedRequest returns a request to target with body, signed like GitHub
+// signs it, from the token "token"
+func signedRequest(t *testing.T, target, body string) *http.Request {
+	t.Helper()
+	digest := sha256.Sum256([]byte(body))
+	sig, err := ecdsa.SignASN1(rand.Reader, testKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set("X-Github-Public-Key-Signature", base64.StdEncoding.EncodeToString(sig))
+	r.Header.Set("X-GitHub-Token", "token")
+	r.Header.Set("Copilot-Integration-Id", "integration")
+	return r
+}
+
+// doChat sends body to the chat completion endpoint of s
+func doChat(t *testing.T, s *Service, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.ChatCompletion(w, signedRequest(t, "/agent", body))
+	return w
+}
+
+// fakeCopilot stands in for the chat completions API of Copilot.  It answers
+// every request with content, streamed in chunks if the request asks for a
+// stream, and keeps the requests.
+type fakeCopilot struct {
+	content []string
+
+	// respond, if set, answers in place of the default
+	respond func(req *copilot.ChatCompletionsRequest) *http.Response
+
+	mu       sync.Mutex
+	requests []*copilot.ChatCompletionsRequest
+}
+
+// stubCopilot sends every request to the Copilot API to f for the duration of
+// the test
+func stubCopilot(t *testing.T, f *fakeCopilot) {
+	t.Helper()
+	prev := http.DefaultTransport
+	http.DefaultTransport = f
+	t.Cleanup(func() { http.DefaultTransport = prev })
+}
+
+func (f *fakeCopilot) RoundTrip(r *http.Request) (*http.Response, error) {
+	var req copilot.ChatCompletionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, &req)
+	f.mu.Unlock()
+
+	if f.respond != nil {
+		return f.respond(&req), nil
+	}
+	if req.Stream {
+		return fakeResponse(http.StatusOK, "text/event-stream", eventStream(f.content...)), nil
+	}
+
+	b, _ := json.Marshal(copilot.ChatCompletionsResponse{
+		Choices: []copilot.ChatCompletionsChoice{{
+			Message:      &copilot.ChatMessage{Role: "assistant", Content: strings.Join(f.content, "")},
+			FinishReason: "stop",
+		}},
+	})
+	return fakeResponse(http.StatusOK, "application/json", string(b)), nil
+}
+
+func (f *fakeCopilot) calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func fakeResponse(status int, contentType, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// eventStream returns a completion stream of chunks carrying content
+func eventStream(content ...string) string {
+	var buf bytes.Buffer
+	for _, c := range content {
+		b, _ := json.Marshal(copilot.ChatCompletionsResponse{
+			Choices: []copilot.ChatCompletionsChoice{{Delta: &copilot.ChatMessage{Role: "assistant", Content: c}}},
+		})
+		fmt.Fprintf(&buf, "data: %s\n\n", b)
+	}
+	buf.WriteString("data: [DONE]\n\n")
+	return buf.String()
+}
+
+// readEvents reads the server-sent events streamed in body
+func readEvents(t *testing.T, body io.Reader) []*copilot.Event {
+	t.Helper()
+	var events []*copilot.Event
+	reader := copilot.NewEventReader(body)
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+}
+
+// eventNames lists the names of events, with "data" standing in for
+// unnamed events and "done" for the event that terminates the stream
+func eventNames(events []*copilot.Event) []string {
+	names := make([]string, len(events))
+	for i, event := range events {
+		switch {
+		case event.IsDone():
+			names[i] = "done"
+		case event.Name == "":
+			names[i] = "data"
+		default:
+			names[i] = event.Name
+		}
+	}
+	return names
+}
+
+func TestIntegrationID(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		defaultID string
+		want      string
+	}{
+		{name: "header", header: "copilot-chat", defaultID: "fallback", want: "copilot-chat"},
+		{name: "missing header", defaultID: "fallback", want: "fallback"},
+		{name: "missing header without default", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{defaultIntegrationID: tt.defaultID}
+			r := httptest.NewRequest("POST", "/agent", nil)
+			if tt.header != "" {
+				r.Header.Set("Copilot-Integration-Id", tt.header)
+			}
+
+			if got := s.integrationID(r); got != tt.want {
+				t.Errorf("integrationID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryPreprocessor(t *testing.T) {
+	docs := map[string]string{"billing.md": "Invoices are sent monthly."}
+	const message = "  When is an INVOICE sent?  "
+
+	tests := []struct {
+		name         string
+		preprocessor QueryPreprocessor
+		wantQuery    string
+		wantStatus   int
+	}{
+		{name: "none", wantQuery: message, wantStatus: http.StatusOK},
+		{name: "normalize", preprocessor: func(query string) (string, error) {
+			return strings.ToLower(strings.TrimSpace(query)), nil
+		}, wantQuery: "when is an invoice sent?", wantStatus: http.StatusOK},
+		{name: "failure", preprocessor: func(query string) (string, error) {
+			return "", errors.New("unsupported query")
+		}, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			var opts []Option
+			if tt.preprocessor != nil {
+				opts = append(opts, WithQueryPreprocessor(tt.preprocessor))
+			}
+			s := newTestService(t, docs, nil, append(opts, WithEmbedder(embedder))...)
+
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"`+message+`"}],"stream":false}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			// The transformed text is embedded ...
+			if embedded := embedder.embedded(); !slices.Contains(embedded, tt.wantQuery) {
+				t.Errorf("embedded %q, want the query %q", embedded, tt.wantQuery)
+			}
+			// ... while the model sees the message as it was sent
+			messages := fake.requests[0].Messages
+			if last := messages[len(messages)-1]; last.Role != "user" || last.Content != message {
+				t.Errorf("last message = %+v, want the original user message", last)
+			}
+		})
+	}
+}
+
+func TestStopSequences(t *testing.T) {
+	tests := []struct {
+		name       string
+		stop       []string
+		wantStatus int
+	}{
+		{name: "none", wantStatus: http.StatusOK},
+		{name: "forwarded", stop: []string{"\n\n", "END"}, wantStatus: http.StatusOK},
+		{name: "at the maximum", stop: []string{"a", "b", "c", "d"}, wantStatus: http.StatusOK},
+		{name: "too many", stop: []string{"a", "b", "c", "d", "e"}, wantStatus: http.StatusBadRequest},
+		{name: "empty sequence", stop: []string{"END", ""}, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"})
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}},
+				"stream":   false,
+				"stop":     tt.stop,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if n := fake.calls(); n != 0 {
+					t.Errorf("the model was called %d times for an invalid request", n)
+				}
+				return
+			}
+
+			if got := fake.requests[0].Stop; !slices.Equal(got, tt.stop) {
+				t.Errorf("stop = %q, want %q", got, tt.stop)
+			}
+		})
+	}
+}
+
+func TestMaxMessageLength(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		oversized  int
+		wantStatus int
+	}{
+		{name: "within the default", oversized: 1000, wantStatus: http.StatusOK},
+		{name: "over the default", oversized: defaultMaxMessageLength + 1, wantStatus: http.StatusBadRequest},
+		{name: "at a configured maximum", opts: []Option{WithMaxMessageLength(100)}, oversized: 100, wantStatus: http.StatusOK},
+		{name: "over a configured maximum", opts: []Option{WithMaxMessageLength(100)}, oversized: 101, wantStatus: http.StatusBadRequest},
+		{name: "check disabled", opts: []Option{WithMaxMessageLength(0)}, oversized: defaultMaxMessageLength + 1, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil, append(tt.opts, WithEmbedder(embedder))...)
+
+			// The oversized message is one of several normal ones
+			body, _ := json.Marshal(map[string]any{
+				"messages": []copilot.ChatMessage{
+					{Role: "user", Content: "Hello"},
+					{Role: "assistant", Content: strings.Repeat("x", tt.oversized)},
+					{Role: "user", Content: "When is an invoice sent?"},
+				},
+				"stream": false,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+
+			if !strings.Contains(w.Body.String(), "message 1 ") {
+				t.Errorf("error doesn't name the oversized message: %s", w.Body)
+			}
+			if n := fake.calls(); n != 0 {
+				t.Errorf("the model was called %d times for a rejected request", n)
+			}
+			if embedded := embedder.embedded(); slices.Contains(embedded, "When is an invoice sent?") {
+				t.Error("the query of a rejected request was embedded")
+			}
+		})
+	}
+}
+
+func TestDisableRAG(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+
+	tests := []struct {
+		name        string
+		rag         *bool
+		wantContext bool
+	}{
+		{name: "default", wantContext: true},
+		{name: "enabled", rag: func() *bool { b := true; return &b }(), wantContext: true},
+		{name: "disabled", rag: new(bool)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			s := newTestService(t, map[string]string{"billing.md": doc}, nil, WithEmbedder(embedder), WithSystemPrompt("Answer the question."))
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}},
+				"stream":   false,
+				"rag":      tt.rag,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			if embedded := embedder.embedded(); !tt.wantContext && len(embedded) > 0 {
+				t.Errorf("embedded %q with RAG disabled", embedded)
+			}
+
+			var hasContext bool
+			for _, msg := range fake.requests[0].Messages {
+				hasContext = hasContext || strings.Contains(msg.Content, doc)
+			}
+			if hasContext != tt.wantContext {
+				t.Errorf("document context sent = %v, want %v", hasContext, tt.wantContext)
+			}
+			if first := fake.requests[0].Messages[0]; first.Role != "system" || !strings.HasPrefix(first.Content, "Answer the question.") {
+				t.Errorf("first message = %+v, want the system prompt", first)
+			}
+		})
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	docs := map[string]string{"billing.md": "Invoices are sent monthly."}
+
+	tests := []struct {
+		name     string
+		progress bool
+		stream   bool
+		want     []string
+	}{
+		{name: "progress", progress: true, stream: true, want: []string{"retrieval_started", "retrieval_completed", "data", "data", "done"}},
+		{name: "no progress", stream: true, want: []string{"data", "data", "done"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCopilot(t, &fakeCopilot{content: []string{"Once a ", "month."}})
+			s := newTestService(t, docs, []string{"invoice"})
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}},
+				"progress": tt.progress,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			events := readEvents(t, w.Body)
+			if got := eventNames(events); !slices.Equal(got, tt.want) {
+				t.Fatalf("events = %q, want %q", got, tt.want)
+			}
+			if !tt.progress {
+				return
+			}
+
+			var completed struct {
+				Sources int `json:"sources"`
+			}
+			if err := json.Unmarshal(events[1].Data, &completed); err != nil {
+				t.Fatal(err)
+			}
+			if completed.Sources != 1 {
+				t.Errorf("retrieval_completed reports %d sources, want 1", completed.Sources)
+			}
+		})
+	}
+
+	t.Run("not streamed", func(t *testing.T) {
+		stubCopilot(t, &fakeCopilot{content: []string{"Once a month."}})
+		s := newTestService(t, docs, []string{"invoice"})
+
+		w := doChat(t, s, `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false,"progress":true}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		var resp copilot.ChatCompletionsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("response is not a completion: %v: %s", err, w.Body)
+		}
+	})
+}
+
+func TestDuplicateUserMessages(t *testing.T) {
+	const question = "When is an invoice sent?"
+
+	tests := []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{name: "embedded once", want: 1},
+		{name: "without the query cache", opts: []Option{WithQueryCacheSize(0)}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCopilot(t, &fakeCopilot{content: []string{"Monthly."}})
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil, append(tt.opts, WithEmbedder(embedder))...)
+
+			// The user sends the same message again after the answer
+			for _, messages := range [][]copilot.ChatMessage{
+				{{Role: "user", Content: question}},
+				{{Role: "user", Content: question}, {Role: "assistant", Content: "Monthly."}, {Role: "user", Content: question}},
+			} {
+				body, _ := json.Marshal(map[string]any{"messages": messages, "stream": false})
+				if w := doChat(t, s, string(body)); w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body)
+				}
+			}
+
+			var n int
+			for _, input := range embedder.embedded() {
+				if input == question {
+					n++
+				}
+			}
+			if n != tt.want {
+				t.Errorf("embedded the message %d times, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinSimilarityOverride(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+	// The query is about 0.7 similar to the document
+	const message = "When is an invoice sent, and by whom?"
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		override    string
+		wantStatus  int
+		wantContext bool
+	}{
+		{name: "default", wantStatus: http.StatusOK, wantContext: true},
+		{name: "stricter", override: "0.9", wantStatus: http.StatusOK},
+		{name: "looser", opts: []Option{WithMinSimilarity(0.9)}, override: "0.5", wantStatus: http.StatusOK, wantContext: true},
+		{name: "negative", override: "-0.1", wantStatus: http.StatusBadRequest},
+		{name: "over one", override: "1.5", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice", "whom"}, tt.opts...)
+
+			body := `{"messages":[{"role":"user","content":"` + message + `"}],"stream":false}`
+			if tt.override != "" {
+				body = `{"messages":[{"role":"user","content":"` + message + `"}],"stream":false,"min_similarity":` + tt.override + `}`
+			}
+			w := doChat(t, s, body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if got := strings.Contains(fake.requests[0].Messages[0].Content, doc); got != tt.wantContext {
+				t.Errorf("document context sent = %v, want %v", got, tt.wantContext)
+			}
+			// The override only applies to its own request
+			if tt.override == "" {
+				return
+			}
+			if w := doChat(t, s, `{"messages":[{"role":"user","content":"`+message+`"}],"stream":false}`); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			wantDefault := len(tt.opts) == 0
+			if got := strings.Contains(fake.requests[1].Messages[0].Content, doc); got != wantDefault {
+				t.Errorf("document context sent without the override = %v, want %v", got, wantDefault)
+			}
+		})
+	}
+}
+
+func TestQueryHistory(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+	conversation := []copilot.ChatMessage{
+		{Role: "user", Content: "When is an invoice sent? Is the invoice late?"},
+		{Role: "assistant", Content: "Monthly."},
+		// Without the question before it, this is about deploying
+		{Role: "user", Content: "What about the main one?"},
+	}
+
+	tests := []struct {
+		name    string
+		history int
+		want    string
+	}{
+		{name: "latest message only", history: 1, want: docs["deploy.md"]},
+		{name: "with history", history: 2, want: docs["billing.md"]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			// The messages are joined into one query rather than weighted, see
+			// WithTurnDecay
+			s := newTestService(t, docs, []string{"invoice", "main"}, WithQueryHistory(tt.history), WithTurnDecay(0))
+
+			body, _ := json.Marshal(map[string]any{"messages": conversation, "stream": false})
+			if w := doChat(t, s, string(body)); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			system := fake.requests[0].Messages[0].Content
+			if !strings.Contains(system, tt.want) {
+				t.Errorf("context is missing %q:\n%s", tt.want, system)
+			}
+			// The model still sees the conversation as it was sent
+			if got := fake.requests[0].Messages[1:]; !slices.EqualFunc(got, conversation, func(a, b copilot.ChatMessage) bool {
+				return a.Role == b.Role && a.Content == b.Content
+			}) {
+				t.Errorf("messages = %+v, want the conversation", got)
+			}
+		})
+	}
+}
+
+func TestTurnDecay(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+	// The earlier message says more about invoices than the latest one says
+	// about deploying, so joined together they are about invoices
+	conversation := []copilot.ChatMessage{
+		{Role: "user", Content: "When is an invoice sent? Is the invoice late?"},
+		{Role: "assistant", Content: "Monthly."},
+		{Role: "user", Content: "How do I deploy?"},
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{name: "default", want: "deploy.md"},
+		{name: "recent messages weigh more", opts: []Option{WithTurnDecay(0.5)}, want: "deploy.md"},
+		{name: "older messages weigh more", opts: []Option{WithTurnDecay(2)}, want: "billing.md"},
+		{name: "joined", opts: []Option{WithTurnDecay(0)}, want: "billing.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Run the release workflow."}}
+			stubCopilot(t, fake)
+			opts := append([]Option{WithQueryHistory(2)}, tt.opts...)
+			s := newTestService(t, docs, []string{"invoice", "deploy"}, opts...)
+
+			body, _ := json.Marshal(map[string]any{"messages": conversation, "stream": false})
+			if w := doChat(t, s, string(body)); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			system := fake.requests[0].Messages[0].Content
+			for filename, content := range docs {
+				if got, want := strings.Contains(system, content), filename == tt.want; got != want {
+					t.Errorf("context has %s = %v, want %v:\n%s", filename, got, want, system)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageContentShapes(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+	const image = `{"type":"image_url","image_url":{"url":"https://example.com/deploy.png"}}`
+
+	tests := []struct {
+		name      string
+		content   string
+		wantQuery string
+		wantParts []string
+	}{
+		{
+			name:      "string",
+			content:   `"When is an invoice sent?"`,
+			wantQuery: "When is an invoice sent?",
+		},
+		{
+			name:      "text parts",
+			content:   `[{"type":"text","text":"When is"},{"type":"text","text":"an invoice sent?"}]`,
+			wantQuery: "When is\nan invoice sent?",
+			wantParts: []string{"text", "text"},
+		},
+		{
+			// The image is about deploying, but only the text is retrieved for
+			name:      "image and text parts",
+			content:   `[` + image + `,{"type":"text","text":"When is an invoice sent?"}]`,
+			wantQuery: "When is an invoice sent?",
+			wantParts: []string{"image_url", "text"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}
+			s := newTestService(t, docs, nil, WithEmbedder(embedder))
+
+			body := `{"messages":[{"role":"user","content":` + tt.content + `}],"stream":false}`
+			if w := doChat(t, s, body); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			if !slices.Contains(embedder.embedded(), tt.wantQuery) {
+				t.Errorf("embedded %q, want the query %q", embedder.embedded(), tt.wantQuery)
+			}
+			if system := fake.requests[0].Messages[0].Content; !strings.Contains(system, docs["billing.md"]) {
+				t.Errorf("context is missing billing.md:\n%s", system)
+			}
+
+			// The model gets the message in the shape it was sent
+			msg := fake.requests[0].Messages[len(fake.requests[0].Messages)-1]
+			var parts []string
+			for _, part := range msg.Parts {
+				parts = append(parts, part.Type)
+			}
+			if !slices.Equal(parts, tt.wantParts) {
+				t.Errorf("parts sent to the model = %q, want %q", parts, tt.wantParts)
+			}
+		})
+	}
+}
+
+func TestMissingToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		body    string
+		handler func(s *Service) http.HandlerFunc
+	}{
+		{name: "chat", target: "/agent", body: `{"messages":[{"role":"user","content":"When is an invoice sent?"}]}`, handler: func(s *Service) http.HandlerFunc { return s.ChatCompletion }},
+		{name: "models", target: "/models", handler: func(s *Service) http.HandlerFunc { return s.Models }},
+		{name: "embed", target: "/embed", body: `{"input":["invoice"]}`, handler: func(s *Service) http.HandlerFunc { return s.Embed }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil, WithEmbedder(embedder))
+
+			r := signedRequest(t, tt.target, tt.body)
+			r.Header.Del("X-GitHub-Token")
+			w := httptest.NewRecorder()
+			tt.handler(s)(w, r)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if !strings.Contains(w.Body.String(), "X-GitHub-Token") {
+				t.Errorf("error doesn't name the missing header: %s", w.Body)
+			}
+			if n := fake.calls(); n != 0 {
+				t.Errorf("the Copilot API was called %d times without a token", n)
+			}
+			if embedded := embedder.embedded(); len(embedded) > 0 {
+				t.Errorf("embedded %q without a token", embedded)
+			}
+		})
+	}
+}
+
+// outageEmbedder embeds like a wordEmbedder until down is set, after which
+// every call fails
+type outageEmbedder struct {
+	wordEmbedder
+	down atomic.Bool
+}
+
+func (e *outageEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	if e.down.Load() {
+		return nil, errors.New("embeddings API is down")
+	}
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func TestRetrievalFailureMode(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantStatus int
+	}{
+		{name: "strict by default", wantStatus: http.StatusInternalServerError},
+		{name: "strict", opts: []Option{WithRetrievalFailureMode(RetrievalStrict)}, wantStatus: http.StatusInternalServerError},
+		{name: "degraded", opts: []Option{WithRetrievalFailureMode(RetrievalDegraded)}, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly, I think."}}
+			stubCopilot(t, fake)
+			embedder := &outageEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			opts := append([]Option{WithEmbedder(embedder), WithSystemPrompt("Answer the question.")}, tt.opts...)
+			s := newTestService(t, map[string]string{"billing.md": doc}, nil, opts...)
+
+			// The datasets are ready, only the query can't be embedded
+			if err := s.WarmDatasets(embedding.WithCredentials(context.Background(), "integration", "token")); err != nil {
+				t.Fatal(err)
+			}
+			embedder.down.Store(true)
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}},
+				"stream":   false,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if fake.calls() != 0 {
+					t.Errorf("made %d completion requests for a failed request", fake.calls())
+				}
+				return
+			}
+
+			msgs := fake.requests[0].Messages
+			for _, msg := range msgs {
+				if strings.Contains(msg.Content, doc) {
+					t.Errorf("document context sent without a query embedding: %+v", msg)
+				}
+			}
+			if msgs[0].Role != "system" || msgs[0].Content != "Answer the question." {
+				t.Errorf("first message = %+v, want the base system prompt", msgs[0])
+			}
+		})
+	}
+}
+
+func TestRequestDocumentFilter(t *testing.T) {
+	docs := map[string]string{
+		"billing.md":  "Invoices are sent monthly.",
+		"internal.md": "Invoice disputes go to finance.",
+	}
+
+	tests := []struct {
+		name       string
+		include    []string
+		exclude    []string
+		wantStatus int
+		want       []string
+	}{
+		{name: "include", include: []string{"billing.md"}, wantStatus: http.StatusOK, want: []string{docs["billing.md"]}},
+		{name: "exclude", exclude: []string{"billing.md"}, wantStatus: http.StatusOK, want: []string{docs["internal.md"]}},
+		{name: "matching nothing", include: []string{"*.txt"}, wantStatus: http.StatusOK},
+		{name: "invalid pattern", exclude: []string{"[billing"}, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, docs, []string{"invoice"})
+
+			body, _ := json.Marshal(map[string]any{
+				"messages":          []copilot.ChatMessage{{Role: "user", Content: "When is an invoice sent?"}},
+				"stream":            false,
+				"include_documents": tt.include,
+				"exclude_documents": tt.exclude,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var sent []string
+			for _, doc := range docs {
+				for _, msg := range fake.requests[0].Messages {
+					if strings.Contains(msg.Content, doc) {
+						sent = append(sent, doc)
+						break
+					}
+				}
+			}
+			if !slices.Equal(sent, tt.want) {
+				t.Errorf("documents sent = %q, want %q", sent, tt.want)
+			}
+		})
+	}
+}
+
+// slowEmbedder embeds like a wordEmbedder, but takes delay to embed queries,
+// which are told apart from documents by their question mark
+type slowEmbedder struct {
+	wordEmbedder
+	delay time.Duration
+}
+
+func (e slowEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	if strings.Contains(inputs[0], "?") {
+		select {
+		case <-time.After(e.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+// slowTransport waits for delay before passing requests on to next
+type slowTransport struct {
+	next  http.RoundTripper
+	delay time.Duration
+}
+
+func (t slowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	select {
+	case <-time.After(t.delay):
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	return t.next.RoundTrip(r)
+}
+
+func TestTimeouts(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+	const slow, short, long = 50 * time.Millisecond, 10 * time.Millisecond, time.Minute
+
+	tests := []struct {
+		name            string
+		embeddingDelay  time.Duration
+		completionDelay time.Duration
+		opts            []Option
+		wantStatus      int
+	}{
+		{
+			name:           "embedding timeout",
+			embeddingDelay: slow,
+			opts:           []Option{WithEmbeddingTimeout(short), WithCompletionTimeout(long)},
+			wantStatus:     http.StatusInternalServerError,
+		},
+		{
+			name:           "slow embedding within its timeout",
+			embeddingDelay: slow,
+			opts:           []Option{WithEmbeddingTimeout(long), WithCompletionTimeout(2 * short)},
+			wantStatus:     http.StatusOK,
+		},
+		{
+			name:            "completion timeout",
+			completionDelay: slow,
+			opts:            []Option{WithEmbeddingTimeout(long), WithCompletionTimeout(short)},
+			wantStatus:      http.StatusGatewayTimeout,
+		},
+		{
+			name:            "slow completion within its timeout",
+			completionDelay: slow,
+			opts:            []Option{WithEmbeddingTimeout(short), WithCompletionTimeout(long)},
+			wantStatus:      http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			prev := http.DefaultTransport
+			http.DefaultTransport = slowTransport{next: fake, delay: tt.completionDelay}
+			t.Cleanup(func() { http.DefaultTransport = prev })
+
+			embedder := slowEmbedder{wordEmbedder: wordEmbedder{"invoice"}, delay: tt.embeddingDelay}
+			opts := append([]Option{WithEmbedder(embedder)}, tt.opts...)
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil, opts...)
+
+			w := doChat(t, s, body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestRetrievalTimeout(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+	const doc = "Invoices are sent monthly."
+	const slow, short, long = 50 * time.Millisecond, 10 * time.Millisecond, time.Minute
+
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		opts        []Option
+		wantContext bool
+	}{
+		{name: "no timeout", delay: slow, wantContext: true},
+		{name: "within the timeout", delay: slow, opts: []Option{WithRetrievalTimeout(long)}, wantContext: true},
+		{name: "past the timeout", delay: slow, opts: []Option{WithRetrievalTimeout(short)}},
+		// The completion may take longer than retrieval is allowed to
+		{name: "separate from the completion", delay: slow, opts: []Option{WithRetrievalTimeout(short), WithCompletionTimeout(long)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			embedder := slowEmbedder{wordEmbedder: wordEmbedder{"invoice"}, delay: tt.delay}
+			opts := append([]Option{WithEmbedder(embedder)}, tt.opts...)
+			s := newTestService(t, map[string]string{"billing.md": doc}, nil, opts...)
+
+			if w := doChat(t, s, body); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if fake.calls() != 1 {
+				t.Fatalf("%d completion requests, want 1", fake.calls())
+			}
+
+			var hasContext bool
+			for _, msg := range fake.requests[0].Messages {
+				hasContext = hasContext || strings.Contains(msg.Content, doc)
+			}
+			if hasContext != tt.wantContext {
+				t.Errorf("document context sent = %v, want %v", hasContext, tt.wantContext)
+			}
+			// The model still gets the question
+			if last := fake.requests[0].Messages[len(fake.requests[0].Messages)-1]; last.Content != "When is an invoice sent?" {
+				t.Errorf("last message = %+v, want the question", last)
+			}
+		})
+	}
+}
+
+func TestContextHeaders(t *testing.T) {
+	docs := map[string]string{
+		"billing.md":  "Invoices are sent monthly.",
+		"payments.md": "An invoice can be paid by card.",
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		opts        []Option
+		rag         *bool
+		wantSources string
+	}{
+		{name: "one source", query: "When is an invoice sent?", wantSources: "1"},
+		{name: "two sources", query: "When is an invoice sent?", opts: []Option{WithMinDistinctSources(2)}, wantSources: "2"},
+		{name: "nothing relevant", query: "What's for lunch?", wantSources: "0"},
+		{name: "RAG disabled", query: "When is an invoice sent?", rag: new(bool), wantSources: "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			opts := append([]Option{WithSystemPrompt("Answer from the context."), WithMinSimilarity(0.5)}, tt.opts...)
+			s := newTestService(t, docs, []string{"invoice"}, opts...)
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []copilot.ChatMessage{{Role: "user", Content: tt.query}},
+				"stream":   false,
+				"rag":      tt.rag,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			if got := w.Header().Get("X-RAG-Sources-Count"); got != tt.wantSources {
+				t.Errorf("X-RAG-Sources-Count = %q, want %q", got, tt.wantSources)
+			}
+
+			// The context is everything the service put in front of the
+			// user's messages
+			wantBytes := 0
+			if tt.wantSources != "0" {
+				for _, msg := range fake.requests[0].Messages {
+					if msg.Role == "system" {
+						wantBytes += len(msg.Content)
+					}
+				}
+			}
+			if got := w.Header().Get("X-RAG-Context-Bytes"); got != strconv.Itoa(wantBytes) {
+				t.Errorf("X-RAG-Context-Bytes = %q, want %d", got, wantBytes)
+			}
+		})
+	}
+}
+
+func TestIntegrationModel(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+
+	tests := []struct {
+		name          string
+		integrationID string
+		want          copilot.Model
+	}{
+		{name: "configured integration", integrationID: "docs-bot", want: copilot.ModelGPT41},
+		{name: "other configured integration", integrationID: "support-bot", want: copilot.ModelGPT35},
+		{name: "unconfigured integration", integrationID: "integration", want: copilot.ModelGPT4o},
+		{name: "missing header", want: copilot.ModelGPT35},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"},
+				WithIntegrationModel("docs-bot", copilot.ModelGPT41),
+				WithIntegrationModel("support-bot", copilot.ModelGPT35),
+				WithDefaultIntegrationID("support-bot"))
+
+			r := signedRequest(t, "/agent", body)
+			r.Header.Set("Copilot-Integration-Id", tt.integrationID)
+			if tt.integrationID == "" {
+				r.Header.Del("Copilot-Integration-Id")
+			}
+			w := httptest.NewRecorder()
+			s.ChatCompletion(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if got := fake.requests[0].Model; got != tt.want {
+				t.Errorf("model = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewService(&testKey.PublicKey, WithIntegrationModel("docs-bot", "")); err == nil {
+		t.Error("an empty integration model was accepted")
+	}
+}
+
+func TestIntegrationDocuments(t *testing.T) {
+	docs := map[string]string{
+		"acme-billing.md":   "Invoices are sent monthly.",
+		"globex-billing.md": "Invoices are sent weekly, every invoice by mail.",
+		"deploy.md":         "Deploy from the main branch.",
+	}
+	const prompt = "Answer in one sentence."
+
+	tests := []struct {
+		name          string
+		integrationID string
+		query         string
+		want          string
+	}{
+		{name: "isolated", integrationID: "acme", query: "When is an invoice sent?", want: "acme-billing.md"},
+		{name: "other isolated integration", integrationID: "globex", query: "When is an invoice sent?", want: "globex-billing.md"},
+		{name: "outside the scope", integrationID: "acme", query: "How do I deploy?"},
+		{name: "not isolated", integrationID: "integration", query: "How do I deploy?", want: "deploy.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, docs, []string{"invoice", "deploy"},
+				WithSystemPrompt(prompt),
+				WithMinSimilarity(0.5),
+				WithIntegrationDocuments("acme", "acme-*"),
+				WithIntegrationDocuments("globex", "globex-*"))
+
+			body, _ := json.Marshal(map[string]any{"messages": []copilot.ChatMessage{{Role: "user", Content: tt.query}}, "stream": false})
+			r := signedRequest(t, "/agent", string(body))
+			r.Header.Set("Copilot-Integration-Id", tt.integrationID)
+			w := httptest.NewRecorder()
+			s.ChatCompletion(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			system := fake.requests[0].Messages[0].Content
+			for filename, content := range docs {
+				if got, want := strings.Contains(system, content), filename == tt.want; got != want {
+					t.Errorf("context has %s = %v, want %v:\n%s", filename, got, want, system)
+				}
+			}
+			// Prompts and models are shared by every integration.  Without a
+			// relevant document, there is no system message at all.
+			if got, want := strings.Contains(system, prompt), tt.want != ""; got != want {
+				t.Errorf("system message has the prompt = %v, want %v:\n%s", got, want, system)
+			}
+			if got := fake.requests[0].Model; got != copilot.ModelGPT4o {
+				t.Errorf("model = %s, want %s", got, copilot.ModelGPT4o)
+			}
+		})
+	}
+
+	for _, patterns := range [][]string{nil, {"["}} {
+		if _, err := NewService(&testKey.PublicKey, WithIntegrationDocuments("acme", patterns...)); err == nil {
+			t.Errorf("document patterns %q were accepted", patterns)
+		}
+	}
+}
+
+func TestSignatureVerification(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}` + "\n  "
+
+	tests := []struct {
+		name       string
+		sent       func(body string) string
+		edit       func(r *http.Request)
+		wantStatus int
+	}{
+		{name: "unmodified, trailing whitespace included", wantStatus: http.StatusOK},
+		{name: "trailing whitespace trimmed", sent: strings.TrimSpace, wantStatus: http.StatusUnauthorized},
+		{
+			name:       "one byte altered",
+			sent:       func(body string) string { return strings.Replace(body, "invoice", "invoicE", 1) },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "reformatted",
+			sent:       func(body string) string { return strings.ReplaceAll(body, `":`, `": `) },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "modified after Content-Length was set",
+			edit:       func(r *http.Request) { r.ContentLength++ },
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"})
+
+			// Sign the body as GitHub sent it, then deliver what the
+			// middleware made of it
+			signed := signedRequest(t, "/agent", body)
+			sent := body
+			if tt.sent != nil {
+				sent = tt.sent(body)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/agent", strings.NewReader(sent))
+			r.Header = signed.Header.Clone()
+			if tt.edit != nil {
+				tt.edit(r)
+			}
+
+			w := httptest.NewRecorder()
+			s.ChatCompletion(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK && fake.calls() != 0 {
+				t.Errorf("the model was called for an unverified request")
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}]}`
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(key *ecdsa.PrivateKey, body string) string {
+		digest := sha256.Sum256([]byte(body))
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		sig     string
+		keyID   string
+		want    bool
+		wantErr error
+	}{
+		{name: "valid", body: body, sig: sign(testKey, body), want: true},
+		{name: "other body", body: body + " ", sig: sign(testKey, body)},
+		{name: "other key", body: body, sig: sign(otherKey, body)},
+		{name: "valid, key selected", body: body, sig: sign(otherKey, body), keyID: "other", want: true},
+		{name: "key selected, signed with another", body: body, sig: sign(testKey, body), keyID: "other"},
+		{name: "unknown key", body: body, sig: sign(testKey, body), keyID: "missing", wantErr: ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, nil, nil, WithPublicKey("other", &otherKey.PublicKey))
+
+			got, err := s.VerifySignature([]byte(tt.body), tt.sig, tt.keyID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("valid = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("malformed signature", func(t *testing.T) {
+		s := newTestService(t, nil, nil)
+		if valid, err := s.VerifySignature([]byte(body), "not base64!", ""); err == nil || valid {
+			t.Errorf("valid = %v, err = %v, want an error", valid, err)
+		}
+	})
+}
+
+func TestFailOnEmptyDataDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		docs    map[string]string
+		fail    bool
+		wantErr bool
+	}{
+		{name: "empty, permissive", docs: nil},
+		{name: "empty, fatal", docs: nil, fail: true, wantErr: true},
+		{name: "blank documents, fatal", docs: map[string]string{"blank.md": " \n\n"}, fail: true, wantErr: true},
+		{name: "documents, fatal", docs: map[string]string{"billing.md": "Invoices are sent monthly."}, fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"I don't know."}}
+			stubCopilot(t, fake)
+
+			dir := t.TempDir()
+			for name, content := range tt.docs {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := []Option{WithDocumentSource(embedding.DirSource(dir)), WithEmbedder(wordEmbedder{"invoice"})}
+			if tt.fail {
+				opts = append(opts, WithFailOnEmptyDataDir())
+			}
+
+			s, err := NewService(&testKey.PublicKey, opts...)
+			if tt.wantErr {
+				if !errors.Is(err, embedding.ErrNoDocuments) {
+					t.Errorf("err = %v, want ErrNoDocuments", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+
+			// Without documents, the model answers without context
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// copilotAPI answers completions like a fakeCopilot and embeddings like a
+// wordEmbedder, recording the value of a header on every request by path
+type copilotAPI struct {
+	chat   *fakeCopilot
+	words  wordEmbedder
+	header string
+
+	mu   sync.Mutex
+	seen map[string][]string
+}
+
+func (a *copilotAPI) RoundTrip(r *http.Request) (*http.Response, error) {
+	a.mu.Lock()
+	a.seen[r.URL.Path] = append(a.seen[r.URL.Path], r.Header.Get(a.header))
+	a.mu.Unlock()
+
+	if r.URL.Path != "/embeddings" {
+		return a.chat.RoundTrip(r)
+	}
+	var req copilot.EmbeddingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	embeddings, _ := a.words.Embed(r.Context(), req.Input)
+	resp := copilot.EmbeddingsResponse{Usage: &copilot.EmbeddingsResponseUsage{PromptTokens: 5, TotalTokens: 5}}
+	for i, emb := range embeddings {
+		resp.Data = append(resp.Data, &copilot.EmbeddingsResponseData{Embedding: emb, Index: i})
+	}
+	b, _ := json.Marshal(resp)
+	return fakeResponse(http.StatusOK, "application/json", string(b)), nil
+}
+
+func TestExtraHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    string
+	}{
+		{name: "none"},
+		{name: "gateway header", headers: http.Header{"X-Gateway-Key": {"secret"}}, want: "secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &copilotAPI{
+				chat:   &fakeCopilot{content: []string{"Monthly."}},
+				words:  wordEmbedder{"invoice"},
+				header: "X-Gateway-Key",
+				seen:   map[string][]string{},
+			}
+			prev := http.DefaultTransport
+			http.DefaultTransport = api
+			t.Cleanup(func() { http.DefaultTransport = prev })
+
+			// The documents are embedded by the Copilot API on first use
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil,
+				WithEmbeddingModel(copilot.ModelEmbeddings), WithExtraHeaders(tt.headers))
+
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			api.mu.Lock()
+			defer api.mu.Unlock()
+			// The document and the query, then the completion
+			if got := len(api.seen["/embeddings"]); got != 2 {
+				t.Errorf("%d embeddings requests, want 2", got)
+			}
+			for path, values := range api.seen {
+				for _, got := range values {
+					if got != tt.want {
+						t.Errorf("%s request has %s = %q, want %q", path, api.header, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
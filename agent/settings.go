@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// Settings are the parts of the Service configuration that can be changed
+// while it is running, see Service.Reload
+type Settings struct {
+	SystemPrompt string        `json:"system_prompt"`
+	Model        copilot.Model `json:"model"`
+
+	// Temperature is left to the model's default when nil
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	// MinSimilarity is the similarity a document must reach to be used as
+	// context.  Any positive similarity is enough when it is 0.
+	MinSimilarity float32 `json:"min_similarity"`
+}
+
+// SettingsLoader reads the current settings from wherever they are kept.  It
+// is given the settings the Service was created with, so it only has to fill
+// in the ones it knows about.
+type SettingsLoader func(base Settings) (Settings, error)
+
+// SettingsFile returns a SettingsLoader that reads settings from a JSON file,
+// e.g. {"system_prompt": "...", "temperature": 0}
+func SettingsFile(path string) SettingsLoader {
+	return func(base Settings) (Settings, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return Settings{}, fmt.Errorf("failed to open settings file: %w", err)
+		}
+		defer f.Close()
+
+		settings := base
+		if err := json.NewDecoder(f).Decode(&settings); err != nil {
+			return Settings{}, fmt.Errorf("failed to decode settings file: %w", err)
+		}
+
+		return settings, nil
+	}
+}
+
+// WithSettingsLoader enables Service.Reload, which applies the settings read
+// by load.  It also requires an admin token, see WithAdminToken.
+func WithSettingsLoader(load SettingsLoader) Option {
+	return func(s *Service) {
+		s.settingsLoader = load
+	}
+}
+
+// currentSettings returns a snapshot of the settings in effect
+func (s *Service) currentSettings() Settings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.settings
+}
+
+// validateSettings makes sure settings can be used to serve requests
+func (s *Service) validateSettings(settings *Settings) error {
+	// Catch accidentally huge prompts now rather than letting them crowd the
+	// document context out of every request
+	if len(settings.SystemPrompt) > s.maxSystemPromptLength {
+		return fmt.Errorf("system prompt is %d bytes, exceeding the maximum of %d", len(settings.SystemPrompt), s.maxSystemPromptLength)
+	}
+
+	if settings.Model == "" {
+		return fmt.Errorf("a model is required")
+	}
+
+	if !validSimilarity(settings.MinSimilarity) {
+		return fmt.Errorf("minimum similarity %v is out of range [0, 1]", settings.MinSimilarity)
+	}
+
+	return nil
+}
+
+// Reload re-reads the settings and applies them to every request from then
+// on.  Requests already in progress finish with the settings they started
+// with.  The applied settings are written back as JSON.
+func (s *Service) Reload(w http.ResponseWriter, r *http.Request) {
+	if s.settingsLoader == nil || s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	settings, err := s.settingsLoader(s.baseSettings)
+	if err != nil {
+		fmt.Printf("failed to load settings: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Keep the settings in effect if the new ones are unusable
+	if err := s.validateSettings(&settings); err != nil {
+		fmt.Printf("invalid settings: %v\n", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.settingsMu.Lock()
+	s.settings = settings
+	s.settingsMu.Unlock()
+
+	fmt.Println("settings reloaded")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		fmt.Printf("failed to write settings: %v\n", err)
+	}
+}
+
+// validSimilarity reports whether min is usable as a minimum similarity.
+// Negative cosine similarities are never relevant, so neither are negative
+// thresholds.
+func validSimilarity(min float32) bool {
+	return min >= 0 && min <= 1
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+func TestMaxSystemPromptLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "default prompt"},
+		{name: "oversized prompt", opts: []Option{WithSystemPrompt(strings.Repeat("x", defaultMaxSystemPromptLength+1))}, wantErr: true},
+		{name: "prompt at the maximum", opts: []Option{WithSystemPrompt(strings.Repeat("x", 100)), WithMaxSystemPromptLength(100)}},
+		{name: "prompt over a configured maximum", opts: []Option{WithSystemPrompt(strings.Repeat("x", 101)), WithMaxSystemPromptLength(100)}, wantErr: true},
+		{name: "default prompt over a configured maximum", opts: []Option{WithMaxSystemPromptLength(100)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithDocumentSource(embedding.DirSource(t.TempDir())),
+				WithEmbedder(wordEmbedder{}),
+			}, tt.opts...)
+			s, err := NewService(nil, opts...)
+			if err == nil {
+				s.Close()
+			}
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// doReload asks s to reload its settings with the admin token "admin"
+func doReload(s *Service) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	s.Reload(w, r)
+	return w
+}
+
+func TestReload(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent, and by whom?"}],"stream":false}`
+
+	fake := &fakeCopilot{content: []string{"Monthly."}}
+	stubCopilot(t, fake)
+	settingsFile := filepath.Join(t.TempDir(), "settings.json")
+	writeSettings := func(settings string) {
+		if err := os.WriteFile(settingsFile, []byte(settings), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice", "whom"},
+		WithAdminToken("admin"), WithSettingsLoader(SettingsFile(settingsFile)))
+
+	// hasContext sends the request and reports whether the document was
+	// injected as context
+	hasContext := func() bool {
+		t.Helper()
+		if w := doChat(t, s, body); w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		request := fake.requests[len(fake.requests)-1]
+		return strings.Contains(request.Messages[0].Content, doc)
+	}
+
+	if !hasContext() {
+		t.Fatal("no context with the initial threshold")
+	}
+
+	writeSettings(`{"min_similarity": 0.9, "system_prompt": "Be brief."}`)
+	w := doReload(s)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reload status = %d: %s", w.Code, w.Body)
+	}
+	var applied Settings
+	if err := json.NewDecoder(w.Body).Decode(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied.MinSimilarity != 0.9 || applied.SystemPrompt != "Be brief." || applied.Model == "" {
+		t.Errorf("applied settings = %+v", applied)
+	}
+	if hasContext() {
+		t.Error("the document is still used as context after raising the threshold")
+	}
+
+	// Unusable settings leave the ones in effect alone
+	writeSettings(`{"min_similarity": 2}`)
+	if w := doReload(s); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reload of invalid settings: status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if got := s.currentSettings().MinSimilarity; got != 0.9 {
+		t.Errorf("min similarity = %v after a failed reload, want 0.9", got)
+	}
+}
+
+func TestReloadRequiresAdminToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		method string
+		header string
+		want   int
+	}{
+		{name: "no loader", opts: []Option{WithAdminToken("admin")}, method: http.MethodPost, header: "Bearer admin", want: http.StatusNotFound},
+		{name: "no admin token", opts: []Option{WithSettingsLoader(SettingsFile("settings.json"))}, method: http.MethodPost, header: "Bearer admin", want: http.StatusNotFound},
+		{name: "wrong token", opts: []Option{WithAdminToken("admin"), WithSettingsLoader(SettingsFile("settings.json"))}, method: http.MethodPost, header: "Bearer other", want: http.StatusUnauthorized},
+		{name: "wrong method", opts: []Option{WithAdminToken("admin"), WithSettingsLoader(SettingsFile("settings.json"))}, method: http.MethodGet, header: "Bearer admin", want: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, nil, nil, tt.opts...)
+			r := httptest.NewRequest(tt.method, "/admin/reload", nil)
+			r.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			s.Reload(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
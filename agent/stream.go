@@ -0,0 +1,419 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// forwardStream copies the server-sent events of a completion stream to w.  If
+// the model produced no content at all, an "empty_completion" event is emitted
+// before the stream terminates so that clients can tell an empty answer apart
+// from one that is still in progress.
+//
+// Tool-call deltas are handled according to the tool event policy, so by
+// default only user-visible content reaches the client.
+//
+// If the content filter stopped the model, a "content_filtered" event is
+// emitted instead, unless content filtering is passed through as it is.
+//
+// If there is any metadata, it is sent in a "metadata" event just before the
+// stream terminates.  Sources may also be cited inline, see
+// WithInlineCitations.
+//
+// Unless disabled, w is flushed after every event so that tokens reach the
+// client as soon as they arrive rather than in bursts.
+func (s *Service) forwardStream(stream io.Reader, w io.Writer, meta *completionMetadata) error {
+	var hasContent, filtered, terminated bool
+	var answer strings.Builder
+	var content string
+
+	events := copilot.NewEventReader(stream)
+	for {
+		event, err := events.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read from stream: %w", err)
+		}
+
+		content = ""
+		switch {
+		case event.IsDone():
+			meta.checkQuotes(answer.String())
+			if err := s.writeTrailer(w, hasContent, filtered, meta); err != nil {
+				return err
+			}
+			terminated = true
+		case event.Name == "":
+			chunk, err := event.Chunk()
+			if err != nil {
+				// Forward anything we don't understand untouched
+				break
+			}
+			if !hasContent {
+				hasContent = chunk.Content() != ""
+			}
+			if !filtered {
+				filtered = chunk.ContentFiltered()
+			}
+			if meta != nil && meta.quoteSource != "" {
+				answer.WriteString(chunk.Content())
+			}
+			content = chunk.Content()
+
+			event, err = s.applyToolEventPolicy(event, chunk, w)
+			if err != nil {
+				return err
+			}
+		}
+		if event == nil {
+			continue
+		}
+
+		if err := s.writeStreamEvent(w, event); err != nil {
+			return err
+		}
+		if err := s.writeInlineCitations(w, meta, content); err != nil {
+			return err
+		}
+		s.flush(w)
+	}
+
+	if !terminated {
+		meta.checkQuotes(answer.String())
+		return s.writeTrailer(w, hasContent, filtered, meta)
+	}
+
+	return nil
+}
+
+// completionMetadata is sent to the client in a trailing "metadata" event
+type completionMetadata struct {
+	Citations []citation `json:"citations,omitempty"`
+
+	QuotesChecked    int      `json:"quotes_checked,omitempty"`
+	UnverifiedQuotes []string `json:"unverified_quotes,omitempty"`
+
+	Retrieval *retrievalExplanation `json:"retrieval,omitempty"`
+
+	// quoteSource is the context quotes in the answer are checked against, if
+	// they are checked at all
+	quoteSource string
+
+	// inline finds the sources cited in the answer as it streams in, if they
+	// are cited inline
+	inline *inlineCitations
+}
+
+// checkQuotes checks the quotes in answer, if quotes are to be checked
+func (m *completionMetadata) checkQuotes(answer string) {
+	if m == nil || m.quoteSource == "" {
+		return
+	}
+	m.QuotesChecked, m.UnverifiedQuotes = unverifiedQuotes(answer, m.quoteSource)
+	if len(m.UnverifiedQuotes) > 0 {
+		fmt.Printf("%d of %d quotes in the answer are not in the context\n", len(m.UnverifiedQuotes), m.QuotesChecked)
+	}
+}
+
+// writeTrailer writes the events that go at the end of a completion stream
+func (s *Service) writeTrailer(w io.Writer, hasContent, filtered bool, meta *completionMetadata) error {
+	switch {
+	case filtered && s.contentFilterMode == ContentFilterSignal:
+		fmt.Println("completion was stopped by the content filter")
+		if err := s.writeEvent(w, "content_filtered", struct {
+			Partial bool `json:"partial"`
+		}{
+			Partial: hasContent,
+		}); err != nil {
+			return err
+		}
+	case !hasContent:
+		if err := s.writeEmptyCompletion(w); err != nil {
+			return err
+		}
+	}
+
+	if meta != nil {
+		if err := s.writeEvent(w, "metadata", meta); err != nil {
+			return err
+		}
+	}
+
+	s.flush(w)
+	return nil
+}
+
+// writeStreamEvent writes an event of the completion stream to w in the
+// configured output format.  Server-sent events are framed as the SSE format
+// requires, however they were framed upstream.
+func (s *Service) writeStreamEvent(w io.Writer, event *copilot.Event) error {
+	if s.outputFormat == OutputText {
+		// Only the text of completion chunks is of interest to text clients
+		if event.Name != "" || event.IsDone() {
+			return nil
+		}
+		chunk, err := event.Chunk()
+		if err != nil {
+			return nil
+		}
+		content := chunk.Content()
+		if content == "" {
+			return nil
+		}
+		if _, err := io.WriteString(w, content+s.textDelimiter); err != nil {
+			return fmt.Errorf("failed to write to stream: %w", err)
+		}
+		return nil
+	}
+
+	return s.emit(w, event)
+}
+
+// emit writes a server-sent event to w, after passing it through the event
+// transform, if there is one
+func (s *Service) emit(w io.Writer, event *copilot.Event) error {
+	if s.eventTransform != nil {
+		var err error
+		event, err = s.eventTransform(event)
+		if err != nil {
+			return fmt.Errorf("failed to transform event: %w", err)
+		}
+		if event == nil {
+			return nil
+		}
+	}
+
+	if _, err := event.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write to stream: %w", err)
+	}
+	return nil
+}
+
+// applyToolEventPolicy handles the tool-call deltas in a completion chunk.  It
+// returns the event to forward in place of the original, which is nil if
+// nothing user-visible is left in it.
+func (s *Service) applyToolEventPolicy(event *copilot.Event, chunk *copilot.ChatCompletionsResponse, w io.Writer) (*copilot.Event, error) {
+	if s.toolEventPolicy == ToolEventsForward {
+		return event, nil
+	}
+
+	var hasToolCalls bool
+	for _, choice := range chunk.Choices {
+		payload := choice.Payload()
+		if payload == nil {
+			continue
+		}
+		for _, call := range payload.ToolCalls {
+			hasToolCalls = true
+
+			// Only the first delta of a call carries the function name
+			if s.toolEventPolicy == ToolEventsSummarize && call.Function.Name != "" {
+				if err := s.writeEvent(w, "tool_call", struct {
+					Name string `json:"name"`
+				}{
+					Name: call.Function.Name,
+				}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if !hasToolCalls {
+		return event, nil
+	}
+
+	data, visible, err := stripToolCalls(event.Data)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, nil
+	}
+
+	return &copilot.Event{
+		Name: event.Name,
+		ID:   event.ID,
+		Data: data,
+	}, nil
+}
+
+// stripToolCalls removes the tool calls from the deltas, or full messages, of
+// a completion chunk, leaving every other field intact.  visible reports whether any choice still
+// has content or a finish reason once the tool calls are gone.
+func stripToolCalls(data []byte) (stripped []byte, visible bool, err error) {
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, false, fmt.Errorf("failed to decode completion chunk: %w", err)
+	}
+
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(chunk["choices"], &choices); err != nil {
+		return nil, false, fmt.Errorf("failed to decode completion choices: %w", err)
+	}
+
+	for _, choice := range choices {
+		// Choose the payload like copilot.ChatCompletionsChoice.Payload does
+		key := "delta"
+		if _, ok := choice[key]; !ok {
+			key = "message"
+		}
+
+		var payload map[string]json.RawMessage
+		if raw, ok := choice[key]; ok {
+			if err := json.Unmarshal(raw, &payload); err != nil {
+				return nil, false, fmt.Errorf("failed to decode completion %s: %w", key, err)
+			}
+		}
+		delete(payload, "tool_calls")
+
+		var content string
+		_ = json.Unmarshal(payload["content"], &content)
+		var finishReason string
+		_ = json.Unmarshal(choice["finish_reason"], &finishReason)
+		if content != "" || finishReason != "" {
+			visible = true
+		}
+
+		if payload == nil {
+			continue
+		}
+		if choice[key], err = json.Marshal(payload); err != nil {
+			return nil, false, fmt.Errorf("failed to encode completion %s: %w", key, err)
+		}
+	}
+
+	if chunk["choices"], err = json.Marshal(choices); err != nil {
+		return nil, false, fmt.Errorf("failed to encode completion choices: %w", err)
+	}
+
+	stripped, err = json.Marshal(chunk)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode completion chunk: %w", err)
+	}
+
+	return stripped, visible, nil
+}
+
+// flush sends anything buffered in w on to the client, unless flushing has
+// been disabled
+func (s *Service) flush(w io.Writer) {
+	if !s.flushStream {
+		return
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *Service) writeEmptyCompletion(w io.Writer) error {
+	return s.writeEvent(w, "empty_completion", struct {
+		Reason string `json:"reason"`
+	}{
+		Reason: "the model produced no content",
+	})
+}
+
+// writeEvent writes a single named server-sent event with a JSON payload.
+// Named events only exist in the SSE output format, so nothing is written for
+// other formats.
+func (s *Service) writeEvent(w io.Writer, name string, data any) error {
+	if s.outputFormat != OutputSSE {
+		return nil
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", name, err)
+	}
+
+	if err := s.emit(w, &copilot.Event{Name: name, Data: b}); err != nil {
+		return fmt.Errorf("failed to write %s event: %w", name, err)
+	}
+
+	return nil
+}
+
+// writeCompletion relays a non-streamed completion to w.  If the model produced
+// neither content nor tool calls, 204 No Content is returned instead, unless
+// the content filter stopped it, which is flagged with a content_filtered
+// field.  When JSON output was asked for, content that isn't valid JSON is
+// reported as a bad gateway.  Checked quotes are reported in a header, since
+// there is no trailer to put them in.
+func (s *Service) writeCompletion(body io.Reader, w http.ResponseWriter, meta *completionMetadata) error {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read completion: %w", err)
+	}
+
+	var resp copilot.ChatCompletionsResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return fmt.Errorf("failed to decode completion: %w", err)
+	}
+
+	filtered := resp.ContentFiltered() && s.contentFilterMode == ContentFilterSignal
+	if filtered {
+		fmt.Println("completion was stopped by the content filter")
+		if b, err = addField(b, "content_filtered", true); err != nil {
+			return err
+		}
+	} else if resp.Empty() {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	// A filtered completion is cut short, so it can't be expected to be valid.
+	// Tool calls come without any content to validate.
+	if !filtered && s.responseFormat == copilot.ResponseFormatJSONObject && resp.Content() != "" && !json.Valid([]byte(resp.Content())) {
+		return &statusError{
+			status: http.StatusBadGateway,
+			err:    fmt.Errorf("model did not return valid JSON"),
+		}
+	}
+
+	meta.checkQuotes(resp.Content())
+	if meta != nil && meta.quoteSource != "" {
+		w.Header().Set("X-RAG-Unverified-Quotes", strconv.Itoa(len(meta.UnverifiedQuotes)))
+	}
+
+	if s.codeExtraction != nil {
+		if b, err = s.codeExtraction.addCodeBlocks(b, resp.Content()); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("failed to write completion: %w", err)
+	}
+
+	return nil
+}
+
+// addField adds a top-level field to the raw JSON object b, leaving every
+// other field intact
+func addField(b []byte, name string, value any) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, fmt.Errorf("failed to decode completion: %w", err)
+	}
+
+	var err error
+	if obj[name], err = json.Marshal(value); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+
+	b, err = json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode completion: %w", err)
+	}
+	return b, nil
+}
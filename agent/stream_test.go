@@ -0,0 +1,603 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+func TestEmptyCompletion(t *testing.T) {
+	const roleOnly = `data: {"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}` + "\n\n"
+
+	t.Run("stream", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			stream    string
+			wantEmpty bool
+		}{
+			{name: "no content", stream: roleOnly + "data: [DONE]\n\n", wantEmpty: true},
+			{name: "no events", stream: "data: [DONE]\n\n", wantEmpty: true},
+			{name: "no terminating event", stream: roleOnly, wantEmpty: true},
+			{name: "content", stream: eventStream("Hello")},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s := &Service{}
+				w := httptest.NewRecorder()
+				if err := s.forwardStream(strings.NewReader(tt.stream), w, nil); err != nil {
+					t.Fatal(err)
+				}
+				if empty := strings.Contains(w.Body.String(), "event: empty_completion\n"); empty != tt.wantEmpty {
+					t.Errorf("empty_completion event = %v, want %v:\n%s", empty, tt.wantEmpty, w.Body)
+				}
+			})
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		const toolCallsOnly = `{"choices":[{"index":0,"message":{"role":"assistant","content":"","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`
+
+		tests := []struct {
+			name       string
+			completion string
+			policy     ToolEventPolicy
+			wantStatus int
+		}{
+			{name: "no content", completion: `{"choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":"stop"}]}`, wantStatus: http.StatusNoContent},
+			{name: "no choices", completion: `{"choices":[]}`, wantStatus: http.StatusNoContent},
+			{name: "content", completion: `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`, wantStatus: http.StatusOK},
+			{name: "tool calls only", completion: toolCallsOnly, wantStatus: http.StatusOK},
+			{name: "tool calls only, forwarded", completion: toolCallsOnly, policy: ToolEventsForward, wantStatus: http.StatusOK},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s := &Service{toolEventPolicy: tt.policy}
+				w := httptest.NewRecorder()
+				if err := s.writeCompletion(strings.NewReader(tt.completion), w, nil); err != nil {
+					t.Fatal(err)
+				}
+				if w.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+				}
+				if tt.wantStatus == http.StatusNoContent && w.Body.Len() > 0 {
+					t.Errorf("204 response has a body: %s", w.Body)
+				}
+				if tt.wantStatus == http.StatusOK && w.Body.String() != tt.completion {
+					t.Errorf("body = %s, want the completion %s", w.Body, tt.completion)
+				}
+			})
+		}
+	})
+}
+
+// flushRecorder records what had been written at every flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushed = append(r.flushed, r.Body.String())
+	r.ResponseRecorder.Flush()
+}
+
+func TestStreamFlushing(t *testing.T) {
+	tokens := []string{"one", "two", "three"}
+
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{name: "enabled", enabled: true},
+		{name: "disabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{flushStream: tt.enabled}
+			w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			if err := s.forwardStream(strings.NewReader(eventStream(tokens...)), w, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.enabled {
+				if len(w.flushed) > 0 {
+					t.Errorf("flushed %d times with flushing disabled", len(w.flushed))
+				}
+				return
+			}
+
+			// Every event is flushed before the next one is written
+			for i, token := range tokens {
+				var found bool
+				for _, flushed := range w.flushed {
+					if !strings.Contains(flushed, token) {
+						continue
+					}
+					found = i == len(tokens)-1 || !strings.Contains(flushed, tokens[i+1])
+					break
+				}
+				if !found {
+					t.Errorf("%q was not flushed on its own: %q", token, w.flushed)
+				}
+			}
+			if last := w.flushed[len(w.flushed)-1]; last != w.Body.String() {
+				t.Errorf("the end of the stream was not flushed: %q", strings.TrimPrefix(w.Body.String(), last))
+			}
+		})
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	upstream := ": keep-alive\n\n" + eventStream("Hello", " world")
+
+	tests := []struct {
+		name            string
+		format          OutputFormat
+		wantContentType string
+		want            string
+	}{
+		{
+			name:   "sse",
+			format: OutputSSE,
+			want:   eventStream("Hello", " world"),
+		},
+		{
+			name:            "text",
+			format:          OutputText,
+			wantContentType: "text/plain; charset=utf-8",
+			want:            "Hello world",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{outputFormat: tt.format}
+			w := httptest.NewRecorder()
+			if err := s.relayCompletion(strings.NewReader(upstream), true, w, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := w.Header().Get("Content-Type"); tt.wantContentType != "" && got != tt.wantContentType {
+				t.Errorf("content type = %q, want %q", got, tt.wantContentType)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	const hello = `{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`
+	const world = `{"choices":[{"index":0,"delta":{"content":" world"}}]}`
+	sse := "data: " + hello + "\n\ndata: " + world + "\n\ndata: [DONE]\n\n"
+
+	tests := []struct {
+		name     string
+		format   OutputFormat
+		delim    string
+		upstream string
+		want     string
+	}{
+		{
+			name:     "sse keeps framed events as they are",
+			upstream: sse,
+			want:     sse,
+		},
+		{
+			name:     "sse frames CRLF terminated events",
+			upstream: strings.ReplaceAll(sse, "\n", "\r\n"),
+			want:     sse,
+		},
+		{
+			name:     "sse terminates an unterminated last event",
+			upstream: strings.TrimSuffix(sse, "\n\n"),
+			want:     sse,
+		},
+		{
+			name:     "text without a delimiter",
+			format:   OutputText,
+			upstream: sse,
+			want:     "Hello world",
+		},
+		{
+			name:     "text with newline delimiters",
+			format:   OutputText,
+			delim:    "\n",
+			upstream: sse,
+			want:     "Hello\n world\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{outputFormat: tt.format, textDelimiter: tt.delim}
+			w := httptest.NewRecorder()
+			if err := s.forwardStream(strings.NewReader(tt.upstream), w, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEventShapes(t *testing.T) {
+	const (
+		helloDelta   = `data: {"choices":[{"index":0,"delta":{"content":"Hello"}}]}` + "\n\n"
+		worldDelta   = `data: {"choices":[{"index":0,"delta":{"content":" world"}}]}` + "\n\n"
+		helloMessage = `data: {"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"}}]}` + "\n\n"
+		worldMessage = `data: {"choices":[{"index":0,"message":{"content":" world"}}]}` + "\n\n"
+		done         = "data: [DONE]\n\n"
+	)
+
+	tests := []struct {
+		name     string
+		upstream string
+	}{
+		{name: "deltas", upstream: helloDelta + worldDelta + done},
+		{name: "messages", upstream: helloMessage + worldMessage + done},
+		{name: "mixed", upstream: helloMessage + worldDelta + done},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{outputFormat: OutputText}
+			w := httptest.NewRecorder()
+			if err := s.forwardStream(strings.NewReader(tt.upstream), w, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Body.String(); got != "Hello world" {
+				t.Errorf("text = %q, want %q", got, "Hello world")
+			}
+
+			// Content of either shape counts as content
+			s = &Service{}
+			w = httptest.NewRecorder()
+			if err := s.forwardStream(strings.NewReader(tt.upstream), w, nil); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(w.Body.String(), "event: empty_completion") {
+				t.Errorf("completion reported as empty:\n%s", w.Body)
+			}
+		})
+	}
+}
+
+func TestToolEventPolicy(t *testing.T) {
+	const (
+		content  = `data: {"choices":[{"index":0,"delta":{"content":"Let me look."}}]}` + "\n\n"
+		toolCall = `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"search","arguments":""}}]}}]}` + "\n\n"
+		toolArgs = `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":1}"}}]}}]}` + "\n\n"
+		mixed    = `data: {"choices":[{"index":0,"delta":{"content":" Found it.","tool_calls":[{"index":1,"function":{"name":"open"}}]}}]}` + "\n\n"
+		done     = "data: [DONE]\n\n"
+	)
+	upstream := content + toolCall + toolArgs + mixed + done
+
+	tests := []struct {
+		name       string
+		policy     ToolEventPolicy
+		wantEvents []string
+		wantTools  bool
+	}{
+		{name: "strip", policy: ToolEventsStrip, wantEvents: []string{"data", "data", "done"}},
+		{name: "forward", policy: ToolEventsForward, wantEvents: []string{"data", "data", "data", "data", "done"}, wantTools: true},
+		{name: "summarize", policy: ToolEventsSummarize, wantEvents: []string{"data", "tool_call", "tool_call", "data", "done"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{toolEventPolicy: tt.policy}
+			w := httptest.NewRecorder()
+			if err := s.forwardStream(strings.NewReader(upstream), w, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			events := readEvents(t, w.Body)
+			if got := eventNames(events); !slices.Equal(got, tt.wantEvents) {
+				t.Fatalf("events = %q, want %q", got, tt.wantEvents)
+			}
+
+			var text strings.Builder
+			var hasTools bool
+			var tools []string
+			for _, event := range events {
+				switch {
+				case event.Name == "tool_call":
+					var call struct {
+						Name string `json:"name"`
+					}
+					if err := json.Unmarshal(event.Data, &call); err != nil {
+						t.Fatal(err)
+					}
+					tools = append(tools, call.Name)
+				case event.Name == "" && !event.IsDone():
+					chunk, err := event.Chunk()
+					if err != nil {
+						t.Fatal(err)
+					}
+					text.WriteString(chunk.Content())
+					for _, choice := range chunk.Choices {
+						hasTools = hasTools || len(choice.Payload().ToolCalls) > 0
+					}
+				}
+			}
+
+			// The content always gets through, whatever happens to the calls
+			if got := text.String(); got != "Let me look. Found it." {
+				t.Errorf("content = %q", got)
+			}
+			if hasTools != tt.wantTools {
+				t.Errorf("tool calls forwarded = %v, want %v", hasTools, tt.wantTools)
+			}
+			if tt.policy == ToolEventsSummarize && !slices.Equal(tools, []string{"search", "open"}) {
+				t.Errorf("tool_call events name %q, want search and open", tools)
+			}
+		})
+	}
+}
+
+func TestResponseFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     copilot.ResponseFormatType
+		content    string
+		wantStatus int
+	}{
+		{name: "valid JSON", format: copilot.ResponseFormatJSONObject, content: `{"answer": 42}`, wantStatus: http.StatusOK},
+		{name: "invalid JSON", format: copilot.ResponseFormatJSONObject, content: "The answer is 42.", wantStatus: http.StatusBadGateway},
+		{name: "text", format: copilot.ResponseFormatText, content: "The answer is 42.", wantStatus: http.StatusOK},
+		{name: "default", content: "The answer is 42.", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{tt.content}}
+			stubCopilot(t, fake)
+			var opts []Option
+			if tt.format != "" {
+				opts = append(opts, WithResponseFormat(tt.format))
+			}
+			s := newTestService(t, map[string]string{"answers.md": "The answer is 42."}, []string{"answer"}, opts...)
+
+			w := doChat(t, s, `{"messages":[{"role":"user","content":"What is the answer?"}],"stream":false}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			var got copilot.ResponseFormatType
+			if format := fake.requests[0].ResponseFormat; format != nil {
+				got = format.Type
+			}
+			if got != tt.format {
+				t.Errorf("requested response format %q, want %q", got, tt.format)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp copilot.ChatCompletionsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Content() != tt.content {
+				t.Errorf("content = %q, want %q", resp.Content(), tt.content)
+			}
+		})
+	}
+}
+
+func TestEventTransform(t *testing.T) {
+	const upstream = `data: {"choices":[{"index":0,"delta":{"content":"Hello"}}]}` + "\n\n" +
+		`data: {"choices":[{"index":0,"delta":{"content":" world"}}]}` + "\n\n" +
+		"data: [DONE]\n\n"
+
+	// envelope renames the choices of a chunk to items and wraps them the way
+	// a frontend might expect
+	envelope := func(event *copilot.Event) (*copilot.Event, error) {
+		if event.IsDone() {
+			return &copilot.Event{Name: "end", Data: []byte("{}")}, nil
+		}
+		var chunk map[string]json.RawMessage
+		if err := json.Unmarshal(event.Data, &chunk); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(map[string]any{"type": "chunk", "items": chunk["choices"]})
+		if err != nil {
+			return nil, err
+		}
+		return &copilot.Event{Name: "message", Data: data}, nil
+	}
+
+	tests := []struct {
+		name      string
+		transform EventTransform
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name: "passthrough",
+			want: []string{
+				`{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":" world"}}]}`,
+				"[DONE]",
+			},
+		},
+		{
+			name:      "envelope",
+			transform: envelope,
+			want: []string{
+				`message {"items":[{"index":0,"delta":{"content":"Hello"}}],"type":"chunk"}`,
+				`message {"items":[{"index":0,"delta":{"content":" world"}}],"type":"chunk"}`,
+				"end {}",
+			},
+		},
+		{
+			name: "drop",
+			transform: func(event *copilot.Event) (*copilot.Event, error) {
+				if event.IsDone() {
+					return nil, nil
+				}
+				return event, nil
+			},
+			want: []string{
+				`{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":" world"}}]}`,
+			},
+		},
+		{
+			name: "error",
+			transform: func(event *copilot.Event) (*copilot.Event, error) {
+				return nil, errors.New("no envelope fits")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{eventTransform: tt.transform}
+			w := httptest.NewRecorder()
+			err := s.forwardStream(strings.NewReader(upstream), w, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var got []string
+			for _, event := range readEvents(t, w.Body) {
+				if event.Name == "" {
+					got = append(got, string(event.Data))
+				} else {
+					got = append(got, event.Name+" "+string(event.Data))
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentFilter(t *testing.T) {
+	const filteredChunk = `data: {"choices":[{"index":0,"delta":{"content":""},"finish_reason":"content_filter"}]}` + "\n\n"
+
+	t.Run("stream", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			mode        ContentFilterMode
+			stream      string
+			wantEvent   string
+			wantPartial bool
+		}{
+			{name: "filtered", stream: filteredChunk + "data: [DONE]\n\n", wantEvent: "content_filtered"},
+			{name: "filtered partway", stream: strings.TrimSuffix(eventStream("Hello"), "data: [DONE]\n\n") + filteredChunk + "data: [DONE]\n\n", wantEvent: "content_filtered", wantPartial: true},
+			{name: "filtered without terminating event", stream: filteredChunk, wantEvent: "content_filtered"},
+			{name: "not filtered", stream: eventStream("Hello")},
+			{name: "passed through", mode: ContentFilterPassThrough, stream: filteredChunk + "data: [DONE]\n\n", wantEvent: "empty_completion"},
+			{name: "passed through partway", mode: ContentFilterPassThrough, stream: strings.TrimSuffix(eventStream("Hello"), "data: [DONE]\n\n") + filteredChunk + "data: [DONE]\n\n"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s := &Service{contentFilterMode: tt.mode}
+				w := httptest.NewRecorder()
+				if err := s.forwardStream(strings.NewReader(tt.stream), w, nil); err != nil {
+					t.Fatal(err)
+				}
+
+				var names []string
+				var partial *bool
+				for _, event := range readEvents(t, w.Body) {
+					if event.Name == "" || event.IsDone() {
+						continue
+					}
+					names = append(names, event.Name)
+					if event.Name == "content_filtered" {
+						var data struct {
+							Partial bool `json:"partial"`
+						}
+						if err := json.Unmarshal(event.Data, &data); err != nil {
+							t.Fatal(err)
+						}
+						partial = &data.Partial
+					}
+				}
+
+				var want []string
+				if tt.wantEvent != "" {
+					want = []string{tt.wantEvent}
+				}
+				if !slices.Equal(names, want) {
+					t.Errorf("named events = %q, want %q", names, want)
+				}
+				if partial != nil && *partial != tt.wantPartial {
+					t.Errorf("partial = %v, want %v", *partial, tt.wantPartial)
+				}
+			})
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		const toolCallsOnly = `{"choices":[{"index":0,"message":{"role":"assistant","content":"","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`
+
+		completion := func(content, finishReason string) string {
+			return `{"choices":[{"index":0,"message":{"role":"assistant","content":` + strconv.Quote(content) + `},"finish_reason":"` + finishReason + `"}]}`
+		}
+
+		tests := []struct {
+			name         string
+			mode         ContentFilterMode
+			format       copilot.ResponseFormatType
+			completion   string
+			wantStatus   int
+			wantFiltered bool
+		}{
+			{name: "filtered", completion: completion("", "content_filter"), wantStatus: http.StatusOK, wantFiltered: true},
+			{name: "filtered partway", completion: completion("Hello", "content_filter"), wantStatus: http.StatusOK, wantFiltered: true},
+			{name: "filtered partway through JSON", format: copilot.ResponseFormatJSONObject, completion: completion(`{"answer": "Hel`, "content_filter"), wantStatus: http.StatusOK, wantFiltered: true},
+			{name: "not filtered", completion: completion("Hello", "stop"), wantStatus: http.StatusOK},
+			{name: "passed through", mode: ContentFilterPassThrough, completion: completion("", "content_filter"), wantStatus: http.StatusNoContent},
+			{name: "passed through partway", mode: ContentFilterPassThrough, completion: completion("Hello", "content_filter"), wantStatus: http.StatusOK},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s := &Service{contentFilterMode: tt.mode, responseFormat: tt.format}
+				w := httptest.NewRecorder()
+				if err := s.writeCompletion(strings.NewReader(tt.completion), w, nil); err != nil {
+					t.Fatal(err)
+				}
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+				}
+				if w.Code == http.StatusNoContent {
+					return
+				}
+
+				var resp struct {
+					ContentFiltered bool `json:"content_filtered"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.ContentFiltered != tt.wantFiltered {
+					t.Errorf("content_filtered = %v, want %v", resp.ContentFiltered, tt.wantFiltered)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"math"
+	"unicode/utf8"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// charsPerToken is the rough average number of characters per token for
+// English text with the GPT tokenizers
+const charsPerToken = 4
+
+// approximateTokens estimates the number of tokens in s without running a
+// tokenizer
+func approximateTokens(s string) int {
+	return (len(s) + charsPerToken - 1) / charsPerToken
+}
+
+// truncateTokens cuts s down to approximately n tokens
+func truncateTokens(s string, n int) string {
+	end := n * charsPerToken
+	if end >= len(s) {
+		return s
+	}
+	if end <= 0 {
+		return ""
+	}
+
+	// Don't split a multi-byte character
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+// Tokenizer counts the tokens in text the way the model's tokenizer does, for
+// token budgets that must be exact
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// ApproximateTokenizer estimates the number of tokens from the length of the
+// text without running a tokenizer.  It is the default Tokenizer.
+type ApproximateTokenizer struct{}
+
+func (ApproximateTokenizer) CountTokens(text string) int {
+	return approximateTokens(text)
+}
+
+// WithTokenizer sets how tokens are counted for token budgets, context
+// windows and trimming documents
+func WithTokenizer(t Tokenizer) Option {
+	return func(s *Service) {
+		s.tokenizer = t
+	}
+}
+
+func (s *Service) countTokens(text string) int {
+	return s.tokenizer.CountTokens(text)
+}
+
+// keepHead cuts text down to its first n tokens
+func (s *Service) keepHead(text string, n int) string {
+	if _, ok := s.tokenizer.(ApproximateTokenizer); ok {
+		return truncateTokens(text, n)
+	}
+	return s.fitTokens(text, n, func(size int) string {
+		end := size
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		return text[:end]
+	})
+}
+
+// keepTail cuts text down to its last n tokens
+func (s *Service) keepTail(text string, n int) string {
+	if _, ok := s.tokenizer.(ApproximateTokenizer); ok {
+		return trimHead(text, n)
+	}
+	return s.fitTokens(text, n, func(size int) string {
+		start := len(text) - size
+		for start < len(text) && !utf8.RuneStart(text[start]) {
+			start++
+		}
+		return text[start:]
+	})
+}
+
+// fitTokens returns the largest piece of text that fits in n tokens.  piece
+// cuts a piece of up to size bytes out of text, never more than its length.
+// Pieces are searched for by bisection, since tokenizers can't be run
+// backwards.
+func (s *Service) fitTokens(text string, n int, piece func(size int) string) string {
+	if n <= 0 {
+		return ""
+	}
+	if s.countTokens(text) <= n {
+		return text
+	}
+
+	// A piece of size lo fits, one of size hi doesn't
+	lo, hi := 0, len(text)
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if s.countTokens(piece(mid)) <= n {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return piece(lo)
+}
+
+// tokenBudget tracks the tokens spent on behalf of a single request.  A limit
+// of zero means the budget is unlimited.
+type tokenBudget struct {
+	limit int
+	used  int
+}
+
+func (b *tokenBudget) spend(n int) {
+	b.used += n
+}
+
+func (b *tokenBudget) remaining() int {
+	if b.limit <= 0 {
+		return math.MaxInt
+	}
+	return b.limit - b.used
+}
+
+func (b *tokenBudget) exceeded() bool {
+	return b.limit > 0 && b.used > b.limit
+}
+
+// defaultContextWindows are the context windows, in tokens, of the models the
+// agent knows about
+var defaultContextWindows = map[copilot.Model]int{
+	copilot.ModelGPT4o: 128_000,
+	copilot.ModelGPT41: 1_047_576,
+}
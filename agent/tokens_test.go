@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+func TestMaxTokensPerRequest(t *testing.T) {
+	const doc = "# Billing\n\nInvoices are sent on the first of every month.\n\nAn invoice can be paid by card or by bank transfer.\n\nLate invoices incur a fee."
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+
+	tests := []struct {
+		name        string
+		limit       int
+		wantStatus  int
+		wantContext string
+		wantTrimmed bool
+	}{
+		{name: "unlimited", wantStatus: http.StatusOK, wantContext: "Late invoices incur a fee."},
+		{name: "room for everything", limit: 1000, wantStatus: http.StatusOK, wantContext: "Late invoices incur a fee."},
+		{name: "context trimmed to fit", limit: 60, wantStatus: http.StatusOK, wantContext: "Invoices are sent", wantTrimmed: true},
+		{name: "no room for the request", limit: 20, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"On the first."}}
+			stubCopilot(t, fake)
+			opts := []Option{WithSystemPrompt("Answer from the context."), WithMaxCompletionTokens(10)}
+			if tt.limit > 0 {
+				opts = append(opts, WithMaxTokensPerRequest(tt.limit))
+			}
+			s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice"}, opts...)
+
+			w := doChat(t, s, body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if n := fake.calls(); n != 0 {
+					t.Errorf("the model was called %d times for a rejected request", n)
+				}
+				return
+			}
+
+			if n := fake.calls(); n != 1 {
+				t.Fatalf("the model was called %d times, want once", n)
+			}
+			req := fake.requests[0]
+
+			var prompt strings.Builder
+			tokens := req.MaxTokens
+			for _, msg := range req.Messages {
+				prompt.WriteString(msg.Content)
+				tokens += s.countTokens(msg.Content)
+			}
+			if !strings.Contains(prompt.String(), tt.wantContext) {
+				t.Errorf("prompt is missing %q:\n%s", tt.wantContext, prompt.String())
+			}
+			if trimmed := !strings.Contains(prompt.String(), "Late invoices incur a fee."); trimmed != tt.wantTrimmed {
+				t.Errorf("trimmed = %v, want %v:\n%s", trimmed, tt.wantTrimmed, prompt.String())
+			}
+			if tt.limit > 0 && tokens > tt.limit {
+				t.Errorf("the prompt and completion take %d tokens, over the limit of %d", tokens, tt.limit)
+			}
+		})
+	}
+}
+
+func TestMaxTokensPerRequestNeedsCompletionCap(t *testing.T) {
+	if _, err := NewService(nil, WithMaxTokensPerRequest(100)); err == nil {
+		t.Error("a token limit without a completion cap was accepted")
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	const prompt = "Answer from the context."
+	message := func(words int) string {
+		return `{"messages":[{"role":"user","content":"` + strings.Repeat("invoice ", words) + `"}],"stream":false}`
+	}
+
+	tests := []struct {
+		name       string
+		window     int
+		body       string
+		wantStatus int
+	}{
+		{name: "fits", window: 1000, body: message(10), wantStatus: http.StatusOK},
+		{name: "oversized message", window: 100, body: message(200), wantStatus: http.StatusUnprocessableEntity},
+		{name: "no room for the completion", window: 20, body: message(5), wantStatus: http.StatusUnprocessableEntity},
+		{name: "window of another model", body: message(200), wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			opts := []Option{WithSystemPrompt(prompt), WithMaxCompletionTokens(10)}
+			if tt.window > 0 {
+				opts = append(opts, WithContextWindow(copilot.ModelGPT4o, tt.window))
+			} else {
+				opts = append(opts, WithContextWindow(copilot.ModelGPT35, 10))
+			}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"}, opts...)
+
+			w := doChat(t, s, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			if n := fake.calls(); n != 0 {
+				t.Errorf("the model was called %d times for a rejected request", n)
+			}
+			if !strings.Contains(w.Body.String(), "context window of gpt-4o") {
+				t.Errorf("body = %q, want an explanation", w.Body)
+			}
+		})
+	}
+}
+
+// wordTokenizer counts every word as one token
+type wordTokenizer struct{}
+
+func (wordTokenizer) CountTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+func TestTokenizer(t *testing.T) {
+	long := strings.Repeat("supercalifragilistic ", 40)
+	body := `{"messages":[{"role":"user","content":"` + long + `"}],"stream":false}`
+
+	tests := []struct {
+		name       string
+		tokenizer  Tokenizer
+		wantStatus int
+	}{
+		{name: "approximate", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "exact", tokenizer: wordTokenizer{}, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCopilot(t, &fakeCopilot{content: []string{"Monthly."}})
+			opts := []Option{WithMaxTokensPerRequest(100), WithMaxCompletionTokens(10)}
+			if tt.tokenizer != nil {
+				opts = append(opts, WithTokenizer(tt.tokenizer))
+			}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, []string{"invoice"}, opts...)
+
+			// 40 words are 40 tokens to one tokenizer, and over 200 to the
+			// other
+			if w := doChat(t, s, body); w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestTokenizerTrimming(t *testing.T) {
+	const text = "one two three four five"
+	s := &Service{tokenizer: wordTokenizer{}}
+
+	tests := []struct {
+		name string
+		trim func(string, int) string
+		n    int
+		want string
+	}{
+		{name: "head", trim: s.keepHead, n: 2, want: "one two"},
+		{name: "tail", trim: s.keepTail, n: 2, want: "four five"},
+		{name: "all of it", trim: s.keepHead, n: 5, want: text},
+		{name: "nothing", trim: s.keepTail, n: 0, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.trim(text, tt.n)
+			if strings.TrimSpace(got) != tt.want {
+				t.Errorf("kept %q, want %q", got, tt.want)
+			}
+			if n := s.countTokens(got); n > tt.n {
+				t.Errorf("kept %d tokens, want at most %d", n, tt.n)
+			}
+		})
+	}
+}
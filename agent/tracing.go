@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// Tracer starts spans for the stages of answering a request, so that they
+// show up in distributed traces.  Its shape follows OpenTelemetry, so that an
+// OpenTelemetry tracer takes little more than a thin adapter.  Spans started
+// with the context Start returns are children of the span it started.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute describes a span, e.g. the model used or the number of sources
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// WithTracer traces every completion with tracer: the request as a whole,
+// each embedding call, the retrieval and scoring of the documents, the
+// assembly of the context and the completion itself.  Nothing is traced by
+// default.
+func WithTracer(tracer Tracer) Option {
+	return func(s *Service) {
+		s.tracer = tracer
+	}
+}
+
+// noopTracer is the Tracer used unless one is configured
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// tracedEmbedder traces the calls to an Embedder
+type tracedEmbedder struct {
+	embedder embedding.Embedder
+	tracer   Tracer
+}
+
+func (e tracedEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	ctx, span := e.tracer.Start(ctx, "rag.embedding")
+	defer span.End()
+	span.SetAttributes(
+		Attribute{Key: "rag.embedding.model", Value: e.EmbeddingModel()},
+		Attribute{Key: "rag.embedding.inputs", Value: len(inputs)},
+	)
+
+	embeddings, err := e.embedder.Embed(ctx, inputs)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return embeddings, err
+}
+
+func (e tracedEmbedder) EmbeddingModel() string {
+	if m, ok := e.embedder.(embedding.ModelEmbedder); ok {
+		return m.EmbeddingModel()
+	}
+	return ""
+}
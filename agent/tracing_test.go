@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// spanRecorder is a Tracer that keeps the spans it starts in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+
+	mu    sync.Mutex
+	attrs map[string]any
+	errs  []error
+	ended bool
+}
+
+type spanKey struct{}
+
+func (r *spanRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attrs: map[string]any{}}
+
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordedSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+// reset forgets the spans recorded so far
+func (r *spanRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}
+
+// find returns the first span named name
+func (r *spanRecorder) find(name string) *recordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, span := range r.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	const body = `{"messages":[{"role":"user","content":"When is an invoice sent?"}],"stream":false}`
+
+	tests := []struct {
+		name       string
+		respond    func(req *copilot.ChatCompletionsRequest) *http.Response
+		queryDown  bool
+		wantStatus int
+		// wantParents maps every span expected to the span it is a child of
+		wantParents map[string]string
+		wantErrors  []string
+	}{
+		{
+			name:       "answered",
+			wantStatus: http.StatusOK,
+			wantParents: map[string]string{
+				"rag.generate_completion": "",
+				"rag.retrieval":           "rag.generate_completion",
+				"rag.embedding":           "rag.retrieval",
+				"rag.assembly":            "rag.generate_completion",
+				"rag.completion":          "rag.generate_completion",
+			},
+		},
+		{
+			name: "completion failed",
+			respond: func(*copilot.ChatCompletionsRequest) *http.Response {
+				return fakeResponse(http.StatusBadRequest, "application/json", `{"error":"bad request"}`)
+			},
+			wantStatus: http.StatusBadRequest,
+			wantParents: map[string]string{
+				"rag.generate_completion": "",
+				"rag.retrieval":           "rag.generate_completion",
+				"rag.embedding":           "rag.retrieval",
+				"rag.assembly":            "rag.generate_completion",
+				"rag.completion":          "rag.generate_completion",
+			},
+			wantErrors: []string{"rag.generate_completion"},
+		},
+		{
+			name:       "embedding failed",
+			queryDown:  true,
+			wantStatus: http.StatusInternalServerError,
+			wantParents: map[string]string{
+				"rag.generate_completion": "",
+				"rag.retrieval":           "rag.generate_completion",
+				"rag.embedding":           "rag.retrieval",
+			},
+			wantErrors: []string{"rag.embedding", "rag.generate_completion", "rag.retrieval"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}, respond: tt.respond}
+			stubCopilot(t, fake)
+			embedder := &outageEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			recorder := &spanRecorder{}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil,
+				WithEmbedder(embedder), WithTracer(recorder))
+
+			// Only the request is traced, not loading the documents
+			if err := s.WarmDatasets(embedding.WithCredentials(context.Background(), "integration", "token")); err != nil {
+				t.Fatal(err)
+			}
+			recorder.reset()
+			embedder.down.Store(tt.queryDown)
+
+			w := doChat(t, s, body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			var names, errored []string
+			for _, span := range recorder.spans {
+				names = append(names, span.name)
+				if len(span.errs) > 0 {
+					errored = append(errored, span.name)
+				}
+				if !span.ended {
+					t.Errorf("span %s wasn't ended", span.name)
+				}
+
+				want, ok := tt.wantParents[span.name]
+				if !ok {
+					t.Errorf("unexpected span %s", span.name)
+					continue
+				}
+				var parent string
+				if span.parent != nil {
+					parent = span.parent.name
+				}
+				if parent != want {
+					t.Errorf("span %s is a child of %q, want %q", span.name, parent, want)
+				}
+			}
+			for name := range tt.wantParents {
+				if !slices.Contains(names, name) {
+					t.Errorf("no %s span", name)
+				}
+			}
+			slices.Sort(errored)
+			if !slices.Equal(errored, tt.wantErrors) {
+				t.Errorf("spans with errors = %q, want %q", errored, tt.wantErrors)
+			}
+
+			if span := recorder.find("rag.generate_completion"); span != nil {
+				if got := span.attrs["rag.model"]; got != copilot.ModelGPT4o {
+					t.Errorf("rag.model = %v, want %s", got, copilot.ModelGPT4o)
+				}
+				if got := span.attrs["rag.integration_id"]; got != "integration" {
+					t.Errorf("rag.integration_id = %v, want integration", got)
+				}
+			}
+			if span := recorder.find("rag.embedding"); span != nil {
+				if got := span.attrs["rag.embedding.inputs"]; got != 1 {
+					t.Errorf("rag.embedding.inputs = %v, want 1", got)
+				}
+			}
+			if span := recorder.find("rag.assembly"); span != nil {
+				if got := span.attrs["rag.sources"]; got != 1 {
+					t.Errorf("rag.sources = %v, want 1", got)
+				}
+				if got, _ := span.attrs["rag.context_tokens"].(int); got <= 0 {
+					t.Errorf("rag.context_tokens = %v, want some", span.attrs["rag.context_tokens"])
+				}
+			}
+			if span := recorder.find("rag.completion"); span != nil {
+				if got := span.attrs["rag.streaming"]; got != false {
+					t.Errorf("rag.streaming = %v, want false", got)
+				}
+			}
+		})
+	}
+}
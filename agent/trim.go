@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// trimMarker stands in for the text cut out of the middle of a document
+const trimMarker = "\n...\n"
+
+// chunkScorer scores paragraphs of a document by their relevance to the query
+// the document was retrieved for, higher is more relevant
+type chunkScorer func(chunks []string) ([]float32, error)
+
+// relevanceScorer returns a chunkScorer that scores paragraphs by the
+// similarity of their embeddings to emb, the embedding the datasets were
+// retrieved with, using the retrieval metric.  The Copilot API is called with
+// the credentials attached to ctx.
+func (s *Service) relevanceScorer(ctx context.Context, emb []float32) chunkScorer {
+	return func(chunks []string) ([]float32, error) {
+		return s.retriever.ScoreChunks(ctx, emb, chunks)
+	}
+}
+
+// trim cuts the document down to approximately n tokens according to the
+// configured trim strategy.  score ranks its paragraphs for TrimTopChunks.
+func (s *Service) trim(doc string, score chunkScorer, n int) string {
+	switch s.trimStrategy {
+	case TrimTail:
+		return s.keepHead(doc, n)
+	case TrimHead:
+		return s.keepTail(doc, n)
+	case TrimMiddle:
+		return s.trimMiddle(doc, n)
+	default:
+		return s.trimTopChunks(doc, score, n, 0)
+	}
+}
+
+// trimHead keeps approximately the last n tokens of s
+func trimHead(s string, n int) string {
+	start := len(s) - n*charsPerToken
+	if start <= 0 {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+
+	// Don't split a multi-byte character
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
+
+// trimMiddle keeps the beginning and the end of text, cutting the middle out so
+// that it fits in n tokens
+func (s *Service) trimMiddle(text string, n int) string {
+	if s.countTokens(text) <= n {
+		return text
+	}
+
+	half := (n - s.countTokens(trimMarker)) / 2
+	if half <= 0 {
+		return s.keepHead(text, n)
+	}
+	return s.keepHead(text, half) + trimMarker + s.keepTail(text, half)
+}
+
+// trimTopChunks keeps the paragraphs of doc that score highest, in their
+// original order, as long as they fit in n tokens.  At most maxChunks
+// paragraphs are kept, unless it is zero.  Later paragraphs get the boost of
+// the recency bias, if any.  If the paragraphs can't be scored, the beginning
+// of doc is kept instead.
+func (s *Service) trimTopChunks(doc string, score chunkScorer, n, maxChunks int) string {
+	chunks := strings.Split(doc, "\n\n")
+
+	scores, err := score(chunks)
+	if err != nil {
+		fmt.Printf("warning: failed to score paragraphs, keeping the beginning of the document: %v\n", err)
+		if maxChunks > 0 && len(chunks) > maxChunks {
+			doc = strings.Join(chunks[:maxChunks], "\n\n")
+		}
+		return s.keepHead(doc, n)
+	}
+	if len(chunks) > 1 {
+		for i := range scores {
+			scores[i] += float32(s.recencyBias * float64(i) / float64(len(chunks)-1))
+		}
+	}
+
+	// Best chunks first, earlier chunks first among equals
+	order := make([]int, len(chunks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	keep := make([]bool, len(chunks))
+	var kept, used int
+	for _, i := range order {
+		if maxChunks > 0 && kept >= maxChunks {
+			break
+		}
+		cost := s.countTokens(chunks[i] + "\n\n")
+		if used+cost > n {
+			// Rather than nothing at all, give part of the best chunk
+			if kept == 0 {
+				chunks[i] = s.keepHead(chunks[i], n)
+				keep[i] = true
+				kept++
+				break
+			}
+			continue
+		}
+		keep[i] = true
+		kept++
+		used += cost
+	}
+
+	var trimmed []string
+	for i, chunk := range chunks {
+		if keep[i] {
+			trimmed = append(trimmed, chunk)
+		}
+	}
+	return strings.Join(trimmed, "\n\n")
+}
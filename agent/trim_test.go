@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// queryScorer scores paragraphs against query with the embeddings of s, the
+// way the paragraphs of documents retrieved for a chat request are scored
+func queryScorer(t *testing.T, s *Service, query string) chunkScorer {
+	t.Helper()
+	ctx := embedding.WithCredentials(context.Background(), "integration", "token")
+	emb, err := s.retriever.EmbedQuery(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.relevanceScorer(ctx, emb)
+}
+
+func TestTrim(t *testing.T) {
+	const doc = "alpha intro paragraph\n\nbilling invoices paragraph\n\ndeploy pipeline paragraph"
+	words := []string{"alpha", "billing", "invoice", "deploy", "pipeline"}
+
+	tests := []struct {
+		name        string
+		strategy    TrimStrategy
+		query       string
+		unavailable bool
+		tokens      int
+		want        string
+	}{
+		{
+			// The query has no word in common with the paragraph, "invoice"
+			// isn't "invoices", but their embeddings are alike
+			name:     "top chunks keeps the most similar paragraph",
+			strategy: TrimTopChunks,
+			query:    "When is an invoice sent?",
+			tokens:   8,
+			want:     "billing invoices paragraph",
+		},
+		{
+			name:     "top chunks keeps the original order",
+			strategy: TrimTopChunks,
+			query:    "deploy alpha",
+			tokens:   14,
+			want:     "alpha intro paragraph\n\ndeploy pipeline paragraph",
+		},
+		{
+			name:     "top chunks gives part of the best paragraph rather than nothing",
+			strategy: TrimTopChunks,
+			query:    "pipeline",
+			tokens:   3,
+			want:     "deploy pipel",
+		},
+		{
+			name:        "top chunks keeps the beginning when paragraphs can't be scored",
+			strategy:    TrimTopChunks,
+			query:       "When is an invoice sent?",
+			unavailable: true,
+			tokens:      5,
+			want:        "alpha intro paragrap",
+		},
+		{
+			name:     "tail",
+			strategy: TrimTail,
+			tokens:   5,
+			want:     "alpha intro paragrap",
+		},
+		{
+			name:     "head",
+			strategy: TrimHead,
+			tokens:   5,
+			want:     "y pipeline paragraph",
+		},
+		{
+			name:     "middle",
+			strategy: TrimMiddle,
+			tokens:   10,
+			want:     "alpha intro para" + trimMarker + "peline paragraph",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, nil, words, WithTrimStrategy(tt.strategy))
+			score := queryScorer(t, s, tt.query)
+			if tt.unavailable {
+				score = func([]string) ([]float32, error) { return nil, errors.New("embeddings unavailable") }
+			}
+
+			got := s.trim(doc, score, tt.tokens)
+			if got != tt.want {
+				t.Errorf("trim = %q, want %q", got, tt.want)
+			}
+			if n := s.countTokens(got); n > tt.tokens {
+				t.Errorf("trimmed to %d tokens, want at most %d", n, tt.tokens)
+			}
+		})
+	}
+}
+
+func TestTrimKeepsWhatFits(t *testing.T) {
+	const doc = "alpha intro paragraph\n\nbilling invoices paragraph"
+
+	for _, strategy := range []TrimStrategy{TrimTopChunks, TrimTail, TrimHead, TrimMiddle} {
+		s := newTestService(t, nil, []string{"billing"}, WithTrimStrategy(strategy))
+		if got := s.trim(doc, queryScorer(t, s, "billing"), 100); got != doc {
+			t.Errorf("strategy %d trimmed a fitting document to %q", strategy, got)
+		}
+	}
+}
+
+func TestRecencyBias(t *testing.T) {
+	// Both entries are equally similar to the query
+	const changelog = "release notes for version one\n\nrelease notes for version two"
+
+	tests := []struct {
+		name      string
+		bias      float64
+		maxChunks int
+		tokens    int
+		want      string
+	}{
+		{
+			name:   "no bias keeps the earlier of equals",
+			tokens: 9,
+			want:   "release notes for version one",
+		},
+		{
+			name:   "bias favors the later of equals",
+			bias:   0.5,
+			tokens: 9,
+			want:   "release notes for version two",
+		},
+		{
+			name:      "no bias with a paragraph cap",
+			maxChunks: 1,
+			tokens:    100,
+			want:      "release notes for version one",
+		},
+		{
+			name:      "bias with a paragraph cap",
+			bias:      0.5,
+			maxChunks: 1,
+			tokens:    100,
+			want:      "release notes for version two",
+		},
+		{
+			name:      "both fit",
+			bias:      0.5,
+			maxChunks: 2,
+			tokens:    100,
+			want:      changelog,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, nil, []string{"release", "notes"}, WithRecencyBias(tt.bias))
+
+			got := s.trimTopChunks(changelog, queryScorer(t, s, "release notes"), tt.tokens, tt.maxChunks)
+			if got != tt.want {
+				t.Errorf("trimTopChunks = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSmallRecencyBiasOnlyBreaksTies(t *testing.T) {
+	const doc = "release notes for version one\n\nversion two"
+
+	s := newTestService(t, nil, []string{"release", "notes"}, WithRecencyBias(0.05))
+	if got := s.trimTopChunks(doc, queryScorer(t, s, "release notes"), 9, 0); got != "release notes for version one" {
+		t.Errorf("trimTopChunks = %q, want the better match", got)
+	}
+}
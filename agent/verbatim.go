@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// verbatimInstructions tell the model to quote rather than paraphrase the
+// context in the verbatim assembly mode
+const verbatimInstructions = `Answer only by quoting the context word for word, enclosing every quote in
+double quotes.  Never paraphrase, summarize or reword the context, and never
+put anything in quotes that isn't in the context.  If the context doesn't
+answer the question, say so.
+`
+
+// minQuoteLength is the length below which quoted text is taken for emphasis
+// rather than a quote from the context
+const minQuoteLength = 20
+
+var quotePattern = regexp.MustCompile(`"([^"]+)"|“([^”]+)”`)
+
+// unverifiedQuotes returns the quotes in answer that aren't found word for
+// word in context.  Differences in whitespace are ignored.
+func unverifiedQuotes(answer, context string) (checked int, unverified []string) {
+	context = normalizeSpace(context)
+	for _, match := range quotePattern.FindAllStringSubmatch(answer, -1) {
+		quote := normalizeSpace(match[1] + match[2])
+		if len(quote) < minQuoteLength {
+			continue
+		}
+
+		checked++
+		if !strings.Contains(context, quote) {
+			unverified = append(unverified, quote)
+		}
+	}
+	return checked, unverified
+}
+
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
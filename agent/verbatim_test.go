@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnverifiedQuotes(t *testing.T) {
+	const context = "Invoices are sent on the first of every month.\nLate invoices incur a fee."
+
+	tests := []struct {
+		name           string
+		answer         string
+		wantChecked    int
+		wantUnverified []string
+	}{
+		{name: "no quotes", answer: "On the first."},
+		{name: "verbatim", answer: `"Invoices are sent on the first of every month."`, wantChecked: 1},
+		{name: "curly quotes", answer: `“Late invoices incur a fee.”`, wantChecked: 1},
+		{name: "whitespace differs", answer: "\"Invoices are sent on the first\n of every  month.\"", wantChecked: 1},
+		{name: "short quote", answer: `It's "monthly".`},
+		{
+			name:           "fabricated",
+			answer:         `"Invoices are sent on the first of every month." and "Late invoices are waived on request."`,
+			wantChecked:    2,
+			wantUnverified: []string{"Late invoices are waived on request."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked, unverified := unverifiedQuotes(tt.answer, context)
+			if checked != tt.wantChecked {
+				t.Errorf("checked %d quotes, want %d", checked, tt.wantChecked)
+			}
+			if !slices.Equal(unverified, tt.wantUnverified) {
+				t.Errorf("unverified = %q, want %q", unverified, tt.wantUnverified)
+			}
+		})
+	}
+}
+
+func TestVerbatimAssembly(t *testing.T) {
+	const doc = "Invoices are sent on the first of every month."
+	const answer = `"Invoices are sent on the first of every month." Also, "late invoices are always waived."`
+
+	tests := []struct {
+		name   string
+		stream bool
+	}{
+		{name: "stream", stream: true},
+		{name: "no stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{answer}}
+			stubCopilot(t, fake)
+			s := newTestService(t, map[string]string{"billing.md": doc}, []string{"invoice"},
+				WithContextAssembly(AssemblyVerbatim), WithQuoteValidation(true))
+
+			body, _ := json.Marshal(map[string]any{
+				"messages": []map[string]string{{"role": "user", "content": "When is an invoice sent?"}},
+				"stream":   tt.stream,
+			})
+			w := doChat(t, s, string(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var prompt strings.Builder
+			for _, msg := range fake.requests[0].Messages {
+				prompt.WriteString(msg.Content)
+			}
+			if !strings.Contains(prompt.String(), verbatimInstructions) || !strings.Contains(prompt.String(), doc) {
+				t.Errorf("prompt is missing the instructions or the context:\n%s", prompt.String())
+			}
+
+			if !tt.stream {
+				if got := w.Header().Get("X-RAG-Unverified-Quotes"); got != "1" {
+					t.Errorf("X-RAG-Unverified-Quotes = %q, want 1", got)
+				}
+				return
+			}
+
+			var meta completionMetadata
+			for _, event := range readEvents(t, w.Body) {
+				if event.Name == "metadata" {
+					if err := json.Unmarshal(event.Data, &meta); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if meta.QuotesChecked != 2 || !slices.Equal(meta.UnverifiedQuotes, []string{"late invoices are always waived."}) {
+				t.Errorf("metadata = %+v, want the fabricated quote flagged", meta)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// WarmupMode decides how requests are handled while the datasets are still
+// being generated in the background
+type WarmupMode int
+
+const (
+	// WarmupWait makes requests wait for the datasets, and start generating
+	// them if the background warmup hasn't started yet.  This is the default.
+	WarmupWait WarmupMode = iota
+
+	// WarmupReject answers requests with 503 Service Unavailable until the
+	// datasets are ready
+	WarmupReject
+)
+
+// backgroundWarmup holds the settings for generating the datasets when the
+// service starts
+type backgroundWarmup struct {
+	integrationID string
+	apiToken      string
+	jitter        time.Duration
+}
+
+// WarmDatasets generates the datasets ahead of the first request and waits for
+// them to be ready.  It never generates them twice, even if requests arrive
+// while it is running.
+func (s *Service) WarmDatasets(ctx context.Context) error {
+	return s.retriever.Warm(s.apiContext(ctx))
+}
+
+// warmInBackground generates the datasets after a random delay of up to the
+// configured jitter, so that replicas started together don't all call the
+// embeddings API at once.
+func (s *Service) warmInBackground() {
+	w := s.warmup
+	if w.jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(w.jitter))))
+	}
+
+	ctx := embedding.WithCredentials(context.Background(), w.integrationID, w.apiToken)
+	if err := s.WarmDatasets(ctx); err != nil {
+		fmt.Printf("failed to warm datasets: %v\n", err)
+		return
+	}
+	fmt.Println("datasets warmed")
+}
+
+// Validate checks that the datasets can be generated, so that a misconfigured
+// document source is found at startup rather than by the first request.  Only
+// one document is embedded.  Calls to the Copilot API use the credentials
+// attached to ctx with embedding.WithCredentials.
+func (s *Service) Validate(ctx context.Context) error {
+	if s.failOnEmptyDataDir {
+		if err := s.retriever.CheckDocuments(); err != nil {
+			return fmt.Errorf("invalid datasets: %w", err)
+		}
+	}
+
+	if err := s.retriever.Validate(s.apiContext(ctx)); err != nil {
+		return fmt.Errorf("invalid datasets: %w", err)
+	}
+	return nil
+}
+
+// PrewarmQueries embeds frequent queries ahead of traffic and caches their
+// embeddings, e.g. the questions of an FAQ, so that they are answered without
+// waiting for an embedding.  Each query is preprocessed like a user message
+// consisting of it.  Calls to the Copilot API use the credentials attached to
+// ctx with embedding.WithCredentials.
+func (s *Service) PrewarmQueries(ctx context.Context, queries []string) error {
+	preprocessed := make([]string, len(queries))
+	for i, query := range queries {
+		var err error
+		if preprocessed[i], err = s.preprocessQuery(query); err != nil {
+			return err
+		}
+	}
+
+	if err := s.retriever.PrewarmQueries(s.apiContext(ctx), preprocessed); err != nil {
+		return fmt.Errorf("failed to prewarm queries: %w", err)
+	}
+	fmt.Printf("prewarmed %d queries\n", len(queries))
+	return nil
+}
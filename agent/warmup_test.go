@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/embedding"
+)
+
+// gatedEmbedder embeds like a wordEmbedder, but holds back the documents
+// containing gate until release is closed, and counts them
+type gatedEmbedder struct {
+	wordEmbedder
+	gate    string
+	release chan struct{}
+	gated   atomic.Int32
+}
+
+func (e *gatedEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	for _, input := range inputs {
+		if strings.Contains(input, e.gate) {
+			e.gated.Add(1)
+			select {
+			case <-e.release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func TestBackgroundWarmup(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       WarmupMode
+		wantStatus int
+	}{
+		{name: "requests wait for the warmup", mode: WarmupWait, wantStatus: http.StatusOK},
+		{name: "requests are rejected during the warmup", mode: WarmupReject, wantStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			embedder := &gatedEmbedder{wordEmbedder: wordEmbedder{"invoice"}, gate: "monthly", release: make(chan struct{})}
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil,
+				WithEmbedder(embedder),
+				WithAdminToken("admin"),
+				WithBackgroundWarmup("integration", "token", 0, tt.mode),
+			)
+
+			// Wait for the background warmup to be embedding the document
+			for embedder.gated.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			const requests = 10
+			var wg sync.WaitGroup
+			statuses := make([]int, requests)
+			retryAfter := make([]string, requests)
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					w := doExplain(s, "invoice")
+					statuses[i] = w.Code
+					retryAfter[i] = w.Header().Get("Retry-After")
+				}(i)
+			}
+			time.AfterFunc(50*time.Millisecond, func() { close(embedder.release) })
+			wg.Wait()
+
+			for i, status := range statuses {
+				if status != tt.wantStatus {
+					t.Errorf("request %d: status = %d, want %d", i, status, tt.wantStatus)
+				}
+				if status == http.StatusServiceUnavailable && retryAfter[i] == "" {
+					t.Errorf("request %d: no Retry-After", i)
+				}
+			}
+
+			// Once warm, requests are answered either way
+			if err := s.WarmDatasets(embedding.WithCredentials(context.Background(), "integration", "token")); err != nil {
+				t.Fatal(err)
+			}
+			if w := doExplain(s, "invoice"); w.Code != http.StatusOK {
+				t.Errorf("status after the warmup = %d", w.Code)
+			}
+			if n := embedder.gated.Load(); n != 1 {
+				t.Errorf("the document was embedded %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+
+	tests := []struct {
+		name    string
+		docs    map[string]string
+		opts    []Option
+		down    bool
+		wantErr error
+		want    string
+	}{
+		{name: "valid", docs: docs},
+		{name: "missing directory", docs: docs, opts: []Option{WithDocumentSource(embedding.DirSource("does-not-exist"))}, want: "does-not-exist"},
+		{name: "empty directory", wantErr: embedding.ErrNoDocuments},
+		{
+			name: "document fails to preprocess",
+			docs: docs,
+			opts: []Option{WithDocumentPreprocessor(func(filename, content string) (string, error) {
+				if strings.HasSuffix(filename, "deploy.md") {
+					return "", errors.New("unterminated front matter")
+				}
+				return content, nil
+			})},
+			want: "unterminated front matter",
+		},
+		{name: "embeddings API down", docs: docs, down: true, want: "embeddings API is down"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			embedder := &outageEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			embedder.down.Store(tt.down)
+			recorder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			opts := append([]Option{WithEmbedder(recorder)}, tt.opts...)
+			if tt.down {
+				opts = append(opts, WithEmbedder(embedder))
+			}
+			s := newTestService(t, tt.docs, nil, opts...)
+
+			err := s.Validate(embedding.WithCredentials(context.Background(), "integration", "token"))
+			switch {
+			case tt.wantErr == nil && tt.want == "":
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				// Validating is cheaper than generating the datasets
+				if embedded := recorder.embedded(); len(embedded) != 1 {
+					t.Errorf("embedded %d documents, want 1", len(embedded))
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			default:
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrewarmQueries(t *testing.T) {
+	const query = "When is an invoice sent?"
+	lower := func(query string) (string, error) { return strings.ToLower(query), nil }
+
+	tests := []struct {
+		name         string
+		opts         []Option
+		prewarmed    []string
+		sent         string
+		wantEmbedded []string
+	}{
+		{name: "prewarmed", prewarmed: []string{query, "How do I deploy?"}, sent: query},
+		{name: "not prewarmed", prewarmed: []string{"How do I deploy?"}, sent: query, wantEmbedded: []string{query}},
+		// Queries are preprocessed the same way as the messages they stand for
+		{name: "preprocessed", opts: []Option{WithQueryPreprocessor(lower)}, prewarmed: []string{"When is an Invoice sent?"}, sent: "WHEN is an invoice sent?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCopilot{content: []string{"Monthly."}}
+			stubCopilot(t, fake)
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}
+			opts := append([]Option{WithEmbedder(embedder)}, tt.opts...)
+			s := newTestService(t, map[string]string{"billing.md": "Invoices are sent monthly."}, nil, opts...)
+
+			ctx := embedding.WithCredentials(context.Background(), "integration", "token")
+			if err := s.WarmDatasets(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PrewarmQueries(ctx, tt.prewarmed); err != nil {
+				t.Fatal(err)
+			}
+			before := len(embedder.embedded())
+
+			body := `{"messages":[{"role":"user","content":"` + tt.sent + `"}],"stream":false}`
+			if w := doChat(t, s, body); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			embedded := embedder.embedded()[before:]
+			if !slices.Equal(embedded, tt.wantEmbedded) {
+				t.Errorf("embedded %q at request time, want %q", embedded, tt.wantEmbedded)
+			}
+			// The cached embedding still retrieves the right document
+			if system := fake.requests[0].Messages[0].Content; !strings.Contains(system, "Invoices are sent monthly.") {
+				t.Errorf("context is missing billing.md:\n%s", system)
+			}
+		})
+	}
+}
@@ -2,7 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Info struct {
@@ -18,6 +22,42 @@ type Info struct {
 
 	// ClientSecret comes from your configured GitHub app
 	ClientSecret string
+
+	// ExtraHeaders are attached to every request sent to the Copilot API.  They
+	// are optional and configured as semicolon separated Name=Value pairs
+	// (e.g. X-Org-Id=1234;X-Team=docs)
+	ExtraHeaders http.Header
+
+	// WarmupToken is an optional token used to generate the datasets in the
+	// background at startup, rather than on the first request
+	WarmupToken string
+
+	// StartupCheck makes the application check that the datasets can be
+	// generated before it starts listening.  It requires WarmupToken.
+	StartupCheck bool
+
+	// SettingsFile is an optional JSON file of settings that can be reloaded
+	// while the application is running
+	SettingsFile string
+
+	// AdminToken authorizes requests to the admin endpoints, which are
+	// disabled without it.  Reloading the settings also requires SettingsFile.
+	AdminToken string
+
+	// DataDirs are the directories the documents are read from.  Several
+	// directories are separated like in PATH, and files in later directories
+	// override files of the same name in earlier ones.
+	DataDirs []string
+
+	// RefreshInterval is how often the datasets are refreshed in the
+	// background, e.g. 1h.  Refreshing is off if it is zero, and it requires
+	// WarmupToken.
+	RefreshInterval time.Duration
+
+	// DefaultIntegrationID is used for requests without a
+	// Copilot-Integration-Id header, and for the background warmup and
+	// refresh
+	DefaultIntegrationID string
 }
 
 const (
@@ -25,6 +65,14 @@ const (
 	clientIdEnv     = "CLIENT_ID"
 	clientSecretEnv = "CLIENT_SECRET"
 	fqdnEnv         = "FQDN"
+	extraHeadersEnv = "COPILOT_EXTRA_HEADERS"
+	warmupTokenEnv  = "WARMUP_TOKEN"
+	startupCheckEnv = "STARTUP_CHECK"
+	settingsFileEnv = "SETTINGS_FILE"
+	adminTokenEnv   = "ADMIN_TOKEN"
+	dataDirsEnv     = "DATA_DIRS"
+	refreshEnv      = "REFRESH_INTERVAL"
+	integrationEnv  = "DEFAULT_INTEGRATION_ID"
 )
 
 func New() (*Info, error) {
@@ -48,10 +96,61 @@ func New() (*Info, error) {
 		return nil, fmt.Errorf("%s environment variable required", clientSecretEnv)
 	}
 
+	extraHeaders, err := parseHeaders(os.Getenv(extraHeadersEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s environment variable: %w", extraHeadersEnv, err)
+	}
+
+	warmupToken := os.Getenv(warmupTokenEnv)
+	startupCheck := os.Getenv(startupCheckEnv) == "true"
+	if startupCheck && warmupToken == "" {
+		return nil, fmt.Errorf("%s environment variable required for %s", warmupTokenEnv, startupCheckEnv)
+	}
+
+	var refreshInterval time.Duration
+	if v := os.Getenv(refreshEnv); v != "" {
+		refreshInterval, err = time.ParseDuration(v)
+		if err != nil || refreshInterval <= 0 {
+			return nil, fmt.Errorf("invalid %s environment variable: %q is not a positive duration", refreshEnv, v)
+		}
+		if warmupToken == "" {
+			return nil, fmt.Errorf("%s environment variable required for %s", warmupTokenEnv, refreshEnv)
+		}
+	}
+
 	return &Info{
-		Port:         port,
-		FQDN:         fqdn,
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
+		Port:                 port,
+		FQDN:                 fqdn,
+		ClientID:             clientID,
+		ClientSecret:         clientSecret,
+		ExtraHeaders:         extraHeaders,
+		WarmupToken:          warmupToken,
+		StartupCheck:         startupCheck,
+		SettingsFile:         os.Getenv(settingsFileEnv),
+		AdminToken:           os.Getenv(adminTokenEnv),
+		DataDirs:             filepath.SplitList(os.Getenv(dataDirsEnv)),
+		RefreshInterval:      refreshInterval,
+		DefaultIntegrationID: os.Getenv(integrationEnv),
 	}, nil
 }
+
+// parseHeaders parses semicolon separated Name=Value pairs.  Values may hold
+// secrets, so they are left out of any error.
+func parseHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+	for i, pair := range strings.Split(s, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("header %d is not in the form Name=Value", i+1)
+		}
+
+		headers.Add(name, strings.TrimSpace(value))
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,109 @@
+package copilot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ContentPart is one part of the content of a message sent as an array of
+// parts, such as text and image references.  Parts other than text are passed
+// on to the model as they were received.
+type ContentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+
+	// raw is the part as it was received, so that fields this package doesn't
+	// know about survive
+	raw json.RawMessage
+}
+
+// ContentPartText is the type of text parts
+const ContentPartText = "text"
+
+func (p *ContentPart) UnmarshalJSON(data []byte) error {
+	type part ContentPart
+	if err := json.Unmarshal(data, (*part)(p)); err != nil {
+		return err
+	}
+	p.raw = bytes.Clone(data)
+	return nil
+}
+
+func (p ContentPart) MarshalJSON() ([]byte, error) {
+	if p.raw != nil {
+		return p.raw, nil
+	}
+	type part ContentPart
+	return json.Marshal(part(p))
+}
+
+// partsText joins the text of the text parts among parts
+func partsText(parts []ContentPart) string {
+	var texts []string
+	for _, part := range parts {
+		if part.Type == ContentPartText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// UnmarshalJSON accepts content both as a plain string and as an array of
+// parts
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	type message ChatMessage
+	aux := struct {
+		*message
+		Content json.RawMessage `json:"content"`
+	}{message: (*message)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Content = ""
+	m.Parts = nil
+	content := bytes.TrimSpace(aux.Content)
+	switch {
+	case len(content) == 0 || bytes.Equal(content, []byte("null")):
+	case content[0] == '"':
+		return json.Unmarshal(content, &m.Content)
+	case content[0] == '[':
+		if err := json.Unmarshal(content, &m.Parts); err != nil {
+			return fmt.Errorf("invalid message content parts: %w", err)
+		}
+		m.Content = partsText(m.Parts)
+	default:
+		return fmt.Errorf("message content must be a string or an array of parts")
+	}
+	return nil
+}
+
+// MarshalJSON sends the content as parts if it was received that way
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	type message ChatMessage
+	if m.Parts == nil {
+		return json.Marshal(message(m))
+	}
+	return json.Marshal(struct {
+		message
+		Content []ContentPart `json:"content"`
+	}{message: message(m), Content: m.Parts})
+}
+
+// MapText replaces the text of the message with the result of f, in Content
+// as well as in every text part
+func (m *ChatMessage) MapText(f func(string) string) {
+	m.Content = f(m.Content)
+	for i := range m.Parts {
+		part := &m.Parts[i]
+		if part.Type != ContentPartText {
+			continue
+		}
+		if text := f(part.Text); text != part.Text {
+			part.Text = text
+			part.raw = nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package copilot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestChatMessageContent(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		want      string
+		wantParts int
+		wantErr   bool
+	}{
+		{name: "string", message: `{"role":"user","content":"When is an invoice sent?"}`, want: "When is an invoice sent?"},
+		{name: "null", message: `{"role":"assistant","content":null}`},
+		{name: "missing", message: `{"role":"assistant"}`},
+		{name: "text parts", message: `{"role":"user","content":[{"type":"text","text":"When is"},{"type":"text","text":"an invoice sent?"}]}`, want: "When is\nan invoice sent?", wantParts: 2},
+		{name: "image part ignored", message: `{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/invoice.png"}},{"type":"text","text":"When is this sent?"}]}`, want: "When is this sent?", wantParts: 2},
+		{name: "no text parts", message: `{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/invoice.png"}}]}`, wantParts: 1},
+		{name: "empty parts", message: `{"role":"user","content":[]}`},
+		{name: "number", message: `{"role":"user","content":42}`, wantErr: true},
+		{name: "malformed parts", message: `{"role":"user","content":["text"]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg ChatMessage
+			err := json.Unmarshal([]byte(tt.message), &msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if msg.Content != tt.want {
+				t.Errorf("content = %q, want %q", msg.Content, tt.want)
+			}
+			if len(msg.Parts) != tt.wantParts {
+				t.Errorf("%d parts, want %d", len(msg.Parts), tt.wantParts)
+			}
+		})
+	}
+}
+
+func TestChatMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		mapText func(string) string
+		want    string
+	}{
+		{
+			name:    "string",
+			message: `{"role":"user","content":"When is an invoice sent?"}`,
+			want:    `{"role":"user","content":"When is an invoice sent?"}`,
+		},
+		{
+			// Fields of parts this package doesn't know survive
+			name:    "parts",
+			message: `{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/invoice.png","detail":"low"}},{"type":"text","text":"When is this sent?"}]}`,
+			want:    `{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/invoice.png","detail":"low"}},{"type":"text","text":"When is this sent?"}]}`,
+		},
+		{
+			name:    "mapped string",
+			message: `{"role":"user","content":"When is an invoice sent?"}`,
+			mapText: strings.ToUpper,
+			want:    `{"role":"user","content":"WHEN IS AN INVOICE SENT?"}`,
+		},
+		{
+			// Only text parts are mapped
+			name:    "mapped parts",
+			message: `{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/invoice.png"}},{"type":"text","text":"When is this sent?"}]}`,
+			mapText: strings.ToUpper,
+			want:    `{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/invoice.png"}},{"type":"text","text":"WHEN IS THIS SENT?"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg ChatMessage
+			if err := json.Unmarshal([]byte(tt.message), &msg); err != nil {
+				t.Fatal(err)
+			}
+			if tt.mapText != nil {
+				msg.MapText(tt.mapText)
+			}
+
+			b, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("message = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
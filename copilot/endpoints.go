@@ -6,35 +6,92 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 )
 
+type headersKey struct{}
+
+// WithHeaders returns a copy of ctx under which every request sent to the
+// Copilot API carries headers, e.g. for gateways that require additional
+// headers.  Header values may be sensitive and are never logged.
+func WithHeaders(ctx context.Context, headers http.Header) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+func setHeaders(ctx context.Context, req *http.Request, integrationID, token string) {
+	headers, _ := ctx.Value(headersKey{}).(http.Header)
+	for name, values := range headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	if integrationID != "" {
+		req.Header.Set("Copilot-Integration-Id", integrationID)
+	}
+}
+
+// APIError is returned when the Copilot API responds with an error status or
+// with content other than what was asked for
+type APIError struct {
+	StatusCode  int
+	ContentType string
+	Body        string
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	b, _ := io.ReadAll(resp.Body)
+	return &APIError{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        string(b),
+	}
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode != http.StatusOK {
+		return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected content type: %q", e.ContentType)
+}
+
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
+
 func ChatCompletions(ctx context.Context, integrationID, apiKey string, req *ChatCompletionsRequest) (io.ReadCloser, error) {
 	body, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.githubcopilot.com/chat/completions", bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Accept", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
-	if integrationID != "" {
-		httpReq.Header.Set("Copilot-Integration-Id", integrationID)
-	}
-
-	resp, err := (&http.Client{}).Do(httpReq)
+	resp, err := do(ctx, func() (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.githubcopilot.com/chat/completions", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		setHeaders(ctx, httpReq, integrationID, apiKey)
+		return httpReq, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		fmt.Println(string(b))
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+
+	// An error page or a JSON error body is not a stream, even if it comes
+	// with a 200 status
+	if req.Stream && !isEventStream(resp.Header.Get("Content-Type")) {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
 	}
 
 	return resp.Body, nil
@@ -46,24 +103,21 @@ func Embeddings(ctx context.Context, integrationID string, token string, req *Em
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.githubcopilot.com/embeddings", bytes.NewReader(body))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Accept", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+token)
-	if integrationID != "" {
-		httpReq.Header.Set("Copilot-Integration-Id", integrationID)
-	}
-
-	resp, err := (&http.Client{}).Do(httpReq)
+	resp, err := do(ctx, func() (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.githubcopilot.com/embeddings", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		setHeaders(ctx, httpReq, integrationID, token)
+		return httpReq, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		fmt.Println(string(b))
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, newAPIError(resp)
 	}
 
 	var embeddingsResponse *EmbeddingsResponse
@@ -74,3 +128,35 @@ func Embeddings(ctx context.Context, integrationID string, token string, req *Em
 
 	return embeddingsResponse, nil
 }
+
+// ListModels returns the models that can be used with apiToken
+func ListModels(ctx context.Context, apiToken string) ([]Model, error) {
+	resp, err := do(ctx, func() (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.githubcopilot.com/models", nil)
+		if err != nil {
+			return nil, err
+		}
+		setHeaders(ctx, httpReq, "", apiToken)
+		return httpReq, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
+	var modelsResponse ModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&modelsResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	models := make([]Model, len(modelsResponse.Data))
+	for i, data := range modelsResponse.Data {
+		models[i] = data.ID
+	}
+
+	return models, nil
+}
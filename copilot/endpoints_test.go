@@ -0,0 +1,284 @@
+package copilot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// stubTransport answers every request sent to the Copilot API with
+// roundTrip for the duration of the test
+func stubTransport(t *testing.T, roundTrip roundTripFunc) {
+	t.Helper()
+	prev := http.DefaultTransport
+	http.DefaultTransport = roundTrip
+	t.Cleanup(func() { http.DefaultTransport = prev })
+}
+
+func response(status int, contentType, body string) *http.Response {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestChatCompletionsRejectsNonEventStreams(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		stream      bool
+		wantErr     bool
+		wantStatus  int
+	}{
+		{
+			name:        "event stream",
+			status:      http.StatusOK,
+			contentType: "text/event-stream; charset=utf-8",
+			body:        "data: [DONE]\n\n",
+			stream:      true,
+		},
+		{
+			name:        "JSON error body as the stream",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"error":{"message":"bad credentials"}}`,
+			stream:      true,
+			wantErr:     true,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "HTML error page as the stream",
+			status:      http.StatusOK,
+			contentType: "text/html",
+			body:        "<html>Sign in</html>",
+			stream:      true,
+			wantErr:     true,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "error status",
+			status:      http.StatusUnauthorized,
+			contentType: "application/json",
+			body:        `{"error":"unauthorized"}`,
+			stream:      true,
+			wantErr:     true,
+			wantStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:        "JSON without streaming",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"choices":[]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubTransport(t, func(*http.Request) (*http.Response, error) {
+				return response(tt.status, tt.contentType, tt.body), nil
+			})
+
+			body, err := ChatCompletions(context.Background(), "integration", "token", &ChatCompletionsRequest{Stream: tt.stream})
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				body.Close()
+				return
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %v, want an *APIError", err)
+			}
+			if apiErr.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", apiErr.StatusCode, tt.wantStatus)
+			}
+			if apiErr.Body != tt.body {
+				t.Errorf("body = %q, want %q", apiErr.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestWithHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("X-Org-Id", "1234")
+	headers.Add("X-Team", "docs")
+	headers.Add("X-Team", "search")
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{
+			name: "chat completions",
+			call: func(ctx context.Context) error {
+				body, err := ChatCompletions(ctx, "integration", "token", &ChatCompletionsRequest{})
+				if err == nil {
+					body.Close()
+				}
+				return err
+			},
+		},
+		{
+			name: "embeddings",
+			call: func(ctx context.Context) error {
+				_, err := Embeddings(ctx, "integration", "token", &EmbeddingsRequest{})
+				return err
+			},
+		},
+		{
+			name: "models",
+			call: func(ctx context.Context) error {
+				_, err := ListModels(ctx, "token")
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			stubTransport(t, func(req *http.Request) (*http.Response, error) {
+				got = req.Header
+				return response(http.StatusOK, "application/json", `{"data":[]}`), nil
+			})
+
+			if err := tt.call(WithHeaders(context.Background(), headers)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v := got.Get("X-Org-Id"); v != "1234" {
+				t.Errorf("X-Org-Id = %q, want 1234", v)
+			}
+			if v := got.Values("X-Team"); len(v) != 2 || v[0] != "docs" || v[1] != "search" {
+				t.Errorf("X-Team = %q, want both values", v)
+			}
+			if v := got.Get("Authorization"); v != "Bearer token" {
+				t.Errorf("Authorization = %q, the extra headers must not replace it", v)
+			}
+		})
+	}
+
+	t.Run("without headers", func(t *testing.T) {
+		var got http.Header
+		stubTransport(t, func(req *http.Request) (*http.Response, error) {
+			got = req.Header
+			return response(http.StatusOK, "application/json", `{"data":[]}`), nil
+		})
+
+		if _, err := Embeddings(context.Background(), "integration", "token", &EmbeddingsRequest{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v := got.Get("X-Org-Id"); v != "" {
+			t.Errorf("X-Org-Id = %q, want none", v)
+		}
+	})
+}
+
+func TestListModels(t *testing.T) {
+	models := func() *http.Response {
+		return response(http.StatusOK, "application/json", `{"data":[{"id":"gpt-4o","name":"GPT 4o"},{"id":"gpt-4.1-2025-04-14"}]}`)
+	}
+
+	tests := []struct {
+		name string
+		// resps are served one per attempt
+		resps        []*http.Response
+		want         []Model
+		wantStatus   int
+		wantAttempts int
+	}{
+		{
+			name:         "models",
+			resps:        []*http.Response{models()},
+			want:         []Model{ModelGPT4o, ModelGPT41},
+			wantAttempts: 1,
+		},
+		{
+			name:         "no models",
+			resps:        []*http.Response{response(http.StatusOK, "application/json", `{"data":[]}`)},
+			want:         []Model{},
+			wantAttempts: 1,
+		},
+		{
+			name:         "null",
+			resps:        []*http.Response{response(http.StatusOK, "application/json", `null`)},
+			want:         []Model{},
+			wantAttempts: 1,
+		},
+		{
+			name:         "unauthorized",
+			resps:        []*http.Response{response(http.StatusUnauthorized, "application/json", `{"error":"bad token"}`)},
+			wantStatus:   http.StatusUnauthorized,
+			wantAttempts: 1,
+		},
+		{
+			name:         "malformed",
+			resps:        []*http.Response{response(http.StatusOK, "text/html", "<html>")},
+			wantAttempts: 1,
+		},
+		{
+			name:         "retried",
+			resps:        []*http.Response{response(http.StatusServiceUnavailable, "text/plain", "busy"), models()},
+			want:         []Model{ModelGPT4o, ModelGPT41},
+			wantAttempts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			stubTransport(t, func(req *http.Request) (*http.Response, error) {
+				if req.Method != http.MethodGet || req.URL.Path != "/models" {
+					t.Errorf("request to %s %s", req.Method, req.URL)
+				}
+				if got := req.Header.Get("Authorization"); got != "Bearer token" {
+					t.Errorf("Authorization = %q", got)
+				}
+				attempts++
+				return tt.resps[min(attempts, len(tt.resps))-1], nil
+			})
+
+			ctx := WithRetryBudget(context.Background(), NewRetryBudget(10*time.Second))
+			models, err := ListModels(ctx, "token")
+			if attempts != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.want == nil {
+				var apiErr *APIError
+				switch {
+				case err == nil:
+					t.Errorf("models = %v, want an error", models)
+				case tt.wantStatus != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != tt.wantStatus):
+					t.Errorf("err = %v, want an APIError with status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(models, tt.want) {
+				t.Errorf("models = %v, want %v", models, tt.want)
+			}
+		})
+	}
+}
@@ -2,11 +2,72 @@ package copilot
 
 type ChatRequest struct {
 	Messages []ChatMessage `json:"messages"`
+
+	// Stream is set to false by clients that want the completion as a single
+	// JSON response rather than a stream of server-sent events.  Completions
+	// are streamed when it is omitted.
+	Stream *bool `json:"stream,omitempty"`
+
+	// Stop holds sequences at which the model stops generating
+	Stop []string `json:"stop,omitempty"`
+
+	// RAG is set to false by clients that want a plain completion without any
+	// document context.  Retrieval is done when it is omitted.
+	RAG *bool `json:"rag,omitempty"`
+
+	// Progress is set by clients that want retrieval_started and
+	// retrieval_completed events streamed ahead of the completion, e.g. to show
+	// a "searching documents..." indicator
+	Progress bool `json:"progress,omitempty"`
+
+	// MinSimilarity overrides the similarity a document must reach to be
+	// used as context, for this request only
+	MinSimilarity *float32 `json:"min_similarity,omitempty"`
+
+	// IncludeDocuments and ExcludeDocuments restrict the documents used as
+	// context to those whose filenames match one of the include patterns, if
+	// there are any, and none of the exclude patterns.  Patterns use the
+	// syntax of filepath.Match.
+	IncludeDocuments []string `json:"include_documents,omitempty"`
+	ExcludeDocuments []string `json:"exclude_documents,omitempty"`
+
+	// CompareModels asks for the completion to be streamed from each of these
+	// models side by side.  It is only available in debug mode.
+	CompareModels []Model `json:"compare_models,omitempty"`
+
+	// RetrieveOnly asks for the documents that would be used as context, as
+	// JSON, instead of a completion
+	RetrieveOnly bool `json:"retrieve_only,omitempty"`
+
+	// Explain asks for an explanation of how the context was retrieved in the
+	// metadata event.  It is only available in debug mode.
+	Explain bool `json:"explain,omitempty"`
 }
 
 type ChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role string `json:"role"`
+
+	// Content is the text of the message.  If the message was sent as an
+	// array of parts, it is the text of the text parts, and Parts holds all of
+	// them.  See content.go.
+	Content string        `json:"content"`
+	Parts   []ContentPart `json:"-"`
+
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// ToolCall is a request from the model to call a function.  In streamed
+// completions the call is spread over several chunks sharing the same Index.
+type ToolCall struct {
+	Index    int              `json:"index"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
 }
 
 type Model string
@@ -20,9 +81,91 @@ const (
 )
 
 type ChatCompletionsRequest struct {
-	Messages []ChatMessage `json:"messages"`
-	Model    Model         `json:"model"`
-	Stream   bool          `json:"stream"`
+	Messages  []ChatMessage `json:"messages"`
+	Model     Model         `json:"model"`
+	Stream    bool          `json:"stream"`
+	MaxTokens int           `json:"max_tokens,omitempty"`
+	Stop      []string      `json:"stop,omitempty"`
+
+	// Temperature is a pointer so that a temperature of 0 can be told apart
+	// from the model's default
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat constrains the kind of output the model produces
+type ResponseFormat struct {
+	Type ResponseFormatType `json:"type"`
+}
+
+type ResponseFormatType string
+
+const (
+	ResponseFormatText       ResponseFormatType = "text"
+	ResponseFormatJSONObject ResponseFormatType = "json_object"
+)
+
+// ChatCompletionsResponse is either a complete, non-streamed completion or a
+// single chunk of a streamed one.  Streamed chunks carry their content in
+// Delta while complete responses carry it in Message.
+type ChatCompletionsResponse struct {
+	ID      string                  `json:"id"`
+	Choices []ChatCompletionsChoice `json:"choices"`
+}
+
+type ChatCompletionsChoice struct {
+	Index        int          `json:"index"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatMessage `json:"delta,omitempty"`
+	FinishReason string       `json:"finish_reason,omitempty"`
+}
+
+// Payload returns what the choice carries, whatever its shape.  Some
+// streams send full messages rather than deltas, and some send both with the
+// same content, in which case the delta wins.  It is nil if there is neither.
+func (c *ChatCompletionsChoice) Payload() *ChatMessage {
+	if c.Delta != nil {
+		return c.Delta
+	}
+	return c.Message
+}
+
+// FinishReasonContentFilter is the finish reason of a choice whose content
+// was withheld or cut short by the content filter
+const FinishReasonContentFilter = "content_filter"
+
+// ContentFiltered reports whether the content filter stopped any of the
+// choices in the response
+func (r *ChatCompletionsResponse) ContentFiltered() bool {
+	for _, choice := range r.Choices {
+		if choice.FinishReason == FinishReasonContentFilter {
+			return true
+		}
+	}
+	return false
+}
+
+// Content returns the text content of all choices in the response
+func (r *ChatCompletionsResponse) Content() string {
+	var content string
+	for _, choice := range r.Choices {
+		if payload := choice.Payload(); payload != nil {
+			content += payload.Content
+		}
+	}
+	return content
+}
+
+// Empty reports whether none of the choices in the response carry content or
+// tool calls
+func (r *ChatCompletionsResponse) Empty() bool {
+	for _, choice := range r.Choices {
+		if payload := choice.Payload(); payload != nil && (payload.Content != "" || len(payload.ToolCalls) > 0) {
+			return false
+		}
+	}
+	return true
 }
 
 type EmbeddingsRequest struct {
@@ -44,3 +187,11 @@ type EmbeddingsResponseUsage struct {
 	PromptTokens int `json:"prompt_tokens"`
 	TotalTokens  int `json:"total_tokens"`
 }
+
+type ModelsResponse struct {
+	Data []*ModelsResponseData `json:"data"`
+}
+
+type ModelsResponseData struct {
+	ID Model `json:"id"`
+}
@@ -0,0 +1,37 @@
+package copilot
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChatCompletionsResponseContent(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunk     string
+		want      string
+		wantEmpty bool
+	}{
+		{name: "delta", chunk: `{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`, want: "Hello"},
+		{name: "message", chunk: `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"}}]}`, want: "Hello"},
+		{name: "both", chunk: `{"choices":[{"index":0,"delta":{"content":"Hello"},"message":{"content":"Hello"}}]}`, want: "Hello"},
+		{name: "neither", chunk: `{"choices":[{"index":0,"finish_reason":"stop"}]}`, want: "", wantEmpty: true},
+		{name: "mixed choices", chunk: `{"choices":[{"index":0,"delta":{"content":"Hello"}},{"index":1,"message":{"content":" world"}}]}`, want: "Hello world"},
+		{name: "tool calls", chunk: `{"choices":[{"index":0,"message":{"role":"assistant","tool_calls":[{"index":0,"function":{"name":"lookup"}}]}}]}`, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ChatCompletionsResponse
+			if err := json.Unmarshal([]byte(tt.chunk), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Content(); got != tt.want {
+				t.Errorf("Content() = %q, want %q", got, tt.want)
+			}
+			if got := resp.Empty(); got != tt.wantEmpty {
+				t.Errorf("Empty() = %v, want %v", got, tt.wantEmpty)
+			}
+		})
+	}
+}
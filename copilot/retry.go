@@ -0,0 +1,153 @@
+package copilot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryBackoff is how long to wait before the first retry.  The wait doubles
+// with every retry after that, unless the response says how long to wait.
+const retryBackoff = 100 * time.Millisecond
+
+// RetryBudget bounds the time spent on failed calls to the Copilot API, and
+// waiting to retry them, on behalf of a single request.  It is shared by every
+// call made with the context it is attached to, so the calls can't compound
+// each other's retries.  Once it is spent, failures are returned right away.
+type RetryBudget struct {
+	mu        sync.Mutex
+	remaining time.Duration
+}
+
+// NewRetryBudget returns a RetryBudget of d
+func NewRetryBudget(d time.Duration) *RetryBudget {
+	return &RetryBudget{remaining: d}
+}
+
+// Remaining returns what is left of the budget
+func (b *RetryBudget) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remaining
+}
+
+// spend charges the time lost to a failed call, along with the wait before the
+// next attempt, to the budget.  It reports whether there was enough left to
+// retry.
+func (b *RetryBudget) spend(failed, wait time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remaining -= failed
+	if b.remaining < wait {
+		b.remaining = max(b.remaining, 0)
+		return false
+	}
+	b.remaining -= wait
+	return true
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a copy of ctx under which calls to the Copilot API
+// that fail with a transient error are retried for as long as b allows.
+// Without a budget, calls are never retried.
+func WithRetryBudget(ctx context.Context, b *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, b)
+}
+
+// do sends the request made by newRequest, retrying transient failures within
+// the retry budget of ctx.  A fresh request is made for every attempt, since a
+// request body can only be read once.  A Retry-After header decides the wait
+// before the next attempt, and without one the wait backs off exponentially.
+func do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	budget, _ := ctx.Value(retryBudgetKey{}).(*RetryBudget)
+
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		start := time.Now()
+		resp, err := (&http.Client{}).Do(req)
+		if !retryable(ctx, resp, err) || budget == nil {
+			return resp, err
+		}
+
+		var wait time.Duration
+		if resp != nil {
+			wait = retryAfter(resp)
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		if !budget.spend(time.Since(start), wait) {
+			fmt.Printf("retry budget exhausted after %d attempts\n", attempt)
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryable reports whether a call failed in a way that may well succeed if it
+// is tried again
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		// Nobody is waiting for the result any more
+		return ctx.Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	return retryableStatus(resp.StatusCode)
+}
+
+// retryableStatus reports whether a response with the given status is worth
+// retrying
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Transient reports whether err is a failure of the Copilot API of the kind
+// that is retried within a retry budget, so that it is returned only once the
+// retries are exhausted, or when there is no budget at all
+func Transient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return retryableStatus(apiErr.StatusCode)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryAfter returns how long the response asks clients to wait, if it says
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
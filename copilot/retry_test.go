@@ -0,0 +1,150 @@
+package copilot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedTransport answers requests with statuses in turn, repeating the
+// last one once they run out, and counts the attempts
+type scriptedTransport struct {
+	mu         sync.Mutex
+	statuses   []int
+	retryAfter string
+	attempts   int
+}
+
+func (s *scriptedTransport) roundTrip(*http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.statuses[min(s.attempts, len(s.statuses)-1)]
+	s.attempts++
+
+	resp := response(status, "application/json", `{"data":[]}`)
+	if status != http.StatusOK && s.retryAfter != "" {
+		resp.Header.Set("Retry-After", s.retryAfter)
+	}
+	return resp, nil
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		budget       time.Duration
+		statuses     []int
+		retryAfter   string
+		wantAttempts int
+		wantStatus   int
+		// The budget left afterwards is within (minLeft, maxLeft]
+		minLeft, maxLeft time.Duration
+	}{
+		{
+			name:         "exponential backoff without Retry-After",
+			budget:       10 * time.Second,
+			statuses:     []int{503, 503, 200},
+			wantAttempts: 3,
+			wantStatus:   http.StatusOK,
+			minLeft:      9500 * time.Millisecond,
+			maxLeft:      9700 * time.Millisecond,
+		},
+		{
+			name:         "Retry-After is the wait, without backoff on top",
+			budget:       10 * time.Second,
+			statuses:     []int{503, 503, 200},
+			retryAfter:   "1",
+			wantAttempts: 3,
+			wantStatus:   http.StatusOK,
+			minLeft:      7800 * time.Millisecond,
+			maxLeft:      8 * time.Second,
+		},
+		{
+			name:         "exhausted budget fails fast",
+			budget:       250 * time.Millisecond,
+			statuses:     []int{503},
+			wantAttempts: 2,
+			wantStatus:   http.StatusServiceUnavailable,
+			maxLeft:      150 * time.Millisecond,
+		},
+		{
+			name:         "Retry-After beyond the budget fails fast",
+			budget:       500 * time.Millisecond,
+			statuses:     []int{503},
+			retryAfter:   "1",
+			wantAttempts: 1,
+			wantStatus:   http.StatusServiceUnavailable,
+			maxLeft:      500 * time.Millisecond,
+		},
+		{
+			name:         "client errors are not retried",
+			budget:       10 * time.Second,
+			statuses:     []int{400, 200},
+			wantAttempts: 1,
+			wantStatus:   http.StatusBadRequest,
+			minLeft:      9900 * time.Millisecond,
+			maxLeft:      10 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := &scriptedTransport{statuses: tt.statuses, retryAfter: tt.retryAfter}
+			stubTransport(t, script.roundTrip)
+
+			budget := NewRetryBudget(tt.budget)
+			ctx := WithRetryBudget(context.Background(), budget)
+			_, err := Embeddings(ctx, "integration", "token", &EmbeddingsRequest{})
+
+			status := http.StatusOK
+			var apiErr *APIError
+			if errors.As(err, &apiErr) {
+				status = apiErr.StatusCode
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if script.attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", script.attempts, tt.wantAttempts)
+			}
+			if left := budget.Remaining(); left <= tt.minLeft || left > tt.maxLeft {
+				t.Errorf("budget left = %v, want within (%v, %v]", left, tt.minLeft, tt.maxLeft)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetIsShared(t *testing.T) {
+	// The embedding call retries twice and spends 300ms of the budget, which
+	// leaves too little for the completion call to retry at all
+	script := &scriptedTransport{statuses: []int{503, 503, 200, 503, 200}}
+	stubTransport(t, script.roundTrip)
+
+	budget := NewRetryBudget(350 * time.Millisecond)
+	ctx := WithRetryBudget(context.Background(), budget)
+
+	if _, err := Embeddings(ctx, "integration", "token", &EmbeddingsRequest{}); err != nil {
+		t.Fatalf("embeddings failed: %v", err)
+	}
+	if script.attempts != 3 {
+		t.Errorf("embedding attempts = %d, want 3", script.attempts)
+	}
+
+	start := time.Now()
+	_, err := ChatCompletions(ctx, "integration", "token", &ChatCompletionsRequest{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want the 503 of the completion call", err)
+	}
+	if script.attempts != 4 {
+		t.Errorf("completion attempts = %d, want 1", script.attempts-3)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("completion took %v, want it to fail fast", elapsed)
+	}
+}
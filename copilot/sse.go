@@ -0,0 +1,115 @@
+package copilot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxEventLineSize bounds a single line of a server-sent event stream
+const maxEventLineSize = 1024 * 1024
+
+// Event is a single server-sent event from a completion stream
+type Event struct {
+	// Name is the event type.  It is empty for the events carrying completion
+	// chunks.
+	Name string
+	ID   string
+	Data []byte
+}
+
+// IsDone reports whether e is the event that terminates a completion stream
+func (e *Event) IsDone() bool {
+	return e.Name == "" && bytes.Equal(e.Data, []byte("[DONE]"))
+}
+
+// Chunk decodes the completion chunk carried by e
+func (e *Event) Chunk() (*ChatCompletionsResponse, error) {
+	var chunk ChatCompletionsResponse
+	if err := json.Unmarshal(e.Data, &chunk); err != nil {
+		return nil, fmt.Errorf("failed to decode completion chunk: %w", err)
+	}
+	return &chunk, nil
+}
+
+// WriteTo writes e to w in the server-sent event wire format
+func (e *Event) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if e.Name != "" {
+		fmt.Fprintf(&buf, "event: %s\n", e.Name)
+	}
+	if e.ID != "" {
+		fmt.Fprintf(&buf, "id: %s\n", e.ID)
+	}
+	for _, line := range bytes.Split(e.Data, []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteByte('\n')
+
+	return buf.WriteTo(w)
+}
+
+// EventReader reads server-sent events from a completion stream
+type EventReader struct {
+	scanner *bufio.Scanner
+}
+
+func NewEventReader(r io.Reader) *EventReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxEventLineSize)
+	return &EventReader{scanner: scanner}
+}
+
+// Next returns the next event in the stream, or io.EOF once the stream has
+// ended.  Comments and unknown fields are skipped.
+func (r *EventReader) Next() (*Event, error) {
+	var event *Event
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+
+		// A blank line terminates an event
+		if len(line) == 0 {
+			if event != nil {
+				return event, nil
+			}
+			continue
+		}
+
+		// Lines starting with a colon are comments
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+
+		if event == nil {
+			event = &Event{}
+		}
+		switch string(field) {
+		case "event":
+			event.Name = string(value)
+		case "id":
+			event.ID = string(value)
+		case "data":
+			if event.Data != nil {
+				event.Data = append(event.Data, '\n')
+			}
+			event.Data = append(event.Data, value...)
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	// The stream may end without a blank line after its last event
+	if event != nil {
+		return event, nil
+	}
+
+	return nil, io.EOF
+}
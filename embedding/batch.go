@@ -0,0 +1,172 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// defaultMaxBatch is the number of inputs a BatchingEmbedder embeds in one
+// call unless configured otherwise
+const defaultMaxBatch = 16
+
+// BatchingEmbedder coalesces concurrent calls into fewer calls to another
+// Embedder.  Inputs are held back for up to a short window, and whatever
+// arrived by then is embedded in one call, so that under load many single
+// queries don't each cost an API call.  Only calls with the same credentials
+// are batched together.  Use it with WithEmbedder.
+//
+// A caller that gives up before its batch is embedded gets the error of its
+// context, and its inputs are left out of the batch if it hasn't been sent
+// yet.  A batch that was sent is given up once all of its callers have.  The
+// tokens a batch spends are shared out among the callers by number of inputs.
+type BatchingEmbedder struct {
+	embedder Embedder
+	window   time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	pending map[credentials]*embeddingBatch
+}
+
+// embeddingBatch is the calls waiting to be embedded together
+type embeddingBatch struct {
+	calls  []*batchedCall
+	inputs int
+	timer  *time.Timer
+}
+
+type batchedCall struct {
+	ctx    context.Context
+	inputs []string
+
+	// done is closed once embeddings or err is set
+	done       chan struct{}
+	embeddings [][]float32
+	err        error
+}
+
+// NewBatchingEmbedder batches calls to embedder, waiting up to window for
+// more inputs and sending at most maxBatch inputs in one call.  A maxBatch of
+// zero sends up to 16.
+func NewBatchingEmbedder(embedder Embedder, window time.Duration, maxBatch int) *BatchingEmbedder {
+	if maxBatch <= 0 {
+		maxBatch = defaultMaxBatch
+	}
+	return &BatchingEmbedder{
+		embedder: embedder,
+		window:   window,
+		maxBatch: maxBatch,
+		pending:  map[credentials]*embeddingBatch{},
+	}
+}
+
+func (e *BatchingEmbedder) EmbeddingModel() string {
+	return embeddingModel(e.embedder)
+}
+
+func (e *BatchingEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	call := &batchedCall{
+		ctx:    ctx,
+		inputs: inputs,
+		done:   make(chan struct{}),
+	}
+
+	var creds credentials
+	creds.integrationID, creds.apiToken = credentialsFrom(ctx)
+
+	e.mu.Lock()
+	batch := e.pending[creds]
+	if batch == nil {
+		batch = &embeddingBatch{}
+		e.pending[creds] = batch
+		batch.timer = time.AfterFunc(e.window, func() { e.dispatch(creds, batch) })
+	}
+	batch.calls = append(batch.calls, call)
+	batch.inputs += len(inputs)
+	if batch.inputs >= e.maxBatch {
+		batch.timer.Stop()
+		delete(e.pending, creds)
+		go e.send(creds, batch)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.embeddings, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch sends batch once its window is over, unless it was sent already
+// for being full
+func (e *BatchingEmbedder) dispatch(creds credentials, batch *embeddingBatch) {
+	e.mu.Lock()
+	if e.pending[creds] != batch {
+		e.mu.Unlock()
+		return
+	}
+	delete(e.pending, creds)
+	e.mu.Unlock()
+
+	e.send(creds, batch)
+}
+
+// send embeds the inputs of the calls in batch whose callers are still
+// waiting, in one call
+func (e *BatchingEmbedder) send(creds credentials, batch *embeddingBatch) {
+	var calls []*batchedCall
+	var inputs []string
+	for _, call := range batch.calls {
+		if call.ctx.Err() != nil {
+			continue
+		}
+		calls = append(calls, call)
+		inputs = append(inputs, call.inputs...)
+	}
+	if len(calls) == 0 {
+		return
+	}
+
+	// The batch carries the values of the first caller, such as its retry
+	// budget and span, and is given up only once every caller has given up
+	var usage Usage
+	ctx, cancel := context.WithCancel(context.WithoutCancel(calls[0].ctx))
+	defer cancel()
+	ctx = WithUsage(WithCredentials(ctx, creds.integrationID, creds.apiToken), &usage)
+	go func() {
+		for _, call := range calls {
+			select {
+			case <-call.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+
+	embeddings, err := e.embedder.Embed(ctx, inputs)
+	if err == nil && len(embeddings) != len(inputs) {
+		err = fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(embeddings))
+	}
+
+	promptTokens, totalTokens := usage.Tokens()
+	var offset int
+	for _, call := range calls {
+		if err != nil {
+			call.err = err
+		} else {
+			call.embeddings = embeddings[offset : offset+len(call.inputs)]
+			usageFrom(call.ctx).add(&copilot.EmbeddingsResponseUsage{
+				PromptTokens: promptTokens * len(call.inputs) / len(inputs),
+				TotalTokens:  totalTokens * len(call.inputs) / len(inputs),
+			})
+		}
+		offset += len(call.inputs)
+		close(call.done)
+	}
+}
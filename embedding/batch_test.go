@@ -0,0 +1,209 @@
+package embedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingEmbedder embeds "input-N" as [N] and counts its calls
+type countingEmbedder struct {
+	mu     sync.Mutex
+	calls  int
+	inputs [][]string
+	ctxs   []context.Context
+
+	// block, if set, holds every call until the call's ctx is done
+	block bool
+}
+
+func (e *countingEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	e.mu.Lock()
+	e.calls++
+	e.inputs = append(e.inputs, inputs)
+	e.ctxs = append(e.ctxs, ctx)
+	e.mu.Unlock()
+
+	if e.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		n, err := strconv.Atoi(strings.TrimPrefix(input, "input-"))
+		if err != nil {
+			return nil, err
+		}
+		embeddings[i] = []float32{float32(n)}
+	}
+	return embeddings, nil
+}
+
+func (e *countingEmbedder) callCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+func TestBatchingEmbedderCoalescesConcurrentCalls(t *testing.T) {
+	tests := []struct {
+		name      string
+		callers   int
+		maxBatch  int
+		wantCalls int
+	}{
+		{name: "one batch", callers: 8, maxBatch: 8, wantCalls: 1},
+		{name: "full batches", callers: 8, maxBatch: 4, wantCalls: 2},
+		{name: "single caller", callers: 1, maxBatch: 8, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &countingEmbedder{}
+			// The window is long enough that only full batches are sent early
+			e := NewBatchingEmbedder(upstream, 200*time.Millisecond, tt.maxBatch)
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			var wg sync.WaitGroup
+			errs := make([]error, tt.callers)
+			for i := 0; i < tt.callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					embeddings, err := e.Embed(ctx, []string{fmt.Sprintf("input-%d", i)})
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					if len(embeddings) != 1 || embeddings[0][0] != float32(i) {
+						errs[i] = fmt.Errorf("caller %d got %v", i, embeddings)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			for _, err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			if got := upstream.callCount(); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBatchingEmbedderSeparatesCredentials(t *testing.T) {
+	upstream := &countingEmbedder{}
+	e := NewBatchingEmbedder(upstream, 20*time.Millisecond, 0)
+
+	var wg sync.WaitGroup
+	for i, token := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			ctx := WithCredentials(context.Background(), "integration", token)
+			if _, err := e.Embed(ctx, []string{fmt.Sprintf("input-%d", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i, token)
+	}
+	wg.Wait()
+
+	if got := upstream.callCount(); got != 2 {
+		t.Errorf("upstream calls = %d, want 2", got)
+	}
+}
+
+type testValueKey struct{}
+
+func TestBatchingEmbedderKeepsCallerValues(t *testing.T) {
+	upstream := &countingEmbedder{}
+	e := NewBatchingEmbedder(upstream, time.Millisecond, 0)
+
+	ctx := context.WithValue(WithCredentials(context.Background(), "integration", "token"), testValueKey{}, "value")
+	if _, err := e.Embed(ctx, []string{"input-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if got := upstream.ctxs[0].Value(testValueKey{}); got != "value" {
+		t.Errorf("value = %v, want the caller's", got)
+	}
+	if id, token := credentialsFrom(upstream.ctxs[0]); id != "integration" || token != "token" {
+		t.Errorf("credentials = %q, %q", id, token)
+	}
+}
+
+func TestBatchingEmbedderCancellation(t *testing.T) {
+	t.Run("caller gives up before the batch is sent", func(t *testing.T) {
+		upstream := &countingEmbedder{}
+		e := NewBatchingEmbedder(upstream, 50*time.Millisecond, 0)
+		base := WithCredentials(context.Background(), "integration", "token")
+
+		cancelled, cancel := context.WithCancel(base)
+		done := make(chan error)
+		go func() {
+			_, err := e.Embed(cancelled, []string{"input-1"})
+			done <- err
+		}()
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			cancel()
+		}()
+
+		embeddings, err := e.Embed(base, []string{"input-2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if embeddings[0][0] != 2 {
+			t.Errorf("embedding = %v, want [2]", embeddings[0])
+		}
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled caller err = %v, want context.Canceled", err)
+		}
+
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		if len(upstream.inputs) != 1 || len(upstream.inputs[0]) != 1 {
+			t.Errorf("upstream inputs = %v, want only the live caller's", upstream.inputs)
+		}
+	})
+
+	t.Run("every caller gives up after the batch is sent", func(t *testing.T) {
+		upstream := &countingEmbedder{block: true}
+		e := NewBatchingEmbedder(upstream, time.Millisecond, 0)
+
+		ctx, cancel := context.WithCancel(WithCredentials(context.Background(), "integration", "token"))
+		done := make(chan error)
+		go func() {
+			_, err := e.Embed(ctx, []string{"input-1"})
+			done <- err
+		}()
+
+		for upstream.callCount() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+
+		upstream.mu.Lock()
+		batchCtx := upstream.ctxs[0]
+		upstream.mu.Unlock()
+		select {
+		case <-batchCtx.Done():
+		case <-time.After(time.Second):
+			t.Error("the batch was not given up")
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package embedding
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// EmbeddingCache stores embeddings under keys that identify the embedded text
+// and the embedding model, see CacheKey.  Implementations may be shared
+// between replicas, e.g. backed by Redis, so that they share embedding work.
+// A cache that fails is worked around by embedding directly.
+type EmbeddingCache interface {
+	// Get returns the embedding stored under key, if there is one
+	Get(ctx context.Context, key string) ([]float32, bool, error)
+
+	// Put stores emb under key
+	Put(ctx context.Context, key string, emb []float32) error
+}
+
+// CacheKey returns the key an EmbeddingCache stores the embedding of text by
+// model under.  It is a hash, so the cache doesn't hold on to the text, e.g.
+// user messages.  The key includes the model, since embeddings of different
+// models can't be mixed.
+func CacheKey(model, text string) string {
+	sum := sha256.Sum256([]byte(model + "\x00" + text))
+	return hex.EncodeToString(sum[:])
+}
+
+// queryCache holds the embeddings of recent queries so that a repeated query,
+// such as a user sending the same message twice, isn't embedded again.  It
+// keeps at most size entries, evicting the oldest first.  It is the default
+// EmbeddingCache of a Retriever.
+type queryCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string][]float32
+	order   []string
+}
+
+func newQueryCache(size int) *queryCache {
+	return &queryCache{
+		size:    size,
+		entries: map[string][]float32{},
+	}
+}
+
+func (c *queryCache) Get(_ context.Context, key string) ([]float32, bool, error) {
+	if c.size <= 0 {
+		return nil, false, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	emb, ok := c.entries[key]
+	return emb, ok, nil
+}
+
+func (c *queryCache) Put(_ context.Context, key string, emb []float32) error {
+	if c.size <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return nil
+	}
+
+	if len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = emb
+	c.order = append(c.order, key)
+	return nil
+}
+
+// cachedEmbed embeds content like embed, but looks it up in cache first and
+// stores it there afterwards.  A nil cache is skipped.
+func cachedEmbed(ctx context.Context, o *options, cache EmbeddingCache, content string) ([]float32, error) {
+	if cache == nil {
+		return embed(ctx, o, content)
+	}
+
+	key := CacheKey(embeddingModel(o.embedder), o.truncated(content))
+	emb, ok, err := cache.Get(ctx, key)
+	if err != nil {
+		fmt.Printf("warning: embedding cache unavailable, embedding directly: %v\n", err)
+	}
+	if ok && validateEmbedding(emb) == nil {
+		return emb, nil
+	}
+
+	emb, err = embed(ctx, o, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Put(ctx, key, emb); err != nil {
+		fmt.Printf("warning: failed to cache embedding: %v\n", err)
+	}
+	return emb, nil
+}
@@ -0,0 +1,248 @@
+package embedding
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+func TestQueryCache(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		puts []string
+		want []string
+	}{
+		{name: "disabled", size: 0, puts: []string{"a"}},
+		{name: "within size", size: 2, puts: []string{"a", "b"}, want: []string{"a", "b"}},
+		{name: "oldest evicted", size: 2, puts: []string{"a", "b", "c"}, want: []string{"b", "c"}},
+		{name: "repeats keep their place", size: 2, puts: []string{"a", "b", "a", "c"}, want: []string{"b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newQueryCache(tt.size)
+			for i, key := range tt.puts {
+				if err := c.Put(ctx, key, []float32{float32(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var cached []string
+			for _, key := range []string{"a", "b", "c"} {
+				if _, ok, _ := c.Get(ctx, key); ok {
+					cached = append(cached, key)
+				}
+			}
+			if !slices.Equal(cached, tt.want) {
+				t.Errorf("cached %q, want %q", cached, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieverReusesRepeatedQueries(t *testing.T) {
+	tests := []struct {
+		name      string
+		cacheSize *int
+		want      int
+	}{
+		{name: "default", want: 1},
+		{name: "disabled", cacheSize: new(int), want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := writeDocuments(t, map[string]string{"billing.md": "Invoices are sent monthly."})
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			opts := []Option{WithEmbedder(embedder)}
+			if tt.cacheSize != nil {
+				opts = append(opts, WithQueryCacheSize(*tt.cacheSize))
+			}
+			r := NewRetriever(source, opts...)
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			const query = "When is an invoice sent?"
+			for i := 0; i < 2; i++ {
+				if _, _, err := r.Retrieve(ctx, query); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var n int
+			for _, input := range embedder.embedded() {
+				if input == query {
+					n++
+				}
+			}
+			if n != tt.want {
+				t.Errorf("embedded the query %d times, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddingModelChange(t *testing.T) {
+	const query = "When is an invoice sent?"
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+
+	tests := []struct {
+		name       string
+		model      copilot.Model
+		wantInputs []string
+	}{
+		{name: "same model", model: "model-a", wantInputs: nil},
+		{name: "other model", model: "model-b", wantInputs: []string{query, "billing", "deploy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeEmbeddingsAPI{words: wordEmbedder{"invoice", "deploy"}}
+			stubEmbeddingsAPI(t, api)
+			source := writeDocuments(t, docs)
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			// Both retrievers share the cache, like replicas sharing Redis
+			cache := newQueryCache(10)
+			before := NewRetriever(source, WithEmbeddingModel("model-a"), WithEmbeddingCache(cache))
+			if _, _, err := before.Retrieve(ctx, query); err != nil {
+				t.Fatal(err)
+			}
+			previous, err := GenerateDatasets("integration", "token", source, WithEmbeddingModel("model-a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			api.requests = nil
+
+			after := NewRetriever(source, WithEmbeddingModel(tt.model), WithEmbeddingCache(cache))
+			if _, _, err := after.Retrieve(ctx, query); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RefreshDatasets(ctx, "integration", "token", source, previous, WithEmbeddingModel(tt.model)); err != nil {
+				t.Fatal(err)
+			}
+
+			// Whatever was embedded by the previous model is embedded again,
+			// and only by the new one
+			var inputs []string
+			for _, req := range api.requests {
+				if req.Model != tt.model {
+					t.Errorf("embedded with %s, want %s", req.Model, tt.model)
+				}
+				for _, input := range req.Input {
+					switch {
+					case strings.Contains(input, "Invoices"):
+						inputs = append(inputs, "billing")
+					case strings.Contains(input, "Deploy"):
+						inputs = append(inputs, "deploy")
+					default:
+						inputs = append(inputs, input)
+					}
+				}
+			}
+			slices.Sort(inputs)
+			if inputs = slices.Compact(inputs); !slices.Equal(inputs, tt.wantInputs) {
+				t.Errorf("embedded %q, want %q", inputs, tt.wantInputs)
+			}
+		})
+	}
+}
+
+// fakeCache is an EmbeddingCache backend that can be made to fail, like a
+// Redis server that is down
+type fakeCache struct {
+	getErr, putErr error
+
+	mu      sync.Mutex
+	entries map[string][]float32
+}
+
+func (c *fakeCache) Get(_ context.Context, key string) ([]float32, bool, error) {
+	if c.getErr != nil {
+		return nil, false, c.getErr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	emb, ok := c.entries[key]
+	return emb, ok, nil
+}
+
+func (c *fakeCache) Put(_ context.Context, key string, emb []float32) error {
+	if c.putErr != nil {
+		return c.putErr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string][]float32{}
+	}
+	c.entries[key] = emb
+	return nil
+}
+
+func TestEmbeddingCache(t *testing.T) {
+	const query = "When is an invoice sent?"
+	docs := map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+	errUnavailable := errors.New("connection refused")
+
+	tests := []struct {
+		name  string
+		cache *fakeCache
+		// wantEmbedded is how many inputs each replica embeds itself
+		wantEmbedded []int
+	}{
+		{name: "shared", cache: &fakeCache{}, wantEmbedded: []int{3, 0}},
+		{name: "lookups failing", cache: &fakeCache{getErr: errUnavailable}, wantEmbedded: []int{3, 3}},
+		{name: "stores failing", cache: &fakeCache{putErr: errUnavailable}, wantEmbedded: []int{3, 3}},
+		{name: "corrupt entry", cache: &fakeCache{entries: map[string][]float32{
+			CacheKey("test-model", query): {0, 0, 0},
+		}}, wantEmbedded: []int{3, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := writeDocuments(t, docs)
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			// Two replicas sharing the cache backend
+			var results [][]*Dataset
+			var embedders []*recordingEmbedder
+			for i := 0; i < 2; i++ {
+				embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}
+				r := NewRetriever(source, WithEmbedder(embedder), WithEmbeddingCache(tt.cache))
+				datasets, _, err := r.Retrieve(ctx, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				results = append(results, datasets)
+				embedders = append(embedders, embedder)
+			}
+
+			for i, embedder := range embedders {
+				if got := len(embedder.embedded()); got != tt.wantEmbedded[i] {
+					t.Errorf("replica %d embedded %d inputs, want %d: %q", i, got, tt.wantEmbedded[i], embedder.embedded())
+				}
+			}
+			if len(results[1]) == 0 || filepath.Base(results[1][0].Filename) != "billing.md" {
+				t.Errorf("second replica matched %+v, want billing.md first", results[1])
+			}
+		})
+	}
+}
@@ -2,71 +2,339 @@ package embedding
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"math"
-	"os"
-
-	"github.com/copilot-extensions/rag-extension/copilot"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Create embeds content with the Copilot embeddings API.  The tokens it spends
+// are recorded in the Usage attached to ctx with WithUsage, if any.
 func Create(ctx context.Context, integrationID, apiToken string, content string) ([]float32, error) {
-	resp, err := copilot.Embeddings(ctx, integrationID, apiToken, &copilot.EmbeddingsRequest{
-		Model: copilot.ModelEmbeddings,
-		Input: []string{content},
-	})
+	return embed(WithCredentials(ctx, integrationID, apiToken), newOptions(nil), content)
+}
+
+type Dataset struct {
+	Embedding []float32
+	Filename  string
 
+	// Size and ModTime describe the document the dataset was generated from.
+	// ModTime is zero if the document source doesn't know it.
+	Size    int64
+	ModTime time.Time
+
+	// Hash identifies the exact text that was embedded and the model that
+	// embedded it, so that an unchanged document doesn't have to be embedded
+	// again
+	Hash string
+
+	// Model is the embedding model that generated the embedding, if the
+	// Embedder names it
+	Model string
+
+	// Normalized is set if the embedding was scaled to unit length, which is
+	// only done for MetricCosine
+	Normalized bool
+}
+
+// DocumentPreprocessor transforms the content of a document before it is
+// embedded.  It can be used to strip boilerplate, redact secrets or normalize
+// whitespace without having to modify the documents themselves.  Several
+// documents may be preprocessed at the same time.
+type DocumentPreprocessor func(filename, content string) (string, error)
+
+// metadataHeader describes the document for embedding purposes
+func metadataHeader(filename, content string) string {
+	header := "File: " + filepath.Base(filename) + "\n"
+	if title := markdownTitle(content); title != "" {
+		header += "Title: " + title + "\n"
+	}
+	return header + "\n"
+}
+
+// markdownTitle returns the text of the first heading in content, if any
+func markdownTitle(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			return strings.TrimSpace(strings.TrimLeft(line, "#"))
+		}
+	}
+	return ""
+}
+
+// prepareDocument reads a document and returns the text to embed for it
+func prepareDocument(source DocumentSource, filename string, o *options) (preparedDocument, error) {
+	fileContent, modTime, err := ReadDocument(source, filename)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching embeddings: %w", err)
+		return preparedDocument{}, fmt.Errorf("error reading in file %s: %w", filename, err)
 	}
 
-	for _, data := range resp.Data {
-		return data.Embedding, nil
+	content, err := o.preprocessor(filename, string(fileContent))
+	if err != nil {
+		return preparedDocument{}, fmt.Errorf("error preprocessing file %s: %w", filename, err)
 	}
+	fields := documentFields(content, o.fieldWeights)
 
-	return nil, fmt.Errorf("no embeddings found in response")
+	if o.metadataHeader {
+		content = metadataHeader(filename, content) + content
+	}
+
+	return preparedDocument{
+		fileContent: fileContent,
+		modTime:     modTime,
+		content:     content,
+		fields:      fields,
+	}, nil
 }
 
-type Dataset struct {
-	Embedding []float32
-	Filename  string
+// preparedDocument is a document that is ready to be embedded
+type preparedDocument struct {
+	fileContent []byte
+	modTime     time.Time
+	content     string
+
+	// fields are embedded in place of content if there are any, see
+	// WithFieldEmbedding
+	fields []documentField
 }
 
-func GenerateDatasets(integrationID, apiToken string, filenames []string) ([]*Dataset, error) {
-	datasets := make([]*Dataset, len(filenames))
-	for i, filename := range filenames {
-		file, err := os.Open(filename)
+// prepareDocuments reads and preprocesses the documents named by filenames,
+// with up to the configured number of documents at a time.  The documents are
+// returned in the order of their names.
+func prepareDocuments(ctx context.Context, source DocumentSource, filenames []string, o *options) ([]preparedDocument, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	docs := make([]preparedDocument, len(filenames))
+	errs := make([]error, len(filenames))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < max(o.readConcurrency, 1); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				doc, err := prepareDocument(source, filenames[i], o)
+				if err != nil {
+					errs[i] = err
+					// No point in reading the rest
+					cancel()
+					continue
+				}
+				docs[i] = doc
+			}
+		}()
+	}
+
+feed:
+	for i := range filenames {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
 		if err != nil {
-			return nil, fmt.Errorf("error reading in file %s: %w", filename, err)
+			return nil, err
 		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("error reading documents: %w", err)
+	}
 
-		fileContent, err := io.ReadAll(file)
+	return docs, nil
+}
 
-		embedding, err := Create(context.Background(), integrationID, apiToken, string(fileContent))
-		if err != nil {
-			return nil, fmt.Errorf("error creating embedding for file %s: %w", filename, err)
+// GenerateDatasets embeds every document in source
+func GenerateDatasets(integrationID, apiToken string, source DocumentSource, opts ...Option) ([]*Dataset, error) {
+	return RefreshDatasets(context.Background(), integrationID, apiToken, source, nil, opts...)
+}
+
+// RefreshDatasets embeds every document in source, like GenerateDatasets, but
+// reuses the embedding of any dataset in previous whose document hasn't
+// changed since.  Only new and changed documents are embedded.  It gives up
+// once ctx is done.
+func RefreshDatasets(ctx context.Context, integrationID, apiToken string, source DocumentSource, previous []*Dataset, opts ...Option) ([]*Dataset, error) {
+	o := newOptions(opts)
+
+	filenames, err := source.List()
+	if err != nil {
+		return nil, fmt.Errorf("error listing documents: %w", err)
+	}
+
+	docs, err := prepareDocuments(ctx, source, filenames, o)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]*Dataset, len(previous))
+	for _, dataset := range previous {
+		if dataset.Hash != "" {
+			hashes[dataset.Filename] = dataset
+		}
+	}
+
+	ctx = WithCredentials(ctx, integrationID, apiToken)
+	model := embeddingModel(o.embedder)
+
+	normalized := o.metric == MetricCosine
+
+	var embedded int
+	datasets := make([]*Dataset, len(filenames))
+	for i, filename := range filenames {
+		doc := docs[i]
+
+		hash := CacheKey(model, o.truncated(doc.content))
+		if len(doc.fields) > 0 {
+			hash = fieldsHash(o, model, doc.fields)
+		}
+
+		var embedding []float32
+		// A normalized embedding can't be used with a metric that needs the
+		// raw one, or the other way around
+		if prev, ok := hashes[filename]; ok && prev.Hash == hash && prev.Normalized == normalized {
+			embedding = prev.Embedding
+		} else {
+			if len(doc.fields) > 0 {
+				embedding, err = embedFields(ctx, o, doc.fields)
+			} else {
+				embedding, err = cachedEmbed(ctx, o, o.embeddingCache, doc.content)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error creating embedding for file %s: %w", filename, err)
+			}
+			if normalized {
+				embedding = normalize(embedding)
+			}
+			embedded++
 		}
 
 		datasets[i] = &Dataset{
-			Embedding: embedding,
-			Filename:  filename,
+			Embedding:  embedding,
+			Filename:   filename,
+			Size:       int64(len(doc.fileContent)),
+			ModTime:    doc.modTime,
+			Hash:       hash,
+			Model:      model,
+			Normalized: normalized,
 		}
 	}
 
+	if previous != nil {
+		fmt.Printf("embedded %d of %d documents, the rest are unchanged\n", embedded, len(datasets))
+	}
+
 	return datasets, nil
 }
 
-func FindBestDataset(datasets []*Dataset, target []float32) (*Dataset, error) {
-	var bestDataset *Dataset
+// CorpusChecksum identifies the whole of a set of datasets: which documents
+// they were generated from, the exact text embedded for each, the embedding
+// model and whether the embeddings were normalized.  Datasets stored for later
+// use are only valid as long as the checksum of freshly prepared datasets
+// matches theirs.  The order of the datasets doesn't matter.
+func CorpusChecksum(datasets []*Dataset) string {
+	entries := make([]string, len(datasets))
+	for i, dataset := range datasets {
+		entries[i] = fmt.Sprintf("%s\x00%s\x00%s\x00%t", dataset.Filename, dataset.Hash, dataset.Model, dataset.Normalized)
+	}
+	sort.Strings(entries)
+
+	sum := sha256.Sum256([]byte(strings.Join(entries, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindBestDataset returns the dataset most similar to target, or nil if none
+// of them are similar at all.  Datasets whose scores are within the configured
+// epsilon of the best score are considered equally good, and the tie-break
+// policy decides between them.
+func FindBestDataset(datasets []*Dataset, target []float32, opts ...Option) (*Dataset, error) {
+	o := newOptions(opts)
+	datasets = o.candidates(datasets)
+
+	scores, err := scoreDatasets(datasets, target, o.metric)
+	if err != nil {
+		return nil, err
+	}
+
 	var bestScore float32
+	for _, score := range scores {
+		if score > bestScore {
+			bestScore = score
+		}
+	}
 
+	var bestDataset *Dataset
+	for i, dataset := range datasets {
+		if !o.relevant(scores[i]) || scores[i] < bestScore-o.tieBreakEpsilon {
+			continue
+		}
+		if bestDataset == nil || o.tieBreak.prefers(dataset, bestDataset) {
+			bestDataset = dataset
+		}
+	}
+
+	return bestDataset, nil
+}
+
+// Match is a dataset scored against a query
+type Match struct {
+	Dataset *Dataset
+	Score   float32
+
+	// Relevant reports whether the score reaches the minimum similarity
+	Relevant bool
+}
+
+// RankDatasets scores every dataset that passes the document filter against
+// target, best match first
+func RankDatasets(datasets []*Dataset, target []float32, opts ...Option) ([]Match, error) {
+	o := newOptions(opts)
+	datasets = o.candidates(datasets)
+
+	scores, err := scoreDatasets(datasets, target, o.metric)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]Match, len(datasets))
+	for i, dataset := range datasets {
+		matches[i] = Match{
+			Dataset:  dataset,
+			Score:    scores[i],
+			Relevant: o.relevant(scores[i]),
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+
+	return matches, nil
+}
+
+// scoreDatasets scores the similarity of every dataset to target using metric
+func scoreDatasets(datasets []*Dataset, target []float32, metric Metric) ([]float32, error) {
 	var targetMagnitude float32
 	for i := 0; i < len(target); i++ {
 		targetMagnitude += target[i] * target[i]
 	}
 
-	for _, dataset := range datasets {
-		// Score similarity using Cosine Similarity
+	if len(datasets) > 0 && targetMagnitude == 0 {
+		return nil, fmt.Errorf("query embedding is empty or a zero vector, cannot compare")
+	}
+
+	scores := make([]float32, len(datasets))
+	for i, dataset := range datasets {
 		if len(target) != len(dataset.Embedding) {
 			return nil, fmt.Errorf("embeddings are different length, cannot compare")
 		}
@@ -77,12 +345,35 @@ func FindBestDataset(datasets []*Dataset, target []float32) (*Dataset, error) {
 			dotProduct += target[i] * dataset.Embedding[i]
 		}
 
-		dotProduct /= float32(math.Sqrt(float64(targetMagnitude)) * math.Sqrt(float64(docMagnitude)))
-		if dotProduct > bestScore {
-			bestDataset = dataset
-			bestScore = dotProduct
+		if metric == MetricDotProduct {
+			scores[i] = dotProduct
+			continue
 		}
+
+		// A zero vector is similar to nothing
+		if docMagnitude == 0 {
+			continue
+		}
+		scores[i] = dotProduct / float32(math.Sqrt(float64(targetMagnitude))*math.Sqrt(float64(docMagnitude)))
 	}
 
-	return bestDataset, nil
+	return scores, nil
+}
+
+// normalize returns emb scaled to unit length
+func normalize(emb []float32) []float32 {
+	var magnitude float64
+	for _, v := range emb {
+		magnitude += float64(v) * float64(v)
+	}
+	magnitude = math.Sqrt(magnitude)
+	if magnitude == 0 {
+		return emb
+	}
+
+	normalized := make([]float32, len(emb))
+	for i, v := range emb {
+		normalized[i] = float32(float64(v) / magnitude)
+	}
+	return normalized
 }
@@ -0,0 +1,493 @@
+package embedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeManyDocuments writes n documents of a few paragraphs each to a new
+// directory
+func writeManyDocuments(tb testing.TB, n int) DirSource {
+	tb.Helper()
+	dir := tb.TempDir()
+	for i := 0; i < n; i++ {
+		content := fmt.Sprintf("# Document %d\n\n%s", i, strings.Repeat("Some paragraph of text.\n\n", 20))
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("doc-%04d.md", i)), []byte(content), 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return DirSource(dir)
+}
+
+// slowPreprocessor stands in for CPU bound extraction, e.g. of PDFs
+func slowPreprocessor(filename, content string) (string, error) {
+	time.Sleep(200 * time.Microsecond)
+	return content, nil
+}
+
+// recordingEmbedder embeds like a wordEmbedder and records the inputs
+type recordingEmbedder struct {
+	wordEmbedder
+
+	mu     sync.Mutex
+	inputs []string
+}
+
+func (e *recordingEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	e.mu.Lock()
+	e.inputs = append(e.inputs, inputs...)
+	e.mu.Unlock()
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func (e *recordingEmbedder) embedded() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.inputs...)
+}
+
+func TestDocumentPreprocessor(t *testing.T) {
+	const doc = "Invoices are sent monthly.\n\n<!-- generated, do not edit -->"
+	stripComments := func(filename, content string) (string, error) {
+		before, _, _ := strings.Cut(content, "<!--")
+		return strings.TrimSpace(before), nil
+	}
+
+	tests := []struct {
+		name         string
+		preprocessor DocumentPreprocessor
+		want         string
+	}{
+		{name: "none", want: doc},
+		{name: "strip comments", preprocessor: stripComments, want: "Invoices are sent monthly."},
+		{name: "by filename", preprocessor: func(filename, content string) (string, error) {
+			return filepath.Base(filename) + ": " + content, nil
+		}, want: "billing.md: " + doc},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := writeDocuments(t, map[string]string{"billing.md": doc})
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}
+			opts := []Option{WithEmbedder(embedder)}
+			if tt.preprocessor != nil {
+				opts = append(opts, WithDocumentPreprocessor(tt.preprocessor))
+			}
+
+			datasets, err := GenerateDatasets("integration", "token", source, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := embedder.embedded(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("embedded %q, want %q", got, tt.want)
+			}
+
+			// The dataset still describes the document as it is on disk
+			if datasets[0].Size != int64(len(doc)) {
+				t.Errorf("size = %d, want %d", datasets[0].Size, len(doc))
+			}
+		})
+	}
+}
+
+func TestMetadataHeader(t *testing.T) {
+	source := writeDocuments(t, map[string]string{
+		"batch.md":  "They run nightly, one after the other.",
+		"office.md": "# Office hours\n\nThe office closes at six.",
+	})
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    string
+	}{
+		{name: "without the header"},
+		{name: "with the header", enabled: true, want: "batch.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"batch", "office"}}
+			r := NewRetriever(source, WithEmbedder(embedder), WithMetadataHeader(tt.enabled), WithMinSimilarity(0.5))
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			// The file is only findable by its name with the header
+			datasets, _, err := r.Retrieve(ctx, "batch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if len(datasets) > 0 {
+				got = filepath.Base(datasets[0].Filename)
+			}
+			if got != tt.want {
+				t.Errorf("retrieved %q, want %q", got, tt.want)
+			}
+
+			embedded := embedder.embedded()
+			want := "The office closes at six."
+			if tt.enabled {
+				want = "File: office.md\nTitle: Office hours\n\n# Office hours\n\n" + want
+			} else {
+				want = "# Office hours\n\n" + want
+			}
+			if !slices.Contains(embedded, want) {
+				t.Errorf("embedded %q, want %q", embedded, want)
+			}
+		})
+	}
+}
+
+func TestPrepareDocuments(t *testing.T) {
+	source := writeManyDocuments(t, 50)
+	filenames, err := source.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{0, 1, 4, 64} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			o := newOptions([]Option{WithReadConcurrency(concurrency)})
+			docs, err := prepareDocuments(context.Background(), source, filenames, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The documents come back in the order of their names
+			for i, doc := range docs {
+				if want := fmt.Sprintf("# Document %d\n", i); !strings.HasPrefix(doc.content, want) {
+					t.Errorf("document %d starts with %q, want %q", i, doc.content[:min(len(doc.content), 20)], want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareDocumentsStops(t *testing.T) {
+	source := writeManyDocuments(t, 50)
+	filenames, err := source.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("cancelled context", func(t *testing.T) {
+		var prepared atomic.Int32
+		ctx, cancel := context.WithCancel(context.Background())
+		o := newOptions([]Option{
+			WithReadConcurrency(2),
+			WithDocumentPreprocessor(func(filename, content string) (string, error) {
+				if prepared.Add(1) == 5 {
+					cancel()
+				}
+				return content, nil
+			}),
+		})
+
+		if _, err := prepareDocuments(ctx, source, filenames, o); !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+		if n := prepared.Load(); n >= int32(len(filenames)) {
+			t.Errorf("prepared all %d documents after cancellation", n)
+		}
+	})
+
+	t.Run("failed document", func(t *testing.T) {
+		failure := errors.New("unreadable")
+		o := newOptions([]Option{
+			WithReadConcurrency(2),
+			WithDocumentPreprocessor(func(filename, content string) (string, error) {
+				if strings.HasSuffix(filename, "doc-0003.md") {
+					return "", failure
+				}
+				return content, nil
+			}),
+		})
+
+		if _, err := prepareDocuments(context.Background(), source, filenames, o); !errors.Is(err, failure) {
+			t.Errorf("err = %v, want the preprocessing error", err)
+		}
+	})
+}
+
+func BenchmarkPrepareDocuments(b *testing.B) {
+	source := writeManyDocuments(b, 500)
+	filenames, err := source.List()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			o := newOptions([]Option{
+				WithReadConcurrency(concurrency),
+				WithDocumentPreprocessor(slowPreprocessor),
+			})
+			for i := 0; i < b.N; i++ {
+				if _, err := prepareDocuments(context.Background(), source, filenames, o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// unitVector returns a unit vector whose cosine similarity to (1, 0) is score
+func unitVector(score float64) []float32 {
+	return []float32{float32(score), float32(math.Sqrt(1 - score*score))}
+}
+
+func TestTieBreak(t *testing.T) {
+	now := time.Now()
+	datasets := []*Dataset{
+		{Filename: "a.md", Embedding: unitVector(1), Size: 10, ModTime: now.Add(-3 * time.Hour)},
+		{Filename: "b.md", Embedding: unitVector(0.99), Size: 30, ModTime: now.Add(-2 * time.Hour)},
+		{Filename: "c.md", Embedding: unitVector(0.98), Size: 20, ModTime: now.Add(-time.Hour)},
+		// Largest and newest, but not close
+		{Filename: "d.md", Embedding: unitVector(0.5), Size: 100, ModTime: now},
+	}
+	target := []float32{1, 0}
+
+	tests := []struct {
+		name    string
+		policy  TieBreak
+		epsilon float32
+		want    string
+	}{
+		{name: "best score", want: "a.md"},
+		{name: "filename", epsilon: 0.05, want: "a.md"},
+		{name: "largest", policy: TieBreakLargest, epsilon: 0.05, want: "b.md"},
+		{name: "newest", policy: TieBreakNewest, epsilon: 0.05, want: "c.md"},
+		{name: "newest within a narrow band", policy: TieBreakNewest, epsilon: 0.015, want: "b.md"},
+		{name: "largest without a band", policy: TieBreakLargest, want: "a.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindBestDataset(datasets, target, WithTieBreak(tt.policy, tt.epsilon))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || got.Filename != tt.want {
+				t.Errorf("best dataset = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTieBreakFallsBackToFilename(t *testing.T) {
+	modTime := time.Now()
+	datasets := []*Dataset{
+		// The better score, but within the band
+		{Filename: "b.md", Embedding: unitVector(1), Size: 10, ModTime: modTime},
+		{Filename: "a.md", Embedding: unitVector(0.99), Size: 10, ModTime: modTime},
+	}
+
+	for _, policy := range []TieBreak{TieBreakFilename, TieBreakLargest, TieBreakNewest} {
+		got, err := FindBestDataset(datasets, []float32{1, 0}, WithTieBreak(policy, 0.05))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.Filename != "a.md" {
+			t.Errorf("policy %d chose %v, want a.md", policy, got)
+		}
+	}
+}
+
+func TestRefreshDatasetsReembedsChangedDocuments(t *testing.T) {
+	initial := map[string]string{
+		"billing.md":  "Invoices are sent monthly.",
+		"deploy.md":   "Deploy from the main branch.",
+		"security.md": "Rotate the keys yearly.",
+	}
+
+	tests := []struct {
+		name         string
+		write        map[string]string
+		remove       []string
+		wantEmbedded []string
+		wantDatasets int
+	}{
+		{name: "unchanged", wantDatasets: 3},
+		{name: "one changed", write: map[string]string{"deploy.md": "Deploy from a release branch."}, wantEmbedded: []string{"Deploy from a release branch."}, wantDatasets: 3},
+		{name: "one added", write: map[string]string{"support.md": "Support answers within a day."}, wantEmbedded: []string{"Support answers within a day."}, wantDatasets: 4},
+		{name: "one removed", remove: []string{"security.md"}, wantDatasets: 2},
+		{name: "rewritten as it was", write: map[string]string{"billing.md": "Invoices are sent monthly."}, wantDatasets: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := writeDocuments(t, initial)
+			opts := []Option{WithEmbedder(wordEmbedder{"invoice", "deploy"})}
+			previous, err := GenerateDatasets("integration", "token", source, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, content := range tt.write {
+				if err := os.WriteFile(filepath.Join(string(source), name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range tt.remove {
+				if err := os.Remove(filepath.Join(string(source), name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}
+			datasets, err := RefreshDatasets(context.Background(), "integration", "token", source, previous, WithEmbedder(embedder))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := embedder.embedded(); !slices.Equal(got, tt.wantEmbedded) {
+				t.Errorf("embedded %q, want %q", got, tt.wantEmbedded)
+			}
+			if len(datasets) != tt.wantDatasets {
+				t.Errorf("got %d datasets, want %d", len(datasets), tt.wantDatasets)
+			}
+			for _, name := range tt.remove {
+				for _, dataset := range datasets {
+					if filepath.Base(dataset.Filename) == name {
+						t.Errorf("removed %s is still a dataset", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMetricNormalization(t *testing.T) {
+	source := memorySource{
+		"billing.md": "Invoice: invoices are sent monthly, one invoice per account.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+	embedder := wordEmbedder{"invoice", "deploy"}
+
+	tests := []struct {
+		name           string
+		metric         Metric
+		wantNormalized bool
+		wantBest       string
+	}{
+		{name: "cosine", metric: MetricCosine, wantNormalized: true, wantBest: "deploy.md"},
+		{name: "dot product", metric: MetricDotProduct, wantBest: "billing.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasets, err := GenerateDatasets("integration", "token", source, WithEmbedder(embedder), WithMetric(tt.metric))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, dataset := range datasets {
+				if dataset.Normalized != tt.wantNormalized {
+					t.Errorf("%s: normalized = %v, want %v", dataset.Filename, dataset.Normalized, tt.wantNormalized)
+				}
+
+				raw, _ := embedder.Embed(context.Background(), []string{source[dataset.Filename]})
+				want := raw[0]
+				if tt.wantNormalized {
+					want = normalize(want)
+				}
+				if !slices.Equal(dataset.Embedding, want) {
+					t.Errorf("%s: embedding = %v, want %v", dataset.Filename, dataset.Embedding, want)
+				}
+			}
+
+			// The magnitude of billing.md only counts for the dot product
+			query := []float32{1, 2, 0.1}
+			best, err := FindBestDataset(datasets, query, WithMetric(tt.metric))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if best == nil || best.Filename != tt.wantBest {
+				t.Errorf("best = %v, want %s", best, tt.wantBest)
+			}
+		})
+	}
+}
+
+func TestCorpusChecksum(t *testing.T) {
+	docs := memorySource{
+		"billing.md": "# Billing\n\nInvoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	}
+	generate := func(source DocumentSource, opts ...Option) string {
+		t.Helper()
+		datasets, err := GenerateDatasets("integration", "token", source, append([]Option{WithEmbedder(wordEmbedder{"invoice", "deploy"})}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CorpusChecksum(datasets)
+	}
+	base := generate(docs)
+
+	tests := []struct {
+		name     string
+		source   DocumentSource
+		opts     []Option
+		wantSame bool
+	}{
+		{name: "regenerated", source: docs, wantSame: true},
+		{name: "document edited", source: memorySource{"billing.md": "Invoices are sent weekly.", "deploy.md": docs["deploy.md"]}},
+		{name: "document renamed", source: memorySource{"invoices.md": docs["billing.md"], "deploy.md": docs["deploy.md"]}},
+		{name: "document added", source: memorySource{"billing.md": docs["billing.md"], "deploy.md": docs["deploy.md"], "faq.md": "Ask support."}},
+		{name: "input truncated", source: docs, opts: []Option{WithInputTruncation(TruncateTail, 4)}},
+		{name: "preprocessed", source: docs, opts: []Option{WithDocumentPreprocessor(func(filename, content string) (string, error) {
+			return strings.ToLower(content), nil
+		})}},
+		{name: "other model", source: docs, opts: []Option{WithEmbedder(modelEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}, model: "other-model"})}},
+		{name: "other metric", source: docs, opts: []Option{WithMetric(MetricDotProduct)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := generate(tt.source, tt.opts...) == base; same != tt.wantSame {
+				t.Errorf("checksum unchanged = %v, want %v", same, tt.wantSame)
+			}
+		})
+	}
+
+	// The order of the datasets doesn't matter
+	datasets, err := GenerateDatasets("integration", "token", docs, WithEmbedder(wordEmbedder{"invoice", "deploy"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(datasets)
+	if CorpusChecksum(datasets) != base {
+		t.Error("reordering the datasets changed the checksum")
+	}
+
+	r := NewRetriever(docs, WithEmbedder(wordEmbedder{"invoice", "deploy"}))
+	if got := r.Checksum(); got != "" {
+		t.Errorf("checksum before loading = %q, want none", got)
+	}
+	if err := r.Warm(WithCredentials(context.Background(), "integration", "token")); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Checksum(); got != base {
+		t.Errorf("checksum after loading = %q, want %q", got, base)
+	}
+}
+
+// modelEmbedder embeds like a wordEmbedder, under the name of another model
+type modelEmbedder struct {
+	wordEmbedder
+	model string
+}
+
+func (e modelEmbedder) EmbeddingModel() string {
+	return e.model
+}
@@ -0,0 +1,117 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// Embedder turns text into embeddings.  It returns one embedding per input, in
+// the same order.
+type Embedder interface {
+	Embed(ctx context.Context, inputs []string) ([][]float32, error)
+}
+
+// ModelEmbedder is implemented by Embedders that can name the model they use.
+// Embeddings are cached per model, so that switching models never reuses
+// embeddings of the previous one.
+type ModelEmbedder interface {
+	Embedder
+	EmbeddingModel() string
+}
+
+// embeddingModel returns the name of the model used by e, if it has one
+func embeddingModel(e Embedder) string {
+	if m, ok := e.(ModelEmbedder); ok {
+		return m.EmbeddingModel()
+	}
+	return ""
+}
+
+// CopilotEmbedder embeds text with the Copilot embeddings API.  It calls the
+// API with the credentials attached to the context with WithCredentials and
+// records the tokens spent in the Usage attached with WithUsage, if any.  It
+// is the default Embedder.
+type CopilotEmbedder struct {
+	// Model is the embedding model to use, copilot.ModelEmbeddings if empty
+	Model copilot.Model
+}
+
+func (e CopilotEmbedder) EmbeddingModel() string {
+	if e.Model == "" {
+		return string(copilot.ModelEmbeddings)
+	}
+	return string(e.Model)
+}
+
+func (e CopilotEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	integrationID, apiToken := credentialsFrom(ctx)
+
+	resp, err := copilot.Embeddings(ctx, integrationID, apiToken, &copilot.EmbeddingsRequest{
+		Model: copilot.Model(e.EmbeddingModel()),
+		Input: inputs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching embeddings: %w", err)
+	}
+	usageFrom(ctx).add(resp.Usage)
+
+	embeddings := make([][]float32, len(inputs))
+	for _, data := range resp.Data {
+		if data.Index < 0 || data.Index >= len(inputs) {
+			return nil, fmt.Errorf("embedding index %d is out of range", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			return nil, fmt.Errorf("no embedding found for input %d", i)
+		}
+	}
+
+	return embeddings, nil
+}
+
+// embed embeds a single text with the configured Embedder, giving up after the
+// embedding timeout
+func embed(ctx context.Context, o *options, content string) ([]float32, error) {
+	if o.embeddingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.embeddingTimeout)
+		defer cancel()
+	}
+
+	embeddings, err := o.embedder.Embed(ctx, []string{o.truncateInput(content)})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != 1 {
+		return nil, fmt.Errorf("expected 1 embedding, got %d", len(embeddings))
+	}
+	if err := validateEmbedding(embeddings[0]); err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// validateEmbedding rejects embeddings that can't be compared by cosine
+// similarity, which the embeddings API may return for edge case inputs
+func validateEmbedding(emb []float32) error {
+	if len(emb) == 0 {
+		return fmt.Errorf("embedding is empty")
+	}
+
+	var magnitude float64
+	for _, v := range emb {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return fmt.Errorf("embedding contains %v", v)
+		}
+		magnitude += float64(v) * float64(v)
+	}
+	if magnitude == 0 {
+		return fmt.Errorf("embedding is a zero vector")
+	}
+	return nil
+}
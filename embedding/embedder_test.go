@@ -0,0 +1,404 @@
+package embedding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// fakeEmbeddingsAPI stands in for the Copilot embeddings API.  It embeds
+// inputs like a wordEmbedder and charges tokensPerInput for each of them.
+type fakeEmbeddingsAPI struct {
+	words          wordEmbedder
+	tokensPerInput int
+
+	// respond, if set, answers in place of the default
+	respond func(req *copilot.EmbeddingsRequest) *copilot.EmbeddingsResponse
+
+	mu       sync.Mutex
+	requests []*copilot.EmbeddingsRequest
+}
+
+// stubEmbeddingsAPI sends every request to the Copilot API to f for the
+// duration of the test
+func stubEmbeddingsAPI(t *testing.T, f *fakeEmbeddingsAPI) {
+	t.Helper()
+	prev := http.DefaultTransport
+	http.DefaultTransport = f
+	t.Cleanup(func() { http.DefaultTransport = prev })
+}
+
+func (f *fakeEmbeddingsAPI) RoundTrip(r *http.Request) (*http.Response, error) {
+	var req copilot.EmbeddingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, &req)
+	f.mu.Unlock()
+
+	var resp *copilot.EmbeddingsResponse
+	if f.respond != nil {
+		resp = f.respond(&req)
+	} else {
+		embeddings, _ := f.words.Embed(r.Context(), req.Input)
+		resp = &copilot.EmbeddingsResponse{
+			Usage: &copilot.EmbeddingsResponseUsage{
+				PromptTokens: f.tokensPerInput * len(req.Input),
+				TotalTokens:  f.tokensPerInput * len(req.Input),
+			},
+		}
+		for i, emb := range embeddings {
+			resp.Data = append(resp.Data, &copilot.EmbeddingsResponseData{Embedding: emb, Index: i})
+		}
+	}
+
+	b, _ := json.Marshal(resp)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(b))),
+	}, nil
+}
+
+func TestUsage(t *testing.T) {
+	source := writeDocuments(t, map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	})
+
+	tests := []struct {
+		name        string
+		queries     []string
+		wantQueries int
+	}{
+		{name: "one query", queries: []string{"invoice"}, wantQueries: 7},
+		{name: "repeated query spends nothing", queries: []string{"invoice", "invoice"}, wantQueries: 7},
+		{name: "two queries", queries: []string{"invoice", "deploy"}, wantQueries: 14},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeEmbeddingsAPI{words: wordEmbedder{"invoice", "deploy"}, tokensPerInput: 7}
+			stubEmbeddingsAPI(t, api)
+			r := NewRetriever(source)
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			// Generating the datasets serves every caller, so it isn't charged
+			// to the one that happens to start it
+			var generation Usage
+			if err := r.Warm(WithUsage(ctx, &generation)); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(api.requests); n != 2 {
+				t.Errorf("generation made %d requests, want one per document", n)
+			}
+			if prompt, total := generation.Tokens(); prompt != 0 || total != 0 {
+				t.Errorf("generation charged %d prompt and %d total tokens to the caller, want none", prompt, total)
+			}
+
+			var usage Usage
+			for _, query := range tt.queries {
+				if _, _, err := r.Retrieve(WithUsage(ctx, &usage), query); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if prompt, total := usage.Tokens(); prompt != tt.wantQueries || total != tt.wantQueries {
+				t.Errorf("queries spent %d prompt and %d total tokens, want %d", prompt, total, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestCreateRecordsUsage(t *testing.T) {
+	stubEmbeddingsAPI(t, &fakeEmbeddingsAPI{words: wordEmbedder{"invoice"}, tokensPerInput: 5})
+
+	var usage Usage
+	emb, err := Create(WithUsage(context.Background(), &usage), "integration", "token", "invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emb) != 2 {
+		t.Errorf("embedding = %v", emb)
+	}
+	if prompt, total := usage.Tokens(); prompt != 5 || total != 5 {
+		t.Errorf("spent %d prompt and %d total tokens, want 5", prompt, total)
+	}
+
+	// Without a Usage nothing is recorded, and nothing breaks
+	if _, err := Create(context.Background(), "integration", "token", "invoice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateDatasetsWithEmbedder(t *testing.T) {
+	// Nothing may reach the Copilot API while another Embedder is in use
+	api := &fakeEmbeddingsAPI{words: wordEmbedder{"invoice"}}
+	stubEmbeddingsAPI(t, api)
+
+	docs := map[string]string{
+		"billing.md": "An invoice, another invoice.",
+		"release.md": "Deploy from the main branch.",
+	}
+	source := writeDocuments(t, docs)
+	embedder := wordEmbedder{"invoice", "deploy"}
+
+	datasets, err := GenerateDatasets("integration", "token", source, WithEmbedder(embedder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != len(docs) {
+		t.Fatalf("got %d datasets, want %d", len(datasets), len(docs))
+	}
+	for _, dataset := range datasets {
+		if dataset.Model != "test-model" {
+			t.Errorf("%s: model = %q, want test-model", dataset.Filename, dataset.Model)
+		}
+
+		want, _ := embedder.Embed(context.Background(), []string{docs[filepath.Base(dataset.Filename)]})
+		if dataset.Normalized {
+			want[0] = normalize(want[0])
+		}
+		if !slices.Equal(dataset.Embedding, want[0]) {
+			t.Errorf("%s: embedding = %v, want %v", dataset.Filename, dataset.Embedding, want[0])
+		}
+	}
+
+	if len(api.requests) != 0 {
+		t.Errorf("made %d requests to the embeddings API", len(api.requests))
+	}
+}
+
+func TestCopilotEmbedder(t *testing.T) {
+	tests := []struct {
+		name    string
+		model   copilot.Model
+		data    []*copilot.EmbeddingsResponseData
+		want    [][]float32
+		wantErr bool
+	}{
+		{
+			name: "in order",
+			data: []*copilot.EmbeddingsResponseData{
+				{Embedding: []float32{1}, Index: 0},
+				{Embedding: []float32{2}, Index: 1},
+			},
+			want: [][]float32{{1}, {2}},
+		},
+		{
+			name:  "out of order",
+			model: "custom-model",
+			data: []*copilot.EmbeddingsResponseData{
+				{Embedding: []float32{2}, Index: 1},
+				{Embedding: []float32{1}, Index: 0},
+			},
+			want: [][]float32{{1}, {2}},
+		},
+		{
+			name: "index out of range",
+			data: []*copilot.EmbeddingsResponseData{
+				{Embedding: []float32{1}, Index: 0},
+				{Embedding: []float32{2}, Index: 2},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing embedding",
+			data:    []*copilot.EmbeddingsResponseData{{Embedding: []float32{1}, Index: 0}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeEmbeddingsAPI{
+				respond: func(req *copilot.EmbeddingsRequest) *copilot.EmbeddingsResponse {
+					return &copilot.EmbeddingsResponse{Data: tt.data}
+				},
+			}
+			stubEmbeddingsAPI(t, api)
+
+			e := CopilotEmbedder{Model: tt.model}
+			got, err := e.Embed(context.Background(), []string{"one", "two"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.EqualFunc(got, tt.want, slices.Equal[[]float32]) {
+				t.Errorf("embeddings = %v, want %v", got, tt.want)
+			}
+
+			wantModel := tt.model
+			if wantModel == "" {
+				wantModel = copilot.ModelEmbeddings
+			}
+			if len(api.requests) != 1 || api.requests[0].Model != wantModel {
+				t.Errorf("requests = %+v, want one for %s", api.requests, wantModel)
+			}
+		})
+	}
+}
+
+func TestDegenerateEmbeddings(t *testing.T) {
+	tests := []struct {
+		name string
+		data []*copilot.EmbeddingsResponseData
+		want string
+	}{
+		{name: "no data", want: "no embedding found"},
+		{name: "empty vector", data: []*copilot.EmbeddingsResponseData{{Embedding: []float32{}}}, want: "embedding is empty"},
+		{name: "zero vector", data: []*copilot.EmbeddingsResponseData{{Embedding: []float32{0, 0, 0}}}, want: "zero vector"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubEmbeddingsAPI(t, &fakeEmbeddingsAPI{
+				respond: func(req *copilot.EmbeddingsRequest) *copilot.EmbeddingsResponse {
+					return &copilot.EmbeddingsResponse{Data: tt.data}
+				},
+			})
+
+			emb, err := Create(context.Background(), "integration", "token", "invoice")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("embedding %v, err = %v, want one mentioning %q", emb, err, tt.want)
+			}
+
+			// Retrieval fails the same way rather than scoring the vector
+			r := NewRetriever(memorySource{"billing.md": "Invoices are sent monthly."})
+			if _, _, err := r.Retrieve(WithCredentials(context.Background(), "integration", "token"), "invoice"); err == nil {
+				t.Error("retrieval with a degenerate embedding succeeded")
+			}
+		})
+	}
+}
+
+func TestValidateEmbedding(t *testing.T) {
+	tests := []struct {
+		name    string
+		emb     []float32
+		wantErr bool
+	}{
+		{name: "valid", emb: []float32{0, 1, 0.5}},
+		{name: "nil", wantErr: true},
+		{name: "zero vector", emb: []float32{0, 0}, wantErr: true},
+		{name: "NaN", emb: []float32{1, float32(math.NaN())}, wantErr: true},
+		{name: "infinity", emb: []float32{float32(math.Inf(-1)), 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateEmbedding(tt.emb); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScoreDatasetsZeroQuery(t *testing.T) {
+	datasets := []*Dataset{{Filename: "billing.md", Embedding: []float32{1, 0}}}
+	if _, err := FindBestDataset(datasets, []float32{0, 0}); err == nil {
+		t.Error("scored datasets against a zero vector")
+	}
+	if _, err := FindBestDataset(datasets, nil); err == nil {
+		t.Error("scored datasets against an empty embedding")
+	}
+}
+
+// limitedEmbedder fails on inputs longer than limit bytes, like an embedding
+// model with a token limit
+type limitedEmbedder struct {
+	recordingEmbedder
+	limit int
+}
+
+func (e *limitedEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	for _, input := range inputs {
+		if len(input) > e.limit {
+			return nil, fmt.Errorf("input of %d bytes exceeds the limit of %d", len(input), e.limit)
+		}
+	}
+	return e.recordingEmbedder.Embed(ctx, inputs)
+}
+
+func TestInputTruncation(t *testing.T) {
+	// 2 tokens are about 8 bytes
+	const maxTokens = 2
+
+	tests := []struct {
+		name       string
+		truncation Truncation
+		input      string
+		want       string
+		wantErr    bool
+	}{
+		{name: "within the limit", truncation: TruncateTail, input: "invoice", want: "invoice"},
+		{name: "at the limit", truncation: TruncateTail, input: "invoices", want: "invoices"},
+		{name: "not truncated", truncation: TruncateNone, input: "invoice deploy", wantErr: true},
+		{name: "tail", truncation: TruncateTail, input: "invoice deploy", want: "invoice "},
+		{name: "head", truncation: TruncateHead, input: "invoice deploy", want: "e deploy"},
+		// "é" is 2 bytes, and isn't split where the limit falls between them
+		{name: "tail, multi-byte", truncation: TruncateTail, input: "invoiceé deploy", want: "invoice"},
+		{name: "head, multi-byte", truncation: TruncateHead, input: "deploy éinvoice", want: "invoice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			embedder := &limitedEmbedder{recordingEmbedder: recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}, limit: maxTokens * charsPerToken}
+			o := newOptions([]Option{WithEmbedder(embedder), WithInputTruncation(tt.truncation, maxTokens)})
+
+			_, err := embed(context.Background(), o, tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := embedder.embedded(); !slices.Equal(got, []string{tt.want}) {
+				t.Errorf("embedded %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("default limit", func(t *testing.T) {
+		embedder := &limitedEmbedder{recordingEmbedder: recordingEmbedder{wordEmbedder: wordEmbedder{"invoice"}}, limit: defaultMaxInputTokens * charsPerToken}
+		o := newOptions([]Option{WithEmbedder(embedder), WithInputTruncation(TruncateTail, 0)})
+
+		input := strings.Repeat("invoice ", defaultMaxInputTokens)
+		if _, err := embed(context.Background(), o, input); err != nil {
+			t.Fatal(err)
+		}
+		if got := embedder.embedded(); len(got) != 1 || len(got[0]) != defaultMaxInputTokens*charsPerToken {
+			t.Errorf("embedded %d bytes, want %d", len(got[0]), defaultMaxInputTokens*charsPerToken)
+		}
+	})
+
+	t.Run("over-long document", func(t *testing.T) {
+		source := writeDocuments(t, map[string]string{
+			"billing.md": "Invoices are sent monthly. " + strings.Repeat("Late invoices incur a fee. ", 10),
+			"deploy.md":  "Deploy from the main branch.",
+		})
+		newEmbedder := func() *limitedEmbedder {
+			return &limitedEmbedder{recordingEmbedder: recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}, limit: 8 * charsPerToken}
+		}
+
+		if _, err := GenerateDatasets("integration", "token", source, WithEmbedder(newEmbedder())); err == nil {
+			t.Fatal("over-long document embedded without truncation")
+		}
+		datasets, err := GenerateDatasets("integration", "token", source, WithEmbedder(newEmbedder()), WithInputTruncation(TruncateTail, 8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(datasets) != 2 {
+			t.Errorf("got %d datasets, want 2", len(datasets))
+		}
+	})
+}
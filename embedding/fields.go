@@ -0,0 +1,99 @@
+package embedding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// documentField is the text of a field of a structured document and how much
+// its embedding weighs
+type documentField struct {
+	name   string
+	text   string
+	weight float32
+}
+
+// documentFields returns the configured fields of content, sorted by name.  It
+// returns nil if content isn't a JSON object or has none of them.
+func documentFields(content string, weights map[string]float32) []documentField {
+	if len(weights) == 0 {
+		return nil
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal([]byte(content), &object); err != nil {
+		return nil
+	}
+
+	var fields []documentField
+	for name, weight := range weights {
+		value, ok := object[name]
+		if !ok || weight <= 0 {
+			continue
+		}
+		if text := fieldText(value); text != "" {
+			fields = append(fields, documentField{name: name, text: text, weight: weight})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+	return fields
+}
+
+// fieldText returns the text of a JSON value, joining lists
+func fieldText(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []any:
+		texts := make([]string, 0, len(value))
+		for _, v := range value {
+			if text := fieldText(v); text != "" {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, ", ")
+	default:
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
+
+// fieldsHash identifies the text embedded for fields and the model that
+// embedded it, like the hash of a whole document
+func fieldsHash(o *options, model string, fields []documentField) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = fmt.Sprintf("%s\x00%g\x00%s", field.name, field.weight, o.truncated(field.text))
+	}
+	return CacheKey(model, "fields\x00"+strings.Join(parts, "\x00"))
+}
+
+// embedFields embeds each of fields and combines their normalized embeddings
+// by weight
+func embedFields(ctx context.Context, o *options, fields []documentField) ([]float32, error) {
+	var combined []float32
+	for _, field := range fields {
+		emb, err := cachedEmbed(ctx, o, o.embeddingCache, field.text)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding field %s: %w", field.name, err)
+		}
+		if combined == nil {
+			combined = make([]float32, len(emb))
+		}
+		if len(emb) != len(combined) {
+			return nil, fmt.Errorf("embeddings of the fields are different lengths")
+		}
+
+		for i, v := range normalize(emb) {
+			combined[i] += field.weight * v
+		}
+	}
+	return combined, nil
+}
@@ -0,0 +1,100 @@
+package embedding
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDocumentFields(t *testing.T) {
+	weights := map[string]float32{"title": 2, "body": 1, "tags": 0.5, "draft": 0}
+
+	tests := []struct {
+		name    string
+		content string
+		want    []documentField
+	}{
+		{
+			name:    "configured fields",
+			content: `{"title":"Invoices","body":"Invoices are sent monthly.","author":"billing"}`,
+			want:    []documentField{{name: "body", text: "Invoices are sent monthly.", weight: 1}, {name: "title", text: "Invoices", weight: 2}},
+		},
+		{
+			name:    "list joined",
+			content: `{"title":"Invoices","tags":["billing","monthly",null]}`,
+			want:    []documentField{{name: "tags", text: "billing, monthly", weight: 0.5}, {name: "title", text: "Invoices", weight: 2}},
+		},
+		{
+			name:    "other values",
+			content: `{"title":42,"body":{"text":"Invoices"}}`,
+			want:    []documentField{{name: "body", text: `{"text":"Invoices"}`, weight: 1}, {name: "title", text: "42", weight: 2}},
+		},
+		{name: "empty and zero weight fields", content: `{"title":"","body":null,"draft":"Invoices"}`},
+		{name: "none of the fields", content: `{"author":"billing"}`},
+		{name: "plain text", content: "Invoices are sent monthly."},
+		{name: "JSON array", content: `[{"title":"Invoices"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := documentFields(tt.content, weights); !slices.Equal(got, tt.want) {
+				t.Errorf("fields = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if got := documentFields(`{"title":"Invoices"}`, nil); got != nil {
+		t.Errorf("fields without weights = %+v, want none", got)
+	}
+}
+
+func TestFieldEmbedding(t *testing.T) {
+	docs := map[string]string{
+		// The related links are about deploying, which drowns out the invoices
+		// when the document is embedded whole
+		"billing.json": `{"title":"Invoices","body":"Invoices are sent monthly.","related":"deploy, deploy, deploy, deploy, deploy, deploy"}`,
+		"faq.json":     `{"title":"FAQ","body":"Ask about an invoice or a deploy."}`,
+		"deploy.md":    "Deploy from the main branch.",
+	}
+	fields := map[string]float32{"title": 1, "body": 1}
+
+	tests := []struct {
+		name   string
+		query  string
+		fields map[string]float32
+		want   string
+	}{
+		{name: "whole documents", query: "When is an invoice sent?", want: "faq.json"},
+		{name: "field-aware", query: "When is an invoice sent?", fields: fields, want: "billing.json"},
+		// Documents that aren't structured are still embedded whole
+		{name: "plain text among structured documents", query: "How do I deploy?", fields: fields, want: "deploy.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := writeDocuments(t, docs)
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}
+			r := NewRetriever(source, WithEmbedder(embedder), WithFieldEmbedding(tt.fields))
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			datasets, _, err := r.Retrieve(ctx, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(datasets) == 0 || filepath.Base(datasets[0].Filename) != tt.want {
+				t.Errorf("retrieved %+v, want %s", datasets, tt.want)
+			}
+
+			// Fields are embedded on their own, and fields that aren't
+			// configured not at all
+			embedded := embedder.embedded()
+			if got, want := slices.Contains(embedded, "Invoices are sent monthly."), tt.fields != nil; got != want {
+				t.Errorf("body embedded on its own = %v, want %v: %q", got, want, embedded)
+			}
+			if !slices.Contains(embedded, docs["deploy.md"]) {
+				t.Errorf("plain text document wasn't embedded whole: %q", embedded)
+			}
+		})
+	}
+}
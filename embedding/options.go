@@ -0,0 +1,504 @@
+package embedding
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// Option configures how datasets are generated and retrieved.
+type Option func(*options)
+
+type options struct {
+	preprocessor       DocumentPreprocessor
+	warmupTimeout      time.Duration
+	metadataHeader     bool
+	tieBreak           TieBreak
+	tieBreakEpsilon    float32
+	queryCacheSize     int
+	minSimilarity      float32
+	embedder           Embedder
+	include            []string
+	minDistinctSources int
+	embeddingTimeout   time.Duration
+	readConcurrency    int
+	exclude            []string
+	scope              []string
+	metric             Metric
+	relaxStep          float32
+	relaxFloor         float32
+	turns              []string
+	turnDecay          float32
+	embeddingCache     EmbeddingCache
+	observer           func(RetrievalDecision)
+	truncation         Truncation
+	fieldWeights       map[string]float32
+	maxInputTokens     int
+}
+
+// defaultQueryCacheSize is the number of query embeddings a Retriever keeps
+// unless configured otherwise
+const defaultQueryCacheSize = 256
+
+// defaultEmbeddingTimeout bounds every embedding call unless configured
+// otherwise
+const defaultEmbeddingTimeout = 30 * time.Second
+
+// defaultReadConcurrency is the number of documents read at a time unless
+// configured otherwise
+const defaultReadConcurrency = 4
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		preprocessor:     func(_, content string) (string, error) { return content, nil },
+		queryCacheSize:   defaultQueryCacheSize,
+		embedder:         CopilotEmbedder{},
+		embeddingTimeout: defaultEmbeddingTimeout,
+		readConcurrency:  defaultReadConcurrency,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithDocumentPreprocessor sets the hook applied to every document before it
+// is embedded.  By default documents are embedded as-is.
+func WithDocumentPreprocessor(p DocumentPreprocessor) Option {
+	return func(o *options) {
+		if p != nil {
+			o.preprocessor = p
+		}
+	}
+}
+
+// WithWarmupTimeout bounds how long a Retriever waits for its datasets to be
+// generated before giving up with ErrWarmingUp.  By default it waits for as
+// long as generating them takes.  A negative timeout doesn't wait at all.
+func WithWarmupTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.warmupTimeout = d
+	}
+}
+
+// WithMetadataHeader sets whether a header naming the document's file and
+// title is prepended to its text before it is embedded, so that a document is
+// also found by those terms.  The header only affects the embedding; it is
+// never part of the context given to the model.
+func WithMetadataHeader(enabled bool) Option {
+	return func(o *options) {
+		o.metadataHeader = enabled
+	}
+}
+
+// Metric is how the similarity of two embeddings is scored
+type Metric int
+
+const (
+	// MetricCosine scores the cosine of the angle between the embeddings.
+	// Document embeddings are normalized to unit length when they are
+	// generated.  This is the default.
+	MetricCosine Metric = iota
+
+	// MetricDotProduct scores the dot product of the raw embeddings, so that
+	// their magnitude counts.  Scores aren't limited to [0, 1].
+	MetricDotProduct
+)
+
+// WithMetric sets how embeddings are compared
+func WithMetric(metric Metric) Option {
+	return func(o *options) {
+		o.metric = metric
+	}
+}
+
+// TieBreak decides which of several datasets with close scores is the best
+// match
+type TieBreak int
+
+const (
+	// TieBreakFilename prefers the dataset whose filename sorts first.  This is
+	// the default.
+	TieBreakFilename TieBreak = iota
+
+	// TieBreakLargest prefers the dataset generated from the largest file
+	TieBreakLargest
+
+	// TieBreakNewest prefers the dataset generated from the most recently
+	// modified file
+	TieBreakNewest
+)
+
+// prefers reports whether a should be chosen over b.  Datasets that are equal
+// under the policy fall back to filename order, so the choice is always
+// deterministic.
+func (t TieBreak) prefers(a, b *Dataset) bool {
+	switch t {
+	case TieBreakLargest:
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+	case TieBreakNewest:
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.After(b.ModTime)
+		}
+	}
+	return a.Filename < b.Filename
+}
+
+// WithTieBreak sets how FindBestDataset chooses between datasets whose scores
+// are within epsilon of the best score.  By default only exact ties are
+// considered and the filename decides.
+func WithTieBreak(policy TieBreak, epsilon float32) Option {
+	return func(o *options) {
+		o.tieBreak = policy
+		o.tieBreakEpsilon = epsilon
+	}
+}
+
+// WithQueryCacheSize sets how many query embeddings a Retriever keeps so that
+// repeated queries, such as a user sending the same message twice in a row,
+// aren't embedded again.  Zero disables the cache.
+func WithQueryCacheSize(n int) Option {
+	return func(o *options) {
+		o.queryCacheSize = n
+	}
+}
+
+// WithEmbeddingCache sets a cache that query and document embeddings are
+// looked up in before they are generated, and stored in afterwards.  It
+// replaces the in-memory query cache of a Retriever, so the query cache size
+// no longer applies.  By default documents aren't cached at all, other than by
+// reusing unchanged datasets on refresh.
+func WithEmbeddingCache(c EmbeddingCache) Option {
+	return func(o *options) {
+		o.embeddingCache = c
+	}
+}
+
+// relevant reports whether a dataset with the given score is relevant at all
+func (o *options) relevant(score float32) bool {
+	return score > 0 && score >= o.minSimilarity
+}
+
+// WithMinSimilarity sets the cosine similarity a dataset must reach to be
+// relevant to a query.  By default any positive similarity is enough.
+func WithMinSimilarity(min float32) Option {
+	return func(o *options) {
+		o.minSimilarity = min
+	}
+}
+
+// WithRelaxedSimilarity makes a Retriever that finds no relevant dataset for a
+// query try again with the minimum similarity lowered by step at a time, but
+// never below floor.  Only the query at hand is affected.  Relaxing is off by
+// default.
+func WithRelaxedSimilarity(step, floor float32) Option {
+	return func(o *options) {
+		o.relaxStep = step
+		o.relaxFloor = floor
+	}
+}
+
+// WithTurnWeighting makes a Retriever embed each of turns, the latest user
+// messages of a conversation oldest first, in place of the query, and combine
+// their embeddings so that every turn weighs decay times as much as the one
+// after it.  A decay of 1 weighs every turn the same.  Each turn is cached
+// like a query, so a conversation only embeds its new message.
+func WithTurnWeighting(turns []string, decay float32) Option {
+	return func(o *options) {
+		o.turns = turns
+		o.turnDecay = decay
+	}
+}
+
+// RetrievalDecision describes how a Retriever chose the datasets for a query
+type RetrievalDecision struct {
+	Query string
+
+	// Ranking scores every dataset that passed the document filter, best
+	// match first
+	Ranking []Match
+
+	// Selected are the datasets that Retrieve returned, if any
+	Selected []*Dataset
+}
+
+// WithRetrievalObserver sets a function that is called with every decision
+// Retrieve makes, e.g. to feed a dashboard.  It is called on a goroutine of
+// its own, so it doesn't hold up the query, and may be called concurrently.
+func WithRetrievalObserver(observer func(RetrievalDecision)) Option {
+	return func(o *options) {
+		o.observer = observer
+	}
+}
+
+// Truncation is what is cut off inputs that are too long for the embedding
+// model
+type Truncation int
+
+const (
+	// TruncateNone embeds inputs as they are, so that the embedding model
+	// fails on those that are too long.  This is the default.
+	TruncateNone Truncation = iota
+
+	// TruncateTail keeps the beginning of the input
+	TruncateTail
+
+	// TruncateHead keeps the end of the input
+	TruncateHead
+)
+
+// defaultMaxInputTokens is the input limit of the Copilot embedding models
+const defaultMaxInputTokens = 8191
+
+// charsPerToken approximates how many characters make up a token
+const charsPerToken = 4
+
+// WithInputTruncation cuts documents and queries down to about maxTokens
+// tokens before they are embedded, keeping their beginning or end according
+// to t, so that a single long input doesn't fail.  A maxTokens of zero uses
+// the limit of the Copilot embedding models.  Tokens are approximated by
+// characters.
+func WithInputTruncation(t Truncation, maxTokens int) Option {
+	return func(o *options) {
+		o.truncation = t
+		o.maxInputTokens = maxTokens
+	}
+}
+
+// truncateInput cuts input down to the maximum input length, if configured to
+func (o *options) truncateInput(input string) string {
+	truncated := o.truncated(input)
+	if len(truncated) < len(input) {
+		fmt.Printf("warning: embedding input of about %d tokens exceeds the limit of %d tokens, truncating it\n", len(input)/charsPerToken, o.inputLimit()/charsPerToken)
+	}
+	return truncated
+}
+
+// inputLimit is the maximum input length in characters
+func (o *options) inputLimit() int {
+	maxTokens := o.maxInputTokens
+	if maxTokens <= 0 {
+		maxTokens = defaultMaxInputTokens
+	}
+	return maxTokens * charsPerToken
+}
+
+// truncated is the text that is embedded for input, without warning about
+// it.  Hashes of embedded text are taken over it.
+func (o *options) truncated(input string) string {
+	limit := o.inputLimit()
+	if o.truncation == TruncateNone || len(input) <= limit {
+		return input
+	}
+
+	if o.truncation == TruncateHead {
+		start := len(input) - limit
+		// Don't split a multi-byte character
+		for start < len(input) && !utf8.RuneStart(input[start]) {
+			start++
+		}
+		return input[start:]
+	}
+
+	end := limit
+	for end > 0 && !utf8.RuneStart(input[end]) {
+		end--
+	}
+	return input[:end]
+}
+
+// WithFieldEmbedding embeds the given top-level fields of JSON documents
+// separately and combines their embeddings, each weighing as much as its
+// weight, so that e.g. a title isn't drowned out by a long body.  Fields that
+// hold lists are joined.  Documents that aren't JSON objects or have none of
+// the fields are embedded whole.
+func WithFieldEmbedding(weights map[string]float32) Option {
+	return func(o *options) {
+		o.fieldWeights = weights
+	}
+}
+
+// WithEmbedder sets the Embedder used for documents and queries.  By default
+// they are embedded with the Copilot embeddings API.
+func WithEmbedder(e Embedder) Option {
+	return func(o *options) {
+		if e != nil {
+			o.embedder = e
+		}
+	}
+}
+
+// WithEmbedderWrapper replaces the Embedder configured by the options before
+// it with the one wrap returns for it, e.g. to instrument embedding calls
+func WithEmbedderWrapper(wrap func(Embedder) Embedder) Option {
+	return func(o *options) {
+		o.embedder = wrap(o.embedder)
+	}
+}
+
+// WithEmbeddingModel sets the model used by the Copilot embeddings API, in
+// place of copilot.ModelEmbeddings.  It replaces any Embedder set before.
+func WithEmbeddingModel(model copilot.Model) Option {
+	return func(o *options) {
+		o.embedder = CopilotEmbedder{Model: model}
+	}
+}
+
+// WithEmbeddingTimeout bounds how long a single embedding call may take,
+// including any retries.  It defaults to 30 seconds, and zero removes the
+// bound.
+func WithEmbeddingTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.embeddingTimeout = d
+	}
+}
+
+// WithReadConcurrency sets how many documents are read and preprocessed at a
+// time when generating datasets, which helps when the source is slow or the
+// preprocessing is CPU bound.  It doesn't affect how many documents are
+// embedded at a time.  Four documents are read at a time by default.
+func WithReadConcurrency(n int) Option {
+	return func(o *options) {
+		o.readConcurrency = n
+	}
+}
+
+// WithMinDistinctSources makes a Retriever return datasets from at least n
+// distinct files, as long as that many are relevant, so that broad questions
+// get context from across the documents.  By default only the best match is
+// returned.
+func WithMinDistinctSources(n int) Option {
+	return func(o *options) {
+		o.minDistinctSources = n
+	}
+}
+
+// WithDocumentFilter restricts the datasets considered for a query to those
+// whose filename matches one of the include patterns, if there are any, and
+// none of the exclude patterns.  Patterns use the syntax of filepath.Match and
+// are matched against both the full filename and its base name.
+func WithDocumentFilter(include, exclude []string) Option {
+	return func(o *options) {
+		o.include = include
+		o.exclude = exclude
+	}
+}
+
+// WithDocumentScope restricts the datasets considered for a query to those
+// whose filename matches one of patterns, if there are any, on top of the
+// document filter.  It is meant for isolating the documents of tenants, while
+// the document filter is up to the user.
+func WithDocumentScope(patterns []string) Option {
+	return func(o *options) {
+		o.scope = patterns
+	}
+}
+
+// candidates returns the datasets that are in scope and pass the document
+// filter.  Filter patterns that match no dataset at all are most likely
+// mistakes, so they are logged.
+func (o *options) candidates(datasets []*Dataset) []*Dataset {
+	if len(o.scope) > 0 {
+		var scoped []*Dataset
+		for _, dataset := range datasets {
+			if o.inScope(dataset.Filename) {
+				scoped = append(scoped, dataset)
+			}
+		}
+		datasets = scoped
+	}
+
+	if len(o.include) == 0 && len(o.exclude) == 0 {
+		return datasets
+	}
+
+	matched := make(map[string]bool)
+	matches := func(patterns []string, filename string) bool {
+		var any bool
+		for _, pattern := range patterns {
+			if matchFilename(pattern, filename) {
+				matched[pattern] = true
+				any = true
+			}
+		}
+		return any
+	}
+
+	var candidates []*Dataset
+	for _, dataset := range datasets {
+		included := len(o.include) == 0 || matches(o.include, dataset.Filename)
+		excluded := matches(o.exclude, dataset.Filename)
+		if included && !excluded {
+			candidates = append(candidates, dataset)
+		}
+	}
+
+	for _, patterns := range [][]string{o.include, o.exclude} {
+		for _, pattern := range patterns {
+			if !matched[pattern] {
+				fmt.Printf("warning: document pattern %q matches no documents\n", pattern)
+			}
+		}
+	}
+
+	return candidates
+}
+
+// inScope reports whether filename matches the document scope, if there is one
+func (o *options) inScope(filename string) bool {
+	if len(o.scope) == 0 {
+		return true
+	}
+	for _, pattern := range o.scope {
+		if matchFilename(pattern, filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// Considered reports whether the document named filename is in the document
+// scope and passes the document filter of opts, that is whether it could be
+// retrieved for a query made with them.
+func Considered(filename string, opts ...Option) bool {
+	o := newOptions(opts)
+	if !o.inScope(filename) {
+		return false
+	}
+	for _, pattern := range o.exclude {
+		if matchFilename(pattern, filename) {
+			return false
+		}
+	}
+	if len(o.include) == 0 {
+		return true
+	}
+	for _, pattern := range o.include {
+		if matchFilename(pattern, filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilename reports whether filename or its base name matches pattern
+func matchFilename(pattern, filename string) bool {
+	if ok, _ := filepath.Match(pattern, filename); ok {
+		return true
+	}
+	ok, _ := filepath.Match(pattern, filepath.Base(filename))
+	return ok
+}
+
+// ValidatePattern reports whether pattern is usable with WithDocumentFilter
+func ValidatePattern(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return nil
+}
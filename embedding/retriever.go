@@ -0,0 +1,590 @@
+package embedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type credentialsKey struct{}
+
+type credentials struct {
+	integrationID string
+	apiToken      string
+}
+
+// WithCredentials returns a copy of ctx carrying the integration id and API
+// token used when a Retriever calls the Copilot embeddings API.
+func WithCredentials(ctx context.Context, integrationID, apiToken string) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, credentials{
+		integrationID: integrationID,
+		apiToken:      apiToken,
+	})
+}
+
+func credentialsFrom(ctx context.Context) (integrationID, apiToken string) {
+	creds, _ := ctx.Value(credentialsKey{}).(credentials)
+	return creds.integrationID, creds.apiToken
+}
+
+// ErrWarmingUp is returned by a Retriever when its datasets are still being
+// generated after the configured warmup timeout, or while a refresh generates
+// them from scratch
+var ErrWarmingUp = errors.New("datasets are still being generated")
+
+// ErrQueryEmbedding is returned by a Retriever when the datasets are ready but
+// the query couldn't be embedded
+var ErrQueryEmbedding = errors.New("query could not be embedded")
+
+// ErrRefreshInProgress is returned by TryRefresh when another refresh of the
+// datasets hasn't finished yet
+var ErrRefreshInProgress = errors.New("datasets are already being refreshed")
+
+// ErrNoDocuments is returned when the document source has no usable documents
+var ErrNoDocuments = errors.New("there are no documents")
+
+// Retriever finds the datasets most relevant to a query.  The datasets for the
+// documents in its source are generated the first time it is used and
+// cached for every query after that.  It does not depend on HTTP, so it can be
+// used from batch jobs and command line tools as well as the agent.
+type Retriever struct {
+	source  DocumentSource
+	opts    []Option
+	o       *options
+	queries EmbeddingCache
+
+	// mu guards the fields below.  datasets is only ever replaced, never
+	// modified in place, so readers can keep using the slice they got after
+	// releasing mu.
+	mu       sync.RWMutex
+	datasets []*Dataset
+	loaded   bool
+	loading  *datasetLoad
+
+	// rebuilding is set while a refresh generates the datasets from scratch,
+	// since there were none to keep using
+	rebuilding bool
+
+	// refreshMu makes refreshes take turns, so that a slow refresh can't
+	// replace the datasets of a later one
+	refreshMu sync.Mutex
+}
+
+// datasetLoad is a single attempt at generating the datasets.  done is closed
+// once the attempt has finished, after which err is safe to read.
+type datasetLoad struct {
+	done chan struct{}
+	err  error
+}
+
+// NewRetriever creates a Retriever over the documents in source.  The options
+// are used when generating the datasets.
+func NewRetriever(source DocumentSource, opts ...Option) *Retriever {
+	o := newOptions(opts)
+	queries := o.embeddingCache
+	if queries == nil {
+		queries = newQueryCache(o.queryCacheSize)
+	}
+	return &Retriever{
+		source:  source,
+		opts:    opts,
+		o:       o,
+		queries: queries,
+	}
+}
+
+// Retrieve returns the datasets relevant to query, best match first, along
+// with the embedding of the query.  No datasets are returned if none of them
+// are relevant.  Calls to the Copilot API use the credentials attached to ctx
+// with WithCredentials.
+//
+// opts override the options of the Retriever for this query only, e.g. to
+// require a higher similarity.  They don't affect how datasets are generated.
+func (r *Retriever) Retrieve(ctx context.Context, query string, opts ...Option) ([]*Dataset, []float32, error) {
+	opts = r.queryOpts(opts)
+	datasets, emb, err := r.prepare(ctx, query, newOptions(opts))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	relevant, opts, err := selectDatasets(datasets, emb, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if observer := newOptions(opts).observer; observer != nil {
+		matches, err := RankDatasets(datasets, emb, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error ranking datasets: %w", err)
+		}
+		// The observer mustn't hold up the query
+		go observer(RetrievalDecision{
+			Query:    query,
+			Ranking:  matches,
+			Selected: slices.Clone(relevant),
+		})
+	}
+
+	return relevant, emb, nil
+}
+
+// selectDatasets chooses the datasets relevant to the query embedded as emb.
+// It returns the options they were chosen with, which include any relaxed
+// minimum similarity.
+func selectDatasets(datasets []*Dataset, emb []float32, opts []Option) ([]*Dataset, []Option, error) {
+	dataset, err := FindBestDataset(datasets, emb, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error computing best dataset: %w", err)
+	}
+
+	o := newOptions(opts)
+	for i := 1; dataset == nil && o.relaxStep > 0; i++ {
+		min := o.minSimilarity - float32(i)*o.relaxStep
+		if min < o.relaxFloor || min <= 0 {
+			break
+		}
+
+		fmt.Printf("no relevant dataset, relaxing the minimum similarity to %.2f\n", min)
+		opts = append(opts, WithMinSimilarity(min))
+		dataset, err = FindBestDataset(datasets, emb, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error computing best dataset: %w", err)
+		}
+	}
+
+	if dataset == nil {
+		return nil, opts, nil
+	}
+	relevant := []*Dataset{dataset}
+
+	o = newOptions(opts)
+	if o.minDistinctSources <= 1 {
+		return relevant, opts, nil
+	}
+
+	// Add the next best files until there are enough, or no more relevant ones
+	matches, err := RankDatasets(datasets, emb, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error ranking datasets: %w", err)
+	}
+	seen := map[string]bool{dataset.Filename: true}
+	for _, match := range matches {
+		if len(relevant) >= o.minDistinctSources || !match.Relevant {
+			break
+		}
+		if seen[match.Dataset.Filename] {
+			continue
+		}
+		seen[match.Dataset.Filename] = true
+		relevant = append(relevant, match.Dataset)
+	}
+
+	return relevant, opts, nil
+}
+
+// Rank scores every dataset against query, best match first, so that the
+// choices Retrieve makes can be explained.  opts override the options of the
+// Retriever like they do for Retrieve.
+func (r *Retriever) Rank(ctx context.Context, query string, opts ...Option) ([]Match, error) {
+	opts = r.queryOpts(opts)
+	datasets, emb, err := r.prepare(ctx, query, newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := RankDatasets(datasets, emb, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error ranking datasets: %w", err)
+	}
+
+	return matches, nil
+}
+
+// prepare loads the datasets and embeds query, or the turns to weight in its
+// place if o has any
+func (r *Retriever) prepare(ctx context.Context, query string, o *options) ([]*Dataset, []float32, error) {
+	integrationID, apiToken := credentialsFrom(ctx)
+
+	datasets, err := r.loadDatasets(ctx, integrationID, apiToken, r.o.warmupTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(o.turns) == 0 {
+		emb, err := r.embedQuery(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return datasets, emb, nil
+	}
+
+	// The latest turn weighs 1, and every turn before decay times the next
+	var emb []float32
+	weight := float32(1)
+	for i := len(o.turns) - 1; i >= 0; i-- {
+		turn, err := r.embedQuery(ctx, o.turns[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if emb == nil {
+			emb = make([]float32, len(turn))
+		}
+		if len(turn) != len(emb) {
+			return nil, nil, fmt.Errorf("%w: embeddings of the turns are different lengths", ErrQueryEmbedding)
+		}
+
+		for j, v := range normalize(turn) {
+			emb[j] += weight * v
+		}
+		weight *= o.turnDecay
+	}
+
+	return datasets, emb, nil
+}
+
+// embedQuery embeds query, reusing the embedding of a repeated query
+func (r *Retriever) embedQuery(ctx context.Context, query string) ([]float32, error) {
+	emb, err := cachedEmbed(ctx, r.o, r.queries, query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrQueryEmbedding, err)
+	}
+	return emb, nil
+}
+
+// ScoreChunks scores each of chunks, parts of a document, against target, the
+// embedding of a query, the way datasets are scored against it, so that the
+// parts of a document most relevant to the query can be told apart.  Chunks
+// are embedded with the Retriever's Embedder and their embeddings reused like
+// those of queries.  Blank chunks score lowest.  Calls to the Copilot API use
+// the credentials attached to ctx with WithCredentials.
+func (r *Retriever) ScoreChunks(ctx context.Context, target []float32, chunks []string) ([]float32, error) {
+	var embedded []*Dataset
+	var indexes []int
+	for i, chunk := range chunks {
+		if strings.TrimSpace(chunk) == "" {
+			continue
+		}
+		emb, err := cachedEmbed(ctx, r.o, r.queries, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding chunk %d: %w", i, err)
+		}
+		embedded = append(embedded, &Dataset{Embedding: emb})
+		indexes = append(indexes, i)
+	}
+
+	scored, err := scoreDatasets(embedded, target, r.o.metric)
+	if err != nil {
+		return nil, err
+	}
+	scores := make([]float32, len(chunks))
+	for i := range scores {
+		scores[i] = float32(math.Inf(-1))
+	}
+	for i, score := range scored {
+		scores[indexes[i]] = score
+	}
+	return scores, nil
+}
+
+// queryOpts returns the options of the Retriever overridden by opts
+func (r *Retriever) queryOpts(opts []Option) []Option {
+	return append(r.opts[:len(r.opts):len(r.opts)], opts...)
+}
+
+// EmbedQuery embeds query the way Retrieve does, reusing the embedding of a
+// repeated query.  Calls to the Copilot API use the credentials attached to
+// ctx with WithCredentials.
+func (r *Retriever) EmbedQuery(ctx context.Context, query string) ([]float32, error) {
+	return r.embedQuery(ctx, query)
+}
+
+// Warm generates the datasets ahead of the first query and waits for them to
+// be ready.  If they are already being generated, e.g. for a query, it waits
+// for that instead of generating them again.  Calls to the Copilot API use the
+// credentials attached to ctx with WithCredentials.
+func (r *Retriever) Warm(ctx context.Context) error {
+	integrationID, apiToken := credentialsFrom(ctx)
+	_, err := r.loadDatasets(ctx, integrationID, apiToken, 0)
+	return err
+}
+
+// Validate checks that the datasets can be generated without generating them:
+// every document is read and preprocessed, but only the first one is embedded.
+// Calls to the Copilot API use the credentials attached to ctx with
+// WithCredentials.
+func (r *Retriever) Validate(ctx context.Context) error {
+	filenames, err := r.source.List()
+	if err != nil {
+		return fmt.Errorf("error listing documents: %w", err)
+	}
+	if len(filenames) == 0 {
+		return ErrNoDocuments
+	}
+
+	var first string
+	for i, filename := range filenames {
+		doc, err := prepareDocument(r.source, filename, r.o)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			first = doc.content
+		}
+	}
+
+	if _, err := embed(ctx, r.o, first); err != nil {
+		return fmt.Errorf("error creating embedding for file %s: %w", filenames[0], err)
+	}
+
+	return nil
+}
+
+// CheckDocuments makes sure that at least one document in the source has any
+// content once preprocessed, without embedding anything.  It returns an error
+// wrapping ErrNoDocuments if there is none.
+func (r *Retriever) CheckDocuments() error {
+	filenames, err := r.source.List()
+	if err != nil {
+		return fmt.Errorf("error listing documents: %w", err)
+	}
+
+	for _, filename := range filenames {
+		doc, err := prepareDocument(r.source, filename, r.o)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(doc.content) != "" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w with any content among %d files", ErrNoDocuments, len(filenames))
+}
+
+// DatasetInfo describes the dataset generated from one document, without its
+// embedding
+type DatasetInfo struct {
+	Filename string    `json:"filename"`
+	Hash     string    `json:"hash"`
+	Model    string    `json:"model,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time,omitempty"`
+}
+
+// Checksum returns the CorpusChecksum of the datasets that are currently
+// loaded.  It is empty until they have been generated.
+func (r *Retriever) Checksum() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if !r.loaded {
+		return ""
+	}
+	return CorpusChecksum(r.datasets)
+}
+
+// Metadata describes the datasets that are currently loaded, in the order of
+// the documents.  It is empty until they have been generated.
+func (r *Retriever) Metadata() []DatasetInfo {
+	r.mu.RLock()
+	datasets := r.datasets
+	r.mu.RUnlock()
+
+	infos := make([]DatasetInfo, 0, len(datasets))
+	for _, dataset := range datasets {
+		infos = append(infos, DatasetInfo{
+			Filename: dataset.Filename,
+			Hash:     dataset.Hash,
+			Model:    dataset.Model,
+			Size:     dataset.Size,
+			ModTime:  dataset.ModTime,
+		})
+	}
+
+	return infos
+}
+
+// Refresh regenerates the datasets from the documents in the source, e.g.
+// after they have been edited.  Only documents that changed since the datasets
+// were last generated are embedded again, and queries keep using the previous
+// datasets until the new ones are ready.  If there are no datasets yet,
+// queries fail with ErrWarmingUp until the refresh is done, rather than wait
+// for it.  Calls to the Copilot API use the credentials attached to ctx with
+// WithCredentials.
+func (r *Retriever) Refresh(ctx context.Context) error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	return r.refresh(ctx)
+}
+
+// TryRefresh is like Refresh, but returns ErrRefreshInProgress rather than
+// waiting if the datasets are being refreshed already
+func (r *Retriever) TryRefresh(ctx context.Context) error {
+	if !r.refreshMu.TryLock() {
+		return ErrRefreshInProgress
+	}
+	defer r.refreshMu.Unlock()
+
+	return r.refresh(ctx)
+}
+
+// refresh does the work of Refresh.  The caller must hold refreshMu.
+func (r *Retriever) refresh(ctx context.Context) error {
+	integrationID, apiToken := credentialsFrom(ctx)
+
+	r.mu.Lock()
+	previous := r.datasets
+	if !r.loaded {
+		r.rebuilding = true
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.rebuilding = false
+	}()
+
+	datasets, err := RefreshDatasets(ctx, integrationID, apiToken, r.source, previous, r.opts...)
+	if err != nil {
+		return fmt.Errorf("error refreshing datasets: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.datasets = datasets
+	r.loaded = true
+
+	return nil
+}
+
+// loadDatasets generates the datasets on first use.  In a real application,
+// these would be generated ahead of time and stored in a database.
+//
+// Only one goroutine generates the datasets no matter how many callers arrive
+// while they are cold.  Every caller waits for it to finish for at most
+// timeout, if it is positive, or not at all if it is negative.  A failed
+// attempt is retried by the next caller.
+func (r *Retriever) loadDatasets(ctx context.Context, integrationID, apiToken string, timeout time.Duration) ([]*Dataset, error) {
+	r.mu.RLock()
+	datasets, loaded := r.datasets, r.loaded
+	r.mu.RUnlock()
+	if loaded {
+		return datasets, nil
+	}
+
+	r.mu.Lock()
+	if r.loaded {
+		defer r.mu.Unlock()
+		return r.datasets, nil
+	}
+	if r.rebuilding {
+		r.mu.Unlock()
+		return nil, ErrWarmingUp
+	}
+
+	load := r.loading
+	if load == nil {
+		load = &datasetLoad{done: make(chan struct{})}
+		r.loading = load
+		// The datasets outlive the caller that happens to start generating
+		// them and serve every caller alike, so nothing of its context is
+		// kept, such as its usage, span or retry budget
+		go r.generate(context.Background(), load, integrationID, apiToken)
+	}
+	r.mu.Unlock()
+
+	if timeout < 0 {
+		select {
+		case <-load.done:
+		default:
+			return nil, ErrWarmingUp
+		}
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-load.done:
+	case <-expired:
+		return nil, ErrWarmingUp
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if load.err != nil {
+		return nil, load.err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.datasets, nil
+}
+
+func (r *Retriever) generate(ctx context.Context, load *datasetLoad, integrationID, apiToken string) {
+	var datasets []*Dataset
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		// A refresh that finished first has the more recent datasets
+		if load.err == nil && !r.loaded {
+			r.datasets = datasets
+			r.loaded = true
+		}
+		r.loading = nil
+		close(load.done)
+	}()
+
+	var err error
+	datasets, err = RefreshDatasets(ctx, integrationID, apiToken, r.source, nil, r.opts...)
+	if err != nil {
+		load.err = fmt.Errorf("error generating datasets: %w", err)
+	}
+}
+
+// PrewarmQueries embeds queries ahead of time and keeps their embeddings in
+// the query cache, so that the first requests with any of them are answered
+// without waiting for an embedding.  Like every cached query, they are
+// evicted once enough other queries come along.  Calls to the Copilot API use
+// the credentials attached to ctx with WithCredentials.
+func (r *Retriever) PrewarmQueries(ctx context.Context, queries []string) error {
+	for _, query := range queries {
+		if _, err := r.embedQuery(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Embed embeds each of inputs with the Retriever's Embedder, the way queries
+// are embedded, e.g. for other services to index text compatible with the
+// datasets.  Calls to the Copilot API use the credentials attached to ctx with
+// WithCredentials.
+func (r *Retriever) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		emb, err := embed(ctx, r.o, input)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding input %d: %w", i, err)
+		}
+		embeddings[i] = emb
+	}
+	return embeddings, nil
+}
+
+// EmbeddingModel names the model the Retriever embeds with, if its Embedder
+// names it
+func (r *Retriever) EmbeddingModel() string {
+	return embeddingModel(r.o.embedder)
+}
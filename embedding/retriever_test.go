@@ -0,0 +1,691 @@
+package embedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wordEmbedder embeds text as the number of times each of its words occurs
+// in it, plus a constant so that no embedding is a zero vector
+type wordEmbedder []string
+
+func (e wordEmbedder) EmbeddingModel() string {
+	return "test-model"
+}
+
+func (e wordEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		emb := make([]float32, len(e)+1)
+		for j, word := range e {
+			emb[j] = float32(strings.Count(strings.ToLower(input), word))
+		}
+		emb[len(e)] = 0.1
+		embeddings[i] = emb
+	}
+	return embeddings, nil
+}
+
+// writeDocuments writes docs, by filename, to a new directory
+func writeDocuments(t *testing.T, docs map[string]string) DirSource {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range docs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return DirSource(dir)
+}
+
+func TestRetrieverRetrieve(t *testing.T) {
+	source := writeDocuments(t, map[string]string{
+		"billing.md": "# Billing\n\nInvoices are sent monthly.",
+		"deploy.md":  "# Deploying\n\nRun the deploy pipeline.",
+	})
+	embedder := wordEmbedder{"invoice", "deploy"}
+	r := NewRetriever(source, WithEmbedder(embedder))
+	ctx := WithCredentials(context.Background(), "integration", "token")
+
+	tests := []struct {
+		name  string
+		query string
+		opts  []Option
+		want  string
+	}{
+		{name: "billing", query: "When is an invoice sent?", want: "billing.md"},
+		{name: "deploy", query: "How do I deploy?", want: "deploy.md"},
+		{name: "threshold override", query: "How do I deploy?", opts: []Option{WithMinSimilarity(0.999)}},
+		{name: "nothing relevant", query: "What's for lunch?", opts: []Option{WithMinSimilarity(0.5)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasets, emb, err := r.Retrieve(ctx, tt.query, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, _ := embedder.Embed(ctx, []string{tt.query})
+			if !slices.Equal(emb, want[0]) {
+				t.Errorf("query embedding = %v, want %v", emb, want[0])
+			}
+
+			if tt.want == "" {
+				if len(datasets) > 0 {
+					t.Errorf("retrieved %s, want nothing", datasets[0].Filename)
+				}
+				return
+			}
+			if len(datasets) == 0 || filepath.Base(datasets[0].Filename) != tt.want {
+				t.Errorf("retrieved %v, want %s first", datasets, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieverMetadata(t *testing.T) {
+	source := writeDocuments(t, map[string]string{
+		"billing.md": "# Billing\n\nInvoices are sent monthly.",
+		"deploy.md":  "# Deploying\n\nRun the pipeline.",
+		"empty.md":   "",
+	})
+	r := NewRetriever(source, WithEmbedder(wordEmbedder{"invoice", "deploy"}))
+
+	if got := r.Metadata(); len(got) != 0 {
+		t.Fatalf("metadata before loading = %v, want none", got)
+	}
+
+	ctx := WithCredentials(context.Background(), "integration", "token")
+	if err := r.Warm(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.RLock()
+	datasets := r.datasets
+	r.mu.RUnlock()
+
+	infos := r.Metadata()
+	if len(infos) != len(datasets) {
+		t.Fatalf("got %d infos for %d datasets", len(infos), len(datasets))
+	}
+	for i, info := range infos {
+		dataset := datasets[i]
+		want := DatasetInfo{
+			Filename: dataset.Filename,
+			Hash:     dataset.Hash,
+			Model:    "test-model",
+			Size:     dataset.Size,
+			ModTime:  dataset.ModTime,
+		}
+		if info != want {
+			t.Errorf("info %d = %+v, want %+v", i, info, want)
+		}
+		if info.Hash == "" {
+			t.Errorf("info %d has no hash", i)
+		}
+
+		content, err := os.ReadFile(dataset.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(content)) {
+			t.Errorf("size of %s = %d, want %d", info.Filename, info.Size, len(content))
+		}
+	}
+}
+
+// contextEmbedder embeds like a wordEmbedder and records the context of the
+// call for each input
+type contextEmbedder struct {
+	wordEmbedder
+
+	mu   sync.Mutex
+	ctxs map[string]context.Context
+}
+
+func (e *contextEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	e.mu.Lock()
+	for _, input := range inputs {
+		e.ctxs[input] = ctx
+	}
+	e.mu.Unlock()
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func TestRetrieverGenerationContext(t *testing.T) {
+	const doc = "Invoices are sent monthly."
+	source := writeDocuments(t, map[string]string{"billing.md": doc})
+	embedder := &contextEmbedder{wordEmbedder: wordEmbedder{"invoice"}, ctxs: map[string]context.Context{}}
+	r := NewRetriever(source, WithEmbedder(embedder))
+
+	var usage Usage
+	ctx := context.WithValue(WithCredentials(context.Background(), "integration", "token"), testValueKey{}, "value")
+	ctx = WithUsage(ctx, &usage)
+	if _, _, err := r.Retrieve(ctx, "invoice"); err != nil {
+		t.Fatal(err)
+	}
+
+	embedder.mu.Lock()
+	defer embedder.mu.Unlock()
+	tests := []struct {
+		name      string
+		input     string
+		wantValue any
+		wantUsage *Usage
+	}{
+		// The datasets are generated for every caller, not for the first
+		{name: "document", input: doc},
+		{name: "query", input: "invoice", wantValue: "value", wantUsage: &usage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := embedder.ctxs[tt.input]
+			if ctx == nil {
+				t.Fatalf("%q wasn't embedded", tt.input)
+			}
+			if got := ctx.Value(testValueKey{}); got != tt.wantValue {
+				t.Errorf("value = %v, want %v", got, tt.wantValue)
+			}
+			if got := usageFrom(ctx); got != tt.wantUsage {
+				t.Errorf("usage = %p, want %p", got, tt.wantUsage)
+			}
+			if integrationID, apiToken := credentialsFrom(ctx); integrationID != "integration" || apiToken != "token" {
+				t.Errorf("credentials = %q, %q", integrationID, apiToken)
+			}
+		})
+	}
+}
+
+// TestRetrieverConcurrentReadsAndRefresh is meant to be run with -race
+func TestRetrieverConcurrentReadsAndRefresh(t *testing.T) {
+	source := writeDocuments(t, map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	})
+	r := NewRetriever(source, WithEmbedder(wordEmbedder{"invoice", "deploy"}))
+	ctx := WithCredentials(context.Background(), "integration", "token")
+
+	tests := []struct {
+		name string
+		read func() error
+	}{
+		{name: "retrieve", read: func() error {
+			_, _, err := r.Retrieve(ctx, "invoice")
+			return err
+		}},
+		{name: "rank", read: func() error {
+			_, err := r.Rank(ctx, "deploy")
+			return err
+		}},
+		{name: "metadata", read: func() error {
+			r.Metadata()
+			return nil
+		}},
+		{name: "checksum", read: func() error {
+			r.Checksum()
+			return nil
+		}},
+	}
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, len(tests)*rounds+rounds)
+	for _, tt := range tests {
+		wg.Add(1)
+		go func(read func() error) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if err := read(); err != nil && !errors.Is(err, ErrWarmingUp) {
+					errs <- err
+				}
+			}
+		}(tt.read)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			content := fmt.Sprintf("Invoices are sent monthly, revision %d.", i)
+			if err := os.WriteFile(filepath.Join(string(source), "billing.md"), []byte(content), 0o644); err != nil {
+				errs <- err
+				return
+			}
+			if err := r.Refresh(ctx); err != nil {
+				errs <- err
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	infos := r.Metadata()
+	if len(infos) != 2 {
+		t.Fatalf("got %d datasets after the refreshes, want 2", len(infos))
+	}
+	content, err := os.ReadFile(filepath.Join(string(source), "billing.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Filename, "billing.md") && info.Size != int64(len(content)) {
+			t.Errorf("billing.md is %d bytes in the datasets, want the last revision's %d", info.Size, len(content))
+		}
+	}
+}
+
+// gatedEmbedder embeds like a wordEmbedder, but holds back the documents
+// containing gate until release is closed, and counts them
+type gatedEmbedder struct {
+	wordEmbedder
+	gate    string
+	release chan struct{}
+	gated   atomic.Int32
+}
+
+func (e *gatedEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	for _, input := range inputs {
+		if strings.Contains(input, e.gate) {
+			e.gated.Add(1)
+			select {
+			case <-e.release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func TestRetrieverConcurrentColdQueries(t *testing.T) {
+	tests := []struct {
+		name          string
+		warmupTimeout time.Duration
+		releaseAfter  time.Duration
+		wantErr       error
+	}{
+		{name: "wait for the datasets", releaseAfter: 50 * time.Millisecond},
+		{name: "bounded wait", warmupTimeout: 20 * time.Millisecond, releaseAfter: 200 * time.Millisecond, wantErr: ErrWarmingUp},
+		{name: "no wait", warmupTimeout: -1, releaseAfter: 50 * time.Millisecond, wantErr: ErrWarmingUp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := writeDocuments(t, map[string]string{"billing.md": "Invoices are sent monthly."})
+			embedder := &gatedEmbedder{wordEmbedder: wordEmbedder{"invoice"}, gate: "monthly", release: make(chan struct{})}
+			r := NewRetriever(source, WithEmbedder(embedder), WithWarmupTimeout(tt.warmupTimeout))
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			const callers = 20
+			var wg sync.WaitGroup
+			errs := make([]error, callers)
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, _, errs[i] = r.Retrieve(ctx, "invoice")
+				}(i)
+			}
+			time.AfterFunc(tt.releaseAfter, func() { close(embedder.release) })
+			wg.Wait()
+
+			for i, err := range errs {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("caller %d: err = %v, want %v", i, err, tt.wantErr)
+				}
+			}
+
+			// The datasets are ready for the callers after the generation
+			if err := r.Warm(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := r.Retrieve(ctx, "invoice"); err != nil {
+				t.Errorf("retrieve after warming: %v", err)
+			}
+			if n := embedder.gated.Load(); n != 1 {
+				t.Errorf("the document was embedded %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestDocumentFilter(t *testing.T) {
+	source := memorySource{
+		"internal/billing.md": "Invoices are sent monthly.",
+		"public/billing.md":   "An invoice is sent after each deploy.",
+		"public/deploy.md":    "Deploy from the main branch.",
+	}
+	r := NewRetriever(source, WithEmbedder(wordEmbedder{"invoice", "deploy"}))
+	ctx := WithCredentials(context.Background(), "integration", "token")
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		scope   []string
+		want    string
+	}{
+		{name: "no filter", want: "internal/billing.md"},
+		{name: "include", include: []string{"public/*"}, want: "public/billing.md"},
+		{name: "exclude", exclude: []string{"internal/*"}, want: "public/billing.md"},
+		{name: "base name", include: []string{"billing.md"}, exclude: []string{"internal/*"}, want: "public/billing.md"},
+		{name: "exclude wins", include: []string{"*/billing.md"}, exclude: []string{"billing.md"}},
+		{name: "pattern matching nothing", include: []string{"*.txt"}},
+		{name: "scope", scope: []string{"public/*"}, want: "public/billing.md"},
+		{name: "include outside the scope", include: []string{"internal/*"}, scope: []string{"public/*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasets, _, err := r.Retrieve(ctx, "Where is my invoice?",
+				WithDocumentFilter(tt.include, tt.exclude),
+				WithDocumentScope(tt.scope))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == "" {
+				if len(datasets) > 0 {
+					t.Errorf("retrieved %s, want nothing", datasets[0].Filename)
+				}
+				return
+			}
+			if len(datasets) == 0 || datasets[0].Filename != tt.want {
+				t.Errorf("retrieved %v, want %s first", datasets, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinDistinctSources(t *testing.T) {
+	source := memorySource{
+		"billing.md":  "Invoices are sent monthly.",
+		"disputes.md": "Dispute an invoice within a week of the deploy.",
+		"deploy.md":   "Deploy from the main branch.",
+	}
+	r := NewRetriever(source, WithEmbedder(wordEmbedder{"invoice", "deploy"}), WithMinSimilarity(0.5))
+	ctx := WithCredentials(context.Background(), "integration", "token")
+
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{name: "default", want: []string{"billing.md"}},
+		{name: "one", n: 1, want: []string{"billing.md"}},
+		{name: "two", n: 2, want: []string{"billing.md", "disputes.md"}},
+		{name: "more than are relevant", n: 3, want: []string{"billing.md", "disputes.md"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasets, _, err := r.Retrieve(ctx, "When is an invoice sent?", WithMinDistinctSources(tt.n))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, dataset := range datasets {
+				got = append(got, dataset.Filename)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("retrieved %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// blockingEmbedder embeds like a wordEmbedder once release is closed, and
+// signals started when it is first called
+type blockingEmbedder struct {
+	wordEmbedder
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingEmbedder) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	e.once.Do(func() { close(e.started) })
+	<-e.release
+	return e.wordEmbedder.Embed(ctx, inputs)
+}
+
+func TestTryRefresh(t *testing.T) {
+	embedder := &blockingEmbedder{wordEmbedder: wordEmbedder{"invoice"}, started: make(chan struct{}), release: make(chan struct{})}
+	r := NewRetriever(memorySource{"billing.md": "Invoices are sent monthly."}, WithEmbedder(embedder))
+	ctx := WithCredentials(context.Background(), "integration", "token")
+
+	refreshed := make(chan error)
+	go func() { refreshed <- r.Refresh(ctx) }()
+	<-embedder.started
+
+	if err := r.TryRefresh(ctx); !errors.Is(err, ErrRefreshInProgress) {
+		t.Errorf("err = %v, want ErrRefreshInProgress", err)
+	}
+
+	close(embedder.release)
+	if err := <-refreshed; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.TryRefresh(ctx); err != nil {
+		t.Errorf("refresh after the other one finished: %v", err)
+	}
+}
+
+func TestRelaxedSimilarity(t *testing.T) {
+	// The query scores about 0.71 against the only document
+	r := NewRetriever(memorySource{"billing.md": "An invoice for each deploy."},
+		WithEmbedder(wordEmbedder{"invoice", "deploy"}), WithMinSimilarity(0.9))
+	ctx := WithCredentials(context.Background(), "integration", "token")
+
+	tests := []struct {
+		name        string
+		step, floor float32
+		want        bool
+	}{
+		{name: "no relaxation"},
+		{name: "relaxed enough", step: 0.1, floor: 0.5, want: true},
+		{name: "floor too high", step: 0.1, floor: 0.75},
+		{name: "single step too small", step: 0.05, floor: 0.8},
+		{name: "no floor", step: 0.3, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasets, _, err := r.Retrieve(ctx, "When is an invoice sent?", WithRelaxedSimilarity(tt.step, tt.floor))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(datasets) > 0; got != tt.want {
+				t.Errorf("found a document = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Relaxing is for the one query only
+	if datasets, _, err := r.Retrieve(ctx, "When is an invoice sent?"); err != nil || len(datasets) > 0 {
+		t.Errorf("retrieved %v, %v after relaxed queries, want nothing", datasets, err)
+	}
+}
+
+func TestRetrievalObserver(t *testing.T) {
+	source := writeDocuments(t, map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+		"mixed.md":   "Invoices are sent after every deploy.",
+	})
+	ctx := WithCredentials(context.Background(), "integration", "token")
+
+	tests := []struct {
+		name         string
+		query        string
+		opts         []Option
+		wantRanking  []string
+		wantRelevant []bool
+		wantSelected []string
+	}{
+		{
+			name:         "invoice",
+			query:        "When is an invoice sent?",
+			wantRanking:  []string{"billing.md", "mixed.md", "deploy.md"},
+			wantRelevant: []bool{true, true, true},
+			wantSelected: []string{"billing.md"},
+		},
+		{
+			name:         "deploy",
+			query:        "How do I deploy?",
+			wantRanking:  []string{"deploy.md", "mixed.md", "billing.md"},
+			wantRelevant: []bool{true, true, true},
+			wantSelected: []string{"deploy.md"},
+		},
+		{
+			name:         "several sources",
+			query:        "When is an invoice sent?",
+			opts:         []Option{WithMinDistinctSources(2)},
+			wantRanking:  []string{"billing.md", "mixed.md", "deploy.md"},
+			wantRelevant: []bool{true, true, true},
+			wantSelected: []string{"billing.md", "mixed.md"},
+		},
+		{
+			// Datasets that aren't chosen are still ranked
+			name:         "nothing relevant",
+			query:        "Is an invoice sent per deploy, or is the invoice monthly?",
+			opts:         []Option{WithMinSimilarity(0.99)},
+			wantRanking:  []string{"mixed.md", "billing.md", "deploy.md"},
+			wantRelevant: []bool{false, false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decisions := make(chan RetrievalDecision, 1)
+			opts := append([]Option{
+				WithEmbedder(wordEmbedder{"invoice", "deploy"}),
+				WithRetrievalObserver(func(d RetrievalDecision) { decisions <- d }),
+			}, tt.opts...)
+			r := NewRetriever(source, opts...)
+
+			if _, _, err := r.Retrieve(ctx, tt.query); err != nil {
+				t.Fatal(err)
+			}
+
+			var decision RetrievalDecision
+			select {
+			case decision = <-decisions:
+			case <-time.After(5 * time.Second):
+				t.Fatal("observer wasn't called")
+			}
+
+			if decision.Query != tt.query {
+				t.Errorf("query = %q, want %q", decision.Query, tt.query)
+			}
+			var ranking []string
+			var relevant []bool
+			for _, match := range decision.Ranking {
+				ranking = append(ranking, filepath.Base(match.Dataset.Filename))
+				relevant = append(relevant, match.Relevant)
+			}
+			if !slices.Equal(ranking, tt.wantRanking) || !slices.Equal(relevant, tt.wantRelevant) {
+				t.Errorf("ranking = %q relevant %v, want %q relevant %v", ranking, relevant, tt.wantRanking, tt.wantRelevant)
+			}
+			var selected []string
+			for _, dataset := range decision.Selected {
+				selected = append(selected, filepath.Base(dataset.Filename))
+			}
+			if !slices.Equal(selected, tt.wantSelected) {
+				t.Errorf("selected = %q, want %q", selected, tt.wantSelected)
+			}
+		})
+	}
+
+	t.Run("slow observer", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		r := NewRetriever(source,
+			WithEmbedder(wordEmbedder{"invoice", "deploy"}),
+			WithRetrievalObserver(func(RetrievalDecision) { <-release }))
+
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := r.Retrieve(ctx, "When is an invoice sent?")
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("retrieval waited for the observer")
+		}
+	})
+}
+
+func TestScoreChunks(t *testing.T) {
+	chunks := []string{"Deploy from main.", "Invoices are sent monthly, every invoice by mail.", " "}
+
+	tests := []struct {
+		name   string
+		metric Metric
+		// want are the scores of the first two chunks
+		want []float32
+	}{
+		{name: "cosine", metric: MetricCosine, want: []float32{0.0099, 0.9988}},
+		{name: "dot product", metric: MetricDotProduct, want: []float32{0.01, 2.01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			embedder := &recordingEmbedder{wordEmbedder: wordEmbedder{"invoice", "deploy"}}
+			r := NewRetriever(writeDocuments(t, nil), WithEmbedder(embedder), WithMetric(tt.metric))
+			ctx := WithCredentials(context.Background(), "integration", "token")
+
+			emb, err := r.EmbedQuery(ctx, "When is an invoice sent?")
+			if err != nil {
+				t.Fatal(err)
+			}
+			scores, err := r.ScoreChunks(ctx, emb, chunks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(scores) != len(chunks) {
+				t.Fatalf("%d scores for %d chunks", len(scores), len(chunks))
+			}
+			for i, want := range tt.want {
+				if diff := scores[i] - want; diff > 0.001 || diff < -0.001 {
+					t.Errorf("score of %q = %v, want %v", chunks[i], scores[i], want)
+				}
+			}
+			if scores[2] >= scores[0] {
+				t.Errorf("blank chunk scored %v, want the lowest", scores[2])
+			}
+			if slices.Contains(embedder.embedded(), " ") {
+				t.Error("blank chunk was embedded")
+			}
+
+			// Chunks are embedded once
+			before := len(embedder.embedded())
+			if _, err := r.ScoreChunks(ctx, emb, chunks); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(embedder.embedded()); n != before {
+				t.Errorf("scoring again embedded %d more inputs", n-before)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package embedding
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DocumentSource lists and opens the documents that datasets are generated
+// from.  Implementing it allows the knowledge base to live somewhere other
+// than the local filesystem, e.g. in an object store.
+type DocumentSource interface {
+	// List returns the names of all documents in the source
+	List() ([]string, error)
+
+	// Open opens the named document for reading
+	Open(name string) (io.ReadCloser, error)
+}
+
+// DirSource is a DocumentSource over the files in a local directory.  The
+// names of its documents are the paths of the files.
+type DirSource string
+
+func (d DirSource) List() ([]string, error) {
+	files, err := os.ReadDir(string(d))
+	if err != nil {
+		return nil, fmt.Errorf("error reading files from %q directory: %w", string(d), err)
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		names = append(names, filepath.Join(string(d), file.Name()))
+	}
+
+	return names, nil
+}
+
+func (d DirSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// MergedDirSource is a DocumentSource over the files in several local
+// directories, e.g. a shared one and a team specific one.  The names of its
+// documents are relative to the directories, and a file in a later directory
+// overrides the file of the same name in an earlier one.
+type MergedDirSource []string
+
+func (m MergedDirSource) List() ([]string, error) {
+	seen := map[string]bool{}
+	var names []string
+	for _, dir := range m {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading files from %q directory: %w", dir, err)
+		}
+
+		for _, file := range files {
+			if file.IsDir() || seen[file.Name()] {
+				continue
+			}
+			seen[file.Name()] = true
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (m MergedDirSource) Open(name string) (io.ReadCloser, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid document name %q", name)
+	}
+
+	for i := len(m) - 1; i >= 0; i-- {
+		f, err := os.Open(filepath.Join(m[i], name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return f, err
+	}
+
+	return nil, fmt.Errorf("document %q not found: %w", name, fs.ErrNotExist)
+}
+
+// ReadDocument reads the whole of the named document from source.  The
+// modification time is only known if the opened document has a Stat method,
+// like an *os.File does.
+func ReadDocument(source DocumentSource, name string) ([]byte, time.Time, error) {
+	doc, err := source.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer doc.Close()
+
+	var modTime time.Time
+	if f, ok := doc.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+
+	content, err := io.ReadAll(doc)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return content, modTime, nil
+}
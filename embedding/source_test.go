@@ -0,0 +1,185 @@
+package embedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// memorySource is a DocumentSource over documents held in memory, like one
+// over an object store would be
+type memorySource map[string]string
+
+func (m memorySource) List() ([]string, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m memorySource) Open(name string) (io.ReadCloser, error) {
+	content, ok := m[name]
+	if !ok {
+		return nil, fmt.Errorf("document %q not found: %w", name, fs.ErrNotExist)
+	}
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+// failingSource fails to list its documents
+type failingSource struct{ memorySource }
+
+func (failingSource) List() ([]string, error) {
+	return nil, errors.New("bucket unavailable")
+}
+
+func TestMemorySource(t *testing.T) {
+	source := memorySource{
+		"kb/billing.md": "Invoices are sent monthly.",
+		"kb/deploy.md":  "Deploy from the main branch.",
+	}
+
+	datasets, err := GenerateDatasets("integration", "token", source, WithEmbedder(wordEmbedder{"invoice", "deploy"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != len(source) {
+		t.Fatalf("got %d datasets, want %d", len(datasets), len(source))
+	}
+	for _, dataset := range datasets {
+		if dataset.Size != int64(len(source[dataset.Filename])) {
+			t.Errorf("size of %s = %d, want %d", dataset.Filename, dataset.Size, len(source[dataset.Filename]))
+		}
+		// In-memory documents have no modification time
+		if !dataset.ModTime.IsZero() {
+			t.Errorf("%s has modification time %v", dataset.Filename, dataset.ModTime)
+		}
+	}
+
+	r := NewRetriever(source, WithEmbedder(wordEmbedder{"invoice", "deploy"}))
+	relevant, _, err := r.Retrieve(WithCredentials(context.Background(), "integration", "token"), "How do I deploy?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relevant) == 0 || relevant[0].Filename != "kb/deploy.md" {
+		t.Errorf("retrieved %v, want kb/deploy.md", relevant)
+	}
+}
+
+func TestSourceErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source DocumentSource
+		want   string
+	}{
+		{name: "list", source: failingSource{}, want: "bucket unavailable"},
+		{name: "missing directory", source: DirSource("does-not-exist"), want: "does-not-exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GenerateDatasets("integration", "token", tt.source, WithEmbedder(wordEmbedder{"invoice"}))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadDocument(t *testing.T) {
+	source := memorySource{"billing.md": "Invoices are sent monthly."}
+
+	content, _, err := ReadDocument(source, "billing.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != source["billing.md"] {
+		t.Errorf("content = %q", content)
+	}
+
+	if _, _, err := ReadDocument(source, "missing.md"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("err = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestMergedDirSource(t *testing.T) {
+	shared := writeDocuments(t, map[string]string{
+		"billing.md": "Invoices are sent monthly.",
+		"deploy.md":  "Deploy from the main branch.",
+	})
+	team := writeDocuments(t, map[string]string{
+		"billing.md": "Our invoices are sent weekly.",
+		"oncall.md":  "Page the on-call engineer.",
+	})
+
+	tests := []struct {
+		name   string
+		source MergedDirSource
+		want   map[string]string
+	}{
+		{
+			name:   "later overrides earlier",
+			source: MergedDirSource{string(shared), string(team)},
+			want: map[string]string{
+				"billing.md": "Our invoices are sent weekly.",
+				"deploy.md":  "Deploy from the main branch.",
+				"oncall.md":  "Page the on-call engineer.",
+			},
+		},
+		{
+			name:   "order matters",
+			source: MergedDirSource{string(team), string(shared)},
+			want: map[string]string{
+				"billing.md": "Invoices are sent monthly.",
+				"deploy.md":  "Deploy from the main branch.",
+				"oncall.md":  "Page the on-call engineer.",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := tt.source.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Names are relative, so that citations don't depend on where the
+			// directories are
+			slices.Sort(names)
+			if want := []string{"billing.md", "deploy.md", "oncall.md"}; !slices.Equal(names, want) {
+				t.Fatalf("names = %q, want %q", names, want)
+			}
+
+			for _, name := range names {
+				content, _, err := ReadDocument(tt.source, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != tt.want[name] {
+					t.Errorf("%s = %q, want %q", name, content, tt.want[name])
+				}
+			}
+		})
+	}
+}
+
+func TestMergedDirSourceErrors(t *testing.T) {
+	dir := writeDocuments(t, map[string]string{"billing.md": "Invoices are sent monthly."})
+
+	if _, err := (MergedDirSource{string(dir), "does-not-exist"}).List(); err == nil {
+		t.Error("listed a missing directory")
+	}
+	for _, name := range []string{"missing.md", "../billing.md", filepath.Join(string(dir), "billing.md")} {
+		if _, err := (MergedDirSource{string(dir)}).Open(name); err == nil {
+			t.Errorf("opened %q", name)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package embedding
+
+import (
+	"context"
+	"sync"
+
+	"github.com/copilot-extensions/rag-extension/copilot"
+)
+
+// Usage adds up the tokens spent on embeddings, e.g. for cost accounting.  It
+// is safe for concurrent use.
+type Usage struct {
+	mu           sync.Mutex
+	promptTokens int
+	totalTokens  int
+}
+
+// Tokens returns the tokens spent so far
+func (u *Usage) Tokens() (promptTokens, totalTokens int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.promptTokens, u.totalTokens
+}
+
+func (u *Usage) add(usage *copilot.EmbeddingsResponseUsage) {
+	if u == nil || usage == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.promptTokens += usage.PromptTokens
+	u.totalTokens += usage.TotalTokens
+}
+
+type usageKey struct{}
+
+// WithUsage returns a copy of ctx that records the tokens spent by embedding
+// calls made with it in u.  Embeddings served from a cache spend none.
+func WithUsage(ctx context.Context, u *Usage) context.Context {
+	return context.WithValue(ctx, usageKey{}, u)
+}
+
+func usageFrom(ctx context.Context) *Usage {
+	u, _ := ctx.Value(usageKey{}).(*Usage)
+	return u
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/json"
@@ -10,9 +11,11 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/copilot-extensions/rag-extension/agent"
 	"github.com/copilot-extensions/rag-extension/config"
+	"github.com/copilot-extensions/rag-extension/embedding"
 	"github.com/copilot-extensions/rag-extension/oauth"
 )
 
@@ -45,9 +48,51 @@ func run() error {
 	http.HandleFunc("/auth/authorization", oauthService.PreAuth)
 	http.HandleFunc("/auth/callback", oauthService.PostAuth)
 
-	agentService := agent.NewService(pubKey)
+	var agentOpts []agent.Option
+	if len(config.ExtraHeaders) > 0 {
+		agentOpts = append(agentOpts, agent.WithExtraHeaders(config.ExtraHeaders))
+	}
+	if config.DefaultIntegrationID != "" {
+		agentOpts = append(agentOpts, agent.WithDefaultIntegrationID(config.DefaultIntegrationID))
+	}
+	if config.WarmupToken != "" {
+		agentOpts = append(agentOpts, agent.WithBackgroundWarmup(config.DefaultIntegrationID, config.WarmupToken, 5*time.Second, agent.WarmupWait))
+	}
+
+	if len(config.DataDirs) > 0 {
+		agentOpts = append(agentOpts, agent.WithDataDirs(config.DataDirs...))
+	}
+
+	if config.RefreshInterval > 0 {
+		agentOpts = append(agentOpts, agent.WithPeriodicRefresh(config.DefaultIntegrationID, config.WarmupToken, config.RefreshInterval))
+	}
+
+	if config.AdminToken != "" {
+		agentOpts = append(agentOpts, agent.WithAdminToken(config.AdminToken))
+	}
+	if config.SettingsFile != "" {
+		agentOpts = append(agentOpts, agent.WithSettingsLoader(agent.SettingsFile(config.SettingsFile)))
+	}
+
+	agentService, err := agent.NewService(pubKey, agentOpts...)
+	if err != nil {
+		return fmt.Errorf("error creating agent service: %w", err)
+	}
+	defer agentService.Close()
+
+	if config.StartupCheck {
+		ctx := embedding.WithCredentials(context.Background(), config.DefaultIntegrationID, config.WarmupToken)
+		if err := agentService.Validate(ctx); err != nil {
+			return fmt.Errorf("startup check failed: %w", err)
+		}
+		fmt.Println("startup check passed")
+	}
 
 	http.HandleFunc("/agent", agentService.ChatCompletion)
+	http.HandleFunc("/models", agentService.Models)
+	http.HandleFunc("/embed", agentService.Embed)
+	http.HandleFunc("/admin/reload", agentService.Reload)
+	http.HandleFunc("/admin/explain", agentService.Explain)
 
 	fmt.Println("Listening on port", config.Port)
 	return http.ListenAndServe(":"+config.Port, nil)